@@ -3,6 +3,7 @@ package common
 import (
 	"fmt"
 	"net"
+	"strconv"
 
 	"github.com/go-logr/logr"
 	"github.com/yago-123/wg-punch/pkg/util"
@@ -14,7 +15,7 @@ type TCPClient struct {
 }
 
 func NewTCPClient(remoteAddr string, remotePort int, logger logr.Logger) (*TCPClient, error) {
-	remoteServerAddr := fmt.Sprintf("%s:%d", remoteAddr, remotePort)
+	remoteServerAddr := net.JoinHostPort(remoteAddr, strconv.Itoa(remotePort))
 	conn, err := net.Dial(util.TCPProtocol, remoteServerAddr)
 	if err != nil {
 		logger.Error(err, "TCP client listen error", "address", remoteServerAddr)
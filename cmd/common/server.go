@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 
 	"github.com/go-logr/logr"
 	"github.com/yago-123/wg-punch/pkg/util"
@@ -22,7 +23,7 @@ type TCPServer struct {
 }
 
 func NewTCPServer(localAddr string, port int, logger logr.Logger) (*TCPServer, error) {
-	serverAddr := fmt.Sprintf("%s:%d", localAddr, port)
+	serverAddr := net.JoinHostPort(localAddr, strconv.Itoa(port))
 	ln, err := net.Listen(util.TCPProtocol, serverAddr)
 	if err != nil {
 		logger.Error(err, "TCP server listen error", "address", serverAddr)
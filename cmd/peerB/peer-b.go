@@ -28,13 +28,11 @@ const (
 	LocalPeerID  = "w2"
 	RemotePeerID = "w1"
 
-	WGLocalListenPort    = 51822
-	WGLocalIfaceName     = "wg2"
-	WGLocalIfaceAddr     = "10.1.1.2"
-	WGLocalIfaceAddrCIDR = "10.1.1.2/32"
-
-	// todo(): this should go away
-	RemotePeerIP = "10.1.1.1"
+	WGLocalListenPort     = 51822
+	WGLocalIfaceName      = "wg2"
+	WGLocalIfaceAddr      = "10.1.1.2"
+	WGLocalIfaceAddrCIDR  = "10.1.1.2/32"
+	WGLocalIfaceAddr6CIDR = "fd0a:1:1::2/64"
 
 	WGLocalPrivKey = "SEK/qGXalmKu3yPhkvZThcc8aQxordG5RkUz0/4jcFE="
 
@@ -81,6 +79,7 @@ func main() {
 		PrivKey:           WGLocalPrivKey,
 		Iface:             WGLocalIfaceName,
 		IfaceIPv4CIDR:     WGLocalIfaceAddrCIDR,
+		IfaceCIDRs:        []string{WGLocalIfaceAddr6CIDR},
 		ListenPort:        WGLocalListenPort,
 		ReplacePeer:       true,
 		CreateIface:       true,
@@ -94,16 +93,20 @@ func main() {
 		return
 	}
 
+	// Advertise every overlay address of the interface, IPv4 and IPv6, to the remote peer
+	allowedIPs, err := tunnelCfg.AllowedIPs()
+	if err != nil {
+		logger.Error(err, "invalid overlay addresses", "localPeer", LocalPeerID)
+		return
+	}
+
 	// Connect to peer using a shared peer ID (both sides use same ID)
-	netConn, err := conn.Connect(ctxHandshake, tunnel, []string{WGLocalIfaceAddrCIDR}, RemotePeerID)
+	session, err := conn.Connect(ctxHandshake, tunnel, allowedIPs, RemotePeerID)
 	if err != nil {
 		logger.Error(err, "failed to connect to peer", "localPeer", LocalPeerID, "remotePeerID", RemotePeerID)
 		return
 	}
-
-	// todo(): think about where to put the cancel of the tunnel itself
-	defer tunnel.Stop(context.Background())
-	defer netConn.Close()
+	defer session.Close(context.Background())
 
 	logger.Info("Tunnel has been stablished! Press Ctrl+C to exit.")
 
@@ -121,9 +124,10 @@ func main() {
 	time.Sleep(DelayClientStart)
 
 	// Start TCP client that will query remote peer over WireGuard
-	tcpClient, err := common.NewTCPClient(RemotePeerIP, TCPClientPort, logger)
+	remotePeerIP := session.RemoteOverlayAddr().String()
+	tcpClient, err := common.NewTCPClient(remotePeerIP, TCPClientPort, logger)
 	if err != nil {
-		logger.Error(err, "failed to create TCP client", "address", RemotePeerIP)
+		logger.Error(err, "failed to create TCP client", "address", remotePeerIP)
 		return
 	}
 	defer tcpClient.Close()
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/yago-123/wg-punch/pkg/relay/server"
+)
+
+const (
+	DefaultListenAddr  = ":7778"
+	DefaultIdleTimeout = 2 * time.Minute
+)
+
+func main() {
+	slogLogger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	logger := logr.FromSlogHandler(slogLogger.Handler())
+
+	listenAddr := flag.String("listen", DefaultListenAddr, "address on which the relay server listens")
+	secretFile := flag.String("secret-file", "", "file holding the secret shared with the rendezvous server that issues the tokens")
+	idleTimeout := flag.Duration("idle-timeout", DefaultIdleTimeout, "time after which silent peers are dropped from their session")
+	flag.Parse()
+
+	if *secretFile == "" {
+		logger.Error(nil, "secret file is required")
+		return
+	}
+
+	secret, err := os.ReadFile(*secretFile)
+	if err != nil {
+		logger.Error(err, "failed to read secret", "file", *secretFile)
+		return
+	}
+
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		logger.Error(nil, "secret file is empty", "file", *secretFile)
+		return
+	}
+
+	// Stop serving on SIGINT or SIGTERM
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	srv := server.New(secret,
+		server.WithIdleTimeout(*idleTimeout),
+		server.WithLogger(logger),
+	)
+
+	if err = srv.ListenAndServe(ctx, *listenAddr); err != nil {
+		logger.Error(err, "relay server stopped", "address", *listenAddr)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/yago-123/wg-punch/pkg/rendezvous/server"
+)
+
+const (
+	DefaultListenAddr = ":7777"
+	DefaultEntryTTL   = 5 * time.Minute
+	DefaultRate       = 5
+	DefaultBurst      = 20
+
+	DefaultRelayTokenTTL = 5 * time.Minute
+)
+
+func main() {
+	slogLogger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	logger := logr.FromSlogHandler(slogLogger.Handler())
+
+	listenAddr := flag.String("listen", DefaultListenAddr, "address on which the rendezvous server listens")
+	storeFile := flag.String("store-file", "", "file in which registrations are persisted, kept in memory if empty")
+	entryTTL := flag.Duration("ttl", DefaultEntryTTL, "time after which registrations and requests expire, 0 disables expiration")
+	rate := flag.Float64("rate", DefaultRate, "requests per second allowed per client address, 0 disables rate limiting")
+	burst := flag.Int("burst", DefaultBurst, "burst of requests allowed per client address")
+	relayAddr := flag.String("relay", "", "address of the relay server handed out to peers that cannot connect directly, see cmd/relay")
+	relaySecretFile := flag.String("relay-secret-file", "", "file holding the secret shared with the relay server")
+	relayTokenTTL := flag.Duration("relay-token-ttl", DefaultRelayTokenTTL, "time during which the relay tokens are valid")
+	flag.Parse()
+
+	// Stop serving on SIGINT or SIGTERM
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	store := server.NewMemoryStore()
+	if *storeFile != "" {
+		fileStore, err := server.NewFileStore(*storeFile)
+		if err != nil {
+			logger.Error(err, "failed to open store", "file", *storeFile)
+			return
+		}
+		store = fileStore
+	}
+
+	opts := []server.Option{
+		server.WithEntryTTL(*entryTTL),
+		server.WithRateLimit(*rate, *burst),
+		server.WithLogger(logger),
+	}
+
+	if *relayAddr != "" {
+		secret, err := os.ReadFile(*relaySecretFile)
+		if err != nil {
+			logger.Error(err, "failed to read relay secret", "file", *relaySecretFile)
+			return
+		}
+
+		secret = bytes.TrimSpace(secret)
+		if len(secret) == 0 {
+			logger.Error(nil, "relay secret file is empty", "file", *relaySecretFile)
+			return
+		}
+
+		opts = append(opts, server.WithRelay(*relayAddr, secret, *relayTokenTTL))
+	}
+
+	srv := server.New(store, opts...)
+
+	if err := srv.ListenAndServe(ctx, *listenAddr); err != nil {
+		logger.Error(err, "rendezvous server stopped", "address", *listenAddr)
+	}
+}
@@ -3,21 +3,20 @@ package main
 import (
 	"context"
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/yago-123/wg-punch/pkg/util"
 
-	kernelwg "github.com/yago-123/wg-punch-kernel/kernel"
-
 	"github.com/sirupsen/logrus"
 	"github.com/yago-123/wg-punch/pkg/peer"
 	"github.com/yago-123/wg-punch/pkg/tunnel"
+	kernelwg "github.com/yago-123/wg-punch/pkg/tunnel/wg-kernel"
 )
 
 const (
@@ -35,6 +34,9 @@ const (
 	WGPrivKey = "0Ejy2JRTmtIOu10ThPYGWonhQMhQt8IqdaUtyP8xR3A="
 	// WGPubKey  = "HhvuS5kX7kuqhlwnvbX7UjdFrjABQFShZ1q9qRSX9xI="
 
+	// Pre-shared key configured on both sides of the tunnel, empty for none
+	WGPresharedKey = ""
+
 	WGKeepAliveInterval = 25 * time.Second
 
 	WGRemoteListenPort    = 51822
@@ -88,6 +90,7 @@ func main() {
 				Mask: remoteIPCIDR.Mask,
 			},
 		},
+		PresharedKey: WGPresharedKey,
 	}
 
 	tunnel, err := kernelwg.NewTunnel(tunnelCfg)
@@ -116,7 +119,7 @@ func main() {
 }
 
 func startTCPServer(logger *logrus.Logger) {
-	serverAddr := fmt.Sprintf("%s:%d", WGLocalIfaceAddr, TCPServerPort)
+	serverAddr := net.JoinHostPort(WGLocalIfaceAddr, strconv.Itoa(TCPServerPort))
 	ln, err := net.Listen(util.TCPProtocol, serverAddr)
 	if err != nil {
 		logger.Errorf("TCP server listen error: %v", err)
@@ -156,7 +159,7 @@ func handleTCPConnection(c net.Conn, logger *logrus.Logger) {
 }
 
 func startTCPClient(logger *logrus.Logger) {
-	remoteServerAddr := fmt.Sprintf("%s:%d", WGRemoteIfaceAddr, TCPClientPort)
+	remoteServerAddr := net.JoinHostPort(WGRemoteIfaceAddr, strconv.Itoa(TCPClientPort))
 	conn, err := net.Dial(util.TCPProtocol, remoteServerAddr)
 	if err != nil {
 		logger.Errorf("TCP dial error: %v", err)
@@ -3,22 +3,21 @@ package main
 import (
 	"context"
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/yago-123/wg-punch/pkg/util"
 
-	kernelwg "github.com/yago-123/wg-punch-kernel/kernel"
-
 	"github.com/sirupsen/logrus"
 
 	"github.com/yago-123/wg-punch/pkg/peer"
 	"github.com/yago-123/wg-punch/pkg/tunnel"
+	kernelwg "github.com/yago-123/wg-punch/pkg/tunnel/wg-kernel"
 )
 
 const (
@@ -36,6 +35,9 @@ const (
 	WGPrivKey = "4EnHGpFp2eW+aRMK1VVWqUtorspluG5FP0/P+YnLCns="
 	// WGPubKey  = "h2iGtZoTXBl7hOF6vCt5bKemrBAEsjmqLHZuAUJi6is="
 
+	// Pre-shared key configured on both sides of the tunnel, empty for none
+	WGPresharedKey = ""
+
 	WGKeepAliveInterval = 25 * time.Second
 
 	WGRemoteListenPort    = 51821
@@ -89,6 +91,7 @@ func main() {
 				Mask: remoteIPCIDR.Mask,
 			},
 		},
+		PresharedKey: WGPresharedKey,
 	}
 
 	tunnel, err := kernelwg.NewTunnel(tunnelCfg)
@@ -117,7 +120,7 @@ func main() {
 }
 
 func startTCPServer(logger *logrus.Logger) {
-	serverAddr := fmt.Sprintf("%s:%d", WGLocalIfaceAddr, TCPServerPort)
+	serverAddr := net.JoinHostPort(WGLocalIfaceAddr, strconv.Itoa(TCPServerPort))
 	ln, err := net.Listen(util.TCPProtocol, serverAddr)
 	if err != nil {
 		logger.Errorf("TCP server listen error: %v", err)
@@ -157,7 +160,7 @@ func handleTCPConnection(c net.Conn, logger *logrus.Logger) {
 }
 
 func startTCPClient(logger *logrus.Logger) {
-	remoteServerAddr := fmt.Sprintf("%s:%d", WGRemoteIfaceAddr, TCPClientPort)
+	remoteServerAddr := net.JoinHostPort(WGRemoteIfaceAddr, strconv.Itoa(TCPClientPort))
 	conn, err := net.Dial(util.TCPProtocol, remoteServerAddr)
 	if err != nil {
 		logger.Errorf("TCP dial error: %v", err)
@@ -9,6 +9,7 @@ require (
 	github.com/vishvananda/netlink v1.3.0
 	github.com/yago-123/peer-hub v0.0.0-20250424153946-19fd6d2b7af2
 	github.com/yago-123/wg-punch-kernel v0.0.0-20250427113806-1f5616ef3a5f
+	golang.org/x/net v0.33.0
 	golang.zx2c4.com/wireguard v0.0.0-20231211153847-12269c276173
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20241231184526-a9ab2273dd10
 )
@@ -25,7 +26,6 @@ require (
 	github.com/stretchr/testify v1.9.0 // indirect
 	github.com/vishvananda/netns v0.0.4 // indirect
 	golang.org/x/crypto v0.31.0 // indirect
-	golang.org/x/net v0.33.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
@@ -0,0 +1,313 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yago-123/wg-punch/pkg/peer"
+	"github.com/yago-123/wg-punch/pkg/tunnel"
+	"github.com/yago-123/wg-punch/pkg/util"
+
+	errors "github.com/yago-123/wg-punch/pkg/error"
+)
+
+// Acceptor accepts incoming connections from any peer that leaves a connection request for the local peer. If the
+// tunnel implements tunnel.MultiPeerTunnel it is brought up once on a shared socket and every accepted peer is added to
+// it, so a public hub node can accept any number of incoming peers at the same time. Otherwise the tunnel carries a
+// single remote peer, so sessions are accepted one at a time: Accept does not consume a new request until the session
+// previously returned has been closed
+type Acceptor struct {
+	connector  *Connector
+	tunnel     tunnel.Tunnel
+	allowedIPs []string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// multi, conn and releaseRegistration are only set if the tunnel is shared by every accepted peer
+	multi               tunnel.MultiPeerTunnel
+	conn                *net.UDPConn
+	releaseRegistration func(ctx context.Context) error
+
+	mu       sync.Mutex
+	current  *Session
+	sessions map[string]*Session
+	closed   bool
+}
+
+// Listen prepares the local peer to accept connections from peers that do not know in advance. A tunnel implementing
+// tunnel.MultiPeerTunnel is brought up right away on a socket shared by every accepted peer. The returned acceptor stops
+// accepting connections once ctx is done or Close is called. Listen fails with ErrListenUnsupported if the rendezvous
+// backend cannot deliver connection requests, like the default peer-hub backend
+func (c *Connector) Listen(ctx context.Context, tun tunnel.Tunnel, allowedIPs []string) (*Acceptor, error) {
+	if c.requester == nil {
+		return nil, c.errListenUnsupported()
+	}
+
+	ctxListen, cancel := context.WithCancel(ctx)
+
+	acceptor := &Acceptor{
+		connector:  c,
+		tunnel:     tun,
+		allowedIPs: allowedIPs,
+		ctx:        ctxListen,
+		cancel:     cancel,
+		sessions:   make(map[string]*Session),
+	}
+
+	if multi, ok := tun.(tunnel.MultiPeerTunnel); ok {
+		if err := acceptor.open(ctx, multi); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	c.logger.Info("Listening for connection requests", "peerID", c.localPeerID, "shared", acceptor.multi != nil)
+
+	return acceptor, nil
+}
+
+// errListenUnsupported explains that the rendezvous backend cannot deliver connection requests, which retrying does not
+// change
+func (c *Connector) errListenUnsupported() error {
+	return errors.Permanent(fmt.Errorf("%w: %T, configure a requester via WithRequester", errors.ErrListenUnsupported, c.rendClient))
+}
+
+// open binds the shared socket, registers the local peer and brings up the interface without any remote peer
+func (a *Acceptor) open(ctx context.Context, multi tunnel.MultiPeerTunnel) error {
+	c := a.connector
+
+	rollback := util.NewRollback(c.logger)
+	defer rollback.Run()
+
+	conn, err := c.Bind(multi.ListenPort())
+	if err != nil {
+		return err
+	}
+
+	rollback.Add("close socket", func() error {
+		return closeConn(conn)
+	})
+
+	// The registration is held before it is made, so that the release of another session cannot withdraw it
+	releaseRegistration := c.lease.hold()
+	rollback.Add("release registration", func() error {
+		ctxRelease, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+		defer cancel()
+
+		return releaseRegistration(ctxRelease)
+	})
+
+	// The public address must be discovered before the socket is handed to the tunnel
+	if _, err = c.AnnounceShared(ctx, conn, multi.PublicKey(), a.allowedIPs); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if err = multi.Open(ctx, conn); err != nil {
+		return c.stepError(errors.StepTunnel, "", start, errors.ErrTunnelStart, err)
+	}
+
+	rollback.Commit()
+
+	a.multi, a.conn = multi, conn
+	a.releaseRegistration = releaseRegistration
+
+	return nil
+}
+
+// Accept waits for the next connection request addressed to the local peer and establishes a session with the peer
+// that issued it. Requests from peers that already have a session with the shared tunnel are skipped
+func (a *Acceptor) Accept(ctx context.Context) (*Session, error) {
+	ctxAccept, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Tie the accept to the lifetime of the acceptor as well
+	stop := context.AfterFunc(a.ctx, cancel)
+	defer stop()
+
+	if a.multi != nil {
+		return a.acceptShared(ctxAccept)
+	}
+
+	// Wait until the tunnel is released by the previous session
+	start := time.Now()
+	a.mu.Lock()
+	current := a.current
+	a.mu.Unlock()
+
+	if current != nil {
+		select {
+		case <-current.Done():
+		case <-ctxAccept.Done():
+			return nil, a.connector.stepError(errors.StepAccept, "", start, errors.ErrAcceptRequest, ctxAccept.Err())
+		}
+	}
+
+	req, err := a.connector.NextRequest(ctxAccept)
+	if err != nil {
+		return nil, err
+	}
+
+	a.connector.logger.Info("Accepted connection request", "peerID", a.connector.localPeerID, "remotePeerID", req.FromPeerID)
+
+	session, err := a.connector.connect(ctxAccept, a.tunnel, a.allowedIPs, req.FromPeerID)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.current = session
+	a.mu.Unlock()
+
+	return session, nil
+}
+
+// acceptShared adds the peer of the next connection request to the shared tunnel. The path is punched through the
+// shared socket, which is already read by the tunnel, and confirmed by the handshake
+func (a *Acceptor) acceptShared(ctx context.Context) (*Session, error) {
+	c := a.connector
+
+	for {
+		req, err := c.NextRequest(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if a.active(req.FromPeerID) {
+			c.logger.Info("Skipping connection request of connected peer", "peerID", c.localPeerID, "remotePeerID", req.FromPeerID)
+			continue
+		}
+
+		c.logger.Info("Accepted connection request", "peerID", c.localPeerID, "remotePeerID", req.FromPeerID)
+
+		remote, err := c.ResolveShared(ctx, a.multi, a.conn, req.FromPeerID)
+		if err != nil {
+			return nil, err
+		}
+
+		// The handshake confirms the path, once done there is no need to keep punching
+		start := time.Now()
+		errAdd := a.multi.AddPeer(ctx, remote.Info)
+		remote.CancelPunch()
+		if errAdd != nil {
+			return nil, c.stepError(errors.StepTunnel, req.FromPeerID, start, errors.ErrTunnelStart, errAdd)
+		}
+
+		c.emit(EventHandshakeCompleted, req.FromPeerID, remote.Info.Endpoint)
+
+		return a.track(req.FromPeerID, remote)
+	}
+}
+
+// track wraps the peer added to the shared tunnel in a session, whose Close removes the peer only. The session is
+// closed right away if the acceptor has been closed in the meantime
+func (a *Acceptor) track(remotePeerID string, remote *Remote) (*Session, error) {
+	c := a.connector
+
+	session := newSession(a.conn, &peerTunnel{tunnel: a.multi, publicKey: remote.Info.PublicKey}, func() {}, remote.Info, overlayAddrs(a.allowedIPs), remote.OverlayAddrs)
+	// The socket belongs to the acceptor, which keeps serving the rest of the peers through it
+	session.sharedConn = true
+	session.onClose = func() {
+		a.mu.Lock()
+		if a.sessions[remotePeerID] == session {
+			delete(a.sessions, remotePeerID)
+		}
+		a.mu.Unlock()
+
+		c.emit(EventStopped, remotePeerID, nil)
+	}
+
+	if monitored, ok := a.multi.(tunnel.MonitoredTunnel); ok {
+		session.watch(monitored)
+	}
+
+	a.mu.Lock()
+	closed := a.closed
+	if !closed {
+		a.sessions[remotePeerID] = session
+	}
+	a.mu.Unlock()
+
+	if closed {
+		_ = session.Close(context.Background())
+		return nil, errors.Permanent(fmt.Errorf("acceptor closed"))
+	}
+
+	return session, nil
+}
+
+// active reports whether the peer already has a session with the shared tunnel
+func (a *Acceptor) active(remotePeerID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, found := a.sessions[remotePeerID]
+	return found
+}
+
+// Close stops accepting new connections. Sessions of a tunnel carrying a single peer are not affected and must be
+// closed separately. A shared tunnel is torn down together with its socket, which ends every session accepted through
+// it
+func (a *Acceptor) Close() error {
+	a.cancel()
+
+	a.mu.Lock()
+	if a.closed || a.multi == nil {
+		a.closed = true
+		a.mu.Unlock()
+		return nil
+	}
+
+	a.closed = true
+	sessions := make([]*Session, 0, len(a.sessions))
+	for _, session := range a.sessions {
+		sessions = append(sessions, session)
+	}
+	a.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), teardownTimeout)
+	defer cancel()
+
+	for _, session := range sessions {
+		_ = session.Close(ctx)
+	}
+
+	errStop := a.multi.Stop(ctx)
+	if errConn := closeConn(a.conn); errConn != nil && errStop == nil {
+		errStop = errConn
+	}
+
+	if errRelease := a.releaseRegistration(ctx); errRelease != nil && errStop == nil {
+		errStop = errRelease
+	}
+
+	return errStop
+}
+
+// peerTunnel presents a remote peer of a tunnel shared by several sessions as a tunnel of its own. Stopping it removes
+// the remote peer only, the interface keeps running for the rest of them
+type peerTunnel struct {
+	tunnel    tunnel.MultiPeerTunnel
+	publicKey string
+}
+
+func (p *peerTunnel) Start(ctx context.Context, _ *net.UDPConn, remotePeer peer.Info, cancelPunch context.CancelFunc) error {
+	cancelPunch()
+	return p.tunnel.AddPeer(ctx, remotePeer)
+}
+
+func (p *peerTunnel) PublicKey() string {
+	return p.tunnel.PublicKey()
+}
+
+func (p *peerTunnel) ListenPort() int {
+	return p.tunnel.ListenPort()
+}
+
+func (p *peerTunnel) Stop(ctx context.Context) error {
+	return p.tunnel.RemovePeer(ctx, p.publicKey)
+}
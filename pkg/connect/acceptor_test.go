@@ -0,0 +1,118 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/rendezvous/memory"
+)
+
+// newTestConnector creates a connector backed by the in-memory rendezvous that punches through the fake puncher
+func newTestConnector(localPeerID string, rend rendezvous.Rendezvous, punch *fakePuncher, opts ...Option) *Connector {
+	opts = append([]Option{
+		WithRendezvous(rend),
+		WithHostCandidates(false),
+		WithICE(false),
+		WithRelayFallback(false),
+		WithSupervision(false),
+	}, opts...)
+
+	return NewConnector(localPeerID, punch, opts...)
+}
+
+// registerRemote registers a remote peer in the rendezvous and leaves a connection request for the local peer
+func registerRemote(t *testing.T, rend *memory.Rendezvous, remotePeerID, localPeerID string) {
+	t.Helper()
+
+	conn := listenLoopback(t)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	ctx := context.Background()
+	if err := rend.Register(ctx, rendezvous.RegisterRequest{
+		PeerID:     remotePeerID,
+		PublicKey:  remotePeerID + "-key",
+		Endpoint:   conn.LocalAddr().String(),
+		AllowedIPs: []string{"10.0.0.2/32"},
+	}); err != nil {
+		t.Fatalf("failed to register remote peer: %v", err)
+	}
+
+	if err := rend.RequestConnection(ctx, rendezvous.ConnRequest{FromPeerID: remotePeerID, ToPeerID: localPeerID}); err != nil {
+		t.Fatalf("failed to request connection: %v", err)
+	}
+}
+
+func TestListenWithoutRequester(t *testing.T) {
+	c := newTestConnector("hub", registerOnly{memory.New()}, &fakePuncher{})
+
+	_, err := c.Listen(context.Background(), newFakeMultiTunnel("hub-key"), []string{"10.0.0.1/32"})
+	if !errors.Is(err, wgerrors.ErrListenUnsupported) {
+		t.Fatalf("expected ErrListenUnsupported, got %v", err)
+	}
+}
+
+func TestAcceptorServesPeersConcurrently(t *testing.T) {
+	rend := memory.New()
+	punch := &fakePuncher{}
+	c := newTestConnector("hub", rend, punch)
+	tun := newFakeMultiTunnel("hub-key")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	acceptor, err := c.Listen(ctx, tun, []string{"10.0.0.1/32"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	registerRemote(t, rend, "alice", "hub")
+	registerRemote(t, rend, "bob", "hub")
+
+	alice, err := acceptor.Accept(ctx)
+	if err != nil {
+		t.Fatalf("failed to accept first peer: %v", err)
+	}
+
+	// The second peer is accepted while the first session is still alive
+	bob, err := acceptor.Accept(ctx)
+	if err != nil {
+		t.Fatalf("failed to accept second peer: %v", err)
+	}
+
+	if tun.peerCount() != 2 {
+		t.Fatalf("expected 2 peers in the shared tunnel, got %d", tun.peerCount())
+	}
+
+	if !punch.allCancelled() {
+		t.Fatalf("expected punching cancelled once peers were added")
+	}
+
+	// Closing a session removes its peer only, the socket keeps serving the other one
+	if err = alice.Close(ctx); err != nil {
+		t.Fatalf("failed to close session: %v", err)
+	}
+
+	if tun.peerCount() != 1 || isClosed(tun.conn) {
+		t.Fatalf("expected the other peer to remain on an open socket")
+	}
+
+	if err = acceptor.Close(); err != nil {
+		t.Fatalf("failed to close acceptor: %v", err)
+	}
+
+	if err = waitDone(t, bob); !errors.Is(err, wgerrors.ErrSessionClosed) {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+
+	if !tun.isStopped() || !isClosed(tun.conn) {
+		t.Fatalf("expected shared tunnel stopped and socket closed")
+	}
+
+	if isRegistered(rend, "hub") {
+		t.Fatalf("expected local peer deregistered")
+	}
+}
@@ -0,0 +1,52 @@
+package connect
+
+import (
+	"context"
+	"net"
+
+	"github.com/yago-123/wg-punch/pkg/natcheck"
+)
+
+// discoverNAT discovers the behavior of the NAT in front of conn if a NAT check has been configured, returns nil
+// otherwise. The behavior is optional, so failing to discover it is not fatal. Sockets shared with a running tunnel
+// cannot be read, so the behavior discovered before is returned for them
+func (c *Connector) discoverNAT(ctx context.Context, conn *net.UDPConn, shared bool) *natcheck.NATBehavior {
+	if c.natChecker == nil {
+		return nil
+	}
+
+	if shared {
+		return c.natBehavior.Load()
+	}
+
+	behavior, err := c.natChecker.Discover(ctx, conn)
+	if err != nil {
+		c.logger.Info("Failed to discover NAT behavior, continuing without it", "reason", err.Error())
+		return c.natBehavior.Load()
+	}
+
+	c.natBehavior.Store(behavior)
+
+	return behavior
+}
+
+// skipsPunching reports whether punching the remote peer can be skipped in favour of the relay server, which is the
+// case if the behaviors of both NATs are known and rule out a direct path. Punching is attempted anyway if there is
+// no relay server to fall back to, or if a TURN relay might carry the traffic of the connectivity checks
+func (c *Connector) skipsPunching(encodedRemote string) bool {
+	if c.relayBroker == nil || c.turnServer != "" || encodedRemote == "" {
+		return false
+	}
+
+	local := c.natBehavior.Load()
+	if local == nil {
+		return false
+	}
+
+	remote, err := natcheck.ParseNATBehavior(encodedRemote)
+	if err != nil {
+		return false
+	}
+
+	return !natcheck.Punchable(*local, remote)
+}
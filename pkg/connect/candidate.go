@@ -0,0 +1,126 @@
+package connect
+
+import (
+	"math"
+	"net"
+
+	"github.com/yago-123/wg-punch/pkg/ice"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+// hostCandidates returns the addresses of the local interfaces combined with the port of conn, so that peers on the
+// same LAN or behind the same NAT can reach the local peer without going through the public address. IPv6 addresses
+// are only included if conn is dual-stack. Addresses inside the allowed IPs of the local peer belong to the tunnel
+// itself and are skipped
+func hostCandidates(conn *net.UDPConn, allowedIPs []string) []ice.Candidate {
+	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+
+	// Only sockets bound to every interface are reachable through all of them
+	if !localAddr.IP.IsUnspecified() {
+		return []ice.Candidate{ice.NewCandidate(ice.CandidateHost, localAddr, familyPreference(localAddr.IP))}
+	}
+
+	overlay, err := util.ConvertAllowedIPs(allowedIPs)
+	if err != nil {
+		return nil
+	}
+
+	var candidates []ice.Candidate
+	var v4, v6 int
+	for _, ip := range util.LocalIPs(util.SupportsIPv6(conn)) {
+		if containsIP(overlay, ip) {
+			continue
+		}
+
+		// Interfaces listed first are preferred within each family
+		listed := &v4
+		if ip.To4() == nil {
+			listed = &v6
+		}
+
+		localPreference := familyPreference(ip) - uint16(min(*listed, math.MaxUint16/2))
+		*listed++
+
+		candidates = append(candidates, ice.NewCandidate(ice.CandidateHost, &net.UDPAddr{IP: ip, Port: localAddr.Port}, localPreference))
+	}
+
+	return candidates
+}
+
+// familyPreference returns the local preference of the candidates of the family of ip. IPv6 is preferred over IPv4
+// when both peers have it (RFC 8421), since global IPv6 addresses usually need no NAT traversal at all
+func familyPreference(ip net.IP) uint16 {
+	if ip.To4() == nil {
+		return math.MaxUint16
+	}
+
+	return math.MaxUint16 / 2
+}
+
+// remoteCandidates returns the candidates of a remote peer, starting by its public endpoint as a server reflexive
+// candidate. Candidates that cannot be parsed or whose address is repeated are skipped
+func remoteCandidates(endpoint *net.UDPAddr, encoded []string) []ice.Candidate {
+	candidates := []ice.Candidate{ice.NewCandidate(ice.CandidateServerReflexive, endpoint, familyPreference(endpoint.IP))}
+	seen := map[string]struct{}{endpoint.String(): {}}
+
+	for _, s := range encoded {
+		candidate, err := ice.ParseCandidate(s)
+		if err != nil {
+			continue
+		}
+
+		if _, found := seen[candidate.Addr.String()]; found {
+			continue
+		}
+
+		seen[candidate.Addr.String()] = struct{}{}
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates
+}
+
+// candidateAddrs returns the addresses of the candidates, in the same order
+func candidateAddrs(candidates []ice.Candidate) []*net.UDPAddr {
+	addrs := make([]*net.UDPAddr, 0, len(candidates))
+	for _, candidate := range candidates {
+		addrs = append(addrs, candidate.Addr)
+	}
+
+	return addrs
+}
+
+// encodeCandidates encodes the candidates in order to publish them in the rendezvous backend
+func encodeCandidates(candidates []ice.Candidate) []string {
+	encoded := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		encoded = append(encoded, candidate.String())
+	}
+
+	return encoded
+}
+
+// hasCandidate reports whether any of the candidates is at addr
+func hasCandidate(candidates []ice.Candidate, addr *net.UDPAddr) bool {
+	for _, candidate := range candidates {
+		if candidate.Addr.IP.Equal(addr.IP) && candidate.Addr.Port == addr.Port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsIP reports whether ip belongs to any of the networks
+func containsIP(networks []net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,175 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/yago-123/wg-punch/pkg/ice"
+	"github.com/yago-123/wg-punch/pkg/peer"
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/turn"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+// iceState holds the credentials with which the local peer runs connectivity checks, together with the candidates and
+// the relay announced for every socket
+type iceState struct {
+	mu          sync.Mutex
+	credentials *ice.Credentials
+	sockets     map[*net.UDPConn]*socketCandidates
+}
+
+// socketCandidates are the local candidates announced for a socket, and the relay allocated through it if any
+type socketCandidates struct {
+	candidates []ice.Candidate
+	relay      *turn.Client
+}
+
+// announce records the candidates announced for conn, the ones published next to the public address, and returns the credentials to publish next to them. Credentials
+// are generated once and kept for the lifetime of the connector, since remote peers might be checking pairs with the
+// ones published by a previous registration
+func (s *iceState) announce(conn *net.UDPConn, hosts []ice.Candidate, publicAddr *net.UDPAddr, relay *turn.Client) (ice.Credentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.credentials == nil {
+		credentials, err := ice.NewCredentials()
+		if err != nil {
+			return ice.Credentials{}, fmt.Errorf("failed to generate ICE credentials: %w", err)
+		}
+
+		s.credentials = &credentials
+	}
+
+	candidates := append([]ice.Candidate(nil), hosts...)
+
+	// The public address matches a host candidate if the local peer is not behind a NAT
+	if !hasCandidate(hosts, publicAddr) {
+		candidates = append(candidates, ice.NewCandidate(ice.CandidateServerReflexive, publicAddr, familyPreference(publicAddr.IP)))
+	}
+
+	if relay != nil {
+		candidates = append(candidates, ice.NewCandidate(ice.CandidateRelayed, relay.Relayed(), math.MaxUint16))
+	}
+
+	// A socket announced again keeps its relay unless a new one was allocated
+	if previous, found := s.sockets[conn]; found && previous.relay != nil && previous.relay != relay {
+		_ = previous.relay.Close()
+	}
+
+	if s.sockets == nil {
+		s.sockets = make(map[*net.UDPConn]*socketCandidates)
+	}
+	s.sockets[conn] = &socketCandidates{candidates: candidates, relay: relay}
+
+	return *s.credentials, nil
+}
+
+// local returns the credentials and the candidates announced for conn, together with its relay
+func (s *iceState) local(conn *net.UDPConn) (ice.Credentials, []ice.Candidate, *turn.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	socket, found := s.sockets[conn]
+	if s.credentials == nil || !found {
+		return ice.Credentials{}, nil, nil
+	}
+
+	return *s.credentials, socket.candidates, socket.relay
+}
+
+// release forgets the candidates announced for conn and releases its relay, if any
+func (s *iceState) release(conn *net.UDPConn) error {
+	s.mu.Lock()
+	socket, found := s.sockets[conn]
+	delete(s.sockets, conn)
+	s.mu.Unlock()
+
+	if !found || socket.relay == nil {
+		return nil
+	}
+
+	return socket.relay.Close()
+}
+
+// allocateRelay allocates a relayed address on the TURN server through conn. The relay is a fallback, so failing to
+// allocate it is not fatal and nil is returned
+func (c *Connector) allocateRelay(ctx context.Context, conn *net.UDPConn) *turn.Client {
+	if c.turnServer == "" {
+		return nil
+	}
+
+	server, err := net.ResolveUDPAddr(util.UDPProtocol, c.turnServer)
+	if err != nil {
+		c.logger.Error(err, "failed to resolve TURN server, continuing without relay", "server", c.turnServer)
+		return nil
+	}
+
+	relay := turn.NewClient(conn, server, c.turnUsername, c.turnPassword, turn.WithLogger(c.logger))
+	if _, err = relay.Allocate(ctx); err != nil {
+		c.logger.Error(err, "failed to allocate relayed address, continuing without relay", "server", c.turnServer)
+		_ = relay.Close()
+		return nil
+	}
+
+	return relay
+}
+
+// releaseSocket releases the TURN relay allocated through conn and leaves the relay session joined through it, if any,
+// and forgets the mapping measured through it
+func (c *Connector) releaseSocket(conn *net.UDPConn) error {
+	c.mappings.release(conn)
+	errRelay := c.relays.release(conn)
+
+	if c.ice == nil {
+		return errRelay
+	}
+
+	return errors.Join(c.ice.release(conn), errRelay)
+}
+
+// check runs the connectivity checks with the remote peer through conn and returns the nominated remote address, along
+// with the relay that carries the traffic towards it if the nominated pair goes through the local relay. The peer with
+// the lowest ID takes the controlling role, conflicts are solved by the agents themselves otherwise
+func (c *Connector) check(ctx context.Context, conn *net.UDPConn, remotePeerID string, remotePeerInfo *rendezvous.PeerInfo, remoteCandidates []ice.Candidate) (*net.UDPAddr, peer.Relay, error) {
+	credentials, localCandidates, relay := c.ice.local(conn)
+	if len(localCandidates) == 0 {
+		return nil, nil, fmt.Errorf("local peer must be announced through the socket before running connectivity checks")
+	}
+
+	opts := []ice.Option{ice.WithLogger(c.logger)}
+	if relay != nil {
+		// The relay server drops the traffic of remote peers without a permission
+		if err := relay.Permit(ctx, candidateAddrs(remoteCandidates)); err != nil {
+			c.logger.Error(err, "failed to install relay permissions", "remotePeerID", remotePeerID)
+		}
+
+		opts = append(opts, ice.WithRelay(relay))
+	}
+
+	agent, err := ice.NewAgent(conn, credentials, localCandidates, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	role := ice.RoleControlled
+	if c.localPeerID < remotePeerID {
+		role = ice.RoleControlling
+	}
+
+	remoteCredentials := ice.Credentials{Ufrag: remotePeerInfo.Ufrag, Pwd: remotePeerInfo.Pwd}
+	pair, err := agent.Connect(ctx, role, remoteCredentials, remoteCandidates)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pair.Local.Type == ice.CandidateRelayed {
+		return pair.Remote.Addr, relay, nil
+	}
+
+	return pair.Remote.Addr, nil, nil
+}
@@ -2,17 +2,23 @@ package connect
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"net"
-
-	"github.com/yago-123/peer-hub/pkg/types"
+	"sync/atomic"
+	"time"
 
 	errors "github.com/yago-123/wg-punch/pkg/error"
 
 	"github.com/go-logr/logr"
 
-	"github.com/yago-123/peer-hub/pkg/client"
+	"github.com/yago-123/wg-punch/pkg/demux"
+	"github.com/yago-123/wg-punch/pkg/ice"
+	"github.com/yago-123/wg-punch/pkg/natcheck"
 	"github.com/yago-123/wg-punch/pkg/peer"
 	"github.com/yago-123/wg-punch/pkg/puncher"
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/rendezvous/peerhub"
 	"github.com/yago-123/wg-punch/pkg/tunnel"
 	"github.com/yago-123/wg-punch/pkg/util"
 )
@@ -20,8 +26,36 @@ import (
 type Connector struct {
 	localPeerID string
 	puncher     puncher.Puncher
-	rendClient  client.Rendezvous
-	logger      logr.Logger
+	rendClient  rendezvous.Rendezvous
+	requester   rendezvous.Requester
+	lease       *lease
+
+	hostCandidates bool
+	ice            *iceState
+
+	turnServer   string
+	turnUsername string
+	turnPassword string
+
+	relayBroker rendezvous.RelayBroker
+	relays      *relaySet
+
+	mappings *mappingSet
+
+	natChecker  *natcheck.Checker
+	natBehavior atomic.Pointer[natcheck.NATBehavior]
+
+	presharedKeys      map[string]string
+	presharedKeySecret []byte
+
+	supervise     bool
+	staleAfter    time.Duration
+	checkInterval time.Duration
+	backoff       Backoff
+
+	observer Observer
+
+	logger logr.Logger
 }
 
 func NewConnector(localPeerID string, puncher puncher.Puncher, opts ...Option) *Connector {
@@ -32,75 +66,573 @@ func NewConnector(localPeerID string, puncher puncher.Puncher, opts ...Option) *
 	}
 
 	// Rendezvous client (registers and discovers peer IPs)
-	rendClient := client.New(cfg.rendezServerURL, cfg.waitInterval)
+	rendClient := cfg.rendezvous
+	if rendClient == nil {
+		rendClient = peerhub.New(cfg.rendezServerURL, cfg.waitInterval)
+	}
+
+	// Exchange connection requests through the rendezvous backend unless told otherwise
+	requester := cfg.requester
+	if r, ok := rendClient.(rendezvous.Requester); ok && requester == nil {
+		requester = r
+	}
+
+	// Request access to the relay server through the rendezvous backend unless told otherwise
+	relayBroker := cfg.relayBroker
+	if b, ok := rendClient.(rendezvous.RelayBroker); ok && relayBroker == nil {
+		relayBroker = b
+	}
+
+	if !cfg.relayFallback {
+		relayBroker = nil
+	}
+
+	var checks *iceState
+	if cfg.ice {
+		checks = &iceState{}
+	}
+
+	var natChecker *natcheck.Checker
+	if len(cfg.natCheckServers) > 0 {
+		natChecker = natcheck.New(cfg.natCheckServers, natcheck.WithLogger(cfg.logger))
+	}
 
 	return &Connector{
 		localPeerID: localPeerID,
 		rendClient:  rendClient,
+		requester:   requester,
+		lease:       newLease(rendClient, cfg.registrationTTL, cfg.logger),
 		puncher:     puncher,
-		logger:      cfg.logger,
+
+		hostCandidates: cfg.hostCandidates,
+		ice:            checks,
+
+		turnServer:   cfg.turnServer,
+		turnUsername: cfg.turnUsername,
+		turnPassword: cfg.turnPassword,
+
+		relayBroker: relayBroker,
+		relays:      &relaySet{},
+
+		mappings: &mappingSet{},
+
+		natChecker: natChecker,
+
+		presharedKeys:      cfg.presharedKeys,
+		presharedKeySecret: cfg.presharedKeySecret,
+
+		supervise:     cfg.supervise,
+		staleAfter:    cfg.staleAfter,
+		checkInterval: cfg.checkInterval,
+		backoff:       cfg.backoff,
+
+		observer: cfg.observer,
+
+		logger: cfg.logger,
 	}
 }
 
 // Connect handles the connection process between two peers. From registering the peer until the handshake is done.
-// Once Connect has been called the inner connection and the tunnel are started and must be closed by the user of the
-// library in order to prevent resource leaks.
-func (c *Connector) Connect(ctx context.Context, tunnel tunnel.Tunnel, allowedIPs []string, remotePeerID string) (net.Conn, error) {
-	localAddr := &net.UDPAddr{IP: net.IPv4zero, Port: tunnel.ListenPort()}
+// The returned session owns the inner connection and the tunnel, and must be closed by the user of the library in
+// order to prevent resource leaks.
+func (c *Connector) Connect(ctx context.Context, tunnel tunnel.Tunnel, allowedIPs []string, remotePeerID string) (*Session, error) {
+	// Let the remote peer know that we want to connect in case it is accepting connections instead of dialing
+	if err := c.Request(ctx, remotePeerID); err != nil {
+		return nil, err
+	}
+
+	return c.connect(ctx, tunnel, allowedIPs, remotePeerID)
+}
+
+// connect performs the connection process with a remote peer whose ID is already known
+func (c *Connector) connect(ctx context.Context, tun tunnel.Tunnel, allowedIPs []string, remotePeerID string) (*Session, error) {
+	// Release every resource acquired so far, in reverse order, if any of the steps fails
+	rollback := util.NewRollback(c.logger)
+	defer rollback.Run()
+
+	conn, err := c.Bind(tun.ListenPort())
+	if err != nil {
+		return nil, err
+	}
+
+	rollback.Add("close socket", func() error {
+		return closeConn(conn)
+	})
+
+	rollback.Add("release socket", func() error {
+		return c.releaseSocket(conn)
+	})
+
+	// Keep the registration alive from now on, resolving the remote peer might take longer than its lease. It is held
+	// before it is made, otherwise the release of another session in between would withdraw it. ctx is likely done if a
+	// later step fails, so the registration is released with a context of its own. It is kept if other sessions rely on
+	// it
+	releaseRegistration := c.lease.hold()
+	rollback.Add("release registration", func() error {
+		ctxRelease, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+		defer cancel()
+
+		return releaseRegistration(ctxRelease)
+	})
 
+	if _, err = c.Announce(ctx, conn, tun.PublicKey(), allowedIPs); err != nil {
+		return nil, err
+	}
+
+	remote, err := c.Resolve(ctx, conn, remotePeerID)
+	if err != nil {
+		return nil, err
+	}
+
+	rollback.Add("stop punching", func() error {
+		remote.CancelPunch()
+		return nil
+	})
+
+	// Port prediction might have opened the path through another socket, which replaces the one bound above
+	if remote.Conn != nil && remote.Conn != conn {
+		if errRelease := c.releaseSocket(conn); errRelease != nil {
+			c.logger.Error(errRelease, "failed to release socket", "remotePeerID", remotePeerID)
+		}
+		_ = closeConn(conn)
+
+		// The rollback steps added above refer to conn, so they take care of the new socket from now on
+		conn = remote.Conn
+	}
+
+	// Start WireGuard tunnel. The tunnel releases the interface, its address and the routes itself if it fails
+	start := time.Now()
+	if errTunnel := tun.Start(ctx, conn, remote.Info, remote.CancelPunch); errTunnel != nil {
+		return nil, c.stepError(errors.StepTunnel, remotePeerID, start, errors.ErrTunnelStart, errTunnel)
+	}
+
+	// From here on the resources are owned by the session
+	rollback.Commit()
+
+	// Start only returns once the first handshake has been completed
+	c.emit(EventTunnelStarted, remotePeerID, nil)
+	c.emit(EventHandshakeCompleted, remotePeerID, remote.Info.Endpoint)
+
+	session := newSession(conn, tun, remote.CancelPunch, remote.Info, overlayAddrs(allowedIPs), remote.OverlayAddrs)
+	session.releaseRegistration = releaseRegistration
+	session.releaseSocket = c.releaseSocket
+	session.onClose = func() {
+		c.emit(EventStopped, remotePeerID, nil)
+	}
+
+	// End the session if the tunnel dies, so that the owner notices through Done and Err
+	if monitored, ok := tun.(tunnel.MonitoredTunnel); ok {
+		session.watch(monitored)
+	}
+
+	// Watch the session so that the path is repaired if it dies and changes are reported to the observer
+	if supervised, ok := tun.(tunnel.SupervisedTunnel); ok && (c.supervise || c.observer != nil) {
+		session.supervise(&supervisor{
+			connector:      c,
+			tunnel:         supervised,
+			session:        session,
+			remotePeerID:   remotePeerID,
+			allowedIPs:     allowedIPs,
+			reconnectStale: c.supervise,
+			staleAfter:     c.staleAfter,
+			checkInterval:  c.checkInterval,
+			backoff:        c.backoff,
+			logger:         c.logger,
+		})
+	}
+
+	return session, nil
+}
+
+// publicAddr6 discovers the public IPv6 address of conn if it is dual-stack and the puncher is able to, returns nil
+// otherwise. IPv6 connectivity is optional, so failing to discover it is not fatal
+func (c *Connector) publicAddr6(ctx context.Context, conn *net.UDPConn) *net.UDPAddr {
+	dualStack, ok := c.puncher.(puncher.DualStack)
+	if !ok || !util.SupportsIPv6(conn) {
+		return nil
+	}
+
+	publicAddr6, err := dualStack.PublicAddr6(ctx, conn)
+	if err != nil {
+		c.logger.Info("No public IPv6 address, continuing without it", "reason", err.Error())
+		return nil
+	}
+
+	return publicAddr6
+}
+
+// Remote describes a remote peer found via the rendezvous server towards which a path has already been opened
+type Remote struct {
+	ID   string
+	Info peer.Info
+	// OverlayAddr is the first address of the remote peer inside the tunnel, OverlayAddrs holds all of them
+	OverlayAddr  net.IP
+	OverlayAddrs []net.IP
+	// CancelPunch stops the punching process towards the remote peer, it must be called once the tunnel is started
+	CancelPunch context.CancelFunc
+	// Conn is the socket through which the path towards the remote peer was opened. It differs from the socket passed
+	// to Resolve if the path was opened through another socket of the pool used for port prediction, in which case the
+	// tunnel must be started on Conn and the socket passed to Resolve closed
+	Conn *net.UDPConn
+}
+
+// Bind creates the UDP socket on which the rest of the connection process and the tunnel run
+func (c *Connector) Bind(port int) (*net.UDPConn, error) {
+	// Dual-stack, so that remote peers can be reached over IPv6 when both sides have it
+	localAddr := util.DualStackAddr(port)
+
+	start := time.Now()
 	conn, err := net.ListenUDP(util.UDPProtocol, localAddr)
 	if err != nil {
-		return nil, errors.Wrap(errors.ErrBindingUDP, err)
+		return nil, c.stepError(errors.StepBind, "", start, errors.ErrBindingUDP, err)
 	}
 
+	boundAddr, _ := conn.LocalAddr().(*net.UDPAddr)
+	c.emit(EventSocketBound, "", boundAddr)
+
+	return conn, nil
+}
+
+// Announce discovers the public address of conn and registers the local peer in the rendezvous server so that remote
+// peers can find it. Since the public address is discovered through conn, it must be called before the socket is
+// handed to the tunnel. If ICE is enabled the credentials of the checks are published as well, together with the
+// relayed address allocated through conn if a TURN server is configured, which is released once the session is closed
+func (c *Connector) Announce(ctx context.Context, conn *net.UDPConn, publicKey string, allowedIPs []string) (*net.UDPAddr, error) {
+	return c.announce(ctx, conn, publicKey, allowedIPs, false)
+}
+
+// AnnounceShared is like Announce for sockets that are handed to a running tunnel right away, which prevents running
+// connectivity checks through them. Neither ICE credentials nor a relayed address are published, so remote peers punch
+// the candidates of the local peer instead
+func (c *Connector) AnnounceShared(ctx context.Context, conn *net.UDPConn, publicKey string, allowedIPs []string) (*net.UDPAddr, error) {
+	return c.announce(ctx, conn, publicKey, allowedIPs, true)
+}
+
+func (c *Connector) announce(ctx context.Context, conn *net.UDPConn, publicKey string, allowedIPs []string, shared bool) (*net.UDPAddr, error) {
 	// Discover own public address via STUN
-	publicAddr, err := c.puncher.PublicAddr(ctx, conn)
+	start := time.Now()
+	var publicAddr *net.UDPAddr
+	var mapping *puncher.Mapping
+	var err error
+	if shared {
+		publicAddr, err = c.puncher.PublicAddr(ctx, conn)
+	} else {
+		// Ports are only predicted for sockets whose connection process has not been handed to a tunnel yet
+		publicAddr, mapping, err = c.publicMapping(ctx, conn)
+	}
+	publicAddr6 := c.publicAddr6(ctx, conn)
 	if err != nil {
-		return nil, errors.Wrap(errors.ErrPubAddrRetrieve, err)
+		if publicAddr6 == nil {
+			return nil, c.stepError(errors.StepDiscover, "", start, errors.ErrPubAddrRetrieve, err)
+		}
+
+		// Hosts without IPv4 connectivity are registered at their IPv6 address
+		publicAddr, publicAddr6 = publicAddr6, nil
+	}
+
+	if publicAddr6 != nil && publicAddr6.IP.Equal(publicAddr.IP) && publicAddr6.Port == publicAddr.Port {
+		publicAddr6 = nil
+	}
+
+	c.emit(EventPublicAddrDiscovered, "", publicAddr)
+	if publicAddr6 != nil {
+		c.emit(EventPublicAddrDiscovered, "", publicAddr6)
 	}
 
 	// Register local peer in rendezvous server
-	localPeerInfo := types.RegisterRequest{
+	localPeerInfo := rendezvous.RegisterRequest{
 		PeerID:     c.localPeerID,
-		PublicKey:  tunnel.PublicKey(),
+		PublicKey:  publicKey,
 		Endpoint:   publicAddr.String(),
 		AllowedIPs: allowedIPs,
+		TTL:        c.lease.ttl,
+	}
+	if mapping != nil {
+		localPeerInfo.PortMapping = mapping.String()
+	}
+	if behavior := c.discoverNAT(ctx, conn, shared); behavior != nil {
+		localPeerInfo.NATBehavior = behavior.String()
+	}
+	start = time.Now()
+
+	var candidates []ice.Candidate
+	if c.hostCandidates {
+		candidates = hostCandidates(conn, allowedIPs)
+	}
+
+	// The public IPv6 address is published as a candidate next to the public address, unless it is a host candidate
+	if publicAddr6 != nil && !hasCandidate(candidates, publicAddr6) {
+		candidates = append(candidates, ice.NewCandidate(ice.CandidateServerReflexive, publicAddr6, familyPreference(publicAddr6.IP)))
+	}
+	localPeerInfo.Candidates = encodeCandidates(candidates)
+
+	if c.ice != nil && !shared {
+		relay := c.allocateRelay(ctx, conn)
+
+		credentials, errICE := c.ice.announce(conn, candidates, publicAddr, relay)
+		if errICE != nil {
+			if relay != nil {
+				_ = relay.Close()
+			}
+			return nil, c.stepError(errors.StepRegister, "", start, errors.ErrRegisterPeer, errICE)
+		}
+
+		if relay != nil {
+			relayed := ice.NewCandidate(ice.CandidateRelayed, relay.Relayed(), math.MaxUint16)
+			localPeerInfo.Candidates = append(localPeerInfo.Candidates, relayed.String())
+		}
+
+		localPeerInfo.Ufrag, localPeerInfo.Pwd = credentials.Ufrag, credentials.Pwd
 	}
+
 	if errRendez := c.rendClient.Register(ctx, localPeerInfo); errRendez != nil {
-		return nil, errors.Wrap(errors.ErrRegisterPeer, errRendez)
+		return nil, c.stepError(errors.StepRegister, "", start, errors.ErrRegisterPeer, errRendez)
+	}
+
+	// Renew the latest registration from now on
+	c.lease.update(localPeerInfo)
+
+	c.logger.Info("Registered local peer", "peerID", c.localPeerID, "publicKey", publicKey, "endpoint", publicAddr.String(), "candidates", localPeerInfo.Candidates, "allowedIPs", allowedIPs)
+	c.emit(EventRegistered, "", publicAddr)
+
+	return publicAddr, nil
+}
+
+// reregister registers the local peer again at publicAddr if it differs from the endpoint of its latest registration,
+// which happens when the NAT drops the mapping of the socket and allocates a new one
+func (c *Connector) reregister(ctx context.Context, publicAddr *net.UDPAddr) error {
+	req := c.lease.current()
+	if req == nil || req.Endpoint == publicAddr.String() {
+		return nil
+	}
+
+	c.emit(EventPublicAddrDiscovered, "", publicAddr)
+
+	start := time.Now()
+	previous := req.Endpoint
+	req.Endpoint = publicAddr.String()
+	if err := c.rendClient.Register(ctx, *req); err != nil {
+		return c.stepError(errors.StepRegister, "", start, errors.ErrRegisterPeer, err)
+	}
+
+	c.lease.update(*req)
+
+	c.logger.Info("Public address changed, registered local peer again", "peerID", c.localPeerID, "previous", previous, "endpoint", req.Endpoint)
+	c.emit(EventRegistered, "", publicAddr)
+
+	return nil
+}
+
+// Resolve waits for the remote peer to show up in the rendezvous server and punches a path towards it through conn.
+// Every candidate of the remote peer is punched and the one that answers first becomes its endpoint, so conn must not
+// be read by anyone else until Resolve returns. If no path can be opened the remote peer is reached through a relay
+// server instead, see WithRelayFallback. If either NAT is symmetric and the puncher predicts ports the path might be
+// opened through another socket, which is returned in Remote.Conn
+func (c *Connector) Resolve(ctx context.Context, conn *net.UDPConn, remotePeerID string) (*Remote, error) {
+	return c.resolve(ctx, conn, remotePeerID, false, nil)
+}
+
+// ResolveShared is like Resolve for sockets already read by the running tunnel tun. Every candidate of the remote peer
+// is punched but no answer is awaited, the public endpoint of the remote peer is used and the tunnel is expected to roam
+// to whichever candidate the remote peer answers from. If tun shares its socket through a demultiplexer the probes of the
+// remote peer are acknowledged until the punching process is canceled, so that a remote peer punching actively through
+// Resolve confirms the path
+func (c *Connector) ResolveShared(ctx context.Context, tun tunnel.Tunnel, conn *net.UDPConn, remotePeerID string) (*Remote, error) {
+	var d *demux.Demux
+	if demuxed, ok := tun.(tunnel.DemuxedTunnel); ok {
+		d = demuxed.Demux()
 	}
 
-	c.logger.Info("Registered local peer", "peerID", c.localPeerID, "publicKey", tunnel.PublicKey(), "endpoint", publicAddr.String(), "allowedIPs", allowedIPs)
+	return c.resolve(ctx, conn, remotePeerID, true, d)
+}
 
+func (c *Connector) resolve(ctx context.Context, conn *net.UDPConn, remotePeerID string, shared bool, d *demux.Demux) (*Remote, error) {
 	// Wait for peer info from the rendezvous server
+	start := time.Now()
 	remotePeerInfo, endpoint, err := c.rendClient.WaitForPeer(ctx, remotePeerID)
 	if err != nil {
-		return nil, errors.Wrap(errors.ErrWaitForPeer, err)
+		return nil, c.stepError(errors.StepWaitForPeer, remotePeerID, start, errors.ErrWaitForPeer, err)
 	}
 
-	// Create UDP connection on local public IP
-	cancelPunch, errPunch := c.puncher.Punch(ctx, conn, endpoint)
-	if errPunch != nil {
-		return nil, errors.Wrap(errors.ErrPunchingNAT, errPunch)
-	}
+	c.emit(EventRemoteFound, remotePeerID, endpoint)
 
 	// Adjust allowedIPs from string to IP format
+	start = time.Now()
 	remoteAllowedIPs, err := util.ConvertAllowedIPs(remotePeerInfo.AllowedIPs)
 	if err != nil {
-		return nil, errors.Wrap(errors.ErrConvertAllowed, err)
+		return nil, c.stepError(errors.StepConfigure, remotePeerID, start, errors.ErrConvertAllowed, errors.Permanent(err))
+	}
+
+	presharedKey, err := c.presharedKey(remotePeerID)
+	if err != nil {
+		return nil, c.stepError(errors.StepConfigure, remotePeerID, start, errors.ErrPresharedKey, errors.Permanent(err))
 	}
 
-	c.logger.Info("Connecting to remote peer", "peerID", remotePeerID, "endpoint", endpoint.String(), "allowedIPs", remoteAllowedIPs)
+	candidates := remoteCandidates(endpoint, remotePeerInfo.Candidates)
 
-	// Start WireGuard tunnel
-	if errTunnel := tunnel.Start(ctx, conn, peer.Info{
-		PublicKey:  remotePeerInfo.PublicKey,
-		Endpoint:   endpoint,
-		AllowedIPs: remoteAllowedIPs,
-	}, cancelPunch); errTunnel != nil {
-		return nil, errors.Wrap(errors.ErrTunnelStart, errTunnel)
+	c.emit(EventPunching, remotePeerID, endpoint)
+
+	start = time.Now()
+	var selected *net.UDPAddr
+	var relay peer.Relay
+	var errPunch error
+	cancelPunch := context.CancelFunc(func() {})
+	// Connectivity checks cannot open a path through a symmetric NAT, so the remote peer is punched with port prediction
+	// instead whenever one of the NATs is symmetric
+	local, remote := c.mappings.get(conn), remoteMapping(remotePeerInfo.PortMapping)
+	predict := !shared && predicts(local, remote)
+	selectedConn := conn
+	if !shared && !predict && c.skipsPunching(remotePeerInfo.NATBehavior) {
+		// Both behaviors are known and rule out a direct path, the relay server is joined right away below
+		errPunch = fmt.Errorf("NAT behaviors rule out a direct path: local %s, remote %s", c.natBehavior.Load(), remotePeerInfo.NATBehavior)
+	} else if c.ice != nil && !shared && !predict && remotePeerInfo.Ufrag != "" {
+		// Check the candidate pairs with the remote peer and use the nominated one, the agent stops on its own. Punch
+		// probes are not sent on this path: a pair is only nominated once a check answered through it, and checks are
+		// authenticated with the ICE credentials registered by the remote peer, so the nominated pair works both ways
+		selected, relay, errPunch = c.check(ctx, conn, remotePeerID, remotePeerInfo, candidates)
+	} else {
+		// Punch every address the remote peer might be reachable at through the local socket
+		target := puncher.Target{
+			Candidates:   candidateAddrs(candidates),
+			Passive:      shared,
+			RemoteKey:    remotePeerInfo.PublicKey,
+			PresharedKey: presharedKey,
+			Demux:        d,
+		}
+		if predict {
+			target.Local, target.Remote = local, remote
+		}
+		// Probes are authenticated with the public keys of both peers, the local one is the latest registered
+		if req := c.lease.current(); req != nil {
+			target.LocalKey = req.PublicKey
+		}
+
+		var punched *puncher.Result
+		punched, errPunch = c.puncher.Punch(ctx, conn, target)
+		if errPunch == nil {
+			selected, cancelPunch = punched.Addr, punched.Cancel
+			if punched.Conn != nil {
+				selectedConn = punched.Conn
+			}
+			if punched.Verified {
+				c.logger.Info("Remote peer confirmed path", "peerID", remotePeerID, "endpoint", selected.String(), "rtt", punched.RTT)
+			}
+		}
 	}
+	if errPunch != nil && !shared && c.relayBroker != nil && ctx.Err() == nil {
+		// Fall back to the relay server, the remote peer is expected to give up on the direct path around the same time
+		c.logger.Info("No direct path towards remote peer, falling back to relay", "peerID", remotePeerID, "reason", errPunch.Error())
 
-	// Return net.Conn (use the raw conn or wrap it)
-	return conn, nil
+		server, client, errRelay := c.joinRelay(ctx, conn, remotePeerID)
+		if errRelay == nil {
+			selected, relay, errPunch = server, client, nil
+			c.emit(EventRelaying, remotePeerID, server)
+		} else {
+			c.logger.Error(errRelay, "failed to fall back to relay", "peerID", remotePeerID)
+		}
+	}
+	if errPunch != nil {
+		return nil, c.stepError(errors.StepPunch, remotePeerID, start, errors.ErrPunchingNAT, errPunch)
+	}
+
+	c.logger.Info("Connecting to remote peer", "peerID", remotePeerID, "endpoint", selected.String(), "relayed", relay != nil, "predicted", predict, "allowedIPs", remoteAllowedIPs)
+
+	overlays := overlayAddrs(remotePeerInfo.AllowedIPs)
+
+	return &Remote{
+		ID: remotePeerID,
+		Info: peer.Info{
+			PublicKey:    remotePeerInfo.PublicKey,
+			Endpoint:     selected,
+			AllowedIPs:   remoteAllowedIPs,
+			PresharedKey: presharedKey,
+			Relay:        relay,
+		},
+		OverlayAddr:  first(overlays),
+		OverlayAddrs: overlays,
+		CancelPunch:  cancelPunch,
+		Conn:         selectedConn,
+	}, nil
+}
+
+// presharedKey returns the pre-shared key to use with the remote peer, which is empty if none has been configured
+func (c *Connector) presharedKey(remotePeerID string) (string, error) {
+	if key, found := c.presharedKeys[remotePeerID]; found {
+		return key, nil
+	}
+
+	if len(c.presharedKeySecret) == 0 {
+		return "", nil
+	}
+
+	return peer.DerivePresharedKey(c.presharedKeySecret, c.localPeerID, remotePeerID)
+}
+
+// Request leaves a connection request for the remote peer in case it is accepting connections instead of dialing.
+// It is a no-op if no requester has been configured
+func (c *Connector) Request(ctx context.Context, remotePeerID string) error {
+	if c.requester == nil {
+		return nil
+	}
+
+	req := rendezvous.ConnRequest{
+		FromPeerID: c.localPeerID,
+		ToPeerID:   remotePeerID,
+	}
+	start := time.Now()
+	if err := c.requester.RequestConnection(ctx, req); err != nil {
+		return c.stepError(errors.StepRequest, remotePeerID, start, errors.ErrRequestConn, err)
+	}
+
+	return nil
+}
+
+// NextRequest waits for the next connection request addressed to the local peer
+func (c *Connector) NextRequest(ctx context.Context) (*rendezvous.ConnRequest, error) {
+	if c.requester == nil {
+		return nil, c.errListenUnsupported()
+	}
+
+	start := time.Now()
+	req, err := c.requester.WaitForRequest(ctx, c.localPeerID)
+	if err != nil {
+		return nil, c.stepError(errors.StepAccept, "", start, errors.ErrAcceptRequest, err)
+	}
+
+	return req, nil
+}
+
+// stepError describes the failure of a step of the connection process that began at start. The error is wrapped
+// with the sentinel of the step so that both can be matched via errors.Is
+func (c *Connector) stepError(step errors.Step, remotePeerID string, start time.Time, sentinel, err error) error {
+	return &errors.ConnectError{
+		Step:         step,
+		LocalPeerID:  c.localPeerID,
+		RemotePeerID: remotePeerID,
+		Elapsed:      time.Since(start),
+		Err:          errors.Wrap(sentinel, err),
+	}
+}
+
+// HoldRegistration keeps the registration of the local peer alive, renewing its lease in the background, until the
+// returned function is called. The local peer is deregistered once no session nor any other holder relies on the
+// registration anymore. Sessions returned by Connect and Accept hold the registration on their own
+func (c *Connector) HoldRegistration() func(ctx context.Context) error {
+	return c.lease.hold()
+}
+
+// Peers returns the peers currently registered in the rendezvous backend, the local peer included. Fails with
+// ErrListUnsupported if the backend cannot enumerate them
+func (c *Connector) Peers(ctx context.Context) ([]rendezvous.PeerInfo, error) {
+	lister, ok := c.rendClient.(rendezvous.Lister)
+	if !ok {
+		return nil, errors.Permanent(fmt.Errorf("%w: %T", errors.ErrListUnsupported, c.rendClient))
+	}
+
+	return lister.Peers(ctx)
+}
+
+// LocalPeerID returns the ID under which the local peer is registered
+func (c *Connector) LocalPeerID() string {
+	return c.localPeerID
 }
@@ -0,0 +1,143 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/rendezvous/memory"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+// TestConnectRollback checks that every resource acquired by Connect is released when one of its steps fails: the
+// socket is closed, the local peer deregistered and punching cancelled
+func TestConnectRollback(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, punch *fakePuncher, tun *fakeTunnel)
+		remoteID string
+		sentinel error
+		// punched tells whether the step fails once punching has started
+		punched bool
+	}{
+		{
+			name: "bind",
+			setup: func(t *testing.T, _ *fakePuncher, tun *fakeTunnel) {
+				// Occupy the listen port of the tunnel
+				busy, err := net.ListenUDP(util.UDPProtocol, util.DualStackAddr(0))
+				if err != nil {
+					t.Fatalf("failed to bind socket: %v", err)
+				}
+				t.Cleanup(func() { _ = busy.Close() })
+
+				tun.listenPort = busy.LocalAddr().(*net.UDPAddr).Port
+			},
+			remoteID: "remote",
+			sentinel: wgerrors.ErrBindingUDP,
+		},
+		{
+			name: "announce",
+			setup: func(_ *testing.T, punch *fakePuncher, _ *fakeTunnel) {
+				punch.publicAddrErr = errFake
+			},
+			remoteID: "remote",
+			sentinel: wgerrors.ErrPubAddrRetrieve,
+		},
+		{
+			name:     "resolve",
+			setup:    func(*testing.T, *fakePuncher, *fakeTunnel) {},
+			remoteID: "unknown",
+			sentinel: wgerrors.ErrWaitForPeer,
+		},
+		{
+			name: "punch",
+			setup: func(_ *testing.T, punch *fakePuncher, _ *fakeTunnel) {
+				punch.punchErr = errFake
+			},
+			remoteID: "remote",
+			sentinel: wgerrors.ErrPunchingNAT,
+		},
+		{
+			name: "start",
+			setup: func(_ *testing.T, _ *fakePuncher, tun *fakeTunnel) {
+				tun.startErr = errFake
+			},
+			remoteID: "remote",
+			sentinel: wgerrors.ErrTunnelStart,
+			punched:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rend := memory.New()
+			if err := rend.Register(context.Background(), rendezvous.RegisterRequest{
+				PeerID:     "remote",
+				PublicKey:  "remote-key",
+				Endpoint:   "127.0.0.1:9",
+				AllowedIPs: []string{"10.0.0.2/32"},
+			}); err != nil {
+				t.Fatalf("failed to register remote peer: %v", err)
+			}
+
+			punch := &fakePuncher{}
+			tun := newFakeTunnel("local-key")
+			tt.setup(t, punch, tun)
+
+			c := newTestConnector("local", rend, punch)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			_, err := c.Connect(ctx, tun, []string{"10.0.0.1/32"}, tt.remoteID)
+			if !errors.Is(err, tt.sentinel) {
+				t.Fatalf("expected %v, got %v", tt.sentinel, err)
+			}
+
+			// The socket is only bound if the bind step succeeded
+			if conn := punch.lastConn(); (conn == nil) != (tt.sentinel == wgerrors.ErrBindingUDP) || (conn != nil && !isClosed(conn)) {
+				t.Fatalf("expected socket closed")
+			}
+
+			if isRegistered(rend, "local") {
+				t.Fatalf("expected local peer deregistered")
+			}
+
+			if punch.punched() != tt.punched || !punch.allCancelled() {
+				t.Fatalf("expected punching cancelled")
+			}
+		})
+	}
+}
+
+func TestConnectRenewsRegistrationWhileResolving(t *testing.T) {
+	rend := memory.New()
+	ttl := 60 * time.Millisecond
+	c := newTestConnector("local", rend, &fakePuncher{}, WithRegistrationTTL(ttl))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*ttl)
+	defer cancel()
+
+	// The remote peer never shows up, so the registration must be renewed while waiting for it
+	registered := make(chan bool, 1)
+	go func() {
+		time.Sleep(5 * ttl)
+		registered <- isRegistered(rend, "local")
+	}()
+
+	if _, err := c.Connect(ctx, newFakeTunnel("local-key"), []string{"10.0.0.1/32"}, "unknown"); !errors.Is(err, wgerrors.ErrWaitForPeer) {
+		t.Fatalf("expected ErrWaitForPeer, got %v", err)
+	}
+
+	if !<-registered {
+		t.Fatalf("expected registration renewed while resolving the remote peer")
+	}
+
+	if isRegistered(rend, "local") {
+		t.Fatalf("expected local peer deregistered")
+	}
+}
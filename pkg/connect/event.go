@@ -0,0 +1,93 @@
+package connect
+
+import (
+	"net"
+	"time"
+)
+
+// EventType identifies a step of the connection process or a change in an established session
+type EventType int
+
+const (
+	// EventSocketBound is emitted once the UDP socket has been bound, Addr holds its local address
+	EventSocketBound EventType = iota
+	// EventPublicAddrDiscovered is emitted once the public address of the socket is known, Addr holds it
+	EventPublicAddrDiscovered
+	// EventRegistered is emitted once the local peer has been registered in the rendezvous backend
+	EventRegistered
+	// EventRemoteFound is emitted once the remote peer shows up in the rendezvous backend, Addr holds its endpoint
+	EventRemoteFound
+	// EventPunching is emitted when punching towards the remote peer starts, Addr holds its public endpoint
+	EventPunching
+	// EventRelaying is emitted when no direct path could be opened and the traffic falls back to a relay server, Addr
+	// holds its address
+	EventRelaying
+	// EventTunnelStarted is emitted once the tunnel is up and configured with the remote peer
+	EventTunnelStarted
+	// EventHandshakeCompleted is emitted once the first handshake with the remote peer has been completed
+	EventHandshakeCompleted
+	// EventHandshakeRenewed is emitted every time the device completes a new handshake with the remote peer
+	EventHandshakeRenewed
+	// EventEndpointRoamed is emitted when the device sees the remote peer at a new endpoint, Addr holds it
+	EventEndpointRoamed
+	// EventPeerStale is emitted when no handshake has happened with the remote peer for longer than the stale threshold
+	EventPeerStale
+	// EventStopped is emitted once the session has been closed
+	EventStopped
+)
+
+var eventTypeNames = map[EventType]string{
+	EventSocketBound:          "socket-bound",
+	EventPublicAddrDiscovered: "public-addr-discovered",
+	EventRegistered:           "registered",
+	EventRemoteFound:          "remote-found",
+	EventPunching:             "punching",
+	EventRelaying:             "relaying",
+	EventTunnelStarted:        "tunnel-started",
+	EventHandshakeCompleted:   "handshake-completed",
+	EventHandshakeRenewed:     "handshake-renewed",
+	EventEndpointRoamed:       "endpoint-roamed",
+	EventPeerStale:            "peer-stale",
+	EventStopped:              "stopped",
+}
+
+func (t EventType) String() string {
+	if name, found := eventTypeNames[t]; found {
+		return name
+	}
+
+	return "unknown"
+}
+
+// Event describes a step of the connection process or a change in an established session. The steps performed while
+// a supervised session is being repaired are emitted again
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	LocalPeerID string
+	// RemotePeerID is empty for the steps that do not involve a remote peer yet (bind, discovery and registration)
+	RemotePeerID string
+
+	// Addr holds the address related to the event, if any
+	Addr *net.UDPAddr
+}
+
+// Observer is called synchronously for every event emitted by the connector and its sessions, so it must return
+// quickly and must not call back into the connector
+type Observer func(Event)
+
+// emit notifies the observer, if any, about an event
+func (c *Connector) emit(eventType EventType, remotePeerID string, addr *net.UDPAddr) {
+	if c.observer == nil {
+		return
+	}
+
+	c.observer(Event{
+		Type:         eventType,
+		Time:         time.Now(),
+		LocalPeerID:  c.localPeerID,
+		RemotePeerID: remotePeerID,
+		Addr:         addr,
+	})
+}
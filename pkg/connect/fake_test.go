@@ -0,0 +1,267 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yago-123/wg-punch/pkg/peer"
+	"github.com/yago-123/wg-punch/pkg/puncher"
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/tunnel"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+var errFake = errors.New("fake failure")
+
+// fakeTunnel records the calls made by the connector and its sessions, without touching any interface
+type fakeTunnel struct {
+	publicKey  string
+	listenPort int
+	startErr   error
+
+	mu       sync.Mutex
+	started  bool
+	stopped  bool
+	conn     *net.UDPConn
+	stats    tunnel.PeerStats
+	statsErr error
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+}
+
+func newFakeTunnel(publicKey string) *fakeTunnel {
+	return &fakeTunnel{publicKey: publicKey, done: make(chan struct{})}
+}
+
+func (f *fakeTunnel) Start(_ context.Context, conn *net.UDPConn, _ peer.Info, cancelPunch context.CancelFunc) error {
+	// Punching is left running on failure, stopping it is up to the caller
+	if f.startErr != nil {
+		return f.startErr
+	}
+
+	cancelPunch()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.started, f.conn = true, conn
+	f.stats.LastHandshake = time.Now()
+
+	return nil
+}
+
+func (f *fakeTunnel) PublicKey() string {
+	return f.publicKey
+}
+
+func (f *fakeTunnel) ListenPort() int {
+	return f.listenPort
+}
+
+func (f *fakeTunnel) Stop(_ context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopped = true
+	f.doneOnce.Do(func() { close(f.done) })
+
+	return nil
+}
+
+func (f *fakeTunnel) PeerStats(_ string) (tunnel.PeerStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.stats, f.statsErr
+}
+
+func (f *fakeTunnel) Suspend(_ context.Context) error {
+	return errFake
+}
+
+func (f *fakeTunnel) Resume(_ context.Context, _ *net.UDPConn) error {
+	return errFake
+}
+
+func (f *fakeTunnel) UpdateEndpoint(_ context.Context, _ string, _ *net.UDPAddr) error {
+	return nil
+}
+
+func (f *fakeTunnel) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *fakeTunnel) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.err
+}
+
+// die stops the tunnel on its own, as if the device failed
+func (f *fakeTunnel) die(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+	f.doneOnce.Do(func() { close(f.done) })
+}
+
+func (f *fakeTunnel) isStopped() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.stopped
+}
+
+// isClosed reports whether conn has been closed
+func isClosed(conn *net.UDPConn) bool {
+	_, err := conn.WriteToUDP([]byte{0}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	return errors.Is(err, net.ErrClosed)
+}
+
+// listenLoopback binds a socket on the loopback interface
+func listenLoopback(t testing.TB) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to bind socket: %v", err)
+	}
+
+	return conn
+}
+
+// fakePuncher reports the local address of the socket as its public address and opens a path towards the first
+// candidate right away, unless told to fail
+type fakePuncher struct {
+	publicAddrErr error
+	punchErr      error
+
+	mu        sync.Mutex
+	conn      *net.UDPConn
+	punches   int
+	cancelled int
+}
+
+func (f *fakePuncher) Punch(_ context.Context, conn *net.UDPConn, target puncher.Target) (*puncher.Result, error) {
+	if f.punchErr != nil {
+		return nil, f.punchErr
+	}
+
+	f.mu.Lock()
+	f.punches++
+	f.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			f.mu.Lock()
+			f.cancelled++
+			f.mu.Unlock()
+		})
+	}
+
+	return &puncher.Result{Addr: target.Candidates[0], Conn: conn, Cancel: cancel}, nil
+}
+
+func (f *fakePuncher) PublicAddr(_ context.Context, conn util.UDPConn) (*net.UDPAddr, error) {
+	f.mu.Lock()
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		f.conn = udpConn
+	}
+	f.mu.Unlock()
+
+	if f.publicAddrErr != nil {
+		return nil, f.publicAddrErr
+	}
+
+	addr, _ := conn.LocalAddr().(*net.UDPAddr)
+	return addr, nil
+}
+
+// lastConn returns the latest socket whose public address was discovered, nil if none
+func (f *fakePuncher) lastConn() *net.UDPConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.conn
+}
+
+// punched reports whether any punch has been started
+func (f *fakePuncher) punched() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.punches > 0
+}
+
+// allCancelled reports whether every punch has been cancelled
+func (f *fakePuncher) allCancelled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.punches == f.cancelled
+}
+
+// fakeMultiTunnel is a fakeTunnel able to carry several remote peers
+type fakeMultiTunnel struct {
+	*fakeTunnel
+
+	opened bool
+	peers  map[string]peer.Info
+}
+
+func newFakeMultiTunnel(publicKey string) *fakeMultiTunnel {
+	return &fakeMultiTunnel{fakeTunnel: newFakeTunnel(publicKey), peers: make(map[string]peer.Info)}
+}
+
+func (f *fakeMultiTunnel) Open(_ context.Context, conn *net.UDPConn) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.opened, f.conn = true, conn
+	return nil
+}
+
+func (f *fakeMultiTunnel) AddPeer(_ context.Context, remotePeer peer.Info) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.peers[remotePeer.PublicKey] = remotePeer
+	return nil
+}
+
+func (f *fakeMultiTunnel) RemovePeer(_ context.Context, publicKey string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.peers, publicKey)
+	return nil
+}
+
+func (f *fakeMultiTunnel) peerCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.peers)
+}
+
+// registerOnly hides the connection requests of a rendezvous backend
+type registerOnly struct {
+	rendezvous.Rendezvous
+}
+
+// isRegistered reports whether the peer is registered, without waiting for it to show up
+func isRegistered(rend rendezvous.Rendezvous, peerID string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err := rend.WaitForPeer(ctx, peerID)
+	return err == nil
+}
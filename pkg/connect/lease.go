@@ -0,0 +1,158 @@
+package connect
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+)
+
+// minRenewInterval bounds how often the registration is renewed, however short its TTL
+const minRenewInterval = 10 * time.Millisecond
+
+// lease keeps the registration of the local peer alive while it is held by at least one session, registering it again
+// before its TTL lapses. The registration is withdrawn once the last holder releases it
+type lease struct {
+	rendClient rendezvous.Rendezvous
+	ttl        time.Duration
+	logger     logr.Logger
+
+	mu      sync.Mutex
+	req     *rendezvous.RegisterRequest
+	holders int
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newLease(rendClient rendezvous.Rendezvous, ttl time.Duration, logger logr.Logger) *lease {
+	return &lease{
+		rendClient: rendClient,
+		ttl:        ttl,
+		logger:     logger,
+	}
+}
+
+// update records the latest registration of the local peer, which is the one renewed from then on
+func (l *lease) update(req rendezvous.RegisterRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.req = &req
+}
+
+// current returns a copy of the latest registration of the local peer, nil if there is none
+func (l *lease) current() *rendezvous.RegisterRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.req == nil {
+		return nil
+	}
+
+	req := *l.req
+	return &req
+}
+
+// hold keeps the registration alive until the returned function is called. The function deregisters the local peer
+// if no one else holds the registration
+func (l *lease) hold() func(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.holders++
+	if l.holders == 1 && l.ttl > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		l.cancel = cancel
+		l.done = make(chan struct{})
+
+		go func(done chan struct{}) {
+			defer close(done)
+			l.renew(ctx)
+		}(l.done)
+	}
+
+	var once sync.Once
+	return func(ctx context.Context) error {
+		var err error
+		once.Do(func() {
+			err = l.release(ctx)
+		})
+		return err
+	}
+}
+
+// release drops a holder of the registration, stopping the renewals and deregistering the local peer if it was the
+// last one
+func (l *lease) release(ctx context.Context) error {
+	l.mu.Lock()
+	l.holders--
+	if l.holders > 0 {
+		l.mu.Unlock()
+		return nil
+	}
+
+	cancel, done := l.cancel, l.done
+	l.cancel, l.done = nil, nil
+	l.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+
+	return l.deregister(ctx)
+}
+
+// deregister withdraws the registration of the local peer unless it is held by a session
+func (l *lease) deregister(ctx context.Context) error {
+	l.mu.Lock()
+	if l.holders > 0 || l.req == nil {
+		l.mu.Unlock()
+		return nil
+	}
+
+	peerID := l.req.PeerID
+	l.req = nil
+	l.mu.Unlock()
+
+	if err := l.rendClient.Deregister(ctx, peerID); err != nil {
+		return err
+	}
+
+	l.logger.Info("Deregistered local peer", "peerID", peerID)
+
+	return nil
+}
+
+// renew registers the local peer again every third of the TTL until ctx is done, so that a lost renewal does not
+// make the registration lapse. Registrations are not renewed more often than minRenewInterval
+func (l *lease) renew(ctx context.Context) {
+	interval := max(l.ttl/3, minRenewInterval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			req := l.req
+			l.mu.Unlock()
+
+			if req == nil {
+				continue
+			}
+
+			ctxRenew, cancel := context.WithTimeout(ctx, interval)
+			if err := l.rendClient.Register(ctxRenew, *req); err != nil {
+				l.logger.Error(err, "failed to renew registration", "peerID", req.PeerID)
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package connect
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/rendezvous/memory"
+)
+
+func TestLeaseSurvivesReleaseOfAnotherHolder(t *testing.T) {
+	rend := memory.New()
+	l := newLease(rend, time.Minute, logr.Discard())
+	ctx := context.Background()
+
+	releaseFirst := l.hold()
+
+	// The second session holds the registration before making it, so the release of the first one keeps it
+	releaseSecond := l.hold()
+
+	req := rendezvous.RegisterRequest{PeerID: "local", PublicKey: "local-key", Endpoint: "127.0.0.1:51820", TTL: time.Minute}
+	if err := rend.Register(ctx, req); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	l.update(req)
+
+	if err := releaseFirst(ctx); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+
+	if !isRegistered(rend, "local") || l.current() == nil {
+		t.Fatalf("expected registration kept while held")
+	}
+
+	if err := releaseSecond(ctx); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+
+	if isRegistered(rend, "local") {
+		t.Fatalf("expected registration withdrawn by the last holder")
+	}
+}
+
+func TestLeaseWithTinyTTL(t *testing.T) {
+	l := newLease(memory.New(), time.Nanosecond, logr.Discard())
+
+	release := l.hold()
+	if err := release(context.Background()); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+}
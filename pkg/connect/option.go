@@ -4,43 +4,245 @@ import (
 	"time"
 
 	"github.com/go-logr/logr"
+
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
 )
 
 const (
 	defaultRendezServer = "http://rendezvous.yago.ninja:7777"
 	defaultWaitInterval = 1 * time.Second
+
+	// WireGuard renews the handshake every 2 minutes while there is traffic, and keepalives count as traffic
+	defaultStaleAfter    = 3 * time.Minute
+	defaultCheckInterval = 5 * time.Second
+
+	// Registrations are renewed every third of the TTL, so a couple of renewals can be lost before they lapse
+	defaultRegistrationTTL = 1 * time.Minute
+
+	defaultBackoffInitial = 1 * time.Second
+	defaultBackoffMax     = 1 * time.Minute
+	defaultBackoffFactor  = 2
+
+	handshakePollInterval = 500 * time.Millisecond
+
+	// inPlaceRepairTimeout bounds the repair over the live socket, which is followed by a repair on a new socket if it
+	// fails
+	inPlaceRepairTimeout = 20 * time.Second
+
+	// rollbackTimeout bounds the calls to the rendezvous backend performed while undoing a failed connection
+	rollbackTimeout = 5 * time.Second
+
+	// teardownTimeout bounds the shutdown of a session that terminated on its own
+	teardownTimeout = 5 * time.Second
 )
 
 type config struct {
 	rendezServerURL string
 	waitInterval    time.Duration
-	logger          logr.Logger
+	rendezvous      rendezvous.Rendezvous
+	requester       rendezvous.Requester
+
+	registrationTTL time.Duration
+	hostCandidates  bool
+	ice             bool
+
+	turnServer   string
+	turnUsername string
+	turnPassword string
+
+	relayFallback bool
+	relayBroker   rendezvous.RelayBroker
+
+	natCheckServers []string
+
+	presharedKeys      map[string]string
+	presharedKeySecret []byte
+
+	supervise     bool
+	staleAfter    time.Duration
+	checkInterval time.Duration
+	backoff       Backoff
+
+	observer Observer
+
+	logger logr.Logger
 }
 
 func newDefaultConfig() *config {
 	return &config{
 		rendezServerURL: defaultRendezServer,
 		waitInterval:    defaultWaitInterval,
-		logger:          logr.Discard(),
+		registrationTTL: defaultRegistrationTTL,
+		hostCandidates:  true,
+		ice:             true,
+		relayFallback:   true,
+		supervise:       true,
+		staleAfter:      defaultStaleAfter,
+		checkInterval:   defaultCheckInterval,
+		backoff: Backoff{
+			Initial: defaultBackoffInitial,
+			Max:     defaultBackoffMax,
+			Factor:  defaultBackoffFactor,
+		},
+		logger: logr.Discard(),
 	}
 }
 
 type Option func(*config)
 
-// WithRendezServer sets the rendezvous server URL. The server must implement interface
+// WithRendezServer sets the URL of the peer-hub rendezvous server. Ignored if a backend is set via WithRendezvous
 func WithRendezServer(server string) Option {
 	return func(cfg *config) {
 		cfg.rendezServerURL = server
 	}
 }
 
-// WithWaitInterval sets the wait interval for the connector. The interval must be greater than 0
+// WithWaitInterval sets the interval at which the peer-hub rendezvous server is polled while waiting for remote peers.
+// The interval must be greater than 0. Ignored if a backend is set via WithRendezvous
 func WithWaitInterval(interval time.Duration) Option {
 	return func(cfg *config) {
 		cfg.waitInterval = interval
 	}
 }
 
+// WithRendezvous sets the backend used to register the local peer and discover remote peers, replacing the default
+// peer-hub client. If the backend implements rendezvous.Requester it is also used to exchange connection requests
+func WithRendezvous(r rendezvous.Rendezvous) Option {
+	return func(cfg *config) {
+		cfg.rendezvous = r
+	}
+}
+
+// WithRequester sets the backend used to exchange connection requests, overriding the rendezvous backend if it is able
+// to exchange them itself. It is required by Listen, and makes Connect leave a request for the remote peer so that it
+// can be accepted without knowing the local peer ID in advance
+func WithRequester(requester rendezvous.Requester) Option {
+	return func(cfg *config) {
+		cfg.requester = requester
+	}
+}
+
+// WithRegistrationTTL sets the lease of the registration of the local peer. The registration is renewed in the
+// background while sessions are alive and withdrawn once the last one is closed. A TTL of 0 disables the lease, leaving
+// the lifetime of the registration up to the rendezvous backend
+func WithRegistrationTTL(ttl time.Duration) Option {
+	return func(cfg *config) {
+		cfg.registrationTTL = ttl
+	}
+}
+
+// WithHostCandidates sets whether the addresses of the local interfaces are published next to the public address, so
+// that peers on the same LAN or behind the same NAT connect directly even if the router does not support hairpinning
+func WithHostCandidates(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.hostCandidates = enabled
+	}
+}
+
+// WithICE sets whether the path towards remote peers is chosen via ICE connectivity checks. Candidate pairs are
+// checked in order of priority with authenticated STUN requests and the pair nominated by the controlling peer becomes
+// the endpoint of the remote peer. The checks are only run if the remote peer publishes ICE credentials as well,
+// otherwise its candidates are punched
+func WithICE(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.ice = enabled
+	}
+}
+
+// WithTURNServer sets the TURN server on which a relayed address is allocated for every socket announced by Connect
+// and Accept. The relayed address is published as a candidate and only used if no direct pair works, which is usually
+// the case between peers that are both behind symmetric NATs. Requires ICE, see WithICE
+func WithTURNServer(server, username, password string) Option {
+	return func(cfg *config) {
+		cfg.turnServer = server
+		cfg.turnUsername = username
+		cfg.turnPassword = password
+	}
+}
+
+// WithRelayFallback sets whether the traffic with remote peers goes through a relay server when no direct path can be
+// opened towards them. Access to the relay server is requested from the broker, which is the rendezvous backend unless
+// one is set via WithRelayBroker. The remote peer must fall back to the same relay server, so the fallback only works
+// if both peers enable it. Only applies to Connect and Accept
+func WithRelayFallback(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.relayFallback = enabled
+	}
+}
+
+// WithRelayBroker sets the backend from which access to the relay server is requested, overriding the rendezvous
+// backend if it is able to hand it out itself, see WithRelayFallback
+func WithRelayBroker(broker rendezvous.RelayBroker) Option {
+	return func(cfg *config) {
+		cfg.relayBroker = broker
+	}
+}
+
+// WithNATCheck sets the STUN servers through which the behavior of the local NAT is discovered for every socket
+// announced by Connect and Accept, see natcheck.Checker. The behavior is published next to the public address, and
+// peers that know both behaviors go straight to the relay server when a direct path is bound to fail, instead of
+// punching until they give up. Servers should support RFC 5780, discovery is skipped by default
+func WithNATCheck(servers []string) Option {
+	return func(cfg *config) {
+		cfg.natCheckServers = servers
+	}
+}
+
+// WithPresharedKeys sets static WireGuard pre-shared keys per remote peer ID, encoded in base64. Keys set this way
+// take precedence over the ones derived via WithPresharedKeySecret
+func WithPresharedKeys(keys map[string]string) Option {
+	return func(cfg *config) {
+		cfg.presharedKeys = keys
+	}
+}
+
+// WithPresharedKeySecret sets a secret shared by all the peers from which a WireGuard pre-shared key is derived for
+// every session, mixing in the IDs of both peers
+func WithPresharedKeySecret(secret []byte) Option {
+	return func(cfg *config) {
+		cfg.presharedKeySecret = secret
+	}
+}
+
+// WithSupervision sets whether sessions are supervised once established. Supervised sessions are reconnected in place
+// when no handshake happens for a while. Only applies to tunnels implementing tunnel.SupervisedTunnel
+func WithSupervision(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.supervise = enabled
+	}
+}
+
+// WithStaleThreshold sets how long a session can go without a handshake before its path is considered dead and a
+// reconnection is attempted. The threshold must be greater than the WireGuard rekey interval (2 minutes)
+func WithStaleThreshold(threshold time.Duration) Option {
+	return func(cfg *config) {
+		cfg.staleAfter = threshold
+	}
+}
+
+// WithHealthCheckInterval sets how often the handshakes of supervised sessions are checked. The interval must be
+// greater than 0
+func WithHealthCheckInterval(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.checkInterval = interval
+	}
+}
+
+// WithReconnectBackoff sets the backoff applied between failed reconnection attempts
+func WithReconnectBackoff(backoff Backoff) Option {
+	return func(cfg *config) {
+		cfg.backoff = backoff
+	}
+}
+
+// WithObserver sets the observer notified about every step of the connection process and about the changes seen in
+// established sessions. Sessions are only watched for changes if the tunnel implements tunnel.SupervisedTunnel
+func WithObserver(observer Observer) Option {
+	return func(cfg *config) {
+		cfg.observer = observer
+	}
+}
+
 // WithLogger sets the logger to use for logging. The logger must implement the logr.Logger interface
 func WithLogger(logger logr.Logger) Option {
 	return func(cfg *config) {
@@ -0,0 +1,85 @@
+package connect
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/yago-123/wg-punch/pkg/puncher"
+)
+
+// mappingSet holds the mapping of the NAT measured through every socket
+type mappingSet struct {
+	mu       sync.Mutex
+	mappings map[*net.UDPConn]puncher.Mapping
+}
+
+// add records the mapping measured through conn
+func (s *mappingSet) add(conn *net.UDPConn, mapping puncher.Mapping) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mappings == nil {
+		s.mappings = make(map[*net.UDPConn]puncher.Mapping)
+	}
+	s.mappings[conn] = mapping
+}
+
+// get returns the mapping measured through conn, nil if it was not measured
+func (s *mappingSet) get(conn *net.UDPConn) *puncher.Mapping {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mapping, found := s.mappings[conn]
+	if !found {
+		return nil
+	}
+
+	return &mapping
+}
+
+// release forgets the mapping measured through conn
+func (s *mappingSet) release(conn *net.UDPConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.mappings, conn)
+}
+
+// publicMapping discovers the public address of conn and, if the puncher is able to, the mapping of the NAT in front of
+// it, which is recorded for conn. The mapping is nil if it could not be measured
+func (c *Connector) publicMapping(ctx context.Context, conn *net.UDPConn) (*net.UDPAddr, *puncher.Mapping, error) {
+	predictor, ok := c.puncher.(puncher.Predictor)
+	if !ok {
+		publicAddr, err := c.puncher.PublicAddr(ctx, conn)
+		return publicAddr, nil, err
+	}
+
+	publicAddr, mapping, err := predictor.PublicMapping(ctx, conn)
+	if err != nil || mapping == nil {
+		return publicAddr, nil, err
+	}
+
+	c.mappings.add(conn, *mapping)
+
+	return publicAddr, mapping, nil
+}
+
+// remoteMapping decodes the mapping published by the remote peer, nil if it published none or it cannot be decoded
+func remoteMapping(encoded string) *puncher.Mapping {
+	if encoded == "" {
+		return nil
+	}
+
+	mapping, err := puncher.ParseMapping(encoded)
+	if err != nil {
+		return nil
+	}
+
+	return &mapping
+}
+
+// predicts reports whether ports must be predicted in order to punch a path between both mappings
+func predicts(local, remote *puncher.Mapping) bool {
+	return local != nil && remote != nil && (local.Symmetric() || remote.Symmetric())
+}
@@ -0,0 +1,79 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	errors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/relay"
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+// relaySet holds the relay sessions joined through every socket
+type relaySet struct {
+	mu      sync.Mutex
+	clients map[*net.UDPConn]*relay.Client
+}
+
+// add records the relay session joined through conn, leaving the one joined before if any
+func (s *relaySet) add(conn *net.UDPConn, client *relay.Client) {
+	s.mu.Lock()
+	previous := s.clients[conn]
+	if s.clients == nil {
+		s.clients = make(map[*net.UDPConn]*relay.Client)
+	}
+	s.clients[conn] = client
+	s.mu.Unlock()
+
+	if previous != nil {
+		_ = previous.Close()
+	}
+}
+
+// release leaves the relay session joined through conn, if any
+func (s *relaySet) release(conn *net.UDPConn) error {
+	s.mu.Lock()
+	client, found := s.clients[conn]
+	delete(s.clients, conn)
+	s.mu.Unlock()
+
+	if !found {
+		return nil
+	}
+
+	return client.Close()
+}
+
+// joinRelay joins through conn the relay session shared with the remote peer, which is granted by the rendezvous
+// backend. The remote peer is reached through the address of the relay server from then on
+func (c *Connector) joinRelay(ctx context.Context, conn *net.UDPConn, remotePeerID string) (*net.UDPAddr, *relay.Client, error) {
+	if c.relayBroker == nil {
+		return nil, nil, errors.ErrRelayUnavailable
+	}
+
+	grant, err := c.relayBroker.RequestRelay(ctx, rendezvous.ConnRequest{
+		FromPeerID: c.localPeerID,
+		ToPeerID:   remotePeerID,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to request relay: %w", err)
+	}
+
+	server, err := net.ResolveUDPAddr(util.UDPProtocol, grant.Server)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid relay server %q: %w", grant.Server, err)
+	}
+
+	client := relay.NewClient(conn, server, grant.Token, grant.Key, relay.WithLogger(c.logger))
+	if err = client.Bind(ctx); err != nil {
+		_ = client.Close()
+		return nil, nil, fmt.Errorf("failed to join relay session on %s: %w", server, err)
+	}
+
+	c.relays.add(conn, client)
+
+	return server, client, nil
+}
@@ -0,0 +1,248 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/peer"
+	"github.com/yago-123/wg-punch/pkg/tunnel"
+)
+
+// Session represents an established connection with a remote peer. It owns the UDP socket, the tunnel running on top
+// of it and the punching process, so the caller must not touch any of them directly and must call Close once the
+// session is no longer needed
+type Session struct {
+	conn        *net.UDPConn
+	tunnel      tunnel.Tunnel
+	cancelPunch context.CancelFunc
+
+	remotePeer     peer.Info
+	localOverlays  []net.IP
+	remoteOverlays []net.IP
+
+	cancelSupervisor context.CancelFunc
+	supervisorDone   chan struct{}
+
+	// releaseRegistration stops keeping the registration of the local peer alive on behalf of the session
+	releaseRegistration func(ctx context.Context) error
+
+	// releaseSocket releases the resources tied to a socket of the session, like its relay
+	releaseSocket func(conn *net.UDPConn) error
+
+	// sharedConn tells that the socket is shared with other sessions, like the ones of an acceptor, so it is left open
+	sharedConn bool
+
+	// onClose is called once the session has been closed
+	onClose func()
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newSession(conn *net.UDPConn, tun tunnel.Tunnel, cancelPunch context.CancelFunc, remotePeer peer.Info, localOverlays, remoteOverlays []net.IP) *Session {
+	return &Session{
+		conn:           conn,
+		tunnel:         tun,
+		cancelPunch:    cancelPunch,
+		remotePeer:     remotePeer,
+		localOverlays:  localOverlays,
+		remoteOverlays: remoteOverlays,
+		done:           make(chan struct{}),
+	}
+}
+
+// Close stops the punching process and the tunnel, releases the UDP socket and its relay, if any, and deregisters the
+// local peer unless other sessions still rely on the registration. It is safe to call Close multiple times, only the
+// first call performs the shutdown
+func (s *Session) Close(ctx context.Context) error {
+	return s.shutdown(ctx, wgerrors.ErrSessionClosed)
+}
+
+// end terminates the session on its own, like when the supervisor gives up or the tunnel dies, so that the owner
+// notices through Done and Err. The resources are released as in Close
+func (s *Session) end(reason error) {
+	ctx, cancel := context.WithTimeout(context.Background(), teardownTimeout)
+	defer cancel()
+
+	_ = s.shutdown(ctx, reason)
+}
+
+// shutdown releases every resource of the session and records reason as its error, only the first call does anything
+func (s *Session) shutdown(ctx context.Context, reason error) error {
+	var errStop error
+
+	s.closeOnce.Do(func() {
+		// Stop the supervisor first so that it does not repair the path while it is being torn down
+		if s.cancelSupervisor != nil {
+			s.cancelSupervisor()
+			<-s.supervisorDone
+		}
+
+		s.cancelPunch()
+
+		errStop = s.tunnel.Stop(ctx)
+
+		// The tunnel usually closes the socket as part of the shutdown, make sure it is released anyway
+		conn := s.getConn()
+		if !s.sharedConn {
+			if errConn := closeConn(conn); errConn != nil && errStop == nil {
+				errStop = errConn
+			}
+		}
+
+		if s.releaseSocket != nil {
+			if errRelay := s.releaseSocket(conn); errRelay != nil && errStop == nil {
+				errStop = errRelay
+			}
+		}
+
+		if s.releaseRegistration != nil {
+			if errRelease := s.releaseRegistration(ctx); errRelease != nil && errStop == nil {
+				errStop = errRelease
+			}
+		}
+
+		s.mu.Lock()
+		s.err = reason
+		s.mu.Unlock()
+
+		close(s.done)
+
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+
+	return errStop
+}
+
+// closeConn closes conn, ignoring the error returned if it has already been closed
+func closeConn(conn *net.UDPConn) error {
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// supervise spawns the supervisor of the session, which runs until the session is closed. The session ends with the
+// error of the supervisor if it gives up
+func (s *Session) supervise(sup *supervisor) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelSupervisor = cancel
+	s.supervisorDone = make(chan struct{})
+
+	go func() {
+		err := sup.run(ctx)
+		// The shutdown waits for the supervisor, so it must be flagged as done first
+		close(s.supervisorDone)
+
+		if err != nil {
+			s.end(err)
+		}
+	}()
+}
+
+// watch ends the session if the tunnel stops on its own
+func (s *Session) watch(tun tunnel.MonitoredTunnel) {
+	stopped := tun.Done()
+	if stopped == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-s.done:
+		case <-stopped:
+			if err := tun.Err(); err != nil {
+				s.end(fmt.Errorf("%w: %w", wgerrors.ErrTunnelDown, err))
+			}
+		}
+	}()
+}
+
+// setConn replaces the socket owned by the session after the supervisor has rebound it
+func (s *Session) setConn(conn *net.UDPConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn = conn
+}
+
+// getConn returns the socket currently owned by the session
+func (s *Session) getConn() *net.UDPConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn
+}
+
+// RemotePeer returns the information of the remote peer as it was used to configure the tunnel
+func (s *Session) RemotePeer() peer.Info {
+	return s.remotePeer
+}
+
+// LocalOverlayAddr returns the address assigned to the local peer inside the tunnel, the first one if it has several
+func (s *Session) LocalOverlayAddr() net.IP {
+	return first(s.localOverlays)
+}
+
+// RemoteOverlayAddr returns the address of the remote peer inside the tunnel, the first one if it has several
+func (s *Session) RemoteOverlayAddr() net.IP {
+	return first(s.remoteOverlays)
+}
+
+// LocalOverlayAddrs returns every address assigned to the local peer inside the tunnel, IPv4 and IPv6
+func (s *Session) LocalOverlayAddrs() []net.IP {
+	return s.localOverlays
+}
+
+// RemoteOverlayAddrs returns every address of the remote peer inside the tunnel, IPv4 and IPv6
+func (s *Session) RemoteOverlayAddrs() []net.IP {
+	return s.remoteOverlays
+}
+
+// Done returns a channel that is closed once the session has terminated
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns nil while the session is alive. Once Done is closed it returns the reason why the session terminated:
+// ErrSessionClosed if it was closed via Close, an error wrapping ErrRepairFailed if the supervisor gave up on the path,
+// or one wrapping ErrTunnelDown if the tunnel stopped on its own
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// overlayAddrs returns the addresses of the entries in a list of CIDRs, which are taken as the addresses of the peer
+// inside the tunnel. Invalid entries are skipped
+func overlayAddrs(cidrs []string) []net.IP {
+	var ips []net.IP
+	for _, cidr := range cidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err == nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips
+}
+
+// first returns the first address of the list, nil if it is empty
+func first(ips []net.IP) net.IP {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	return ips[0]
+}
@@ -0,0 +1,117 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/peer"
+)
+
+func newTestSession(t *testing.T, tun *fakeTunnel) (*Session, *net.UDPConn) {
+	t.Helper()
+
+	conn := listenLoopback(t)
+	session := newSession(conn, tun, func() {}, peer.Info{PublicKey: "remote"}, nil, nil)
+
+	return session, conn
+}
+
+// waitDone waits until the session terminates and returns its error
+func waitDone(t *testing.T, session *Session) error {
+	t.Helper()
+
+	select {
+	case <-session.Done():
+		return session.Err()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session did not terminate")
+		return nil
+	}
+}
+
+func TestSessionCloseSetsErr(t *testing.T) {
+	tun := newFakeTunnel("local")
+	session, conn := newTestSession(t, tun)
+
+	if err := session.Err(); err != nil {
+		t.Fatalf("expected no error while alive, got %v", err)
+	}
+
+	if err := session.Close(context.Background()); err != nil {
+		t.Fatalf("failed to close session: %v", err)
+	}
+
+	if err := waitDone(t, session); !errors.Is(err, wgerrors.ErrSessionClosed) {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+
+	if !tun.isStopped() || !isClosed(conn) {
+		t.Fatalf("expected tunnel stopped and socket closed")
+	}
+}
+
+func TestSessionEndsWhenTunnelDies(t *testing.T) {
+	tun := newFakeTunnel("local")
+	session, conn := newTestSession(t, tun)
+	session.watch(tun)
+
+	tun.die(errFake)
+
+	err := waitDone(t, session)
+	if !errors.Is(err, wgerrors.ErrTunnelDown) || !errors.Is(err, errFake) {
+		t.Fatalf("expected ErrTunnelDown wrapping the failure, got %v", err)
+	}
+
+	if !isClosed(conn) {
+		t.Fatalf("expected socket closed")
+	}
+}
+
+func TestSessionEndsWhenSupervisorGivesUp(t *testing.T) {
+	tun := newFakeTunnel("local")
+	session, conn := newTestSession(t, tun)
+
+	// The last handshake is zero, so the path is stale on the first check and the repair fails on Suspend
+	session.supervise(&supervisor{
+		connector:      &Connector{},
+		tunnel:         tun,
+		session:        session,
+		remotePeerID:   "remote",
+		reconnectStale: true,
+		staleAfter:     time.Second,
+		checkInterval:  10 * time.Millisecond,
+		backoff:        Backoff{Initial: time.Millisecond, Max: time.Millisecond, Factor: 1, Attempts: 2},
+	})
+
+	err := waitDone(t, session)
+	if !errors.Is(err, wgerrors.ErrRepairFailed) || !errors.Is(err, errFake) {
+		t.Fatalf("expected ErrRepairFailed wrapping the failure, got %v", err)
+	}
+
+	if !tun.isStopped() || !isClosed(conn) {
+		t.Fatalf("expected tunnel stopped and socket closed")
+	}
+}
+
+func TestSessionEndsWhenTunnelLosesPeer(t *testing.T) {
+	tun := newFakeTunnel("local")
+	tun.statsErr = wgerrors.Permanent(errFake)
+	session, _ := newTestSession(t, tun)
+
+	session.supervise(&supervisor{
+		connector:     &Connector{},
+		tunnel:        tun,
+		session:       session,
+		remotePeerID:  "remote",
+		staleAfter:    time.Second,
+		checkInterval: 10 * time.Millisecond,
+	})
+
+	if err := waitDone(t, session); !errors.Is(err, wgerrors.ErrTunnelDown) {
+		t.Fatalf("expected ErrTunnelDown, got %v", err)
+	}
+}
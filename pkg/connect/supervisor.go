@@ -0,0 +1,274 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/yago-123/wg-punch/pkg/demux"
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/tunnel"
+)
+
+// Backoff configures the delay between reconnection attempts. The delay starts at Initial and is multiplied by Factor
+// after every failed attempt, up to Max. Once Attempts consecutive attempts have failed the session is given up on and
+// terminated, 0 keeps retrying until the session is closed
+type Backoff struct {
+	Initial  time.Duration
+	Max      time.Duration
+	Factor   float64
+	Attempts int
+}
+
+// next returns the delay that follows the given one
+func (b Backoff) next(delay time.Duration) time.Duration {
+	if delay <= 0 {
+		return b.Initial
+	}
+
+	next := time.Duration(float64(delay) * b.Factor)
+	if next > b.Max || next <= 0 {
+		return b.Max
+	}
+
+	return next
+}
+
+// supervisor watches the handshakes of an established session, reports the changes to the observer of the connector
+// and repairs the path towards the remote peer when it goes stale: public address discovery, registration and punching
+// are performed again and the endpoint of the remote peer is updated in place, without tearing down the interface nor
+// its routes
+type supervisor struct {
+	connector    *Connector
+	tunnel       tunnel.SupervisedTunnel
+	session      *Session
+	remotePeerID string
+	allowedIPs   []string
+
+	// reconnectStale tells whether stale paths are repaired or only reported
+	reconnectStale bool
+
+	staleAfter    time.Duration
+	checkInterval time.Duration
+	backoff       Backoff
+	logger        logr.Logger
+}
+
+// run checks the handshakes with the remote peer every check interval until ctx is done. An error is returned if the
+// session cannot be kept alive anymore, either because the tunnel lost track of the remote peer or because the path
+// could not be repaired
+func (s *supervisor) run(ctx context.Context) error {
+	ticker := time.NewTicker(s.checkInterval)
+	defer ticker.Stop()
+
+	// The tunnel has just completed a handshake, so the first stats retrieved are the baseline
+	var last *tunnel.PeerStats
+	stale := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			stats, err := s.tunnel.PeerStats(s.session.remotePeer.PublicKey)
+			if err != nil {
+				if wgerrors.IsPermanent(err) {
+					return fmt.Errorf("%w: %w", wgerrors.ErrTunnelDown, err)
+				}
+
+				s.logger.Error(err, "failed to retrieve peer stats", "remotePeerID", s.remotePeerID)
+				continue
+			}
+
+			s.report(last, stats)
+			last = &stats
+
+			if time.Since(stats.LastHandshake) < s.staleAfter {
+				stale = false
+				continue
+			}
+
+			// Report the stale path only once until a handshake happens again
+			if !stale {
+				s.connector.emit(EventPeerStale, s.remotePeerID, stats.Endpoint)
+				stale = true
+			}
+
+			if !s.reconnectStale {
+				continue
+			}
+
+			s.logger.Info("Path to remote peer is stale, reconnecting", "remotePeerID", s.remotePeerID, "lastHandshake", stats.LastHandshake)
+
+			if errReconnect := s.reconnect(ctx); errReconnect != nil {
+				return errReconnect
+			}
+		}
+	}
+}
+
+// report emits the changes between the previous and the current stats of the remote peer
+func (s *supervisor) report(prev *tunnel.PeerStats, curr tunnel.PeerStats) {
+	if prev == nil {
+		return
+	}
+
+	if curr.LastHandshake.After(prev.LastHandshake) {
+		s.connector.emit(EventHandshakeRenewed, s.remotePeerID, curr.Endpoint)
+	}
+
+	if curr.Endpoint != nil && (prev.Endpoint == nil || curr.Endpoint.String() != prev.Endpoint.String()) {
+		s.connector.emit(EventEndpointRoamed, s.remotePeerID, curr.Endpoint)
+	}
+}
+
+// reconnect repairs the path towards the remote peer, retrying with backoff until it succeeds or ctx is done. It gives
+// up once the attempts of the backoff are exhausted or an attempt fails for a reason that retrying cannot fix
+func (s *supervisor) reconnect(ctx context.Context) error {
+	var delay time.Duration
+
+	for attempt := 1; ; attempt++ {
+		err := s.repair(ctx)
+		if err == nil {
+			s.logger.Info("Path to remote peer repaired", "remotePeerID", s.remotePeerID, "attempt", attempt)
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if wgerrors.IsPermanent(err) || (s.backoff.Attempts > 0 && attempt >= s.backoff.Attempts) {
+			s.logger.Error(err, "giving up on path to remote peer", "remotePeerID", s.remotePeerID, "attempt", attempt)
+			return fmt.Errorf("%w after %d attempts: %w", wgerrors.ErrRepairFailed, attempt, err)
+		}
+
+		delay = s.backoff.next(delay)
+		s.logger.Error(err, "failed to repair path to remote peer", "remotePeerID", s.remotePeerID, "attempt", attempt, "retryIn", delay)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// repair performs a single reconnection attempt. The path is repaired over the live socket first if the tunnel shares
+// it through a demultiplexer. Otherwise, or if that fails, the tunnel is suspended while the public address is
+// discovered again on a new socket and brought back up on it as soon as possible, so that it keeps working if only the
+// remote peer moved
+func (s *supervisor) repair(ctx context.Context) error {
+	// Bound the attempt so that a remote peer that never shows up does not block the retries
+	ctxRepair, cancel := context.WithTimeout(ctx, s.staleAfter)
+	defer cancel()
+
+	if demuxed, ok := s.tunnel.(tunnel.DemuxedTunnel); ok {
+		if d := demuxed.Demux(); d != nil {
+			errInPlace := s.repairInPlace(ctxRepair, d)
+			if errInPlace == nil {
+				return nil
+			}
+
+			s.logger.Info("Failed to repair path over the live socket, binding a new one", "remotePeerID", s.remotePeerID, "reason", errInPlace.Error())
+		}
+	}
+
+	start := time.Now()
+
+	if err := s.tunnel.Suspend(ctxRepair); err != nil {
+		return fmt.Errorf("failed to suspend tunnel: %w", err)
+	}
+
+	// The relay of the previous socket, if any, cannot be reached anymore. The new socket is handed to the tunnel right
+	// away, so the path is punched rather than checked and no relay is allocated for it
+	if err := s.connector.releaseSocket(s.session.getConn()); err != nil {
+		s.logger.Error(err, "failed to release relay", "remotePeerID", s.remotePeerID)
+	}
+
+	conn, err := s.connector.Bind(s.tunnel.ListenPort())
+	if err != nil {
+		return err
+	}
+
+	_, errAnnounce := s.connector.AnnounceShared(ctxRepair, conn, s.tunnel.PublicKey(), s.allowedIPs)
+
+	// From here on the socket belongs to the tunnel again
+	s.session.setConn(conn)
+	if errResume := s.tunnel.Resume(ctxRepair, conn); errResume != nil {
+		return fmt.Errorf("failed to resume tunnel: %w", errResume)
+	}
+
+	if errAnnounce != nil {
+		return errAnnounce
+	}
+
+	remote, err := s.connector.ResolveShared(ctxRepair, s.tunnel, conn, s.remotePeerID)
+	if err != nil {
+		return err
+	}
+	defer remote.CancelPunch()
+
+	if errUpdate := s.tunnel.UpdateEndpoint(ctxRepair, remote.Info.PublicKey, remote.Info.Endpoint); errUpdate != nil {
+		return fmt.Errorf("failed to update endpoint: %w", errUpdate)
+	}
+
+	return s.waitForHandshake(ctxRepair, start)
+}
+
+// repairInPlace repairs the path without replacing the socket of the tunnel. The public address is discovered again via
+// STUN through the demultiplexer of the socket, and the local peer registered again if the NAT changed it. The remote
+// peer is then resolved and punched through the same socket
+func (s *supervisor) repairInPlace(ctx context.Context, d *demux.Demux) error {
+	ctxRepair, cancel := context.WithTimeout(ctx, inPlaceRepairTimeout)
+	defer cancel()
+
+	start := time.Now()
+
+	stunConn := d.Listen(demux.ClassSTUN)
+	publicAddr, err := s.connector.puncher.PublicAddr(ctxRepair, stunConn)
+	_ = stunConn.Close()
+	if err != nil {
+		return fmt.Errorf("failed to discover public address: %w", err)
+	}
+
+	if err = s.connector.reregister(ctxRepair, publicAddr); err != nil {
+		return err
+	}
+
+	remote, err := s.connector.ResolveShared(ctxRepair, s.tunnel, s.session.getConn(), s.remotePeerID)
+	if err != nil {
+		return err
+	}
+	defer remote.CancelPunch()
+
+	if errUpdate := s.tunnel.UpdateEndpoint(ctxRepair, remote.Info.PublicKey, remote.Info.Endpoint); errUpdate != nil {
+		return fmt.Errorf("failed to update endpoint: %w", errUpdate)
+	}
+
+	return s.waitForHandshake(ctxRepair, start)
+}
+
+// waitForHandshake waits until a handshake newer than since has been completed with the remote peer
+func (s *supervisor) waitForHandshake(ctx context.Context, since time.Time) error {
+	ticker := time.NewTicker(handshakePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("handshake did not complete: %w", ctx.Err())
+		case <-ticker.C:
+			stats, err := s.tunnel.PeerStats(s.session.remotePeer.PublicKey)
+			if err != nil {
+				return fmt.Errorf("failed to retrieve peer stats: %w", err)
+			}
+
+			if stats.LastHandshake.After(since) {
+				return nil
+			}
+		}
+	}
+}
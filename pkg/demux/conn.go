@@ -0,0 +1,126 @@
+package demux
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conn receives the datagrams of a single class dispatched by a Demux, and writes through the shared socket. It
+// implements the subset of *net.UDPConn used by the STUN helpers of the util package, so that STUN runs over a socket
+// already read by a tunnel. Read deadlines only apply to the Conn itself, the shared socket is never touched
+type Conn struct {
+	demux   *Demux
+	class   Class
+	packets chan datagram
+
+	mu       sync.Mutex
+	deadline time.Time
+	// wake is closed and replaced whenever the deadline changes, so that blocked reads pick the new one up
+	wake chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newConn(d *Demux, class Class) *Conn {
+	return &Conn{
+		demux:   d,
+		class:   class,
+		packets: make(chan datagram, subscriberQueueLen),
+		wake:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+// ReadFromUDP waits for the next datagram of the class, until the read deadline expires or the connection is closed
+func (c *Conn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		c.mu.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.mu.Unlock()
+
+		n, from, done, err := c.read(b, deadline, wake)
+		if done {
+			return n, from, err
+		}
+	}
+}
+
+// read waits for the next datagram until the deadline expires, done is false if the deadline changed in the meantime
+func (c *Conn) read(b []byte, deadline time.Time, wake <-chan struct{}) (int, *net.UDPAddr, bool, error) {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case dgram := <-c.packets:
+		return copy(b, dgram.payload), dgram.from, true, nil
+	case <-expired:
+		return 0, nil, true, os.ErrDeadlineExceeded
+	case <-wake:
+		return 0, nil, false, nil
+	case <-c.closed:
+		return 0, nil, true, net.ErrClosed
+	}
+}
+
+// WriteToUDP writes a datagram through the shared socket
+func (c *Conn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	conn, err := c.demux.socket()
+	if err != nil {
+		return 0, err
+	}
+
+	return conn.WriteToUDP(b, addr)
+}
+
+// SetReadDeadline sets the deadline of the reads of the Conn, the zero time disables it
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+
+	return nil
+}
+
+// LocalAddr returns the local address of the shared socket
+func (c *Conn) LocalAddr() net.Addr {
+	conn, err := c.demux.socket()
+	if err != nil {
+		return nil
+	}
+
+	return conn.LocalAddr()
+}
+
+// Close stops receiving datagrams, the shared socket is left open
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.demux.unsubscribe(c)
+		close(c.closed)
+	})
+
+	return nil
+}
+
+// deliver queues a datagram, which is dropped if the queue is full
+func (c *Conn) deliver(dgram datagram) {
+	select {
+	case c.packets <- dgram:
+	default:
+	}
+}
@@ -0,0 +1,149 @@
+package demux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// Class identifies the protocol a datagram belongs to
+type Class int
+
+const (
+	// ClassUnknown datagrams belong to none of the protocols below
+	ClassUnknown Class = iota
+	// ClassWireGuard datagrams are WireGuard messages
+	ClassWireGuard
+	// ClassSTUN datagrams are STUN messages (RFC 5389)
+	ClassSTUN
+	// ClassPunch datagrams are the control frames sent by the puncher
+	ClassPunch
+)
+
+// PunchPrefix starts every datagram sent by the puncher, WireGuard and STUN messages never start with it
+const PunchPrefix = "punch"
+
+const (
+	// WireGuard messages start with their type, between 1 and 4, followed by 3 reserved zero bytes
+	wireGuardHeaderLen = 4
+	wireGuardMinType   = 1
+	wireGuardMaxType   = 4
+
+	// STUN messages start with two zero bits and carry the magic cookie right after the type and the length
+	stunHeaderLen   = 20
+	stunMagicCookie = 0x2112A442
+
+	// subscriberQueueLen bounds the datagrams queued for a subscriber that is not reading, newer ones are dropped
+	subscriberQueueLen = 64
+)
+
+// Classify tells the protocol of a datagram by its first bytes
+func Classify(packet []byte) Class {
+	switch {
+	case isWireGuard(packet):
+		return ClassWireGuard
+	case isSTUN(packet):
+		return ClassSTUN
+	case bytes.HasPrefix(packet, []byte(PunchPrefix)):
+		return ClassPunch
+	default:
+		return ClassUnknown
+	}
+}
+
+func isWireGuard(packet []byte) bool {
+	if len(packet) < wireGuardHeaderLen {
+		return false
+	}
+
+	return packet[0] >= wireGuardMinType && packet[0] <= wireGuardMaxType && packet[1] == 0 && packet[2] == 0 && packet[3] == 0
+}
+
+func isSTUN(packet []byte) bool {
+	if len(packet) < stunHeaderLen || packet[0]&0xC0 != 0 {
+		return false
+	}
+
+	return binary.BigEndian.Uint32(packet[4:8]) == stunMagicCookie
+}
+
+// datagram is a packet received from a remote address
+type datagram struct {
+	payload []byte
+	from    *net.UDPAddr
+}
+
+// Demux routes the datagrams received through a socket shared by several protocols. The owner of the socket keeps
+// reading it and hands every datagram that is not for itself to Dispatch, which delivers it to the subscribers of its
+// class, see Listen. Subscribers write through the socket directly
+type Demux struct {
+	mu          sync.Mutex
+	conn        *net.UDPConn
+	subscribers map[Class]map[*Conn]struct{}
+}
+
+func New(conn *net.UDPConn) *Demux {
+	return &Demux{
+		conn:        conn,
+		subscribers: make(map[Class]map[*Conn]struct{}),
+	}
+}
+
+// Reset replaces the socket the datagrams are written through, nil while the owner has no socket
+func (d *Demux) Reset(conn *net.UDPConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.conn = conn
+}
+
+// Listen subscribes to the datagrams of the given class. The returned connection must be closed once done
+func (d *Demux) Listen(class Class) *Conn {
+	c := newConn(d, class)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.subscribers[class] == nil {
+		d.subscribers[class] = make(map[*Conn]struct{})
+	}
+	d.subscribers[class][c] = struct{}{}
+
+	return c
+}
+
+// Dispatch delivers a copy of the datagram to every subscriber of its class and reports whether there was any
+func (d *Demux) Dispatch(packet []byte, from *net.UDPAddr) bool {
+	class := Classify(packet)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subscribers := d.subscribers[class]
+	for c := range subscribers {
+		c.deliver(datagram{payload: append([]byte(nil), packet...), from: from})
+	}
+
+	return len(subscribers) > 0
+}
+
+// unsubscribe stops delivering datagrams to c
+func (d *Demux) unsubscribe(c *Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.subscribers[c.class], c)
+}
+
+// socket returns the socket the datagrams are written through
+func (d *Demux) socket() (*net.UDPConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn == nil {
+		return nil, net.ErrClosed
+	}
+
+	return d.conn, nil
+}
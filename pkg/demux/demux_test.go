@@ -0,0 +1,216 @@
+package demux_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/yago-123/wg-punch/pkg/demux"
+)
+
+// wireGuardMessage returns a message of the given WireGuard type, padded to the size of a handshake initiation
+func wireGuardMessage(kind byte) []byte {
+	packet := make([]byte, 148)
+	packet[0] = kind
+
+	return packet
+}
+
+// stunMessage returns a binding request with the magic cookie set
+func stunMessage() []byte {
+	packet := make([]byte, 20)
+	binary.BigEndian.PutUint16(packet[0:2], 0x0001)
+	binary.BigEndian.PutUint32(packet[4:8], 0x2112A442)
+
+	return packet
+}
+
+func TestClassify(t *testing.T) {
+	reserved := wireGuardMessage(1)
+	reserved[2] = 1
+
+	badCookie := stunMessage()
+	badCookie[4] ^= 0xff
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   demux.Class
+	}{
+		{name: "handshake initiation", packet: wireGuardMessage(1), want: demux.ClassWireGuard},
+		{name: "handshake response", packet: wireGuardMessage(2), want: demux.ClassWireGuard},
+		{name: "cookie reply", packet: wireGuardMessage(3), want: demux.ClassWireGuard},
+		{name: "transport data", packet: wireGuardMessage(4), want: demux.ClassWireGuard},
+		{name: "unknown WireGuard type", packet: wireGuardMessage(5), want: demux.ClassUnknown},
+		{name: "WireGuard reserved bytes set", packet: reserved, want: demux.ClassUnknown},
+		{name: "STUN", packet: stunMessage(), want: demux.ClassSTUN},
+		{name: "STUN without magic cookie", packet: badCookie, want: demux.ClassUnknown},
+		{name: "short STUN", packet: stunMessage()[:19], want: demux.ClassUnknown},
+		{name: "punch", packet: []byte(demux.PunchPrefix + "\x01nonce"), want: demux.ClassPunch},
+		{name: "bare punch", packet: []byte(demux.PunchPrefix), want: demux.ClassPunch},
+		{name: "short", packet: []byte{1, 0}, want: demux.ClassUnknown},
+		{name: "empty", packet: nil, want: demux.ClassUnknown},
+		{name: "garbage", packet: []byte("garbage"), want: demux.ClassUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := demux.Classify(tt.packet); got != tt.want {
+				t.Fatalf("expected class %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to bind socket: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func TestDispatchDeliversToSubscribersOfTheClass(t *testing.T) {
+	d := demux.New(listenLoopback(t))
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+
+	stun := d.Listen(demux.ClassSTUN)
+	defer stun.Close()
+
+	if d.Dispatch([]byte(demux.PunchPrefix), from) {
+		t.Fatalf("expected no subscriber for punch frames")
+	}
+
+	packet := stunMessage()
+	if !d.Dispatch(packet, from) {
+		t.Fatalf("expected STUN message delivered")
+	}
+
+	// The subscriber gets its own copy of the datagram
+	packet[0] = 0xff
+
+	_ = stun.SetReadDeadline(time.Now().Add(time.Second))
+
+	buf := make([]byte, 64)
+	n, sender, err := stun.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("failed to read dispatched datagram: %v", err)
+	}
+
+	if demux.Classify(buf[:n]) != demux.ClassSTUN || sender.String() != from.String() {
+		t.Fatalf("expected STUN message from %s, got %x from %s", from, buf[:n], sender)
+	}
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	d := demux.New(listenLoopback(t))
+
+	conn := d.Listen(demux.ClassSTUN)
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+
+	buf := make([]byte, 64)
+	if _, _, err := conn.ReadFromUDP(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	// Moving the deadline wakes up a blocked read, which picks the new one up
+	_ = conn.SetReadDeadline(time.Time{})
+
+	errRead := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFromUDP(buf)
+		errRead <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	_ = conn.SetReadDeadline(time.Now().Add(-time.Second))
+
+	select {
+	case err := <-errRead:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("blocked read ignored the new deadline")
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	socket := listenLoopback(t)
+	d := demux.New(socket)
+
+	conn := d.Listen(demux.ClassSTUN)
+
+	errRead := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFromUDP(make([]byte, 64))
+		errRead <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close connection: %v", err)
+	}
+
+	select {
+	case err := <-errRead:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected closed connection, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("blocked read outlived Close")
+	}
+
+	if d.Dispatch(stunMessage(), socket.LocalAddr().(*net.UDPAddr)) {
+		t.Fatalf("expected closed connection unsubscribed")
+	}
+
+	if _, err := conn.WriteToUDP([]byte("ping"), socket.LocalAddr().(*net.UDPAddr)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected write on closed connection to fail, got %v", err)
+	}
+
+	// Closing twice is harmless and leaves the shared socket open
+	_ = conn.Close()
+	if _, err := socket.WriteToUDP([]byte("ping"), socket.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("expected shared socket left open: %v", err)
+	}
+}
+
+func TestConnWritesThroughSharedSocket(t *testing.T) {
+	socket, remote := listenLoopback(t), listenLoopback(t)
+	d := demux.New(socket)
+
+	conn := d.Listen(demux.ClassPunch)
+	defer conn.Close()
+
+	if _, err := conn.WriteToUDP([]byte(demux.PunchPrefix), remote.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	_ = remote.SetReadDeadline(time.Now().Add(time.Second))
+
+	buf := make([]byte, 64)
+	_, from, err := remote.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("datagram not received: %v", err)
+	}
+
+	if from.Port != socket.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("expected datagram from %s, got %s", socket.LocalAddr(), from)
+	}
+
+	// Without a socket, like while the owner restarts, writes fail
+	d.Reset(nil)
+	if _, err = conn.WriteToUDP([]byte(demux.PunchPrefix), remote.LocalAddr().(*net.UDPAddr)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected write without socket to fail, got %v", err)
+	}
+}
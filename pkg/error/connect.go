@@ -0,0 +1,161 @@
+package errors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Step identifies the stage of the connection process in which an error happened
+type Step string
+
+const (
+	StepRequest     Step = "request"
+	StepAccept      Step = "accept"
+	StepBind        Step = "bind"
+	StepDiscover    Step = "discover"
+	StepRegister    Step = "register"
+	StepWaitForPeer Step = "wait-for-peer"
+	StepConfigure   Step = "configure"
+	StepPunch       Step = "punch"
+	StepTunnel      Step = "tunnel"
+)
+
+// ConnectError describes a failed step of the connection process between two peers. It wraps the sentinel of the
+// step together with the underlying cause, so errors.Is keeps working with both
+type ConnectError struct {
+	Step         Step
+	LocalPeerID  string
+	RemotePeerID string
+	// Elapsed is the time spent in the step before it failed
+	Elapsed time.Duration
+	Err     error
+}
+
+func (e *ConnectError) Error() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%v (step %s, local peer %q", e.Err, e.Step, e.LocalPeerID)
+	if e.RemotePeerID != "" {
+		fmt.Fprintf(&sb, ", remote peer %q", e.RemotePeerID)
+	}
+	fmt.Fprintf(&sb, ", after %s)", e.Elapsed.Round(time.Millisecond))
+
+	return sb.String()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the step failed because a deadline was exceeded
+func (e *ConnectError) Timeout() bool {
+	return IsTimeout(e.Err)
+}
+
+// Temporary reports whether retrying the step may succeed
+func (e *ConnectError) Temporary() bool {
+	return IsTemporary(e.Err)
+}
+
+// classifiedError marks an error as temporary or permanent regardless of the errors it wraps
+type classifiedError struct {
+	err       error
+	temporary bool
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// Temporary marks err as temporary, retrying the operation that returned it may succeed
+func Temporary(err error) error {
+	return &classifiedError{err: err, temporary: true}
+}
+
+// Permanent marks err as permanent, retrying the operation that returned it will fail again
+func Permanent(err error) error {
+	return &classifiedError{err: err, temporary: false}
+}
+
+// IsPermanent reports whether err has been marked via Permanent. Unlike a negative IsTemporary, it leaves out the errors
+// that have not been classified at all
+func IsPermanent(err error) bool {
+	var classified *classifiedError
+	return errors.As(err, &classified) && !classified.temporary
+}
+
+var (
+	// temporarySentinels are the errors that depend on the state of remote parties and may go away on their own
+	temporarySentinels = []error{ErrPeerNotFound, ErrRequestNotFound, ErrRateLimited, ErrUnexpectedReply}
+
+	// temporaryErrnos are the socket errors caused by the state of the network rather than by the local setup
+	temporaryErrnos = []error{
+		syscall.ECONNREFUSED,
+		syscall.ECONNRESET,
+		syscall.ENETUNREACH,
+		syscall.EHOSTUNREACH,
+		syscall.EADDRINUSE,
+		syscall.EAGAIN,
+	}
+)
+
+// IsTimeout reports whether err was caused by an exceeded deadline, either of a context or of a socket
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsTemporary reports whether retrying the operation that returned err may succeed. Errors marked via Temporary or
+// Permanent are classified as such, timeouts are temporary and cancellations are not
+func IsTemporary(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.temporary
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrSessionClosed) {
+		return false
+	}
+
+	if IsTimeout(err) {
+		return true
+	}
+
+	for _, target := range temporarySentinels {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	for _, target := range temporaryErrnos {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	// DNS failures are usually transient, unless the name does not exist at all
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+
+	return false
+}
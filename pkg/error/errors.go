@@ -13,7 +13,41 @@ var (
 	ErrWaitForPeer     = errors.New("failed to wait for remote peer")
 	ErrPunchingNAT     = errors.New("failed to perform UDP hole punching")
 	ErrConvertAllowed  = errors.New("failed to convert allowed IPs")
+	ErrPresharedKey    = errors.New("failed to derive preshared key")
 	ErrTunnelStart     = errors.New("failed to start wireguard tunnel")
+	ErrRequestConn     = errors.New("failed to request connection to remote peer")
+
+	// Puncher errors
+	ErrPathUnconfirmed = errors.New("remote peer did not acknowledge any probe")
+
+	// Acceptor errors
+	ErrListenUnsupported = errors.New("rendezvous backend does not support connection requests")
+	ErrAcceptRequest     = errors.New("failed to accept connection request")
+
+	// Rendezvous errors
+	ErrPeerNotFound    = errors.New("peer not found")
+	ErrRequestNotFound = errors.New("connection request not found")
+	ErrRateLimited     = errors.New("rate limit exceeded")
+	ErrUnexpectedReply = errors.New("unexpected reply from rendezvous server")
+	ErrListUnsupported = errors.New("rendezvous backend does not support listing peers")
+	ErrNotOwner        = errors.New("registration is owned by another peer")
+
+	// Mesh errors
+	ErrMeshNotStarted = errors.New("mesh has not been started")
+	ErrMeshStarted    = errors.New("mesh has already been started")
+	ErrUnknownMember  = errors.New("peer is not a member of the mesh")
+
+	// Relay errors
+	ErrRelayClosed      = errors.New("relay closed")
+	ErrRelayUnavailable = errors.New("no relay server available")
+	ErrRelayRejected    = errors.New("relay server rejected the binding")
+	ErrInvalidToken     = errors.New("invalid relay token")
+	ErrTokenExpired     = errors.New("relay token expired")
+
+	// Session errors
+	ErrSessionClosed = errors.New("session closed")
+	ErrRepairFailed  = errors.New("failed to repair path to remote peer")
+	ErrTunnelDown    = errors.New("tunnel stopped unexpectedly")
 )
 
 func Wrap(step error, err error) error {
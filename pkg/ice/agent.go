@@ -0,0 +1,541 @@
+package ice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pion/stun"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/peer"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+// Role tells which of the two agents nominates the pair that ends up being used
+type Role int
+
+const (
+	RoleControlling Role = iota
+	RoleControlled
+)
+
+func (r Role) String() string {
+	if r == RoleControlling {
+		return "controlling"
+	}
+
+	return "controlled"
+}
+
+const (
+	readPollInterval = 100 * time.Millisecond
+	packetQueueLen   = 16
+)
+
+// Agent runs the connectivity checks of RFC 8445 over the socket of the tunnel. Both peers form prioritized pairs out
+// of their local candidates and the candidates of the other peer, check them with STUN binding requests authenticated
+// by the credentials exchanged through the rendezvous backend, and the controlling agent nominates the best pair that
+// works in both directions
+type Agent struct {
+	conn       *net.UDPConn
+	local      Credentials
+	candidates []Candidate
+	tieBreaker uint64
+
+	pacing               time.Duration
+	retransmitTimeout    time.Duration
+	maxRetransmitTimeout time.Duration
+	maxRetransmits       int
+	timeout              time.Duration
+	relay                peer.Relay
+	logger               logr.Logger
+}
+
+// NewAgent creates an agent that checks pairs through conn on behalf of the given local candidates, all of which must
+// share conn as their base except for the relayed candidate, which requires WithRelay
+func NewAgent(conn *net.UDPConn, local Credentials, candidates []Candidate, opts ...Option) (*Agent, error) {
+	cfg := newDefaultConfig()
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	var tieBreaker [tieBreakLen]byte
+	if _, err := rand.Read(tieBreaker[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate tie-breaker: %w", err)
+	}
+
+	return &Agent{
+		conn:                 conn,
+		local:                local,
+		candidates:           candidates,
+		tieBreaker:           binary.BigEndian.Uint64(tieBreaker[:]),
+		pacing:               cfg.pacing,
+		retransmitTimeout:    cfg.retransmitTimeout,
+		maxRetransmitTimeout: cfg.maxRetransmitTimeout,
+		maxRetransmits:       cfg.maxRetransmits,
+		timeout:              cfg.timeout,
+		relay:                cfg.relay,
+		logger:               cfg.logger,
+	}, nil
+}
+
+// Connect checks the pairs formed with the candidates of the remote agent until one of them is nominated and returns
+// the nominated pair. Pairs going through a relay are only nominated once every direct pair has been checked. conn
+// must not be read by anyone else until Connect returns
+func (a *Agent) Connect(ctx context.Context, role Role, remote Credentials, remoteCandidates []Candidate) (*Pair, error) {
+	if len(a.candidates) == 0 || len(remoteCandidates) == 0 {
+		return nil, wgerrors.Permanent(fmt.Errorf("local and remote candidates are required"))
+	}
+
+	ctxCheck, cancel := context.WithTimeout(ctx, a.timeout)
+
+	packets := make(chan packet, packetQueueLen)
+	readerDone := make(chan struct{})
+	go a.read(ctxCheck, packets, readerDone)
+
+	// The socket is handed to the tunnel afterwards, so the reader must be gone by then
+	defer func() {
+		cancel()
+		<-readerDone
+	}()
+
+	s := &checkSession{
+		agent:       a,
+		controlling: role == RoleControlling,
+		remote:      remote,
+		checkList:   NewCheckList(a.candidates, remoteCandidates, role == RoleControlling),
+		pending:     make(map[[stun.TransactionIDSize]byte]*transaction),
+	}
+
+	a.logger.Info("Starting connectivity checks", "role", role, "pairs", len(s.checkList.Pairs()))
+
+	ticker := time.NewTicker(a.pacing)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctxCheck.Done():
+			return nil, fmt.Errorf("no candidate pair nominated: %w", ctxCheck.Err())
+		case pkt := <-packets:
+			s.handle(pkt)
+		case now := <-ticker.C:
+			s.tick(now)
+		}
+
+		if s.nominated != nil {
+			a.logger.Info("Nominated candidate pair", "local", s.nominated.Local.Addr.String(), "remote", s.nominated.Remote.Addr.String(), "localType", s.nominated.Local.Type, "remoteType", s.nominated.Remote.Type)
+			return s.nominated, nil
+		}
+
+		if s.failed() {
+			return nil, errors.New("every candidate pair failed")
+		}
+	}
+}
+
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+	// viaRelay tells whether the packet was relayed by the local relay
+	viaRelay bool
+}
+
+// read forwards the STUN messages received on conn until ctx is done, unwrapping the ones relayed by the local relay.
+// Anything else, like punch packets or WireGuard messages sent by a remote peer that finished earlier, is dropped
+func (a *Agent) read(ctx context.Context, packets chan<- packet, done chan<- struct{}) {
+	defer close(done)
+	defer func() {
+		_ = a.conn.SetReadDeadline(time.Time{})
+	}()
+
+	buf := make([]byte, util.UDPMaxBuffer)
+
+	for ctx.Err() == nil {
+		// Wake up regularly in order to notice the cancellation of ctx
+		_ = a.conn.SetReadDeadline(time.Now().Add(readPollInterval))
+
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			if wgerrors.IsTimeout(err) {
+				continue
+			}
+			return
+		}
+
+		// Dual-stack sockets report IPv4 peers as IPv4-mapped addresses, which would be learnt as IPv6 candidates
+		from.IP = util.NormalizeIP(from.IP)
+
+		pkt := packet{data: buf[:n], from: from}
+		if a.relay != nil && sameAddr(from, a.relay.Server()) {
+			payload, peerAddr, ok := a.relay.Unwrap(buf[:n])
+			if !ok {
+				continue
+			}
+			pkt = packet{data: payload, from: peerAddr, viaRelay: true}
+		}
+
+		if !stun.IsMessage(pkt.data) {
+			continue
+		}
+
+		pkt.data = append([]byte(nil), pkt.data...)
+
+		select {
+		case packets <- pkt:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// transaction is a connectivity check waiting for its response
+type transaction struct {
+	pair         *Pair
+	useCandidate bool
+	// controlling is the role of the agent at the time the check was sent
+	controlling bool
+	raw         []byte
+	sentAt      time.Time
+	rto         time.Duration
+	retransmits int
+}
+
+// checkSession holds the state of a single run of connectivity checks
+type checkSession struct {
+	agent       *Agent
+	controlling bool
+	remote      Credentials
+
+	checkList  *CheckList
+	pending    map[[stun.TransactionIDSize]byte]*transaction
+	triggered  []*Pair
+	nominating *Pair
+	nominated  *Pair
+}
+
+// tick retransmits the checks whose response is late and sends the next check, one per pacing interval
+func (s *checkSession) tick(now time.Time) {
+	for id, tx := range s.pending {
+		if now.Sub(tx.sentAt) < tx.rto {
+			continue
+		}
+
+		if tx.retransmits >= s.agent.maxRetransmits {
+			delete(s.pending, id)
+			s.expire(tx)
+			continue
+		}
+
+		tx.retransmits++
+		tx.sentAt = now
+		tx.rto = min(2*tx.rto, s.agent.maxRetransmitTimeout)
+		s.send(tx)
+	}
+
+	// The controlling agent nominates the best pair that succeeded so far, falling back to relays only once every
+	// direct path has been given a chance
+	if s.controlling && s.nominating == nil {
+		if best := s.checkList.Best(); best != nil && (!best.Relayed() || !s.checkList.directPending()) {
+			s.nominating = best
+			s.check(best, true)
+			return
+		}
+	}
+
+	if pair := s.nextPair(); pair != nil {
+		s.check(pair, false)
+	}
+}
+
+// nextPair returns the pair to check next, giving precedence to the triggered checks
+func (s *checkSession) nextPair() *Pair {
+	for len(s.triggered) > 0 {
+		pair := s.triggered[0]
+		s.triggered = s.triggered[1:]
+
+		if pair.State == PairWaiting {
+			return pair
+		}
+	}
+
+	return s.checkList.Next()
+}
+
+// expire handles a check that never got a response
+func (s *checkSession) expire(tx *transaction) {
+	if tx.useCandidate {
+		// The pair already succeeded, so the remote agent answered our checks before. The nomination most likely got
+		// through and the remote agent moved on before answering its retransmissions
+		s.agent.logger.Info("Nomination was not acknowledged, using the pair anyway", "remote", tx.pair.Remote.Addr.String())
+		s.nominated = tx.pair
+		return
+	}
+
+	if tx.pair.State == PairInProgress {
+		tx.pair.State = PairFailed
+	}
+}
+
+// check sends a connectivity check over pair, nominating it if useCandidate is set
+func (s *checkSession) check(pair *Pair, useCandidate bool) {
+	setters := []stun.Setter{
+		stun.TransactionID,
+		stun.BindingRequest,
+		stun.NewUsername(s.remote.Ufrag + ":" + s.agent.local.Ufrag),
+		priorityAttr(Priority(CandidatePeerReflexive, localPreference(pair.Local))),
+		roleAttr{controlling: s.controlling, tieBreaker: s.agent.tieBreaker},
+	}
+	if useCandidate {
+		setters = append(setters, useCandidateAttr{})
+	}
+	setters = append(setters, stun.NewShortTermIntegrity(s.remote.Pwd), stun.Fingerprint)
+
+	msg, err := stun.Build(setters...)
+	if err != nil {
+		s.agent.logger.Error(err, "failed to build connectivity check")
+		pair.State = PairFailed
+		return
+	}
+
+	if pair.State == PairWaiting {
+		pair.State = PairInProgress
+	}
+
+	tx := &transaction{
+		pair:         pair,
+		useCandidate: useCandidate,
+		controlling:  s.controlling,
+		raw:          msg.Raw,
+		sentAt:       time.Now(),
+		rto:          s.agent.retransmitTimeout,
+	}
+	s.pending[msg.TransactionID] = tx
+	s.send(tx)
+}
+
+func (s *checkSession) send(tx *transaction) {
+	if err := s.write(tx.raw, tx.pair.Remote.Addr, tx.pair.viaRelay()); err != nil {
+		s.agent.logger.Error(err, "failed to send connectivity check", "remote", tx.pair.Remote.Addr.String())
+	}
+}
+
+// write sends a message to the remote agent, through the local relay if told so
+func (s *checkSession) write(raw []byte, to *net.UDPAddr, viaRelay bool) error {
+	if !viaRelay {
+		_, err := s.agent.conn.WriteToUDP(raw, to)
+		return err
+	}
+
+	if s.agent.relay == nil {
+		return fmt.Errorf("no relay configured")
+	}
+
+	wrapped, err := s.agent.relay.Wrap(raw, to)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.agent.conn.WriteToUDP(wrapped, s.agent.relay.Server())
+	return err
+}
+
+// handle processes a STUN message received from the remote agent
+func (s *checkSession) handle(pkt packet) {
+	msg := &stun.Message{Raw: pkt.data}
+	if err := msg.Decode(); err != nil {
+		return
+	}
+
+	// Every message exchanged between agents carries a fingerprint, which tells them apart from other traffic
+	if err := stun.Fingerprint.Check(msg); err != nil {
+		return
+	}
+
+	switch msg.Type {
+	case stun.BindingRequest:
+		s.handleRequest(msg, pkt.from, pkt.viaRelay)
+	case stun.BindingSuccess, stun.BindingError:
+		s.handleResponse(msg, pkt.from, pkt.viaRelay)
+	}
+}
+
+// handleRequest answers a connectivity check of the remote agent and schedules a triggered check towards its source
+func (s *checkSession) handleRequest(msg *stun.Message, from *net.UDPAddr, viaRelay bool) {
+	var username stun.Username
+	if err := username.GetFrom(msg); err != nil || username.String() != s.agent.local.Ufrag+":"+s.remote.Ufrag {
+		return
+	}
+
+	if err := stun.NewShortTermIntegrity(s.agent.local.Pwd).Check(msg); err != nil {
+		return
+	}
+
+	var role roleAttr
+	if err := role.GetFrom(msg); err != nil {
+		return
+	}
+
+	// Resolve role conflicts via the tie-breakers (RFC 8445, section 7.3.1.1)
+	if role.controlling == s.controlling {
+		ours := s.agent.tieBreaker >= role.tieBreaker
+		if s.controlling == ours {
+			s.respond(msg, from, viaRelay, roleConflict)
+			return
+		}
+
+		s.switchRole(!s.controlling)
+	}
+
+	s.respond(msg, from, viaRelay, 0)
+
+	pair := s.checkList.Find(from, viaRelay)
+	if pair == nil {
+		// The remote agent reached us from an address it did not advertise, learn it as a peer-reflexive candidate
+		local, found := s.localFor(from, viaRelay)
+		if !found {
+			return
+		}
+
+		var priority priorityAttr
+		if err := priority.GetFrom(msg); err != nil {
+			return
+		}
+
+		remote := Candidate{
+			Type:       CandidatePeerReflexive,
+			Addr:       from,
+			Priority:   uint32(priority),
+			Foundation: foundation(CandidatePeerReflexive, from.IP),
+		}
+		pair = s.checkList.add(local, remote, s.controlling)
+	}
+
+	if pair.State == PairFailed {
+		pair.State = PairWaiting
+	}
+
+	if pair.State == PairWaiting {
+		s.triggered = append(s.triggered, pair)
+	}
+
+	// The controlling agent only nominates pairs whose check already succeeded on its side, and this request proves
+	// the other direction, so the pair works both ways
+	if !s.controlling && msg.Contains(stun.AttrUseCandidate) {
+		s.nominated = pair
+	}
+}
+
+// respond answers a connectivity check through the same path it came from, with an error if code is set
+func (s *checkSession) respond(req *stun.Message, to *net.UDPAddr, viaRelay bool, code stun.ErrorCode) {
+	setters := []stun.Setter{stun.NewTransactionIDSetter(req.TransactionID)}
+	if code != 0 {
+		setters = append(setters, stun.BindingError, code)
+	} else {
+		setters = append(setters, stun.BindingSuccess, &stun.XORMappedAddress{IP: to.IP, Port: to.Port})
+	}
+	setters = append(setters, stun.NewShortTermIntegrity(s.agent.local.Pwd), stun.Fingerprint)
+
+	msg, err := stun.Build(setters...)
+	if err != nil {
+		s.agent.logger.Error(err, "failed to build connectivity check response")
+		return
+	}
+
+	if errWrite := s.write(msg.Raw, to, viaRelay); errWrite != nil {
+		s.agent.logger.Error(errWrite, "failed to answer connectivity check", "remote", to.String())
+	}
+}
+
+// handleResponse updates the state of the pair checked by the transaction the response belongs to
+func (s *checkSession) handleResponse(msg *stun.Message, from *net.UDPAddr, viaRelay bool) {
+	tx, found := s.pending[msg.TransactionID]
+	if !found {
+		return
+	}
+
+	if err := stun.NewShortTermIntegrity(s.remote.Pwd).Check(msg); err != nil {
+		return
+	}
+
+	// Responses must come from the address the check was sent to, through the same path (RFC 8445, section 7.2.5.2.1)
+	if !sameAddr(from, tx.pair.Remote.Addr) || viaRelay != tx.pair.viaRelay() {
+		return
+	}
+
+	delete(s.pending, msg.TransactionID)
+
+	if msg.Type == stun.BindingError {
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(msg); err == nil && code.Code == roleConflict {
+			// Switch away from the role the check was sent with, unless a request of the remote agent already made us
+			// switch in the meantime, and check again
+			if s.controlling == tx.controlling {
+				s.switchRole(!tx.controlling)
+			}
+			tx.pair.State = PairWaiting
+			s.triggered = append(s.triggered, tx.pair)
+			return
+		}
+
+		tx.pair.State = PairFailed
+		return
+	}
+
+	tx.pair.State = PairSucceeded
+
+	if tx.useCandidate {
+		s.nominated = tx.pair
+	}
+}
+
+// switchRole changes the role of the agent after a role conflict
+func (s *checkSession) switchRole(controlling bool) {
+	s.agent.logger.Info("Switching ICE role after a conflict", "controlling", controlling)
+
+	s.controlling = controlling
+	s.nominating = nil
+	s.checkList.recompute(controlling)
+}
+
+// localFor returns the local candidate with the highest priority of the same address family as addr, among the
+// relayed candidates or among the rest
+func (s *checkSession) localFor(addr *net.UDPAddr, viaRelay bool) (Candidate, bool) {
+	var best Candidate
+	found := false
+
+	for _, candidate := range s.agent.candidates {
+		if (candidate.Addr.IP.To4() == nil) != (addr.IP.To4() == nil) || (candidate.Type == CandidateRelayed) != viaRelay {
+			continue
+		}
+
+		if !found || candidate.Priority > best.Priority {
+			best, found = candidate, true
+		}
+	}
+
+	return best, found
+}
+
+// failed reports whether there is nothing left to check. Only the controlling agent gives up early, the controlled
+// one keeps answering checks until it times out since the remote agent might still nominate a pair
+func (s *checkSession) failed() bool {
+	return s.controlling && s.nominating == nil && len(s.pending) == 0 && len(s.triggered) == 0 &&
+		s.checkList.Done() && s.checkList.Best() == nil
+}
+
+// sameAddr reports whether both addresses are equal
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// localPreference extracts the local preference from the priority of a candidate
+func localPreference(c Candidate) uint16 {
+	return uint16(c.Priority >> 8)
+}
@@ -0,0 +1,89 @@
+package ice
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pion/stun"
+)
+
+const (
+	priorityLen  = 4
+	tieBreakLen  = 8
+	roleConflict = stun.CodeRoleConflict
+)
+
+// priorityAttr is the PRIORITY attribute of a connectivity check (RFC 8445, section 7.1.1)
+type priorityAttr uint32
+
+func (p priorityAttr) AddTo(m *stun.Message) error {
+	v := make([]byte, priorityLen)
+	binary.BigEndian.PutUint32(v, uint32(p))
+	m.Add(stun.AttrPriority, v)
+
+	return nil
+}
+
+func (p *priorityAttr) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrPriority)
+	if err != nil {
+		return err
+	}
+
+	if len(v) != priorityLen {
+		return fmt.Errorf("invalid PRIORITY length %d", len(v))
+	}
+
+	*p = priorityAttr(binary.BigEndian.Uint32(v))
+
+	return nil
+}
+
+// roleAttr is the ICE-CONTROLLING or ICE-CONTROLLED attribute of a connectivity check together with its tie-breaker
+// (RFC 8445, section 7.1.3)
+type roleAttr struct {
+	controlling bool
+	tieBreaker  uint64
+}
+
+func (r roleAttr) AddTo(m *stun.Message) error {
+	v := make([]byte, tieBreakLen)
+	binary.BigEndian.PutUint64(v, r.tieBreaker)
+
+	if r.controlling {
+		m.Add(stun.AttrICEControlling, v)
+	} else {
+		m.Add(stun.AttrICEControlled, v)
+	}
+
+	return nil
+}
+
+func (r *roleAttr) GetFrom(m *stun.Message) error {
+	attrType := stun.AttrICEControlled
+	r.controlling = m.Contains(stun.AttrICEControlling)
+	if r.controlling {
+		attrType = stun.AttrICEControlling
+	}
+
+	v, err := m.Get(attrType)
+	if err != nil {
+		return err
+	}
+
+	if len(v) != tieBreakLen {
+		return fmt.Errorf("invalid %s length %d", attrType, len(v))
+	}
+
+	r.tieBreaker = binary.BigEndian.Uint64(v)
+
+	return nil
+}
+
+// useCandidateAttr is the USE-CANDIDATE attribute through which the controlling agent nominates a pair
+type useCandidateAttr struct{}
+
+func (useCandidateAttr) AddTo(m *stun.Message) error {
+	m.Add(stun.AttrUseCandidate, nil)
+	return nil
+}
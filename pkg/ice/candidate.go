@@ -0,0 +1,151 @@
+package ice
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+// CandidateType tells how the address of a candidate was obtained (RFC 8445, section 5.1.1)
+type CandidateType int
+
+const (
+	// CandidateHost is an address of a local interface
+	CandidateHost CandidateType = iota
+	// CandidateServerReflexive is the public address of a local interface as seen by a STUN server
+	CandidateServerReflexive
+	// CandidatePeerReflexive is an address learnt from the source of a connectivity check
+	CandidatePeerReflexive
+	// CandidateRelayed is an address allocated on a relay server
+	CandidateRelayed
+)
+
+// componentID is the only component used, WireGuard runs on a single UDP socket
+const componentID = 1
+
+var candidateTypeNames = map[CandidateType]string{
+	CandidateHost:            "host",
+	CandidateServerReflexive: "srflx",
+	CandidatePeerReflexive:   "prflx",
+	CandidateRelayed:         "relay",
+}
+
+func (t CandidateType) String() string {
+	if name, found := candidateTypeNames[t]; found {
+		return name
+	}
+
+	return "unknown"
+}
+
+// preference returns the type preference recommended by RFC 8445, section 5.1.2.2
+func (t CandidateType) preference() uint32 {
+	switch t {
+	case CandidateHost:
+		return 126
+	case CandidatePeerReflexive:
+		return 110
+	case CandidateServerReflexive:
+		return 100
+	default:
+		return 0
+	}
+}
+
+// Candidate is a transport address at which a peer might be reachable
+type Candidate struct {
+	Type       CandidateType
+	Addr       *net.UDPAddr
+	Priority   uint32
+	Foundation string
+}
+
+// NewCandidate creates a candidate of the given type. The local preference orders candidates of the same type, the
+// higher the better
+func NewCandidate(typ CandidateType, addr *net.UDPAddr, localPreference uint16) Candidate {
+	return Candidate{
+		Type:       typ,
+		Addr:       addr,
+		Priority:   Priority(typ, localPreference),
+		Foundation: foundation(typ, addr.IP),
+	}
+}
+
+// Priority computes the priority of a candidate (RFC 8445, section 5.1.2.1)
+func Priority(typ CandidateType, localPreference uint16) uint32 {
+	return typ.preference()<<24 | uint32(localPreference)<<8 | (256 - componentID)
+}
+
+// foundation groups candidates of the same type obtained from the same base address
+func foundation(typ CandidateType, ip net.IP) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(typ.String()))
+	_, _ = h.Write(ip)
+
+	return strconv.FormatUint(uint64(h.Sum32()), 10)
+}
+
+// String encodes the candidate in the format of the candidate attribute of SDP (RFC 8839, section 5.1)
+func (c Candidate) String() string {
+	return fmt.Sprintf("candidate:%s %d udp %d %s %d typ %s", c.Foundation, componentID, c.Priority, c.Addr.IP.String(), c.Addr.Port, c.Type)
+}
+
+// ParseCandidate decodes a candidate encoded via Candidate.String. A plain address is accepted as well and taken as a
+// host candidate, so that peers publishing bare addresses can still be reached
+func ParseCandidate(s string) (Candidate, error) {
+	if !strings.HasPrefix(s, "candidate:") {
+		addr, err := net.ResolveUDPAddr(util.UDPProtocol, s)
+		if err != nil {
+			return Candidate{}, fmt.Errorf("invalid candidate %q: %w", s, err)
+		}
+
+		addr.IP = util.NormalizeIP(addr.IP)
+
+		return NewCandidate(CandidateHost, addr, 0), nil
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(s, "candidate:"))
+	if len(fields) < 8 || fields[6] != "typ" {
+		return Candidate{}, fmt.Errorf("invalid candidate %q: malformed attribute", s)
+	}
+
+	if !strings.EqualFold(fields[2], "udp") {
+		return Candidate{}, fmt.Errorf("invalid candidate %q: unsupported transport %s", s, fields[2])
+	}
+
+	priority, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return Candidate{}, fmt.Errorf("invalid candidate %q: invalid priority: %w", s, err)
+	}
+
+	ip := net.ParseIP(fields[4])
+	if ip == nil {
+		return Candidate{}, fmt.Errorf("invalid candidate %q: invalid address %s", s, fields[4])
+	}
+
+	port, err := strconv.Atoi(fields[5])
+	if err != nil || port <= 0 || port > 65535 {
+		return Candidate{}, fmt.Errorf("invalid candidate %q: invalid port %s", s, fields[5])
+	}
+
+	typ := CandidateType(-1)
+	for t, name := range candidateTypeNames {
+		if name == fields[7] {
+			typ = t
+		}
+	}
+	if typ < 0 {
+		return Candidate{}, fmt.Errorf("invalid candidate %q: unknown type %s", s, fields[7])
+	}
+
+	return Candidate{
+		Type:       typ,
+		Addr:       &net.UDPAddr{IP: util.NormalizeIP(ip), Port: port},
+		Priority:   uint32(priority),
+		Foundation: fields[0],
+	}, nil
+}
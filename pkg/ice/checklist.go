@@ -0,0 +1,174 @@
+package ice
+
+import (
+	"net"
+	"sort"
+)
+
+// PairState is the state of the connectivity checks of a candidate pair (RFC 8445, section 6.1.2.6)
+type PairState int
+
+const (
+	PairWaiting PairState = iota
+	PairInProgress
+	PairSucceeded
+	PairFailed
+)
+
+// Pair is a local candidate paired with a remote one. Every local candidate but the relayed one shares the socket of
+// the tunnel as its base, so pairs towards the same remote address through the same base are redundant and only the
+// one with the highest priority is kept
+type Pair struct {
+	Local    Candidate
+	Remote   Candidate
+	Priority uint64
+	State    PairState
+}
+
+// Relayed reports whether the traffic of the pair goes through a relay server on either side
+func (p *Pair) Relayed() bool {
+	return p.Local.Type == CandidateRelayed || p.Remote.Type == CandidateRelayed
+}
+
+// viaRelay reports whether the checks of the pair are sent through the local relay
+func (p *Pair) viaRelay() bool {
+	return p.Local.Type == CandidateRelayed
+}
+
+// pairPriority computes the priority of a pair given the priorities of the candidates of the controlling and the
+// controlled agent (RFC 8445, section 6.1.2.3)
+func pairPriority(controlling, controlled uint32) uint64 {
+	g, d := uint64(controlling), uint64(controlled)
+
+	var tie uint64
+	if g > d {
+		tie = 1
+	}
+
+	return 1<<32*min(g, d) + 2*max(g, d) + tie
+}
+
+// CheckList holds the candidate pairs ordered by priority, highest first
+type CheckList struct {
+	pairs []*Pair
+}
+
+// NewCheckList pairs every local candidate with every remote candidate of the same address family. A single pair is
+// kept per remote candidate and base, the base being either the socket of the tunnel or the local relay
+func NewCheckList(local, remote []Candidate, controlling bool) *CheckList {
+	cl := &CheckList{}
+
+	for _, r := range remote {
+		for _, l := range local {
+			if (l.Addr.IP.To4() == nil) != (r.Addr.IP.To4() == nil) {
+				continue
+			}
+
+			cl.add(l, r, controlling)
+		}
+	}
+
+	return cl
+}
+
+// add inserts a pair, replacing the pair towards the same remote address through the same base if the new one has a
+// higher priority
+func (cl *CheckList) add(local, remote Candidate, controlling bool) *Pair {
+	priority := pairPriority(remote.Priority, local.Priority)
+	if controlling {
+		priority = pairPriority(local.Priority, remote.Priority)
+	}
+
+	if existing := cl.Find(remote.Addr, local.Type == CandidateRelayed); existing != nil {
+		if existing.Priority < priority && existing.State == PairWaiting {
+			existing.Local, existing.Remote, existing.Priority = local, remote, priority
+			cl.sort()
+		}
+		return existing
+	}
+
+	pair := &Pair{Local: local, Remote: remote, Priority: priority}
+	cl.pairs = append(cl.pairs, pair)
+	cl.sort()
+
+	return pair
+}
+
+// Find returns the pair towards the given remote address, through the local relay or not, or nil if there is none
+func (cl *CheckList) Find(addr *net.UDPAddr, viaRelay bool) *Pair {
+	for _, pair := range cl.pairs {
+		if pair.viaRelay() == viaRelay && pair.Remote.Addr.IP.Equal(addr.IP) && pair.Remote.Addr.Port == addr.Port {
+			return pair
+		}
+	}
+
+	return nil
+}
+
+// Next returns the waiting pair with the highest priority, or nil if there is none
+func (cl *CheckList) Next() *Pair {
+	for _, pair := range cl.pairs {
+		if pair.State == PairWaiting {
+			return pair
+		}
+	}
+
+	return nil
+}
+
+// Best returns the succeeded pair with the highest priority, or nil if there is none
+func (cl *CheckList) Best() *Pair {
+	for _, pair := range cl.pairs {
+		if pair.State == PairSucceeded {
+			return pair
+		}
+	}
+
+	return nil
+}
+
+// directPending reports whether any pair that does not go through a relay is still being checked
+func (cl *CheckList) directPending() bool {
+	for _, pair := range cl.pairs {
+		if !pair.Relayed() && (pair.State == PairWaiting || pair.State == PairInProgress) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Done reports whether every pair has either succeeded or failed
+func (cl *CheckList) Done() bool {
+	for _, pair := range cl.pairs {
+		if pair.State == PairWaiting || pair.State == PairInProgress {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Pairs returns the pairs ordered by priority, highest first
+func (cl *CheckList) Pairs() []*Pair {
+	return cl.pairs
+}
+
+// recompute updates the priorities after a role switch
+func (cl *CheckList) recompute(controlling bool) {
+	for _, pair := range cl.pairs {
+		if controlling {
+			pair.Priority = pairPriority(pair.Local.Priority, pair.Remote.Priority)
+		} else {
+			pair.Priority = pairPriority(pair.Remote.Priority, pair.Local.Priority)
+		}
+	}
+
+	cl.sort()
+}
+
+func (cl *CheckList) sort() {
+	sort.SliceStable(cl.pairs, func(i, j int) bool {
+		return cl.pairs[i].Priority > cl.pairs[j].Priority
+	})
+}
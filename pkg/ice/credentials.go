@@ -0,0 +1,50 @@
+package ice
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+const (
+	// RFC 8445, section 5.3 requires at least 24 bits of randomness for the ufrag and 128 bits for the password
+	ufragLen = 8
+	pwdLen   = 24
+
+	iceChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789+/"
+)
+
+// Credentials authenticate the connectivity checks between two agents. They are exchanged through the rendezvous
+// backend next to the candidates of the peer
+type Credentials struct {
+	Ufrag string
+	Pwd   string
+}
+
+// NewCredentials generates a random username fragment and password
+func NewCredentials() (Credentials, error) {
+	ufrag, err := randomString(ufragLen)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	pwd, err := randomString(pwdLen)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	return Credentials{Ufrag: ufrag, Pwd: pwd}, nil
+}
+
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate ICE credentials: %w", err)
+	}
+
+	// The alphabet has 64 characters so every byte maps to one of them without bias
+	for i, b := range buf {
+		buf[i] = iceChars[b%byte(len(iceChars))]
+	}
+
+	return string(buf), nil
+}
@@ -0,0 +1,81 @@
+package ice
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/yago-123/wg-punch/pkg/peer"
+)
+
+const (
+	// Pacing of the connectivity checks (Ta), RFC 8445 recommends 50ms for non real-time traffic
+	defaultPacing = 50 * time.Millisecond
+
+	defaultRetransmitTimeout    = 250 * time.Millisecond
+	defaultMaxRetransmitTimeout = 1 * time.Second
+	defaultMaxRetransmits       = 5
+
+	defaultTimeout = 15 * time.Second
+)
+
+type config struct {
+	pacing               time.Duration
+	retransmitTimeout    time.Duration
+	maxRetransmitTimeout time.Duration
+	maxRetransmits       int
+	timeout              time.Duration
+	relay                peer.Relay
+	logger               logr.Logger
+}
+
+type Option func(*config)
+
+func newDefaultConfig() *config {
+	return &config{
+		pacing:               defaultPacing,
+		retransmitTimeout:    defaultRetransmitTimeout,
+		maxRetransmitTimeout: defaultMaxRetransmitTimeout,
+		maxRetransmits:       defaultMaxRetransmits,
+		timeout:              defaultTimeout,
+		logger:               logr.Discard(),
+	}
+}
+
+// WithPacing sets the interval between two consecutive connectivity checks. The interval must be greater than 0
+func WithPacing(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.pacing = interval
+	}
+}
+
+// WithRetransmits sets the number of retransmissions of a connectivity check before its pair is considered failed,
+// together with the initial retransmission timeout, which doubles after every retransmission up to 1 second
+func WithRetransmits(retransmits int, timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxRetransmits = retransmits
+		cfg.retransmitTimeout = timeout
+	}
+}
+
+// WithTimeout sets how long the agent keeps checking pairs before giving up
+func WithTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.timeout = timeout
+	}
+}
+
+// WithRelay sets the relay through which the checks of the relayed local candidate are sent. The packets received from
+// the relay server are handed to the relay while the agent reads the socket
+func WithRelay(relay peer.Relay) Option {
+	return func(cfg *config) {
+		cfg.relay = relay
+	}
+}
+
+// WithLogger sets the logger to use for logging. The logger must implement the logr.Logger interface
+func WithLogger(logger logr.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
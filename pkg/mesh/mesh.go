@@ -0,0 +1,529 @@
+package mesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/yago-123/wg-punch/pkg/connect"
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/peer"
+	"github.com/yago-123/wg-punch/pkg/tunnel"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const (
+	requestRetryInterval  = 1 * time.Second
+	handshakePollInterval = 500 * time.Millisecond
+
+	// rollbackTimeout bounds the calls to the rendezvous backend performed while undoing a failed start
+	rollbackTimeout = 5 * time.Second
+)
+
+// Member describes a remote peer that is part of the mesh
+type Member struct {
+	ID          string
+	Info        peer.Info
+	OverlayAddr net.IP
+}
+
+// Mesh keeps a single interface and a single UDP socket shared by any number of remote peers. Peers are connected
+// concurrently and can join or leave the mesh at any time without tearing down the interface. Members whose path goes
+// stale are punched again, and members whose registration lapses in the rendezvous backend are removed, provided the
+// backend is able to list its peers
+type Mesh struct {
+	connector  *connect.Connector
+	tunnel     tunnel.MultiPeerTunnel
+	allowedIPs []string
+
+	acceptRequests bool
+	discover       bool
+	staleAfter     time.Duration
+	checkInterval  time.Duration
+	logger         logr.Logger
+
+	conn   *net.UDPConn
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	releaseRegistration func(ctx context.Context) error
+
+	mu        sync.Mutex
+	starting  bool
+	members   map[string]*Member
+	joining   map[string]struct{}
+	repairing map[string]struct{}
+}
+
+func New(connector *connect.Connector, tun tunnel.MultiPeerTunnel, allowedIPs []string, opts ...Option) *Mesh {
+	cfg := newDefaultConfig()
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &Mesh{
+		connector:      connector,
+		tunnel:         tun,
+		allowedIPs:     allowedIPs,
+		acceptRequests: cfg.acceptRequests,
+		discover:       cfg.discover,
+		staleAfter:     cfg.staleAfter,
+		checkInterval:  cfg.checkInterval,
+		logger:         cfg.logger,
+		members:        make(map[string]*Member),
+		joining:        make(map[string]struct{}),
+		repairing:      make(map[string]struct{}),
+	}
+}
+
+// Start binds the shared socket, registers the local peer in the rendezvous server and brings up the interface. If
+// the connector supports connection requests, peers that request a connection are added to the mesh until Close is
+// called. The members are supervised from then on as well
+func (m *Mesh) Start(ctx context.Context) error {
+	m.mu.Lock()
+	if m.conn != nil || m.starting {
+		m.mu.Unlock()
+		return wgerrors.ErrMeshStarted
+	}
+
+	// The rest of the calls must not wait for the network, so the lock is not held while bringing up the mesh
+	m.starting = true
+	m.mu.Unlock()
+
+	conn, releaseRegistration, err := m.open(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.starting = false
+	if err != nil {
+		return err
+	}
+
+	ctxMesh, cancel := context.WithCancel(context.Background())
+	m.conn = conn
+	m.cancel = cancel
+	m.releaseRegistration = releaseRegistration
+
+	if m.acceptRequests {
+		m.wg.Add(1)
+		go m.acceptLoop(ctxMesh)
+	}
+
+	m.wg.Add(1)
+	go m.superviseLoop(ctxMesh)
+
+	m.logger.Info("Mesh started", "peerID", m.connector.LocalPeerID(), "listenPort", m.tunnel.ListenPort())
+
+	return nil
+}
+
+// open binds the shared socket, registers the local peer and brings up the interface without any remote peer. The
+// registration is held from the moment it succeeds, so that it does not lapse while the interface comes up
+func (m *Mesh) open(ctx context.Context) (*net.UDPConn, func(ctx context.Context) error, error) {
+	// Release every resource acquired so far, in reverse order, if any of the steps fails
+	rollback := util.NewRollback(m.logger)
+	defer rollback.Run()
+
+	conn, err := m.connector.Bind(m.tunnel.ListenPort())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rollback.Add("close socket", func() error {
+		return conn.Close()
+	})
+
+	// The registration is held before it is made, so that the release of a session of the connector cannot withdraw it
+	releaseRegistration := m.connector.HoldRegistration()
+	rollback.Add("release registration", func() error {
+		ctxRelease, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+		defer cancel()
+
+		return releaseRegistration(ctxRelease)
+	})
+
+	// The public address must be discovered before the socket is handed to the tunnel
+	if _, err = m.connector.AnnounceShared(ctx, conn, m.tunnel.PublicKey(), m.allowedIPs); err != nil {
+		return nil, nil, err
+	}
+
+	if err = m.tunnel.Open(ctx, conn); err != nil {
+		return nil, nil, fmt.Errorf("failed to open tunnel: %w", err)
+	}
+
+	rollback.Commit()
+
+	return conn, releaseRegistration, nil
+}
+
+// Join connects concurrently to all the given peers. Peers that are already members are skipped. The returned error
+// joins the errors of every peer that could not be added
+func (m *Mesh) Join(ctx context.Context, peerIDs []string) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(peerIDs))
+
+	for i, peerID := range peerIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = m.AddPeer(ctx, peerID)
+		}()
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// AddPeer connects to the remote peer and adds it to the running interface
+func (m *Mesh) AddPeer(ctx context.Context, peerID string) error {
+	if err := m.connector.Request(ctx, peerID); err != nil {
+		return err
+	}
+
+	return m.addPeer(ctx, peerID)
+}
+
+// addPeer adds the remote peer to the running interface without leaving a connection request
+func (m *Mesh) addPeer(ctx context.Context, peerID string) error {
+	m.mu.Lock()
+	if m.conn == nil {
+		m.mu.Unlock()
+		return wgerrors.ErrMeshNotStarted
+	}
+
+	// Skip peers that are already members or that are being added concurrently
+	_, isMember := m.members[peerID]
+	_, isJoining := m.joining[peerID]
+	if isMember || isJoining || peerID == m.connector.LocalPeerID() {
+		m.mu.Unlock()
+		return nil
+	}
+
+	m.joining[peerID] = struct{}{}
+	conn := m.conn
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.joining, peerID)
+		m.mu.Unlock()
+	}()
+
+	remote, err := m.connector.ResolveShared(ctx, m.tunnel, conn, peerID)
+	if err != nil {
+		return fmt.Errorf("failed to resolve peer %s: %w", peerID, err)
+	}
+
+	// The handshake confirms the path, once done there is no need to keep punching
+	errAdd := m.tunnel.AddPeer(ctx, remote.Info)
+	remote.CancelPunch()
+	if errAdd != nil {
+		return fmt.Errorf("failed to add peer %s: %w", peerID, errAdd)
+	}
+
+	m.mu.Lock()
+	m.members[peerID] = &Member{
+		ID:          peerID,
+		Info:        remote.Info,
+		OverlayAddr: remote.OverlayAddr,
+	}
+	m.mu.Unlock()
+
+	m.logger.Info("Peer joined the mesh", "peerID", peerID, "endpoint", remote.Info.Endpoint.String(), "overlayAddr", remote.OverlayAddr)
+
+	return nil
+}
+
+// RemovePeer removes the remote peer from the running interface
+func (m *Mesh) RemovePeer(ctx context.Context, peerID string) error {
+	m.mu.Lock()
+	member, found := m.members[peerID]
+	delete(m.members, peerID)
+	m.mu.Unlock()
+
+	if !found {
+		return wgerrors.ErrUnknownMember
+	}
+
+	if err := m.tunnel.RemovePeer(ctx, member.Info.PublicKey); err != nil {
+		return fmt.Errorf("failed to remove peer %s: %w", peerID, err)
+	}
+
+	m.logger.Info("Peer left the mesh", "peerID", peerID)
+
+	return nil
+}
+
+// Members returns a snapshot of the peers that are currently part of the mesh
+func (m *Mesh) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := make([]Member, 0, len(m.members))
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+
+	return members
+}
+
+// Close stops accepting new peers, tears down the interface together with the shared socket and withdraws the
+// registration of the local peer
+func (m *Mesh) Close(ctx context.Context) error {
+	m.mu.Lock()
+	if m.conn == nil {
+		m.mu.Unlock()
+		return nil
+	}
+
+	m.cancel()
+	conn := m.conn
+	release := m.releaseRegistration
+	m.conn = nil
+	m.releaseRegistration = nil
+	m.members = make(map[string]*Member)
+	m.mu.Unlock()
+
+	m.wg.Wait()
+
+	errStop := m.tunnel.Stop(ctx)
+	if errConn := conn.Close(); errConn != nil && !errors.Is(errConn, net.ErrClosed) && errStop == nil {
+		errStop = errConn
+	}
+
+	if errRelease := release(ctx); errRelease != nil && errStop == nil {
+		errStop = errRelease
+	}
+
+	return errStop
+}
+
+// acceptLoop adds to the mesh every peer that leaves a connection request for the local peer
+func (m *Mesh) acceptLoop(ctx context.Context) {
+	defer m.wg.Done()
+
+	for {
+		req, err := m.connector.NextRequest(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			m.logger.Error(err, "failed to wait for connection request", "peerID", m.connector.LocalPeerID())
+
+			// The connector might not support requests at all, in which case there is nothing to accept
+			if errors.Is(err, wgerrors.ErrListenUnsupported) {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(requestRetryInterval):
+			}
+			continue
+		}
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+
+			if errAdd := m.addPeer(ctx, req.FromPeerID); errAdd != nil {
+				m.logger.Error(errAdd, "failed to add requesting peer", "peerID", req.FromPeerID)
+			}
+		}()
+	}
+}
+
+// superviseLoop checks the members every check interval until the mesh is closed
+func (m *Mesh) superviseLoop(ctx context.Context) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+
+	// Stop following the rendezvous backend as soon as it turns out that it cannot list its peers
+	follow := true
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.checkMembers(ctx)
+
+		if follow {
+			follow = m.syncMembers(ctx)
+		}
+	}
+}
+
+// checkMembers punches again the path towards every member whose last handshake is older than the stale threshold.
+// Members the tunnel lost track of are removed from the mesh
+func (m *Mesh) checkMembers(ctx context.Context) {
+	supervised, ok := m.tunnel.(tunnel.SupervisedTunnel)
+	if !ok {
+		return
+	}
+
+	for _, member := range m.Members() {
+		stats, err := supervised.PeerStats(member.Info.PublicKey)
+		if err != nil {
+			if wgerrors.IsPermanent(err) {
+				m.logger.Error(err, "tunnel lost track of member, removing it", "peerID", member.ID)
+				m.dropMember(ctx, member.ID)
+				continue
+			}
+
+			m.logger.Error(err, "failed to retrieve peer stats", "peerID", member.ID)
+			continue
+		}
+
+		if time.Since(stats.LastHandshake) < m.staleAfter {
+			continue
+		}
+
+		m.mu.Lock()
+		_, isRepairing := m.repairing[member.ID]
+		if !isRepairing {
+			m.repairing[member.ID] = struct{}{}
+		}
+		m.mu.Unlock()
+
+		if isRepairing {
+			continue
+		}
+
+		m.logger.Info("Path to member is stale, punching it again", "peerID", member.ID, "lastHandshake", stats.LastHandshake)
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+
+			if errRepair := m.repair(ctx, supervised, member.ID); errRepair != nil {
+				m.logger.Error(errRepair, "failed to repair path to member", "peerID", member.ID)
+			}
+
+			m.mu.Lock()
+			delete(m.repairing, member.ID)
+			m.mu.Unlock()
+		}()
+	}
+}
+
+// repair resolves the member again, points it to its current endpoint and waits for a new handshake. The attempt is
+// bounded by the stale threshold, the next checks retry it if it fails
+func (m *Mesh) repair(ctx context.Context, supervised tunnel.SupervisedTunnel, peerID string) error {
+	ctxRepair, cancel := context.WithTimeout(ctx, m.staleAfter)
+	defer cancel()
+
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+
+	if conn == nil {
+		return wgerrors.ErrMeshNotStarted
+	}
+
+	start := time.Now()
+
+	remote, err := m.connector.ResolveShared(ctxRepair, m.tunnel, conn, peerID)
+	if err != nil {
+		return err
+	}
+	defer remote.CancelPunch()
+
+	if errUpdate := supervised.UpdateEndpoint(ctxRepair, remote.Info.PublicKey, remote.Info.Endpoint); errUpdate != nil {
+		return fmt.Errorf("failed to update endpoint: %w", errUpdate)
+	}
+
+	ticker := time.NewTicker(handshakePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctxRepair.Done():
+			return fmt.Errorf("handshake did not complete: %w", ctxRepair.Err())
+		case <-ticker.C:
+			stats, errStats := supervised.PeerStats(remote.Info.PublicKey)
+			if errStats != nil {
+				return fmt.Errorf("failed to retrieve peer stats: %w", errStats)
+			}
+
+			if stats.LastHandshake.After(start) {
+				m.logger.Info("Path to member repaired", "peerID", peerID, "endpoint", remote.Info.Endpoint.String())
+				return nil
+			}
+		}
+	}
+}
+
+// syncMembers follows the peers registered in the rendezvous backend: members whose registration lapsed are removed
+// and, if discovery is enabled, registered peers that are not members yet are added. Returns false if the backend
+// cannot list its peers, in which case there is nothing to follow
+func (m *Mesh) syncMembers(ctx context.Context) bool {
+	peers, err := m.connector.Peers(ctx)
+	if err != nil {
+		if errors.Is(err, wgerrors.ErrListUnsupported) {
+			return false
+		}
+
+		m.logger.Error(err, "failed to list registered peers", "peerID", m.connector.LocalPeerID())
+		return true
+	}
+
+	registered := make(map[string]struct{}, len(peers))
+	for _, info := range peers {
+		registered[info.PeerID] = struct{}{}
+	}
+
+	for _, member := range m.Members() {
+		if _, found := registered[member.ID]; !found {
+			m.logger.Info("Registration of member lapsed, removing it", "peerID", member.ID)
+			m.dropMember(ctx, member.ID)
+		}
+	}
+
+	if !m.discover {
+		return true
+	}
+
+	for peerID := range registered {
+		m.mu.Lock()
+		_, isMember := m.members[peerID]
+		_, isJoining := m.joining[peerID]
+		m.mu.Unlock()
+
+		if isMember || isJoining || peerID == m.connector.LocalPeerID() {
+			continue
+		}
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+
+			if errAdd := m.addPeer(ctx, peerID); errAdd != nil {
+				m.logger.Error(errAdd, "failed to add registered peer", "peerID", peerID)
+			}
+		}()
+	}
+
+	return true
+}
+
+// dropMember removes a member that the mesh gave up on, logging the failure if any
+func (m *Mesh) dropMember(ctx context.Context, peerID string) {
+	if err := m.RemovePeer(ctx, peerID); err != nil && !errors.Is(err, wgerrors.ErrUnknownMember) {
+		m.logger.Error(err, "failed to remove member", "peerID", peerID)
+	}
+}
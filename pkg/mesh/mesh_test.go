@@ -0,0 +1,184 @@
+package mesh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yago-123/wg-punch/pkg/connect"
+	"github.com/yago-123/wg-punch/pkg/peer"
+	"github.com/yago-123/wg-punch/pkg/puncher"
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/rendezvous/memory"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+// fakePuncher reports the local address of the socket as its public address and takes the first candidate as the
+// path towards the remote peer
+type fakePuncher struct{}
+
+func (fakePuncher) Punch(_ context.Context, conn *net.UDPConn, target puncher.Target) (*puncher.Result, error) {
+	return &puncher.Result{Addr: target.Candidates[0], Conn: conn, Cancel: func() {}}, nil
+}
+
+func (fakePuncher) PublicAddr(_ context.Context, conn util.UDPConn) (*net.UDPAddr, error) {
+	addr, _ := conn.LocalAddr().(*net.UDPAddr)
+	return addr, nil
+}
+
+// fakeTunnel records the remote peers configured in the mesh, without touching any interface
+type fakeTunnel struct {
+	openErr error
+
+	mu    sync.Mutex
+	peers map[string]peer.Info
+}
+
+func (f *fakeTunnel) Start(_ context.Context, _ *net.UDPConn, _ peer.Info, _ context.CancelFunc) error {
+	return nil
+}
+
+func (f *fakeTunnel) PublicKey() string {
+	return "local-key"
+}
+
+func (f *fakeTunnel) ListenPort() int {
+	return 0
+}
+
+func (f *fakeTunnel) Stop(_ context.Context) error {
+	return nil
+}
+
+func (f *fakeTunnel) Open(_ context.Context, _ *net.UDPConn) error {
+	return f.openErr
+}
+
+func (f *fakeTunnel) AddPeer(_ context.Context, remotePeer peer.Info) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.peers[remotePeer.PublicKey] = remotePeer
+	return nil
+}
+
+func (f *fakeTunnel) RemovePeer(_ context.Context, publicKey string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.peers, publicKey)
+	return nil
+}
+
+func (f *fakeTunnel) hasPeer(publicKey string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, found := f.peers[publicKey]
+	return found
+}
+
+// register registers a remote peer whose registration lapses after ttl
+func register(t *testing.T, rend *memory.Rendezvous, peerID string, ttl time.Duration) {
+	t.Helper()
+
+	err := rend.Register(context.Background(), rendezvous.RegisterRequest{
+		PeerID:     peerID,
+		PublicKey:  peerID + "-key",
+		Endpoint:   "127.0.0.1:51820",
+		AllowedIPs: []string{"10.0.0.2/32"},
+		TTL:        ttl,
+	})
+	if err != nil {
+		t.Fatalf("failed to register %s: %v", peerID, err)
+	}
+}
+
+// eventually fails the test unless cond holds within a few seconds
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newMesh(rend *memory.Rendezvous, tun *fakeTunnel, opts ...Option) *Mesh {
+	connector := connect.NewConnector("local", fakePuncher{},
+		connect.WithRendezvous(rend),
+		connect.WithHostCandidates(false),
+		connect.WithICE(false),
+		connect.WithRelayFallback(false),
+	)
+
+	opts = append([]Option{WithAcceptRequests(false), WithHealthCheckInterval(10 * time.Millisecond)}, opts...)
+	return New(connector, tun, []string{"10.0.0.1/32"}, opts...)
+}
+
+func newTestMesh(t *testing.T, rend *memory.Rendezvous, tun *fakeTunnel, opts ...Option) *Mesh {
+	t.Helper()
+
+	m := newMesh(rend, tun, opts...)
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start mesh: %v", err)
+	}
+	t.Cleanup(func() { _ = m.Close(context.Background()) })
+
+	return m
+}
+
+func TestMeshRemovesLapsedMembers(t *testing.T) {
+	rend := memory.New()
+	tun := &fakeTunnel{peers: make(map[string]peer.Info)}
+	m := newTestMesh(t, rend, tun)
+
+	register(t, rend, "alice", 200*time.Millisecond)
+	register(t, rend, "bob", time.Minute)
+
+	if err := m.Join(context.Background(), []string{"alice", "bob"}); err != nil {
+		t.Fatalf("failed to join peers: %v", err)
+	}
+
+	eventually(t, func() bool { return !tun.hasPeer("alice-key") }, "expected lapsed member removed")
+
+	if !tun.hasPeer("bob-key") || len(m.Members()) != 1 {
+		t.Fatalf("expected registered member kept, got %v", m.Members())
+	}
+}
+
+func TestMeshDiscoversRegisteredPeers(t *testing.T) {
+	rend := memory.New()
+	tun := &fakeTunnel{peers: make(map[string]peer.Info)}
+	m := newTestMesh(t, rend, tun, WithDiscovery(true))
+
+	register(t, rend, "alice", time.Minute)
+
+	eventually(t, func() bool { return tun.hasPeer("alice-key") }, "expected registered peer added")
+
+	if err := rend.Deregister(context.Background(), "alice"); err != nil {
+		t.Fatalf("failed to deregister: %v", err)
+	}
+
+	eventually(t, func() bool { return len(m.Members()) == 0 }, "expected deregistered member removed")
+}
+
+func TestMeshStartDeregistersOnOpenFailure(t *testing.T) {
+	rend := memory.New()
+	tun := &fakeTunnel{openErr: errors.New("fake failure"), peers: make(map[string]peer.Info)}
+
+	if err := newMesh(rend, tun).Start(context.Background()); err == nil {
+		t.Fatalf("expected start to fail")
+	}
+
+	peers, _ := rend.Peers(context.Background())
+	if len(peers) != 0 {
+		t.Fatalf("expected local peer deregistered, got %+v", peers)
+	}
+}
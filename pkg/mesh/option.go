@@ -0,0 +1,69 @@
+package mesh
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	defaultStaleAfter    = 3 * time.Minute
+	defaultCheckInterval = 5 * time.Second
+)
+
+type config struct {
+	acceptRequests bool
+	discover       bool
+	staleAfter     time.Duration
+	checkInterval  time.Duration
+	logger         logr.Logger
+}
+
+type Option func(*config)
+
+func newDefaultConfig() *config {
+	return &config{
+		acceptRequests: true,
+		staleAfter:     defaultStaleAfter,
+		checkInterval:  defaultCheckInterval,
+		logger:         logr.Discard(),
+	}
+}
+
+// WithAcceptRequests sets whether the mesh adds the peers that leave a connection request for the local peer in the
+// rendezvous server. Only takes effect if the connector has been configured with a requester
+func WithAcceptRequests(accept bool) Option {
+	return func(cfg *config) {
+		cfg.acceptRequests = accept
+	}
+}
+
+// WithDiscovery sets whether the mesh adds every peer registered in the rendezvous backend on its own, so that nodes
+// sharing a private backend form a full mesh without being told about each other. Only takes effect if the backend
+// implements rendezvous.Lister
+func WithDiscovery(discover bool) Option {
+	return func(cfg *config) {
+		cfg.discover = discover
+	}
+}
+
+// WithStaleThreshold sets how long a member may go without a handshake before its path is punched again
+func WithStaleThreshold(threshold time.Duration) Option {
+	return func(cfg *config) {
+		cfg.staleAfter = threshold
+	}
+}
+
+// WithHealthCheckInterval sets how often the handshakes of the members and the registered peers are checked
+func WithHealthCheckInterval(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.checkInterval = interval
+	}
+}
+
+// WithLogger sets the logger to use for logging. The logger must implement the logr.Logger interface
+func WithLogger(logger logr.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
@@ -0,0 +1,106 @@
+package natcheck
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Behavior classifies how a NAT maps or filters the traffic of a socket (RFC 4787, sections 4.1 and 5)
+type Behavior int
+
+const (
+	// BehaviorUnknown is reported if the tests required to tell the behavior apart could not be performed
+	BehaviorUnknown Behavior = iota
+	// EndpointIndependent mappings are reused for every destination, and endpoint independent filters let in the
+	// traffic of any remote address once the mapping exists
+	EndpointIndependent
+	// AddressDependent mappings and filters depend on the IP of the remote address only
+	AddressDependent
+	// AddressAndPortDependent mappings and filters depend on both the IP and the port of the remote address
+	AddressAndPortDependent
+)
+
+var behaviorNames = map[Behavior]string{
+	BehaviorUnknown:         "unknown",
+	EndpointIndependent:     "endpoint-independent",
+	AddressDependent:        "address-dependent",
+	AddressAndPortDependent: "address-and-port-dependent",
+}
+
+func (b Behavior) String() string {
+	if name, found := behaviorNames[b]; found {
+		return name
+	}
+
+	return fmt.Sprintf("Behavior(%d)", int(b))
+}
+
+// parseBehavior decodes a behavior encoded via Behavior.String
+func parseBehavior(s string) (Behavior, error) {
+	for behavior, name := range behaviorNames {
+		if name == s {
+			return behavior, nil
+		}
+	}
+
+	return BehaviorUnknown, fmt.Errorf("unknown behavior %q", s)
+}
+
+// NATBehavior describes the NAT in front of a socket, as discovered via RFC 5780
+type NATBehavior struct {
+	// PublicAddr is the public address of the socket as seen by the primary address of the server
+	PublicAddr *net.UDPAddr
+	// Mapping tells how the NAT allocates public addresses for new destinations
+	Mapping Behavior
+	// Filtering tells which remote addresses the NAT lets in through an existing mapping
+	Filtering Behavior
+}
+
+// Symmetric reports whether the NAT allocates a different public address for every destination, which defeats
+// punching through the public address discovered via STUN
+func (n NATBehavior) Symmetric() bool {
+	return n.Mapping == AddressDependent || n.Mapping == AddressAndPortDependent
+}
+
+// String encodes the mapping and the filtering behaviors in order to publish them in the rendezvous backend
+func (n NATBehavior) String() string {
+	return n.Mapping.String() + "/" + n.Filtering.String()
+}
+
+// ParseNATBehavior decodes the mapping and the filtering behaviors encoded via NATBehavior.String. The public address
+// is not part of the encoding
+func ParseNATBehavior(s string) (NATBehavior, error) {
+	mapping, filtering, found := strings.Cut(s, "/")
+	if !found {
+		return NATBehavior{}, fmt.Errorf("invalid NAT behavior %q", s)
+	}
+
+	var behavior NATBehavior
+	var err error
+
+	if behavior.Mapping, err = parseBehavior(mapping); err != nil {
+		return NATBehavior{}, err
+	}
+
+	if behavior.Filtering, err = parseBehavior(filtering); err != nil {
+		return NATBehavior{}, err
+	}
+
+	return behavior, nil
+}
+
+// Punchable reports whether a direct path can be punched between two peers behind NATs with the given behaviors.
+// Punching fails if the NAT of one peer allocates a new public address towards the other, and the NAT of the other
+// only lets in the address and port it sent to. Unknown behaviors are assumed to be punchable
+func Punchable(local, remote NATBehavior) bool {
+	if local.Symmetric() && remote.Symmetric() {
+		return false
+	}
+
+	if local.Symmetric() && remote.Filtering == AddressAndPortDependent {
+		return false
+	}
+
+	return !remote.Symmetric() || local.Filtering != AddressAndPortDependent
+}
@@ -0,0 +1,330 @@
+package natcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pion/stun"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+// Flags of the CHANGE-REQUEST attribute (RFC 5780, section 7.2)
+const (
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+// errNoResponse is returned when a request is not answered, which is the expected outcome of some filtering tests
+var errNoResponse = errors.New("no response from STUN server")
+
+// response holds the attributes of a Binding response relevant to the tests
+type response struct {
+	mapped *net.UDPAddr
+	other  *net.UDPAddr
+}
+
+// Checker discovers the behavior of the NAT in front of a socket. The tests of RFC 5780 require a STUN server with two
+// public IPs that announces the alternate one in the OTHER-ADDRESS attribute, which most public STUN servers do not.
+// Without such a server the mapping behavior is estimated by comparing the public addresses reported by several
+// servers, and the filtering behavior is left unknown
+type Checker struct {
+	servers           []string
+	retransmitTimeout time.Duration
+	maxRetransmits    int
+	logger            logr.Logger
+}
+
+func New(servers []string, opts ...Option) *Checker {
+	cfg := newDefaultConfig()
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &Checker{
+		servers:           servers,
+		retransmitTimeout: cfg.retransmitTimeout,
+		maxRetransmits:    cfg.maxRetransmits,
+		logger:            cfg.logger,
+	}
+}
+
+// Discover runs the mapping and filtering tests through conn, which must not be read by anyone else until Discover
+// returns. The first server supporting RFC 5780 is used, falling back to comparing every server otherwise
+func (c *Checker) Discover(ctx context.Context, conn *net.UDPConn) (*NATBehavior, error) {
+	if len(c.servers) == 0 {
+		return nil, wgerrors.Permanent(fmt.Errorf("no STUN servers configured"))
+	}
+
+	// The socket is handed to the tunnel afterwards, which must not inherit the deadline
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	var mapped []*net.UDPAddr
+	var lastErr error
+
+	for _, server := range c.servers {
+		serverAddr, err := net.ResolveUDPAddr(util.UDP4Protocol, server)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to resolve STUN server %q: %w", server, err)
+			continue
+		}
+
+		// Test I: the public address as seen by the primary address of the server
+		res, err := c.request(ctx, conn, serverAddr, 0)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			lastErr = err
+			continue
+		}
+
+		if res.other != nil {
+			return c.discover(ctx, conn, serverAddr, res)
+		}
+
+		mapped = append(mapped, res.mapped)
+	}
+
+	if len(mapped) == 0 {
+		return nil, wgerrors.Temporary(fmt.Errorf("all STUN servers failed: %w", lastErr))
+	}
+
+	behavior := &NATBehavior{PublicAddr: mapped[0], Mapping: compareMappings(conn, mapped)}
+	c.logger.Info("Estimated NAT behavior without RFC 5780 server", "behavior", behavior.String(), "publicAddr", behavior.PublicAddr.String())
+
+	return behavior, nil
+}
+
+// discover runs the mapping and filtering tests against a server supporting RFC 5780, given the response to test I
+func (c *Checker) discover(ctx context.Context, conn *net.UDPConn, server *net.UDPAddr, first *response) (*NATBehavior, error) {
+	behavior := &NATBehavior{PublicAddr: first.mapped}
+
+	mapping, err := c.mappingBehavior(ctx, conn, server, first)
+	if err != nil {
+		return nil, err
+	}
+	behavior.Mapping = mapping
+
+	filtering, err := c.filteringBehavior(ctx, conn, server)
+	if err != nil {
+		return nil, err
+	}
+	behavior.Filtering = filtering
+
+	c.logger.Info("Discovered NAT behavior", "behavior", behavior.String(), "publicAddr", behavior.PublicAddr.String(), "server", server.String())
+
+	return behavior, nil
+}
+
+// mappingBehavior runs the mapping tests of RFC 5780, section 4.3. The public address is compared when sending from
+// the same socket to the alternate IP of the server, and then to its alternate IP and port
+func (c *Checker) mappingBehavior(ctx context.Context, conn *net.UDPConn, server *net.UDPAddr, first *response) (Behavior, error) {
+	// No NAT at all if the public address is the address of the socket
+	if isLocal(conn, first.mapped) {
+		return EndpointIndependent, nil
+	}
+
+	// Test II: alternate IP, primary port
+	second, err := c.request(ctx, conn, &net.UDPAddr{IP: first.other.IP, Port: server.Port}, 0)
+	if err != nil {
+		return c.unknownOnNoResponse(ctx, "mapping test II", err)
+	}
+
+	if sameAddr(second.mapped, first.mapped) {
+		return EndpointIndependent, nil
+	}
+
+	// Test III: alternate IP, alternate port
+	third, err := c.request(ctx, conn, first.other, 0)
+	if err != nil {
+		return c.unknownOnNoResponse(ctx, "mapping test III", err)
+	}
+
+	if sameAddr(third.mapped, second.mapped) {
+		return AddressDependent, nil
+	}
+
+	return AddressAndPortDependent, nil
+}
+
+// filteringBehavior runs the filtering tests of RFC 5780, section 4.4. The server is asked to answer from its alternate
+// IP and port, and then from its alternate port only, the first answer that makes it through tells the filtering
+func (c *Checker) filteringBehavior(ctx context.Context, conn *net.UDPConn, server *net.UDPAddr) (Behavior, error) {
+	// Test II: answer from the alternate IP and port
+	_, err := c.request(ctx, conn, server, changeIP|changePort)
+	if err == nil {
+		return EndpointIndependent, nil
+	}
+	if !errors.Is(err, errNoResponse) {
+		return c.unknownOnNoResponse(ctx, "filtering test II", err)
+	}
+
+	// Test III: answer from the alternate port
+	_, err = c.request(ctx, conn, server, changePort)
+	if err == nil {
+		return AddressDependent, nil
+	}
+	if !errors.Is(err, errNoResponse) {
+		return c.unknownOnNoResponse(ctx, "filtering test III", err)
+	}
+
+	return AddressAndPortDependent, nil
+}
+
+// unknownOnNoResponse returns the error of a test if ctx is done, otherwise the behavior is left unknown so that the
+// rest of the tests still run
+func (c *Checker) unknownOnNoResponse(ctx context.Context, test string, err error) (Behavior, error) {
+	if ctx.Err() != nil {
+		return BehaviorUnknown, ctx.Err()
+	}
+
+	c.logger.Info("NAT behavior test failed, leaving it unknown", "test", test, "reason", err.Error())
+
+	return BehaviorUnknown, nil
+}
+
+// request sends a Binding request to server with the given CHANGE-REQUEST flags and waits for the response with the
+// same transaction ID, retransmitting it with an exponential backoff. Responses may come from any address, since the
+// server might have been asked to answer from its alternate one
+func (c *Checker) request(ctx context.Context, conn *net.UDPConn, server *net.UDPAddr, change uint32) (*response, error) {
+	setters := []stun.Setter{stun.TransactionID, stun.BindingRequest}
+	if change != 0 {
+		setters = append(setters, changeRequest(change))
+	}
+	setters = append(setters, stun.Fingerprint)
+
+	req, err := stun.Build(setters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build STUN request: %w", err)
+	}
+
+	buf := make([]byte, util.UDPMaxBuffer)
+	rto := c.retransmitTimeout
+
+	for range c.maxRetransmits + 1 {
+		if _, err = conn.WriteToUDP(req.Raw, server); err != nil {
+			return nil, fmt.Errorf("failed to send STUN request to %s: %w", server, err)
+		}
+
+		deadline := time.Now().Add(rto)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		_ = conn.SetReadDeadline(deadline)
+
+		res, errRead := readResponse(conn, buf, req.TransactionID)
+		if errRead == nil {
+			return res, nil
+		}
+		if !wgerrors.IsTimeout(errRead) {
+			return nil, errRead
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		rto *= 2
+	}
+
+	return nil, fmt.Errorf("%w %s", errNoResponse, server)
+}
+
+// readResponse reads conn until the response to the transaction arrives or the read deadline expires. Any other packet
+// is dropped
+func readResponse(conn *net.UDPConn, buf []byte, transactionID [stun.TransactionIDSize]byte) (*response, error) {
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if !stun.IsMessage(buf[:n]) {
+			continue
+		}
+
+		msg := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+		if msg.Decode() != nil || msg.TransactionID != transactionID || msg.Type != stun.BindingSuccess {
+			continue
+		}
+
+		if util.CheckFingerprint(msg) != nil {
+			continue
+		}
+
+		var xorAddr stun.XORMappedAddress
+		if errAddr := xorAddr.GetFrom(msg); errAddr != nil {
+			continue
+		}
+
+		res := &response{mapped: &net.UDPAddr{IP: util.NormalizeIP(xorAddr.IP), Port: xorAddr.Port}}
+
+		var other stun.OtherAddress
+		if other.GetFrom(msg) == nil {
+			res.other = &net.UDPAddr{IP: util.NormalizeIP(other.IP), Port: other.Port}
+		}
+
+		return res, nil
+	}
+}
+
+// changeRequest sets the CHANGE-REQUEST attribute with the given flags
+func changeRequest(flags uint32) stun.Setter {
+	return stun.RawAttribute{
+		Type:  stun.AttrChangeRequest,
+		Value: []byte{byte(flags >> 24), byte(flags >> 16), byte(flags >> 8), byte(flags)},
+	}
+}
+
+// compareMappings estimates the mapping behavior from the public addresses reported by different servers. Dependent
+// mappings cannot be told apart this way, so the most restrictive one is assumed
+func compareMappings(conn *net.UDPConn, mapped []*net.UDPAddr) Behavior {
+	if isLocal(conn, mapped[0]) {
+		return EndpointIndependent
+	}
+
+	if len(mapped) < 2 {
+		return BehaviorUnknown
+	}
+
+	for _, addr := range mapped[1:] {
+		if !sameAddr(addr, mapped[0]) {
+			return AddressAndPortDependent
+		}
+	}
+
+	return EndpointIndependent
+}
+
+// isLocal reports whether addr is the address of conn, which means that there is no NAT in front of it
+func isLocal(conn *net.UDPConn, addr *net.UDPAddr) bool {
+	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || localAddr.Port != addr.Port {
+		return false
+	}
+
+	if !localAddr.IP.IsUnspecified() {
+		return localAddr.IP.Equal(addr.IP)
+	}
+
+	for _, ip := range util.LocalIPs(false) {
+		if ip.Equal(addr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,46 @@
+package natcheck
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// The filtering tests wait for responses that might never arrive, so requests are retransmitted fewer times than
+	// in other STUN transactions
+	defaultRetransmitTimeout = 300 * time.Millisecond
+	defaultMaxRetransmits    = 2
+)
+
+type config struct {
+	retransmitTimeout time.Duration
+	maxRetransmits    int
+	logger            logr.Logger
+}
+
+type Option func(*config)
+
+func newDefaultConfig() *config {
+	return &config{
+		retransmitTimeout: defaultRetransmitTimeout,
+		maxRetransmits:    defaultMaxRetransmits,
+		logger:            logr.Discard(),
+	}
+}
+
+// WithRetransmits sets the number of retransmissions of every request before taking it as unanswered, together with
+// the initial retransmission timeout, which doubles after every retransmission
+func WithRetransmits(retransmits int, timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxRetransmits = retransmits
+		cfg.retransmitTimeout = timeout
+	}
+}
+
+// WithLogger sets the logger to use for logging. The logger must implement the logr.Logger interface
+func WithLogger(logger logr.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
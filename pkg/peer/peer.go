@@ -6,4 +6,8 @@ type Info struct {
 	PublicKey  string
 	Endpoint   *net.UDPAddr
 	AllowedIPs []net.IPNet
+	// PresharedKey is the optional WireGuard pre-shared key used with the peer, encoded in base64
+	PresharedKey string
+	// Relay carries the traffic towards the peer if it can only be reached through a relay server, nil otherwise
+	Relay Relay
 }
@@ -0,0 +1,34 @@
+package peer
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	presharedKeyLen  = 32
+	presharedKeySalt = "wg-punch preshared key"
+)
+
+// DerivePresharedKey derives the WireGuard pre-shared key of the session between two peers from a secret shared by
+// both of them. The peer IDs are sorted before being mixed in, so both peers derive the same key regardless of which
+// one is local. The key is returned encoded in base64
+func DerivePresharedKey(secret []byte, peerID, otherPeerID string) (string, error) {
+	if len(secret) == 0 {
+		return "", fmt.Errorf("shared secret must not be empty")
+	}
+
+	ids := []string{peerID, otherPeerID}
+	sort.Strings(ids)
+
+	key, err := hkdf.Key(sha256.New, secret, []byte(presharedKeySalt), strings.Join(ids, "\x00"), presharedKeyLen)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive preshared key: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
@@ -0,0 +1,16 @@
+package peer
+
+import "net"
+
+// Relay carries the traffic exchanged with remote peers that can only be reached through a relay server. The relay
+// talks to its server through the socket of the tunnel, so whoever reads the socket hands the packets received from
+// the server to Unwrap
+type Relay interface {
+	// Server returns the address of the relay server
+	Server() *net.UDPAddr
+	// Wrap encapsulates a packet addressed to a remote peer so that it can be sent to the relay server
+	Wrap(packet []byte, to *net.UDPAddr) ([]byte, error)
+	// Unwrap decapsulates a packet received from the relay server and returns the remote peer it comes from. ok is
+	// false if the packet was addressed to the relay itself, like the responses to its requests
+	Unwrap(packet []byte) (payload []byte, from *net.UDPAddr, ok bool)
+}
@@ -0,0 +1,93 @@
+package puncher
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	mappingIndependent = "independent"
+	mappingRandom      = "random"
+	mappingDeltaPrefix = "delta:"
+
+	// maxPredictableDelta bounds the difference between consecutive ports that is still taken as a sequential
+	// allocation, larger differences are usually caused by other hosts sharing the NAT or by random allocation
+	maxPredictableDelta = 64
+)
+
+// Mapping describes how the NAT in front of a socket allocates public ports for new destinations (RFC 4787, section
+// 4.1). NATs with endpoint-independent mapping keep the same public port for every destination and are punched
+// directly, while symmetric NATs allocate a new port for every destination, which must be predicted by the remote peer
+type Mapping struct {
+	// Delta is the difference between the ports allocated for consecutive destinations. It is 0 if the NAT keeps the
+	// same port for every destination
+	Delta int
+	// Random is set if the allocated ports follow no pattern, so they can only be guessed
+	Random bool
+}
+
+// Symmetric reports whether the NAT allocates a new port for every destination
+func (m Mapping) Symmetric() bool {
+	return m.Delta != 0 || m.Random
+}
+
+// String encodes the mapping in order to publish it in the rendezvous backend
+func (m Mapping) String() string {
+	switch {
+	case m.Random:
+		return mappingRandom
+	case m.Delta != 0:
+		return fmt.Sprintf("%s%+d", mappingDeltaPrefix, m.Delta)
+	default:
+		return mappingIndependent
+	}
+}
+
+// ParseMapping decodes a mapping encoded via Mapping.String
+func ParseMapping(s string) (Mapping, error) {
+	switch {
+	case s == mappingIndependent:
+		return Mapping{}, nil
+	case s == mappingRandom:
+		return Mapping{Random: true}, nil
+	case strings.HasPrefix(s, mappingDeltaPrefix):
+		delta, err := strconv.Atoi(strings.TrimPrefix(s, mappingDeltaPrefix))
+		if err != nil || delta == 0 {
+			return Mapping{}, fmt.Errorf("invalid mapping %q", s)
+		}
+		return Mapping{Delta: delta}, nil
+	default:
+		return Mapping{}, fmt.Errorf("unknown mapping %q", s)
+	}
+}
+
+// measureMapping infers the mapping of a NAT from the public addresses it allocated for consecutive destinations, in
+// order of allocation. NATs that change the public IP between destinations cannot be predicted either
+func measureMapping(mapped []*net.UDPAddr) Mapping {
+	if len(mapped) < 2 {
+		return Mapping{}
+	}
+
+	delta := mapped[1].Port - mapped[0].Port
+	for i := 1; i < len(mapped); i++ {
+		if !mapped[i].IP.Equal(mapped[0].IP) || mapped[i].Port-mapped[i-1].Port != delta {
+			return Mapping{Random: true}
+		}
+	}
+
+	if abs(delta) > maxPredictableDelta {
+		return Mapping{Random: true}
+	}
+
+	return Mapping{Delta: delta}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
@@ -8,6 +8,7 @@ import (
 
 const (
 	defaultPuncherInterval = 300 * time.Millisecond
+	defaultAnswerTimeout   = 5 * time.Second
 
 	defaultSTUNServer1 = "stun.l.google.com:19302"
 	defaultSTUNServer2 = "stun1.l.google.com:19302"
@@ -15,7 +16,10 @@ const (
 
 type config struct {
 	puncherInterval time.Duration
+	answerTimeout   time.Duration
 	stunServers     []string
+	poolSize        int
+	predictedPorts  int
 	logger          logr.Logger
 }
 
@@ -24,6 +28,7 @@ type Option func(*config)
 func newDefaultConfig() *config {
 	return &config{
 		puncherInterval: defaultPuncherInterval,
+		answerTimeout:   defaultAnswerTimeout,
 		stunServers:     []string{defaultSTUNServer1, defaultSTUNServer2},
 		logger:          logr.Discard(),
 	}
@@ -36,13 +41,36 @@ func WithPuncherInterval(interval time.Duration) Option {
 	}
 }
 
-// WithSTUNServers sets the STUN servers to use for hole punching. The servers must be reachable
+// WithAnswerTimeout sets how long to wait for one of the candidates of the remote peer to answer before falling back
+// to the first candidate
+func WithAnswerTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.answerTimeout = timeout
+	}
+}
+
+// WithSTUNServers sets the STUN servers to use for hole punching. The servers must be reachable. An empty list skips
+// public address discovery, which is only useful with LAN rendezvous backends like mDNS
 func WithSTUNServers(servers []string) Option {
 	return func(cfg *config) {
 		cfg.stunServers = servers
 	}
 }
 
+// WithPortPrediction enables punching peers behind symmetric NATs, which allocate a new public port for every
+// destination. The allocation pattern of the local NAT is measured through the STUN servers, which requires at least
+// two of them, and published for the remote peer. When either side is symmetric the remote peer is punched from a pool
+// of local sockets, each of them opening its own mapping in the local NAT, towards ports predicted after the pattern of
+// the remote NAT, or random ones if it follows none. By the birthday paradox one of the mappings opened on each side is
+// likely to be hit after a few rounds. Sensible values are 64 sockets and 256 ports, 0 disables port prediction, which is
+// the default
+func WithPortPrediction(sockets, ports int) Option {
+	return func(cfg *config) {
+		cfg.poolSize = sockets
+		cfg.predictedPorts = ports
+	}
+}
+
 // WithLogger sets the logger to use for logging. The logger must implement the logr.Logger interface
 func WithLogger(logger logr.Logger) Option {
 	return func(cfg *config) {
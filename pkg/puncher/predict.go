@@ -0,0 +1,88 @@
+package puncher
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const (
+	minPredictedPort = 1024
+	maxPredictedPort = 65535
+)
+
+// openPool returns the sockets the remote peer is punched from, starting with conn. If port prediction is enabled and
+// the local NAT is symmetric a pool of sockets is opened next to conn, so that the NAT allocates a mapping for each of
+// them. The socket that gets the first answer keeps punching the address it came from and the rest of the pool is
+// closed. The remote peer might have settled on another mapping of the pool in the meantime, but since the answer
+// proves that the path from the winning socket is open, WireGuard roams to it as soon as the first handshake arrives
+func (p *puncher) openPool(conn *net.UDPConn, target Target) ([]*net.UDPConn, error) {
+	pool := []*net.UDPConn{conn}
+	if p.poolSize <= 0 || target.Local == nil || !target.Local.Symmetric() {
+		return pool, nil
+	}
+
+	for len(pool) < p.poolSize {
+		socket, err := net.ListenUDP(util.UDPProtocol, util.DualStackAddr(0))
+		if err != nil {
+			closePool(pool, nil)
+			return nil, fmt.Errorf("failed to open socket for port prediction: %w", err)
+		}
+		pool = append(pool, socket)
+	}
+
+	return pool, nil
+}
+
+// candidates returns the addresses to punch on every round. If port prediction is enabled and the NAT of the remote peer
+// is symmetric, the ports it is about to allocate towards the local peer are punched next to the candidates, and
+// answers are accepted from any port of its public IP, see readAnswer
+func (p *puncher) candidates(target Target) func() []*net.UDPAddr {
+	if p.poolSize <= 0 || target.Remote == nil || !target.Remote.Symmetric() {
+		return func() []*net.UDPAddr { return target.Candidates }
+	}
+
+	// Only the public endpoint of the remote peer is allocated by its NAT, the rest of the candidates are local ones
+	endpoint := target.Candidates[0]
+
+	return func() []*net.UDPAddr {
+		return append(append([]*net.UDPAddr(nil), target.Candidates...), predictedAddrs(endpoint, *target.Remote, p.predictedPorts)...)
+	}
+}
+
+// predictedAddrs returns the addresses that the NAT of the remote peer is expected to allocate next for new
+// destinations, starting after its public endpoint. Random ports are drawn if its allocation follows no pattern
+func predictedAddrs(endpoint *net.UDPAddr, mapping Mapping, n int) []*net.UDPAddr {
+	if !mapping.Symmetric() {
+		return nil
+	}
+
+	addrs := make([]*net.UDPAddr, 0, n)
+
+	for k := 1; len(addrs) < n; k++ {
+		port := endpoint.Port + mapping.Delta*k
+		if mapping.Random {
+			port = minPredictedPort + rand.IntN(maxPredictedPort-minPredictedPort+1) //nolint:gosec // ports are guessed, not secret
+		}
+
+		if port < minPredictedPort || port > maxPredictedPort {
+			break
+		}
+
+		addrs = append(addrs, &net.UDPAddr{IP: endpoint.IP, Port: port})
+	}
+
+	return addrs
+}
+
+// closePool closes every socket of the pool opened for port prediction except keep. The first socket is the one passed
+// to Punch, which belongs to the caller
+func closePool(pool []*net.UDPConn, keep *net.UDPConn) {
+	for _, socket := range pool[1:] {
+		if socket != keep {
+			_ = socket.Close()
+		}
+	}
+}
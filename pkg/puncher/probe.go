@@ -0,0 +1,162 @@
+package puncher
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Punch frames are made of PunchMessage, the frame type, a random nonce and a MAC over all of them and the public key of
+// the sender. PunchMessage is demux.PunchPrefix, so that demux.Classify tells them apart from WireGuard and STUN messages
+const (
+	frameProbe byte = 1
+	frameAck   byte = 2
+
+	nonceLen       = 16
+	frameHeaderLen = len(PunchMessage) + 1 + nonceLen
+	frameLen       = frameHeaderLen + sha256.Size
+
+	// punchKeyLabel separates the key of the frames from any other use of the keys it is derived from
+	punchKeyLabel = "wg-punch frame key v1"
+
+	// maxPendingProbes bounds the probes awaiting an acknowledgement, the oldest ones are forgotten first
+	maxPendingProbes = 4096
+)
+
+type nonce [nonceLen]byte
+
+// handshake authenticates the frames exchanged with the remote peer while punching. Every round of probes carries a
+// fresh nonce, which the remote peer echoes back in an acknowledgement. Frames are MACed with a key derived from the
+// WireGuard public keys of both peers, together with the public key of the sender, so probes reflected back at their
+// sender are told apart from the probes of the remote peer. Frames with a wrong MAC and acknowledgements of nonces that
+// were never sent, or already acknowledged, are dropped. Public keys are handed out by the rendezvous server, so the key
+// keeps out stray traffic and attackers that do not know both of them, while the peer itself is authenticated by the
+// WireGuard handshake afterwards. Mixing in the pre-shared key, if any, keeps out everyone else as well
+type handshake struct {
+	key       []byte
+	localKey  string
+	remoteKey string
+
+	mu sync.Mutex
+	// probes maps the nonce of every probe awaiting an acknowledgement to the time it was sent, order keeps the nonces
+	// in the order they were sent in
+	probes map[nonce]time.Time
+	order  []nonce
+}
+
+// newHandshake returns the handshake with the remote peer of target, nil unless the public keys of both peers are known
+func newHandshake(target Target) *handshake {
+	if target.LocalKey == "" || target.RemoteKey == "" {
+		return nil
+	}
+
+	return &handshake{
+		key:       punchKey(target.LocalKey, target.RemoteKey, target.PresharedKey),
+		localKey:  target.LocalKey,
+		remoteKey: target.RemoteKey,
+		probes:    make(map[nonce]time.Time),
+	}
+}
+
+// punchKey derives the key of the frames from the public keys of both peers, sorted so that both of them derive the same
+// one, and the pre-shared key
+func punchKey(localKey, remoteKey, presharedKey string) []byte {
+	keys := []string{localKey, remoteKey}
+	slices.Sort(keys)
+
+	mac := hmac.New(sha256.New, []byte(punchKeyLabel))
+	for _, key := range append(keys, presharedKey) {
+		mac.Write([]byte(key))
+		mac.Write([]byte{0})
+	}
+
+	return mac.Sum(nil)
+}
+
+// probe returns a probe with a fresh nonce, which is remembered until acknowledged
+func (h *handshake) probe() ([]byte, error) {
+	var n nonce
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate probe nonce: %w", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.order) == maxPendingProbes {
+		delete(h.probes, h.order[0])
+		h.order = h.order[1:]
+	}
+	h.probes[n] = time.Now()
+	h.order = append(h.order, n)
+
+	return h.frame(frameProbe, n), nil
+}
+
+// ack returns the acknowledgement of the probe with the given nonce
+func (h *handshake) ack(n nonce) []byte {
+	return h.frame(frameAck, n)
+}
+
+// acknowledged forgets the probe with the given nonce and returns the time elapsed since it was sent, false if no such
+// probe is awaiting an acknowledgement
+func (h *handshake) acknowledged(n nonce) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sent, found := h.probes[n]
+	if !found {
+		return 0, false
+	}
+
+	delete(h.probes, n)
+	h.order = slices.DeleteFunc(h.order, func(pending nonce) bool { return pending == n })
+
+	return time.Since(sent), true
+}
+
+// verify checks that packet is a frame sent by the remote peer and returns its type and nonce
+func (h *handshake) verify(packet []byte) (byte, nonce, bool) {
+	var n nonce
+
+	if len(packet) != frameLen || !bytes.HasPrefix(packet, []byte(PunchMessage)) {
+		return 0, n, false
+	}
+
+	kind := packet[len(PunchMessage)]
+	if kind != frameProbe && kind != frameAck {
+		return 0, n, false
+	}
+
+	if !hmac.Equal(packet[frameHeaderLen:], frameMAC(h.key, packet[:frameHeaderLen], h.remoteKey)) {
+		return 0, n, false
+	}
+
+	copy(n[:], packet[len(PunchMessage)+1:frameHeaderLen])
+
+	return kind, n, true
+}
+
+// frame encodes a frame sent by the local peer
+func (h *handshake) frame(kind byte, n nonce) []byte {
+	frame := make([]byte, 0, frameLen)
+	frame = append(frame, PunchMessage...)
+	frame = append(frame, kind)
+	frame = append(frame, n[:]...)
+
+	return append(frame, frameMAC(h.key, frame, h.localKey)...)
+}
+
+// frameMAC computes the MAC of the header of a frame sent by the peer with the given public key
+func frameMAC(key, header []byte, sender string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header)
+	mac.Write([]byte(sender))
+
+	return mac.Sum(nil)
+}
@@ -5,25 +5,96 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
 
+	"github.com/yago-123/wg-punch/pkg/demux"
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
 	"github.com/yago-123/wg-punch/pkg/util"
 )
 
 const (
-	PunchMessage = "punch"
+	PunchMessage = demux.PunchPrefix
+
+	answerPollInterval = 200 * time.Millisecond
+
+	// ackLingerRounds is how many punch intervals a confirmed path is kept reading for the probes of the remote peer
+	ackLingerRounds = 2
 )
 
+// Target describes the remote peer to punch
+type Target struct {
+	// Candidates are the addresses the remote peer might be reachable at, in order of preference. The first one is
+	// used if none of them answers, unless the probes are authenticated, see LocalKey
+	Candidates []*net.UDPAddr
+	// Passive skips waiting for an answer, so the first candidate is picked right away. It must be set when conn is
+	// already being read by someone else, like a running tunnel
+	Passive bool
+	// Local and Remote are the mappings of the NATs in front of the local and the remote peer, if known. Ports are
+	// predicted if either of them is symmetric, see WithPortPrediction
+	Local  *Mapping
+	Remote *Mapping
+	// LocalKey and RemoteKey are the WireGuard public keys of the local and the remote peer. If both are set the probes
+	// are authenticated and only an acknowledged probe opens the path, otherwise any packet from a candidate does
+	LocalKey  string
+	RemoteKey string
+	// PresharedKey is the WireGuard pre-shared key of the peers, if any, which is mixed into the key of the probes
+	PresharedKey string
+	// Demux routes the datagrams arriving through conn in passive mode, if the tunnel reading conn shares them. The
+	// probes of the remote peer are acknowledged through it, which the remote peer requires to confirm the path when it
+	// punches actively. Without it the probes are left unanswered
+	Demux *demux.Demux
+}
+
+// Result describes the path opened towards the remote peer
+type Result struct {
+	// Addr is the candidate that answered first
+	Addr *net.UDPAddr
+	// Conn is the socket the candidate answered through. It differs from the socket passed to Punch if the answer
+	// arrived through another socket of the pool opened for port prediction, in which case the path only exists for
+	// Conn and the socket passed to Punch is left for the caller to close
+	Conn *net.UDPConn
+	// Verified reports whether the remote peer acknowledged a probe sent through Conn, which proves that the path works
+	// both ways. It is only false in passive mode and without public keys, Punch fails otherwise
+	Verified bool
+	// RTT is the round trip time of the acknowledged probe, zero unless Verified
+	RTT time.Duration
+	// Cancel stops the punching process, it must be called once the tunnel is started
+	Cancel context.CancelFunc
+}
+
 type Puncher interface {
-	Punch(ctx context.Context, conn *net.UDPConn, remoteHint *net.UDPAddr) (context.CancelFunc, error)
-	PublicAddr(ctx context.Context, conn *net.UDPConn) (*net.UDPAddr, error)
+	Punch(ctx context.Context, conn *net.UDPConn, target Target) (*Result, error)
+	// PublicAddr returns the public address of conn, which might be a socket shared with a running tunnel through a
+	// demux.Conn
+	PublicAddr(ctx context.Context, conn util.UDPConn) (*net.UDPAddr, error)
+}
+
+// Predictor is implemented by punchers able to measure how the NAT in front of a socket allocates public ports, which
+// is required to punch peers behind symmetric NATs
+type Predictor interface {
+	// PublicMapping is like PublicAddr but returns the mapping of the NAT in front of conn as well, which is nil if
+	// port prediction is disabled or the mapping could not be measured
+	PublicMapping(ctx context.Context, conn *net.UDPConn) (*net.UDPAddr, *Mapping, error)
+}
+
+// DualStack is implemented by punchers able to discover the public IPv6 address of dual-stack sockets, next to the
+// address returned by PublicAddr
+type DualStack interface {
+	// PublicAddr6 returns the public IPv6 address of conn. Hosts with a global IPv6 address are usually reachable at
+	// it without punching, except for the firewalls that only let answers in
+	PublicAddr6(ctx context.Context, conn *net.UDPConn) (*net.UDPAddr, error)
 }
 
 type puncher struct {
 	puncherInterval time.Duration
+	answerTimeout   time.Duration
 	stunServers     []string
+	poolSize        int
+	predictedPorts  int
 	logger          logr.Logger
 }
 
@@ -36,55 +107,356 @@ func NewPuncher(opts ...Option) Puncher {
 
 	return &puncher{
 		puncherInterval: cfg.puncherInterval,
+		answerTimeout:   cfg.answerTimeout,
 		stunServers:     cfg.stunServers,
+		poolSize:        cfg.poolSize,
+		predictedPorts:  cfg.predictedPorts,
 		logger:          cfg.logger,
 	}
 }
 
-// Punch attempts to establish a UDP connection with the remote peer by sending empty UDP packets. The return value is
-// a cancel function that must be called to stop the spawned punching process that happen in the background
-func (p *puncher) Punch(ctx context.Context, conn *net.UDPConn, remoteHint *net.UDPAddr) (context.CancelFunc, error) {
-	// If remoteHint is nil, return an error
-	if remoteHint == nil {
-		return func() {}, fmt.Errorf("remote hint required for punching")
+// Punch attempts to establish a UDP connection with the remote peer by sending probes to every candidate of the target,
+// and waits until one of them answers. If the public keys of both peers are known the probes are authenticated and Punch
+// only returns once the remote peer acknowledged one of them, which proves that the path works both ways, see handshake,
+// and fails with ErrPathUnconfirmed if none is acknowledged within the answer timeout.
+// The remote peer is answered meanwhile, so that it confirms the path as well. Once a candidate answers the punching
+// process keeps going in the background towards that candidate only, the returned cancel function must be called to
+// stop it
+func (p *puncher) Punch(ctx context.Context, conn *net.UDPConn, target Target) (*Result, error) {
+	if len(target.Candidates) == 0 {
+		return nil, wgerrors.Permanent(fmt.Errorf("at least one candidate is required for punching"))
 	}
 
 	if conn == nil {
-		return func() {}, fmt.Errorf("UDP connection must be initialized in order to punch remote host")
+		return nil, wgerrors.Permanent(fmt.Errorf("UDP connection must be initialized in order to punch remote host"))
+	}
+
+	hs := newHandshake(target)
+
+	if target.Passive {
+		p.logger.Info("punching remote host", "candidates", target.Candidates, "passive", true, "authenticated", hs != nil)
+
+		ctxPunch, cancelPunch := context.WithCancel(ctx)
+
+		var selected atomic.Pointer[net.UDPAddr]
+		go p.spray(ctxPunch, conn, func() []*net.UDPAddr { return target.Candidates }, &selected, hs)
+
+		// Subscribe right away, so that no probe arriving after Punch returns is missed
+		if hs != nil && target.Demux != nil {
+			go p.acknowledge(ctxPunch, target.Demux.Listen(demux.ClassPunch), hs)
+		}
+
+		return &Result{Addr: target.Candidates[0], Conn: conn, Cancel: cancelPunch}, nil
+	}
+
+	pool, err := p.openPool(conn, target)
+	if err != nil {
+		return nil, err
 	}
 
-	p.logger.Info("punching remote host", "remoteHint", remoteHint.String())
+	p.logger.Info("punching remote host", "candidates", target.Candidates, "sockets", len(pool), "authenticated", hs != nil, "local", target.Local, "remote", target.Remote)
 
 	ctxPunch, cancelPunch := context.WithCancel(ctx)
 
-	// Try sending empty UDP packets to open NAT mappings
-	go func() {
-		ticker := time.NewTicker(p.puncherInterval)
-		defer ticker.Stop()
-
-		for {
-			select {
-			// This context might be triggered if the handshake timeout expires or if the cancel func is called,
-			// the cancel func must be called before the WireGuard tunnel is started so that the connection is
-			// managed by a single entity
-			case <-ctxPunch.Done():
+	var selected atomic.Pointer[net.UDPAddr]
+	candidates := p.candidates(target)
+	for _, socket := range pool {
+		go p.spray(ctxPunch, socket, candidates, &selected, hs)
+	}
+
+	winner, err := p.waitForAnswer(ctxPunch, pool, target, hs)
+	if err != nil {
+		cancelPunch()
+		closePool(pool, nil)
+		return nil, err
+	}
+
+	if winner == nil {
+		p.logger.Info("no candidate answered, falling back to the first one", "addr", target.Candidates[0].String())
+		winner = &answer{conn: conn, addr: target.Candidates[0]}
+	}
+
+	selected.Store(winner.addr)
+	closePool(pool, winner.conn)
+
+	p.logger.Info("remote host answered", "addr", winner.addr.String(), "local", winner.conn.LocalAddr().String(), "verified", winner.verified, "rtt", winner.rtt)
+
+	return &Result{Addr: winner.addr, Conn: winner.conn, RTT: winner.rtt, Verified: winner.verified, Cancel: cancelPunch}, nil
+}
+
+// spray sends probes to the candidates every punch interval until ctx is done. The candidates are retrieved again on
+// every round, and once a candidate is selected only that one is punched. Every round carries a fresh nonce if hs is not
+// nil, the literal PunchMessage is sent otherwise
+func (p *puncher) spray(ctx context.Context, conn *net.UDPConn, candidates func() []*net.UDPAddr, selected *atomic.Pointer[net.UDPAddr], hs *handshake) {
+	ticker := time.NewTicker(p.puncherInterval)
+	defer ticker.Stop()
+
+	for {
+		targets := candidates()
+		if addr := selected.Load(); addr != nil {
+			targets = []*net.UDPAddr{addr}
+		}
+
+		payload := []byte(PunchMessage)
+		if hs != nil {
+			probe, err := hs.probe()
+			if err != nil {
+				p.logger.Error(err, "failed to build probe")
+				return
+			}
+			payload = probe
+		}
+
+		for _, addr := range targets {
+			_, errConn := conn.WriteToUDP(payload, addr)
+
+			// The connection will be closed right before the WireGuard tunnel is started
+			if errors.Is(errConn, net.ErrClosed) {
 				return
-			case <-ticker.C:
-				_, errConn := conn.WriteToUDP([]byte(PunchMessage), remoteHint)
+			}
+		}
+
+		select {
+		// This context might be triggered if the handshake timeout expires or if the cancel func is called,
+		// the cancel func must be called before the WireGuard tunnel is started so that the connection is
+		// managed by a single entity
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// answer is a packet from the remote peer received through a socket of the pool
+type answer struct {
+	conn     *net.UDPConn
+	addr     *net.UDPAddr
+	rtt      time.Duration
+	verified bool
+}
+
+// waitForAnswer reads every socket of the pool until one of them gets an answer from the remote peer, see readAnswer.
+// If the probes are authenticated and none is acknowledged within the answer timeout it fails with ErrPathUnconfirmed,
+// even if probes of the remote peer arrived, since those only prove the path towards the local peer. nil is returned
+// if the probes are not authenticated and nothing arrived
+func (p *puncher) waitForAnswer(ctx context.Context, pool []*net.UDPConn, target Target, hs *handshake) (*answer, error) {
+	ctxWait, cancel := context.WithTimeout(ctx, p.answerTimeout)
+	defer cancel()
+
+	answers := make(chan answer, len(pool))
+	var heard atomic.Pointer[answer]
+	var wg sync.WaitGroup
+
+	for _, socket := range pool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if winner := p.readAnswer(ctxWait, socket, target, hs, &heard); winner != nil {
+				answers <- *winner
+				cancel()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// The sockets are handed to the tunnel afterwards, which must not inherit the deadline
+	for _, socket := range pool {
+		_ = socket.SetReadDeadline(time.Time{})
+	}
+
+	select {
+	case winner := <-answers:
+		return &winner, nil
+	default:
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if hs == nil {
+		return nil, nil
+	}
+
+	if probed := heard.Load(); probed != nil {
+		return nil, wgerrors.Temporary(fmt.Errorf("%w within %s, probes only arrived from %s", wgerrors.ErrPathUnconfirmed, p.answerTimeout, probed.addr))
+	}
+
+	return nil, wgerrors.Temporary(fmt.Errorf("%w within %s", wgerrors.ErrPathUnconfirmed, p.answerTimeout))
+}
+
+// readAnswer reads conn until the remote peer acknowledges one of the probes sent through it, and acknowledges the
+// probes of the remote peer meanwhile. Once acknowledged, it keeps reading for a couple of punch intervals unless a probe
+// has been acknowledged already, so that the remote peer gets to confirm the path too. The first address a valid probe
+// arrives from is stored in heard. Without handshake any packet from a candidate, or a punch packet from the public IP
+// of the remote peer if its NAT is symmetric, is taken as an answer. Returns nil if ctx is done or conn fails before
+func (p *puncher) readAnswer(ctx context.Context, conn *net.UDPConn, target Target, hs *handshake, heard *atomic.Pointer[answer]) *answer {
+	anyPort := p.poolSize > 0 && target.Remote != nil && target.Remote.Symmetric()
+	buf := make([]byte, util.UDPMaxBuffer)
+
+	var confirmed *answer
+	var lingerUntil time.Time
+	acked := false
+
+	for ctx.Err() == nil {
+		if confirmed != nil && (acked || time.Now().After(lingerUntil)) {
+			return confirmed
+		}
+
+		// Wake up regularly in order to notice the cancellation of ctx
+		_ = conn.SetReadDeadline(time.Now().Add(answerPollInterval))
+
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if wgerrors.IsTimeout(err) {
+				continue
+			}
+			return confirmed
+		}
+
+		addr, exact := remoteAddr(target.Candidates, from, anyPort)
+		if addr == nil {
+			continue
+		}
+
+		if hs == nil {
+			if exact || string(buf[:n]) == PunchMessage {
+				return &answer{conn: conn, addr: addr}
+			}
+			continue
+		}
+
+		kind, nonce, valid := hs.verify(buf[:n])
+		if !valid {
+			continue
+		}
+
+		switch kind {
+		case frameProbe:
+			// Echo the nonce so that the remote peer confirms its side of the path
+			if _, errAck := conn.WriteToUDP(hs.ack(nonce), from); errAck != nil {
+				continue
+			}
+			acked = true
+			heard.CompareAndSwap(nil, &answer{conn: conn, addr: addr})
+		case frameAck:
+			rtt, pending := hs.acknowledged(nonce)
+			if !pending || confirmed != nil {
+				continue
+			}
+			confirmed = &answer{conn: conn, addr: addr, rtt: rtt, verified: true}
+			lingerUntil = time.Now().Add(ackLingerRounds * p.puncherInterval)
+		}
+	}
+
+	return confirmed
+}
+
+// acknowledge answers the probes of the remote peer delivered through inbox until ctx is done, and closes inbox
+// afterwards. It stands for readAnswer in passive mode, where conn is read by the tunnel. Probes are answered whichever
+// address they arrive from, since the MAC already proves they were sent by the remote peer, whose NAT might map them to
+// a port that is not a candidate
+func (p *puncher) acknowledge(ctx context.Context, inbox *demux.Conn, hs *handshake) {
+	defer inbox.Close()
+
+	buf := make([]byte, util.UDPMaxBuffer)
+
+	for ctx.Err() == nil {
+		// Wake up regularly in order to notice the cancellation of ctx
+		_ = inbox.SetReadDeadline(time.Now().Add(answerPollInterval))
 
-				// The connection will be closed right before the WireGuard tunnel is started
-				if errors.Is(errConn, net.ErrClosed) {
-					return
-				}
+		n, from, err := inbox.ReadFromUDP(buf)
+		if err != nil {
+			if wgerrors.IsTimeout(err) {
+				continue
 			}
+			return
 		}
-	}()
 
-	return cancelPunch, nil
+		kind, nonce, valid := hs.verify(buf[:n])
+		if !valid || kind != frameProbe {
+			continue
+		}
+
+		// The write fails while the tunnel has no socket, the remote peer probes again on the next round
+		if _, errAck := inbox.WriteToUDP(hs.ack(nonce), from); errAck != nil {
+			p.logger.Error(errAck, "failed to acknowledge probe", "addr", from.String())
+		}
+	}
+}
+
+// remoteAddr returns the candidate from matches, exact is false if it only matches the public IP of the remote peer,
+// which is accepted from any port if anyPort is set. nil is returned if from is not the remote peer
+func remoteAddr(candidates []*net.UDPAddr, from *net.UDPAddr, anyPort bool) (*net.UDPAddr, bool) {
+	for _, candidate := range candidates {
+		if candidate.IP.Equal(from.IP) && candidate.Port == from.Port {
+			return candidate, true
+		}
+	}
+
+	if anyPort && from.IP.Equal(candidates[0].IP) {
+		return &net.UDPAddr{IP: util.NormalizeIP(from.IP), Port: from.Port}, false
+	}
+
+	return nil, false
 }
 
 // PublicAddr retrieves the public address of the local peer by using STUN servers. It is used to discover the public
-// IP and port of the local peer, which is necessary for establishing a connection with the remote peer
-func (p *puncher) PublicAddr(ctx context.Context, conn *net.UDPConn) (*net.UDPAddr, error) {
+// IP and port of the local peer, which is necessary for establishing a connection with the remote peer. If no STUN
+// servers are configured the local address of conn is returned instead
+func (p *puncher) PublicAddr(ctx context.Context, conn util.UDPConn) (*net.UDPAddr, error) {
+	if len(p.stunServers) == 0 {
+		localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			return nil, wgerrors.Permanent(fmt.Errorf("invalid local address type"))
+		}
+		return localAddr, nil
+	}
+
 	return util.GetPublicEndpoint(ctx, conn, p.stunServers)
 }
+
+// PublicMapping retrieves the public address of the local peer like PublicAddr, and measures the mapping of the NAT in
+// front of conn from the public addresses reported by every STUN server when port prediction is enabled. The address
+// reported by the last server is returned, since ports are predicted from the one allocated last
+func (p *puncher) PublicMapping(ctx context.Context, conn *net.UDPConn) (*net.UDPAddr, *Mapping, error) {
+	if p.poolSize <= 0 || len(p.stunServers) < 2 {
+		publicAddr, err := p.PublicAddr(ctx, conn)
+		return publicAddr, nil, err
+	}
+
+	mapped, err := util.GetPublicEndpoints(ctx, conn, p.stunServers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publicAddr := mapped[len(mapped)-1]
+	if len(mapped) < 2 {
+		return publicAddr, nil, nil
+	}
+
+	mapping := measureMapping(mapped)
+	p.logger.Info("measured NAT mapping", "mapping", mapping.String(), "addr", publicAddr.String())
+
+	return publicAddr, &mapping, nil
+}
+
+// PublicAddr6 retrieves the public IPv6 address of the local peer by using the IPv6 addresses of the STUN servers. If no
+// STUN servers are configured the local address of conn is returned instead, as long as it is an IPv6 address
+func (p *puncher) PublicAddr6(ctx context.Context, conn *net.UDPConn) (*net.UDPAddr, error) {
+	if !util.SupportsIPv6(conn) {
+		return nil, wgerrors.Permanent(fmt.Errorf("socket does not support IPv6"))
+	}
+
+	if len(p.stunServers) == 0 {
+		localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+		if !ok || localAddr.IP.IsUnspecified() {
+			return nil, wgerrors.Permanent(fmt.Errorf("no STUN servers configured"))
+		}
+		return localAddr, nil
+	}
+
+	return util.GetPublicEndpoint6(ctx, conn, p.stunServers)
+}
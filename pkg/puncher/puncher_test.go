@@ -0,0 +1,261 @@
+package puncher
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yago-123/wg-punch/pkg/demux"
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const (
+	aliceKey = "alice-public-key"
+	bobKey   = "bob-public-key"
+)
+
+// handshakes returns the handshakes of alice and bob with each other
+func handshakes(t *testing.T) (*handshake, *handshake) {
+	t.Helper()
+
+	alice := newHandshake(Target{LocalKey: aliceKey, RemoteKey: bobKey})
+	bob := newHandshake(Target{LocalKey: bobKey, RemoteKey: aliceKey})
+	if alice == nil || bob == nil {
+		t.Fatalf("expected handshakes with both public keys set")
+	}
+
+	return alice, bob
+}
+
+// probe returns a fresh probe of hs
+func probe(t *testing.T, hs *handshake) []byte {
+	t.Helper()
+
+	frame, err := hs.probe()
+	if err != nil {
+		t.Fatalf("failed to build probe: %v", err)
+	}
+
+	return frame
+}
+
+func TestHandshakeAcknowledgesProbe(t *testing.T) {
+	alice, bob := handshakes(t)
+
+	kind, n, valid := bob.verify(probe(t, alice))
+	if !valid || kind != frameProbe {
+		t.Fatalf("expected valid probe, got kind %d valid %v", kind, valid)
+	}
+
+	kind, acked, valid := alice.verify(bob.ack(n))
+	if !valid || kind != frameAck || acked != n {
+		t.Fatalf("expected valid acknowledgement of the probe, got kind %d valid %v", kind, valid)
+	}
+
+	if _, pending := alice.acknowledged(acked); !pending {
+		t.Fatalf("expected probe awaiting acknowledgement")
+	}
+}
+
+func TestHandshakeRejectsForgedFrames(t *testing.T) {
+	alice, bob := handshakes(t)
+
+	forged := probe(t, alice)
+	forged[len(forged)-1] ^= 0xff
+
+	// Someone who knows both public keys but not the pre-shared key of the peers
+	outsider := newHandshake(Target{LocalKey: aliceKey, RemoteKey: bobKey, PresharedKey: "guessed"})
+
+	truncated := probe(t, alice)
+
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{name: "forged MAC", frame: forged},
+		{name: "wrong key", frame: probe(t, outsider)},
+		{name: "truncated", frame: truncated[:len(truncated)-1]},
+		{name: "bare punch message", frame: []byte(PunchMessage)},
+		{name: "garbage", frame: make([]byte, frameLen)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, valid := bob.verify(tt.frame); valid {
+				t.Fatalf("expected frame rejected")
+			}
+		})
+	}
+}
+
+func TestHandshakeRejectsReflectedProbe(t *testing.T) {
+	alice, _ := handshakes(t)
+
+	// A NAT or attacker bouncing the probe back at alice must not make her believe bob answered
+	if _, _, valid := alice.verify(probe(t, alice)); valid {
+		t.Fatalf("expected reflected probe rejected")
+	}
+}
+
+func TestHandshakeRejectsReplayedAck(t *testing.T) {
+	alice, bob := handshakes(t)
+
+	_, n, _ := bob.verify(probe(t, alice))
+	ack := bob.ack(n)
+
+	_, acked, _ := alice.verify(ack)
+	if _, pending := alice.acknowledged(acked); !pending {
+		t.Fatalf("expected probe awaiting acknowledgement")
+	}
+
+	// The acknowledgement is still authentic, but its nonce has been consumed already
+	_, replayed, valid := alice.verify(ack)
+	if !valid {
+		t.Fatalf("expected replayed acknowledgement to carry a valid MAC")
+	}
+
+	if _, pending := alice.acknowledged(replayed); pending {
+		t.Fatalf("expected replayed acknowledgement rejected")
+	}
+
+	// Nonces that were never sent are rejected as well
+	if _, pending := alice.acknowledged(nonce{1}); pending {
+		t.Fatalf("expected acknowledgement of unknown nonce rejected")
+	}
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to bind socket: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+// serveTunnel stands for a tunnel that reads conn and dispatches every datagram through d, until the test ends
+func serveTunnel(t *testing.T, conn *net.UDPConn, d *demux.Demux) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, util.UDPMaxBuffer)
+		for ctx.Err() == nil {
+			_ = conn.SetReadDeadline(time.Now().Add(answerPollInterval))
+
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				continue
+			}
+			d.Dispatch(buf[:n], from)
+		}
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// punchSharedPeer punches alice actively from a fresh socket against bob, whose socket is read by a running tunnel
+func punchSharedPeer(t *testing.T, bobDemux bool) (*Result, error) {
+	t.Helper()
+
+	p := NewPuncher(WithPuncherInterval(20*time.Millisecond), WithAnswerTimeout(time.Second))
+
+	aliceConn, bobConn := listenLoopback(t), listenLoopback(t)
+	aliceAddr, bobAddr := aliceConn.LocalAddr().(*net.UDPAddr), bobConn.LocalAddr().(*net.UDPAddr)
+
+	d := demux.New(bobConn)
+	serveTunnel(t, bobConn, d)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	passive := Target{Candidates: []*net.UDPAddr{aliceAddr}, Passive: true, LocalKey: bobKey, RemoteKey: aliceKey}
+	if bobDemux {
+		passive.Demux = d
+	}
+
+	bob, err := p.Punch(ctx, bobConn, passive)
+	if err != nil {
+		t.Fatalf("failed to punch passively: %v", err)
+	}
+	defer bob.Cancel()
+
+	alice, err := p.Punch(ctx, aliceConn, Target{Candidates: []*net.UDPAddr{bobAddr}, LocalKey: aliceKey, RemoteKey: bobKey})
+	if alice != nil {
+		alice.Cancel()
+	}
+
+	return alice, err
+}
+
+func TestPunchConfirmedByPassivePeer(t *testing.T) {
+	res, err := punchSharedPeer(t, true)
+	if err != nil {
+		t.Fatalf("failed to punch: %v", err)
+	}
+
+	if !res.Verified {
+		t.Fatalf("expected path confirmed by the passive peer")
+	}
+}
+
+func TestPunchUnconfirmedWithoutAcknowledgements(t *testing.T) {
+	// Without the demultiplexer the probes reach the tunnel, which drops them
+	if _, err := punchSharedPeer(t, false); !errors.Is(err, wgerrors.ErrPathUnconfirmed) {
+		t.Fatalf("expected ErrPathUnconfirmed, got %v", err)
+	}
+}
+
+func TestPunchBothActive(t *testing.T) {
+	p := NewPuncher(WithPuncherInterval(20*time.Millisecond), WithAnswerTimeout(2*time.Second))
+
+	aliceConn, bobConn := listenLoopback(t), listenLoopback(t)
+	aliceAddr, bobAddr := aliceConn.LocalAddr().(*net.UDPAddr), bobConn.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type outcome struct {
+		res *Result
+		err error
+	}
+	bob := make(chan outcome, 1)
+
+	go func() {
+		res, err := p.Punch(ctx, bobConn, Target{Candidates: []*net.UDPAddr{aliceAddr}, LocalKey: bobKey, RemoteKey: aliceKey})
+		bob <- outcome{res: res, err: err}
+	}()
+
+	alice, err := p.Punch(ctx, aliceConn, Target{Candidates: []*net.UDPAddr{bobAddr}, LocalKey: aliceKey, RemoteKey: bobKey})
+	if err != nil {
+		t.Fatalf("alice failed to punch: %v", err)
+	}
+	defer alice.Cancel()
+
+	other := <-bob
+	if other.err != nil {
+		t.Fatalf("bob failed to punch: %v", other.err)
+	}
+	defer other.res.Cancel()
+
+	if !alice.Verified || !other.res.Verified {
+		t.Fatalf("expected path confirmed by both peers, got %v and %v", alice.Verified, other.res.Verified)
+	}
+
+	if alice.Addr.String() != bobAddr.String() || other.res.Addr.String() != aliceAddr.String() {
+		t.Fatalf("expected each peer to select the other, got %s and %s", alice.Addr, other.res.Addr)
+	}
+}
@@ -0,0 +1,285 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const readPollInterval = 100 * time.Millisecond
+
+// reply is a message sent by the server to the client itself
+type reply struct {
+	t       Type
+	payload []byte
+}
+
+// Client joins a session of a relay server in pkg/relay/server and exchanges through it the traffic with the remote
+// peer of the session. The server forwards the datagrams blindly, so they are only protected by WireGuard. The client
+// shares the socket of the tunnel: while nobody else reads the socket it reads the replies of the server itself,
+// otherwise whoever reads the socket must hand the packets received from the server to Unwrap. Client implements
+// peer.Relay
+type Client struct {
+	conn   *net.UDPConn
+	server *net.UDPAddr
+	token  string
+	key    []byte
+
+	keepalive         time.Duration
+	retransmitTimeout time.Duration
+	maxRetransmits    int
+	logger            logr.Logger
+
+	mu      sync.Mutex
+	replies chan reply
+	bound   bool
+	closed  bool
+
+	// ctx is canceled once the client is closed, stopping the keepalive
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewClient creates a client of the relay server at server that joins the session granted by token through conn,
+// proving possession of the token with its bind key, see BindKey
+func NewClient(conn *net.UDPConn, server *net.UDPAddr, token string, key []byte, opts ...Option) *Client {
+	cfg := newDefaultConfig()
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Client{
+		conn:              conn,
+		server:            server,
+		token:             token,
+		key:               key,
+		keepalive:         cfg.keepalive,
+		retransmitTimeout: cfg.retransmitTimeout,
+		maxRetransmits:    cfg.maxRetransmits,
+		logger:            cfg.logger,
+		ctx:               ctx,
+		cancel:            cancel,
+		done:              make(chan struct{}),
+	}
+}
+
+// Bind joins the session and keeps the binding alive in the background until Close is called. The remote peer is only
+// reachable once it has joined the session as well. conn must not be read by anyone else until Bind returns
+func (c *Client) Bind(ctx context.Context) error {
+	c.mu.Lock()
+	bound, closed := c.bound, c.closed
+	c.mu.Unlock()
+
+	if closed {
+		return wgerrors.ErrRelayClosed
+	}
+
+	if bound {
+		return wgerrors.Permanent(fmt.Errorf("session already joined"))
+	}
+
+	if err := c.exclusive(ctx, c.bind); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.bound = true
+	c.mu.Unlock()
+
+	c.logger.Info("Joined relay session", "server", c.server.String())
+
+	go c.maintain()
+
+	return nil
+}
+
+// Server returns the address of the relay server
+func (c *Client) Server() *net.UDPAddr {
+	return c.server
+}
+
+// Wrap encapsulates a packet for the remote peer of the session. The server knows who the remote peer is, so to is
+// ignored
+func (c *Client) Wrap(packet []byte, _ *net.UDPAddr) ([]byte, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+
+	if closed {
+		return nil, wgerrors.ErrRelayClosed
+	}
+
+	return Encode(TypeData, packet), nil
+}
+
+// Unwrap decapsulates a packet received from the server. The remote peer is only known by the server, so its packets
+// are attributed to the address of the server itself
+func (c *Client) Unwrap(packet []byte) ([]byte, *net.UDPAddr, bool) {
+	t, payload, err := Decode(packet)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	if t == TypeData {
+		return payload, c.server, true
+	}
+
+	c.mu.Lock()
+	replies := c.replies
+	c.mu.Unlock()
+
+	if replies != nil {
+		select {
+		case replies <- reply{t: t, payload: append([]byte(nil), payload...)}:
+		default:
+		}
+		return nil, nil, false
+	}
+
+	if t == TypeRejected {
+		c.logger.Error(wgerrors.ErrRelayRejected, "relay binding lost", "server", c.server.String(), "reason", string(payload))
+	}
+
+	return nil, nil, false
+}
+
+// Close stops refreshing the binding, which lapses on the server once its idle timeout expires
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	bound := c.bound
+	c.mu.Unlock()
+
+	c.cancel()
+	if bound {
+		<-c.done
+	}
+
+	return nil
+}
+
+// bind sends the binding request and waits for the reply of the server, retransmitting it with an exponential backoff
+func (c *Client) bind(ctx context.Context) error {
+	replies := make(chan reply, 1)
+
+	c.mu.Lock()
+	c.replies = replies
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.replies = nil
+		c.mu.Unlock()
+	}()
+
+	// Retransmissions carry the same stamp, the server accepts them from the address that already joined
+	msg := Encode(TypeBind, EncodeBind(c.token, c.key, time.Now()))
+
+	rto := c.retransmitTimeout
+	for range c.maxRetransmits + 1 {
+		if _, err := c.conn.WriteToUDP(msg, c.server); err != nil {
+			return fmt.Errorf("failed to send binding request to %s: %w", c.server, err)
+		}
+
+		timer := time.NewTimer(rto)
+		select {
+		case res := <-replies:
+			timer.Stop()
+			if res.t == TypeRejected {
+				return wgerrors.Permanent(wgerrors.Wrap(wgerrors.ErrRelayRejected, errors.New(string(res.payload))))
+			}
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		rto *= 2
+	}
+
+	return fmt.Errorf("no response from %s: %w", c.server, os.ErrDeadlineExceeded)
+}
+
+// maintain refreshes the binding until the client is closed. The replies are consumed by Unwrap
+func (c *Client) maintain() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			// Every refresh carries a fresh stamp, which lets the server move the binding if the NAT mapping changed
+			msg := Encode(TypeBind, EncodeBind(c.token, c.key, time.Now()))
+			if _, err := c.conn.WriteToUDP(msg, c.server); err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				c.logger.Error(err, "failed to refresh relay binding", "server", c.server.String())
+			}
+		}
+	}
+}
+
+// exclusive runs fn while reading conn on behalf of the client, so that the replies of the server are received
+func (c *Client) exclusive(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctxRead, cancel := context.WithCancel(ctx)
+
+	done := make(chan struct{})
+	go c.read(ctxRead, done)
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	return fn(ctxRead)
+}
+
+// read hands the packets received from the server to Unwrap until ctx is done. Anything else is dropped
+func (c *Client) read(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	defer func() {
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}()
+
+	buf := make([]byte, util.UDPMaxBuffer)
+
+	for ctx.Err() == nil {
+		// Wake up regularly in order to notice the cancellation of ctx
+		_ = c.conn.SetReadDeadline(time.Now().Add(readPollInterval))
+
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if wgerrors.IsTimeout(err) {
+				continue
+			}
+			return
+		}
+
+		if from.IP.Equal(c.server.IP) && from.Port == c.server.Port {
+			c.Unwrap(buf[:n])
+		}
+	}
+}
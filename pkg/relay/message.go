@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Type identifies the messages of the relay protocol. Every datagram exchanged with the relay server starts with a
+// header made of a magic prefix and the type of the message, followed by its payload
+type Type byte
+
+const (
+	// TypeBind is sent by clients to join a session, its payload is the token granting access to it authenticated with
+	// its bind key, see EncodeBind. Clients send it again regularly in order to keep the binding and the NAT mapping
+	// towards the server alive
+	TypeBind Type = iota + 1
+	// TypeBound acknowledges a binding
+	TypeBound
+	// TypeRejected refuses a binding, its payload is the reason
+	TypeRejected
+	// TypeData carries a datagram exchanged between the peers of a session, its payload is the datagram itself
+	TypeData
+)
+
+// HeaderLen is the length of the header prepended to every message
+const HeaderLen = 4
+
+var magic = []byte{'w', 'g', 'r'}
+
+func (t Type) String() string {
+	switch t {
+	case TypeBind:
+		return "bind"
+	case TypeBound:
+		return "bound"
+	case TypeRejected:
+		return "rejected"
+	case TypeData:
+		return "data"
+	default:
+		return fmt.Sprintf("type(%d)", byte(t))
+	}
+}
+
+// Encode returns a message of the given type carrying payload
+func Encode(t Type, payload []byte) []byte {
+	msg := make([]byte, HeaderLen, HeaderLen+len(payload))
+	copy(msg, magic)
+	msg[len(magic)] = byte(t)
+
+	return append(msg, payload...)
+}
+
+// Decode returns the type and the payload of a message. The payload shares the memory of msg
+func Decode(msg []byte) (Type, []byte, error) {
+	if len(msg) < HeaderLen || !bytes.Equal(msg[:len(magic)], magic) {
+		return 0, nil, fmt.Errorf("not a relay message")
+	}
+
+	t := Type(msg[len(magic)])
+	if t < TypeBind || t > TypeData {
+		return 0, nil, fmt.Errorf("unknown relay message %s", t)
+	}
+
+	return t, msg[HeaderLen:], nil
+}
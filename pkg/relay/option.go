@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// Bindings lapse after a couple of minutes without traffic and NAT mappings usually sooner, the keepalive refreshes
+	// both even if the tunnel is idle
+	defaultKeepalive = 25 * time.Second
+
+	defaultRetransmitTimeout = 500 * time.Millisecond
+	defaultMaxRetransmits    = 5
+)
+
+type config struct {
+	keepalive         time.Duration
+	retransmitTimeout time.Duration
+	maxRetransmits    int
+	logger            logr.Logger
+}
+
+type Option func(*config)
+
+func newDefaultConfig() *config {
+	return &config{
+		keepalive:         defaultKeepalive,
+		retransmitTimeout: defaultRetransmitTimeout,
+		maxRetransmits:    defaultMaxRetransmits,
+		logger:            logr.Discard(),
+	}
+}
+
+// WithKeepalive sets the interval at which the binding is refreshed once established. It must be shorter than the
+// idle timeout of the server
+func WithKeepalive(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.keepalive = interval
+	}
+}
+
+// WithRetransmits sets the number of retransmissions of the binding request before giving up, together with the
+// initial retransmission timeout, which doubles after every retransmission
+func WithRetransmits(retransmits int, timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxRetransmits = retransmits
+		cfg.retransmitTimeout = timeout
+	}
+}
+
+// WithLogger sets the logger to use for logging. The logger must implement the logr.Logger interface
+func WithLogger(logger logr.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
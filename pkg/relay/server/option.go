@@ -0,0 +1,41 @@
+package server
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// Clients refresh their bindings every 25 seconds by default, so a few refreshes can be lost before they lapse
+	defaultIdleTimeout = 2 * time.Minute
+)
+
+type config struct {
+	idleTimeout time.Duration
+	logger      logr.Logger
+}
+
+type Option func(*config)
+
+func newDefaultConfig() *config {
+	return &config{
+		idleTimeout: defaultIdleTimeout,
+		logger:      logr.Discard(),
+	}
+}
+
+// WithIdleTimeout sets how long a binding is kept without receiving anything from its client. The timeout must be
+// greater than the keepalive interval of the clients
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.idleTimeout = timeout
+	}
+}
+
+// WithLogger sets the logger to use for logging. The logger must implement the logr.Logger interface
+func WithLogger(logger logr.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/relay"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const (
+	// sessionPeers is the number of peers that can join a session
+	sessionPeers = 2
+	// maxBindSkew bounds how far the stamp of a binding request might be from the clock of the server, which limits
+	// for how long a sniffed request can be replayed
+	maxBindSkew = time.Minute
+)
+
+var (
+	errSessionFull = errors.New("session already joined by two other peers")
+	errStaleBind   = errors.New("binding request is stale or replayed")
+)
+
+// binding ties the address of a client to the peer it joined a session as
+type binding struct {
+	addr    *net.UDPAddr
+	session string
+	peerID  string
+	// stamp is the stamp of the latest binding request accepted
+	stamp    time.Time
+	lastSeen time.Time
+}
+
+// expired reports whether the client of the binding has gone silent for longer than idle
+func (b *binding) expired(now time.Time, idle time.Duration) bool {
+	return now.Sub(b.lastSeen) > idle
+}
+
+// Server is a relay server that forwards the datagrams exchanged between the two peers of a session. Peers join a
+// session with a token signed with the secret of the server, see relay.IssueToken, and the server forwards whatever
+// they send to the address the other peer joined from. Datagrams are forwarded blindly, so they are only protected by
+// WireGuard.
+//
+// Binding requests are authenticated with the bind key of the token and stamped, so a request sniffed on the way can
+// neither join a session nor move a peer to another address. Tokens only grant joining or moving within their TTL, a
+// binding is kept for as long as its client refreshes it from the same address
+type Server struct {
+	secret      []byte
+	idleTimeout time.Duration
+	logger      logr.Logger
+
+	mu        sync.Mutex
+	bindings  map[string]*binding
+	sessions  map[string]map[string]*binding
+	lastSweep time.Time
+}
+
+func New(secret []byte, opts ...Option) *Server {
+	cfg := newDefaultConfig()
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &Server{
+		secret:      secret,
+		idleTimeout: cfg.idleTimeout,
+		logger:      cfg.logger,
+		bindings:    make(map[string]*binding),
+		sessions:    make(map[string]map[string]*binding),
+		lastSweep:   time.Now(),
+	}
+}
+
+// ListenAndServe serves the relay protocol on addr until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	localAddr, err := net.ResolveUDPAddr(util.UDPProtocol, addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP(util.UDPProtocol, localAddr)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Relay server listening", "address", conn.LocalAddr().String())
+
+	return s.Serve(ctx, conn)
+}
+
+// Serve serves the relay protocol on conn until ctx is done. conn is closed once Serve returns
+func (s *Server) Serve(ctx context.Context, conn *net.UDPConn) error {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// Unblock the read below once ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	buf := make([]byte, util.UDPMaxBuffer)
+
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			// Errors like ICMP unreachable messages reported by the kernel only concern a single client
+			s.logger.Error(err, "failed to read datagram")
+			continue
+		}
+
+		s.handle(conn, buf[:n], from)
+	}
+}
+
+// handle processes a datagram received from a client
+func (s *Server) handle(conn *net.UDPConn, packet []byte, from *net.UDPAddr) {
+	t, payload, err := relay.Decode(packet)
+	if err != nil {
+		return
+	}
+
+	switch t {
+	case relay.TypeBind:
+		s.handleBind(conn, payload, from)
+	case relay.TypeData:
+		// The header is the same in both directions, so the datagram is forwarded as is
+		if to := s.peerOf(from); to != nil {
+			if _, errWrite := conn.WriteToUDP(packet, to); errWrite != nil {
+				s.logger.Error(errWrite, "failed to forward datagram", "from", from.String(), "to", to.String())
+			}
+		}
+	case relay.TypeBound, relay.TypeRejected:
+		// Replies are only sent by the server
+	}
+}
+
+// handleBind joins the client to the session granted by its token and replies whether it succeeded
+func (s *Server) handleBind(conn *net.UDPConn, payload []byte, from *net.UDPAddr) {
+	reply := relay.Encode(relay.TypeBound, nil)
+
+	token, stamp, err := relay.VerifyBind(s.secret, payload)
+	if err == nil {
+		err = s.bind(token, stamp, from)
+	}
+
+	if err != nil {
+		s.logger.Info("Rejected binding", "address", from.String(), "reason", err.Error())
+		reply = relay.Encode(relay.TypeRejected, []byte(err.Error()))
+	}
+
+	if _, errWrite := conn.WriteToUDP(reply, from); errWrite != nil {
+		s.logger.Error(errWrite, "failed to reply to binding", "address", from.String())
+	}
+}
+
+// bind ties from to the peer of the token, replacing the address the peer joined from before if it changed. Moving a
+// peer takes a request stamped after any other request of the peer, so that replaying an old one does not steal the
+// binding. Retransmissions from the address that already joined carry the same stamp and are accepted
+func (s *Server) bind(token *relay.Token, stamp time.Time, from *net.UDPAddr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if stamp.Before(now.Add(-maxBindSkew)) || stamp.After(now.Add(maxBindSkew)) {
+		return errStaleBind
+	}
+
+	s.sweep(now)
+
+	peers := s.sessions[token.Session]
+	existing := peers[token.PeerID]
+	moving := existing == nil || existing.addr.String() != from.String()
+
+	// Expired tokens only refresh the binding of the address that joined with them
+	if moving && token.Expired(now) {
+		return wgerrors.ErrTokenExpired
+	}
+
+	if existing != nil && (stamp.Before(existing.stamp) || (moving && !stamp.After(existing.stamp))) {
+		return errStaleBind
+	}
+
+	if existing == nil && len(peers) >= sessionPeers {
+		return errSessionFull
+	}
+
+	// The address might have joined another session before
+	if previous := s.bindings[from.String()]; previous != nil && previous != existing {
+		s.unbind(previous)
+	}
+
+	if existing != nil {
+		if existing.addr.String() != from.String() {
+			delete(s.bindings, existing.addr.String())
+			existing.addr = from
+			s.logger.Info("Peer moved", "session", token.Session, "peerID", token.PeerID, "address", from.String())
+		}
+
+		existing.lastSeen, existing.stamp = now, stamp
+		s.bindings[from.String()] = existing
+
+		return nil
+	}
+
+	if peers == nil {
+		peers = make(map[string]*binding)
+		s.sessions[token.Session] = peers
+	}
+
+	b := &binding{addr: from, session: token.Session, peerID: token.PeerID, stamp: stamp, lastSeen: now}
+	peers[token.PeerID] = b
+	s.bindings[from.String()] = b
+
+	s.logger.Info("Peer joined session", "session", token.Session, "peerID", token.PeerID, "address", from.String())
+
+	return nil
+}
+
+// peerOf returns the address of the other peer in the session joined from addr, or nil if there is none yet
+func (s *Server) peerOf(addr *net.UDPAddr) *net.UDPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	b := s.bindings[addr.String()]
+	if b == nil {
+		return nil
+	}
+
+	b.lastSeen = now
+
+	for peerID, other := range s.sessions[b.session] {
+		if peerID != b.peerID {
+			return other.addr
+		}
+	}
+
+	return nil
+}
+
+// sweep drops the expired bindings, at most once every half idle timeout. Must be called with the lock held
+func (s *Server) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.idleTimeout/2 {
+		return
+	}
+	s.lastSweep = now
+
+	for _, b := range s.bindings {
+		if b.expired(now, s.idleTimeout) {
+			s.unbind(b)
+			s.logger.Info("Binding expired", "session", b.session, "peerID", b.peerID, "address", b.addr.String())
+		}
+	}
+}
+
+// unbind removes a binding from its session. Must be called with the lock held
+func (s *Server) unbind(b *binding) {
+	delete(s.bindings, b.addr.String())
+
+	peers := s.sessions[b.session]
+	delete(peers, b.peerID)
+	if len(peers) == 0 {
+		delete(s.sessions, b.session)
+	}
+}
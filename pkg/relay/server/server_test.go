@@ -0,0 +1,213 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/relay"
+	"github.com/yago-123/wg-punch/pkg/relay/server"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+var secret = []byte("relay-secret")
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to bind socket: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+// startServer serves the relay protocol on a loopback socket until the test ends
+func startServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to bind socket: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = server.New(secret).Serve(ctx, conn)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// join binds a client of peerID to its session with otherPeerID
+func join(t *testing.T, srv *net.UDPAddr, peerID, otherPeerID string) (*relay.Client, *net.UDPConn) {
+	t.Helper()
+
+	token, err := relay.IssueToken(secret, peerID, otherPeerID, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+
+	conn := listenLoopback(t)
+	client := relay.NewClient(conn, srv, token, relay.BindKey(secret, token))
+	t.Cleanup(func() { _ = client.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = client.Bind(ctx); err != nil {
+		t.Fatalf("failed to join session as %s: %v", peerID, err)
+	}
+
+	return client, conn
+}
+
+// exchange sends payload from one client to the other and checks that it is delivered as is
+func exchange(t *testing.T, srv *net.UDPAddr, from *relay.Client, fromConn *net.UDPConn, to *relay.Client, toConn *net.UDPConn, payload string) {
+	t.Helper()
+
+	packet, err := from.Wrap([]byte(payload), nil)
+	if err != nil {
+		t.Fatalf("failed to wrap packet: %v", err)
+	}
+
+	if _, err = fromConn.WriteToUDP(packet, srv); err != nil {
+		t.Fatalf("failed to send packet: %v", err)
+	}
+
+	buf := make([]byte, util.UDPMaxBuffer)
+	_ = toConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		n, _, errRead := toConn.ReadFromUDP(buf)
+		if errRead != nil {
+			t.Fatalf("packet was not relayed: %v", errRead)
+		}
+
+		if data, sender, ok := to.Unwrap(buf[:n]); ok {
+			if string(data) != payload || sender.String() != srv.String() {
+				t.Fatalf("expected %q from %s, got %q from %s", payload, srv, data, sender)
+			}
+			return
+		}
+	}
+}
+
+func TestRelayedExchange(t *testing.T) {
+	srv := startServer(t)
+
+	alice, aliceConn := join(t, srv, "alice", "bob")
+	bob, bobConn := join(t, srv, "bob", "alice")
+
+	exchange(t, srv, alice, aliceConn, bob, bobConn, "ping")
+	exchange(t, srv, bob, bobConn, alice, aliceConn, "pong")
+}
+
+func TestBindRejectsForgedToken(t *testing.T) {
+	srv := startServer(t)
+
+	token, err := relay.IssueToken([]byte("other-secret"), "mallory", "bob", time.Minute)
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+
+	client := relay.NewClient(listenLoopback(t), srv, token, relay.BindKey([]byte("other-secret"), token))
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = client.Bind(ctx); !errors.Is(err, wgerrors.ErrRelayRejected) {
+		t.Fatalf("expected ErrRelayRejected, got %v", err)
+	}
+}
+
+// bindAs sends a binding request from conn and returns the type of the reply of the server
+func bindAs(t *testing.T, srv *net.UDPAddr, conn *net.UDPConn, payload []byte) relay.Type {
+	t.Helper()
+
+	if _, err := conn.WriteToUDP(relay.Encode(relay.TypeBind, payload), srv); err != nil {
+		t.Fatalf("failed to send binding request: %v", err)
+	}
+
+	buf := make([]byte, util.UDPMaxBuffer)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no reply to binding request: %v", err)
+	}
+
+	reply, _, err := relay.Decode(buf[:n])
+	if err != nil {
+		t.Fatalf("invalid reply: %v", err)
+	}
+
+	return reply
+}
+
+func TestBindRequiresProofOfPossession(t *testing.T) {
+	srv := startServer(t)
+
+	token, err := relay.IssueToken(secret, "alice", "bob", time.Minute)
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	key := relay.BindKey(secret, token)
+
+	aliceConn, attackerConn := listenLoopback(t), listenLoopback(t)
+
+	sniffed := relay.EncodeBind(token, key, time.Now())
+	if reply := bindAs(t, srv, aliceConn, sniffed); reply != relay.TypeBound {
+		t.Fatalf("expected binding accepted, got %s", reply)
+	}
+
+	// Retransmissions from the address that joined are accepted
+	if reply := bindAs(t, srv, aliceConn, sniffed); reply != relay.TypeBound {
+		t.Fatalf("expected retransmission accepted, got %s", reply)
+	}
+
+	// A sniffed request replayed from another address does not move the peer, nor does a request signed without the key
+	if reply := bindAs(t, srv, attackerConn, sniffed); reply != relay.TypeRejected {
+		t.Fatalf("expected replayed binding rejected, got %s", reply)
+	}
+
+	if reply := bindAs(t, srv, attackerConn, relay.EncodeBind(token, []byte("guessed-key"), time.Now())); reply != relay.TypeRejected {
+		t.Fatalf("expected binding without key rejected, got %s", reply)
+	}
+
+	bob, bobConn := join(t, srv, "bob", "alice")
+
+	packet, err := bob.Wrap([]byte("ping"), nil)
+	if err != nil {
+		t.Fatalf("failed to wrap packet: %v", err)
+	}
+
+	if _, err = bobConn.WriteToUDP(packet, srv); err != nil {
+		t.Fatalf("failed to send packet: %v", err)
+	}
+
+	buf := make([]byte, util.UDPMaxBuffer)
+	_ = aliceConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err = aliceConn.ReadFromUDP(buf); err != nil {
+		t.Fatalf("expected traffic still relayed to alice: %v", err)
+	}
+
+	// A fresh request signed with the key moves the peer, like after its NAT mapping changes
+	movedConn := listenLoopback(t)
+	if reply := bindAs(t, srv, movedConn, relay.EncodeBind(token, key, time.Now())); reply != relay.TypeBound {
+		t.Fatalf("expected peer moved, got %s", reply)
+	}
+}
@@ -0,0 +1,159 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+)
+
+const (
+	sessionIDLen = 16
+	bindStampLen = 8
+)
+
+// Token grants a peer access to a session of the relay server. Tokens are signed with a secret shared by the relay
+// server and whoever issues them, usually the rendezvous server, so the relay server verifies them without keeping any
+// state nor talking to the issuer. A token is only usable together with its bind key, see BindKey
+type Token struct {
+	Session   string    `json:"session"`
+	PeerID    string    `json:"peer_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the token no longer grants joining its session at the given time
+func (t *Token) Expired(now time.Time) bool {
+	return now.After(t.ExpiresAt)
+}
+
+// SessionID returns the ID of the relay session between two peers. The peer IDs are sorted before being mixed in, so
+// both peers end up in the same session regardless of which one asked for its token
+func SessionID(peerID, otherPeerID string) string {
+	ids := []string{peerID, otherPeerID}
+	sort.Strings(ids)
+
+	sum := sha256.Sum256([]byte(strings.Join(ids, "\x00")))
+
+	return hex.EncodeToString(sum[:sessionIDLen])
+}
+
+// IssueToken returns the signed token through which peerID joins its session with otherPeerID, valid for ttl
+func IssueToken(secret []byte, peerID, otherPeerID string, ttl time.Duration) (string, error) {
+	token := Token{
+		Session:   SessionID(peerID, otherPeerID),
+		PeerID:    peerID,
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+	}
+
+	return token.Sign(secret)
+}
+
+// Sign encodes the token together with its signature
+func (t Token) Sign(secret []byte) (string, error) {
+	if len(secret) == 0 {
+		return "", fmt.Errorf("shared secret must not be empty")
+	}
+
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sign(secret, payload)), nil
+}
+
+// ParseToken verifies the signature and the expiration of an encoded token and returns it
+func ParseToken(secret []byte, encoded string) (*Token, error) {
+	token, err := parseToken(secret, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Expired(time.Now()) {
+		return nil, wgerrors.ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+// BindKey returns the key with which a client proves that it has been granted the encoded token when joining its
+// session. The issuer hands it out next to the token and the relay server derives it from the token, so it never
+// travels with the binding requests and a token sniffed from them is useless on its own
+func BindKey(secret []byte, encoded string) []byte {
+	return sign(secret, []byte("bind\x00"+encoded))
+}
+
+// EncodeBind returns the payload of a binding request for the encoded token sent at stamp, authenticated with the
+// bind key of the token. The stamp lets the relay server tell fresh requests from replayed ones
+func EncodeBind(encoded string, key []byte, stamp time.Time) []byte {
+	payload := binary.BigEndian.AppendUint64(make([]byte, 0, bindStampLen+sha256.Size+len(encoded)), uint64(stamp.UnixNano()))
+	payload = append(payload, bindMAC(key, payload, encoded)...)
+
+	return append(payload, encoded...)
+}
+
+// VerifyBind verifies the token and the authentication of a binding request encoded via EncodeBind, and returns the
+// token together with the stamp of the request. The expiration of the token is left to the caller
+func VerifyBind(secret []byte, payload []byte) (*Token, time.Time, error) {
+	if len(payload) < bindStampLen+sha256.Size {
+		return nil, time.Time{}, wgerrors.ErrInvalidToken
+	}
+
+	stamp, mac, encoded := payload[:bindStampLen], payload[bindStampLen:bindStampLen+sha256.Size], string(payload[bindStampLen+sha256.Size:])
+
+	token, err := parseToken(secret, encoded)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if !hmac.Equal(mac, bindMAC(BindKey(secret, encoded), stamp, encoded)) {
+		return nil, time.Time{}, wgerrors.ErrInvalidToken
+	}
+
+	return token, time.Unix(0, int64(binary.BigEndian.Uint64(stamp))), nil
+}
+
+// parseToken verifies the signature of an encoded token and returns it
+func parseToken(secret []byte, encoded string) (*Token, error) {
+	encodedPayload, encodedMAC, found := strings.Cut(encoded, ".")
+	if !found {
+		return nil, wgerrors.ErrInvalidToken
+	}
+
+	payload, errPayload := base64.RawURLEncoding.DecodeString(encodedPayload)
+	mac, errMAC := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if errPayload != nil || errMAC != nil || !hmac.Equal(mac, sign(secret, payload)) {
+		return nil, wgerrors.ErrInvalidToken
+	}
+
+	var token Token
+	if err := json.Unmarshal(payload, &token); err != nil || token.Session == "" || token.PeerID == "" {
+		return nil, wgerrors.ErrInvalidToken
+	}
+
+	return &token, nil
+}
+
+// bindMAC authenticates the stamp of a binding request for the encoded token with its bind key
+func bindMAC(key, stamp []byte, encoded string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(stamp)
+	mac.Write([]byte(encoded))
+
+	return mac.Sum(nil)
+}
+
+func sign(secret, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
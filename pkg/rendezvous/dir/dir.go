@@ -0,0 +1,369 @@
+package dir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const (
+	peersDir    = "peers"
+	requestsDir = "requests"
+
+	fileExt    = ".json"
+	tmpPrefix  = ".tmp-"
+	claimedExt = ".claimed"
+	// badExt marks the request files that could not be decoded, which are kept aside for inspection
+	badExt = ".bad"
+
+	dirPerm  = 0o755
+	filePerm = 0o644
+)
+
+// Rendezvous is a backend for sites where peers share a directory, like an NFS export or an rsync'd folder. Each peer
+// atomically writes its registration as a JSON file and remote peers are discovered by polling the directory. Files
+// that cannot be read or decoded while polling are treated as not there yet, since shared filesystems fail
+// transiently and rsync might not have delivered a file completely
+type Rendezvous struct {
+	root         string
+	pollInterval time.Duration
+	logger       logr.Logger
+}
+
+// New creates a backend rooted at root, polling it every pollInterval while waiting for remote peers or connection
+// requests. The directory layout is created if it does not exist yet
+func New(root string, pollInterval time.Duration, opts ...Option) (*Rendezvous, error) {
+	cfg := newDefaultConfig()
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	for _, sub := range []string{peersDir, requestsDir} {
+		if err := os.MkdirAll(filepath.Join(root, sub), dirPerm); err != nil {
+			return nil, fmt.Errorf("failed to create rendezvous directory: %w", err)
+		}
+	}
+
+	return &Rendezvous{
+		root:         root,
+		pollInterval: pollInterval,
+		logger:       cfg.logger,
+	}, nil
+}
+
+func (r *Rendezvous) Register(_ context.Context, req rendezvous.RegisterRequest) error {
+	path, err := r.peerPath(req.PeerID)
+	if err != nil {
+		return err
+	}
+
+	if _, errAddr := net.ResolveUDPAddr(util.UDPProtocol, req.Endpoint); errAddr != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", req.Endpoint, errAddr)
+	}
+
+	return writeAtomic(path, rendezvous.PeerInfo{
+		PeerID:      req.PeerID,
+		PublicKey:   req.PublicKey,
+		Endpoint:    req.Endpoint,
+		AllowedIPs:  req.AllowedIPs,
+		Candidates:  req.Candidates,
+		Ufrag:       req.Ufrag,
+		Pwd:         req.Pwd,
+		PortMapping: req.PortMapping,
+		NATBehavior: req.NATBehavior,
+		ExpiresAt:   req.ExpiresAt(time.Now()),
+	})
+}
+
+func (r *Rendezvous) WaitForPeer(ctx context.Context, peerID string) (*rendezvous.PeerInfo, *net.UDPAddr, error) {
+	path, err := r.peerPath(peerID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var info rendezvous.PeerInfo
+
+	// Lapsed registrations are left in place since the peer might renew them, the clocks of the hosts sharing the
+	// directory are expected to be in sync
+	errPoll := r.poll(ctx, func() (bool, error) {
+		found, errRead := readJSON(path, &info)
+		if errRead != nil || !found {
+			return found, errRead
+		}
+
+		return !info.Expired(time.Now()), nil
+	})
+	if errPoll != nil {
+		return nil, nil, errPoll
+	}
+
+	endpoint, err := net.ResolveUDPAddr(util.UDPProtocol, info.Endpoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid endpoint %q for peer %s: %w", info.Endpoint, peerID, err)
+	}
+
+	return &info, endpoint, nil
+}
+
+func (r *Rendezvous) Deregister(_ context.Context, peerID string) error {
+	path, err := r.peerPath(peerID)
+	if err != nil {
+		return err
+	}
+
+	if errRemove := os.Remove(path); errRemove != nil && !os.IsNotExist(errRemove) {
+		return fmt.Errorf("failed to remove registration of %s: %w", peerID, errRemove)
+	}
+
+	return nil
+}
+
+// Peers lists the registration files of the peers directory. Files that cannot be read or decoded are skipped, they
+// are usually being replaced by their peer
+func (r *Rendezvous) Peers(_ context.Context) ([]rendezvous.PeerInfo, error) {
+	dir := filepath.Join(r.root, peersDir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+
+	now := time.Now()
+	peers := make([]rendezvous.PeerInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tmpPrefix) || !strings.HasSuffix(entry.Name(), fileExt) {
+			continue
+		}
+
+		var info rendezvous.PeerInfo
+		if found, errRead := readJSON(filepath.Join(dir, entry.Name()), &info); errRead != nil || !found {
+			continue
+		}
+
+		if !info.Expired(now) {
+			peers = append(peers, info)
+		}
+	}
+
+	return peers, nil
+}
+
+func (r *Rendezvous) RequestConnection(_ context.Context, req rendezvous.ConnRequest) error {
+	dir, err := r.requestsPath(req.ToPeerID)
+	if err != nil {
+		return err
+	}
+
+	if errMkdir := os.MkdirAll(dir, dirPerm); errMkdir != nil {
+		return fmt.Errorf("failed to create requests directory: %w", errMkdir)
+	}
+
+	// Prefix with the creation time so that requests are consumed in order
+	name := fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), url.PathEscape(req.FromPeerID), fileExt)
+
+	return writeAtomic(filepath.Join(dir, name), req)
+}
+
+func (r *Rendezvous) WaitForRequest(ctx context.Context, peerID string) (*rendezvous.ConnRequest, error) {
+	dir, err := r.requestsPath(peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var req rendezvous.ConnRequest
+
+	errPoll := r.poll(ctx, func() (bool, error) {
+		return r.claimOldest(dir, &req)
+	})
+	if errPoll != nil {
+		return nil, errPoll
+	}
+
+	return &req, nil
+}
+
+// poll calls check every poll interval until it reports that it found what it was looking for. Errors reported by
+// check are logged and the directory polled again, only ctx ends the polling
+func (r *Rendezvous) poll(ctx context.Context, check func() (bool, error)) error {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		found, err := check()
+		if err != nil {
+			r.logger.Error(err, "failed to poll rendezvous directory, retrying", "root", r.root)
+		}
+
+		if found {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// peerPath returns the path of the registration file of peerID
+func (r *Rendezvous) peerPath(peerID string) (string, error) {
+	name, err := fileName(peerID)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(r.root, peersDir, name+fileExt), nil
+}
+
+// requestsPath returns the path of the directory holding the connection requests addressed to peerID
+func (r *Rendezvous) requestsPath(peerID string) (string, error) {
+	name, err := fileName(peerID)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(r.root, requestsDir, name), nil
+}
+
+// fileName escapes peerID so that it can be safely used as a file name
+func fileName(peerID string) (string, error) {
+	name := url.PathEscape(peerID)
+	if name == "" || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid peer ID %q", peerID)
+	}
+
+	return name, nil
+}
+
+// writeAtomic writes v as JSON into a temporary file that is then renamed to path, so that readers never observe a
+// partially written file
+func writeAtomic(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", path, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), tmpPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, errWrite := tmp.Write(data); errWrite != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, errWrite)
+	}
+
+	if errSync := tmp.Sync(); errSync != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", path, errSync)
+	}
+
+	if errClose := tmp.Close(); errClose != nil {
+		return fmt.Errorf("failed to write %s: %w", path, errClose)
+	}
+
+	if errChmod := os.Chmod(tmp.Name(), filePerm); errChmod != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", path, errChmod)
+	}
+
+	if errRename := os.Rename(tmp.Name(), path); errRename != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, errRename)
+	}
+
+	return nil
+}
+
+// readJSON decodes the file at path into v. Returns false if the file does not exist
+func readJSON(path string, v any) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if errDecode := json.Unmarshal(data, v); errDecode != nil {
+		return false, fmt.Errorf("failed to decode %s: %w", path, errDecode)
+	}
+
+	return true, nil
+}
+
+// claimOldest consumes the oldest request file in dir and decodes it into v. Files are claimed by renaming them
+// before reading, so that a request is consumed only once even if several processes watch the same directory. Claimed
+// files that cannot be read or decoded are quarantined and the next one is tried. Returns false if there is no request
+// to consume
+func (r *Rendezvous) claimOldest(dir string, v any) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), fileExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		claimed := path + claimedExt
+
+		// Someone else claimed the request in the meantime
+		if errRename := os.Rename(path, claimed); errRename != nil {
+			if errors.Is(errRename, os.ErrNotExist) {
+				continue
+			}
+			return false, fmt.Errorf("failed to claim %s: %w", path, errRename)
+		}
+
+		found, errRead := readJSON(claimed, v)
+		if errRead != nil {
+			r.quarantine(claimed, errRead)
+			continue
+		}
+
+		_ = os.Remove(claimed)
+
+		if found {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// quarantine sets aside a claimed request file that could not be consumed, so that it neither blocks the requests
+// queued after it nor gets lost
+func (r *Rendezvous) quarantine(claimed string, reason error) {
+	bad := strings.TrimSuffix(claimed, claimedExt) + badExt
+	if err := os.Rename(claimed, bad); err != nil {
+		r.logger.Error(err, "failed to quarantine request file, dropping it", "file", claimed)
+		_ = os.Remove(claimed)
+		return
+	}
+
+	r.logger.Error(reason, "quarantined undecodable request file", "file", bad)
+}
@@ -0,0 +1,71 @@
+package dir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+)
+
+const pollInterval = 10 * time.Millisecond
+
+func TestWaitForPeerSkipsUndecodableRegistration(t *testing.T) {
+	r, err := New(t.TempDir(), pollInterval)
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+
+	path, _ := r.peerPath("alice")
+	if err = os.WriteFile(path, []byte("{partial"), filePerm); err != nil {
+		t.Fatalf("failed to write registration: %v", err)
+	}
+
+	// The registration is completed while the remote peer is being waited for
+	go func() {
+		time.Sleep(5 * pollInterval)
+		_ = r.Register(context.Background(), rendezvous.RegisterRequest{PeerID: "alice", PublicKey: "alice-key", Endpoint: "192.0.2.1:51820"})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	info, _, err := r.WaitForPeer(ctx, "alice")
+	if err != nil || info.PublicKey != "alice-key" {
+		t.Fatalf("expected registration of alice, got %+v: %v", info, err)
+	}
+}
+
+func TestWaitForRequestQuarantinesUndecodableRequest(t *testing.T) {
+	r, err := New(t.TempDir(), pollInterval)
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+
+	dir, _ := r.requestsPath("hub")
+	if err = os.MkdirAll(dir, dirPerm); err != nil {
+		t.Fatalf("failed to create requests directory: %v", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, "0-broken"+fileExt), []byte("not json"), filePerm); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = r.RequestConnection(ctx, rendezvous.ConnRequest{FromPeerID: "bob", ToPeerID: "hub"}); err != nil {
+		t.Fatalf("failed to request connection: %v", err)
+	}
+
+	req, err := r.WaitForRequest(ctx, "hub")
+	if err != nil || req.FromPeerID != "bob" {
+		t.Fatalf("expected request from bob, got %+v: %v", req, err)
+	}
+
+	if _, errStat := os.Stat(filepath.Join(dir, "0-broken"+fileExt+badExt)); errStat != nil {
+		t.Fatalf("expected undecodable request quarantined: %v", errStat)
+	}
+}
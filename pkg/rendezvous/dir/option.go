@@ -0,0 +1,24 @@
+package dir
+
+import (
+	"github.com/go-logr/logr"
+)
+
+type config struct {
+	logger logr.Logger
+}
+
+type Option func(*config)
+
+func newDefaultConfig() *config {
+	return &config{
+		logger: logr.Discard(),
+	}
+}
+
+// WithLogger sets the logger to use for logging. The logger must implement the logr.Logger interface
+func WithLogger(logger logr.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
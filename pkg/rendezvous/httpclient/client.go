@@ -0,0 +1,225 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	errors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/rendezvous/server"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const (
+	defaultRequestTimeout = 5 * time.Second
+	maxErrorBodyLen       = 512
+)
+
+// Client talks to the rendezvous server in pkg/rendezvous/server. Peers are registered and looked up through the
+// peer-hub routes, carrying the fields peer-hub lacks, and the extensions of the server are used for the rest. It
+// implements rendezvous.Rendezvous, rendezvous.Lister, rendezvous.Requester and rendezvous.RelayBroker.
+//
+// The token handed out by the server when a peer registers is kept by the client and presented whenever the
+// registration of that peer is updated, removed or acted upon
+type Client struct {
+	serverURL    string
+	waitInterval time.Duration
+	httpClient   *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// New creates a client for the rendezvous server at serverURL, polling it every waitInterval while waiting for remote
+// peers or connection requests
+func New(serverURL string, waitInterval time.Duration) *Client {
+	return &Client{
+		serverURL:    strings.TrimSuffix(serverURL, "/"),
+		waitInterval: waitInterval,
+		httpClient:   &http.Client{Timeout: defaultRequestTimeout},
+		tokens:       make(map[string]string),
+	}
+}
+
+// Register registers the peer and keeps the token returned by the server. Fails with ErrNotOwner if the peer ID is
+// registered by someone else
+func (c *Client) Register(ctx context.Context, req rendezvous.RegisterRequest) error {
+	var reply server.RegisterReply
+
+	if _, err := c.do(ctx, http.MethodPost, server.RegisterPath, c.token(req.PeerID), req, &reply); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tokens[req.PeerID] = reply.Token
+
+	return nil
+}
+
+// WaitForPeer polls the server until the remote peer is registered. The server does not return lapsed registrations,
+// so the expiration time is not checked locally in order not to depend on the clocks being in sync
+func (c *Client) WaitForPeer(ctx context.Context, peerID string) (*rendezvous.PeerInfo, *net.UDPAddr, error) {
+	var info rendezvous.PeerInfo
+
+	if err := c.poll(ctx, server.PeerPath+"/"+url.PathEscape(peerID), "", &info); err != nil {
+		return nil, nil, err
+	}
+
+	endpoint, err := net.ResolveUDPAddr(util.UDPProtocol, info.Endpoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid endpoint %q for peer %s: %w", info.Endpoint, peerID, err)
+	}
+
+	return &info, endpoint, nil
+}
+
+func (c *Client) Deregister(ctx context.Context, peerID string) error {
+	if _, err := c.do(ctx, http.MethodDelete, server.PeerPath+"/"+url.PathEscape(peerID), c.token(peerID), nil, nil); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.tokens, peerID)
+
+	return nil
+}
+
+func (c *Client) Peers(ctx context.Context) ([]rendezvous.PeerInfo, error) {
+	var peers []rendezvous.PeerInfo
+
+	if _, err := c.do(ctx, http.MethodGet, server.PeersPath, "", nil, &peers); err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
+
+func (c *Client) RequestConnection(ctx context.Context, req rendezvous.ConnRequest) error {
+	_, err := c.do(ctx, http.MethodPost, server.RequestsPath, "", req, nil)
+	return err
+}
+
+func (c *Client) WaitForRequest(ctx context.Context, peerID string) (*rendezvous.ConnRequest, error) {
+	var req rendezvous.ConnRequest
+
+	if err := c.poll(ctx, server.RequestsPath+"/"+url.PathEscape(peerID), c.token(peerID), &req); err != nil {
+		return nil, err
+	}
+
+	return &req, nil
+}
+
+// RequestRelay asks the server for access to its relay server on behalf of req.FromPeerID, which must have registered
+// through this client. Returns ErrRelayUnavailable if the server has no relay server configured
+func (c *Client) RequestRelay(ctx context.Context, req rendezvous.ConnRequest) (*rendezvous.RelayGrant, error) {
+	var grant rendezvous.RelayGrant
+
+	found, err := c.do(ctx, http.MethodPost, server.RelayPath, c.token(req.FromPeerID), req, &grant)
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, errors.Permanent(errors.ErrRelayUnavailable)
+	}
+
+	return &grant, nil
+}
+
+// token returns the token handed out when peerID registered, which is empty if it did not register through this client
+func (c *Client) token(peerID string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.tokens[peerID]
+}
+
+// poll queries path every wait interval until the server returns the resource, which is decoded into out
+func (c *Client) poll(ctx context.Context, path, token string, out any) error {
+	ticker := time.NewTicker(c.waitInterval)
+	defer ticker.Stop()
+
+	for {
+		found, err := c.do(ctx, http.MethodGet, path, token, nil, out)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// do sends a request with in encoded as JSON body and decodes the reply into out. The token is presented as bearer
+// token unless it is empty. Returns false if the server replied that the resource does not exist
+func (c *Client) do(ctx context.Context, method, path, token string, in, out any) (bool, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return false, fmt.Errorf("failed to encode request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.serverURL+path, body)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to reach rendezvous server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if out == nil {
+			return true, nil
+		}
+		if errDecode := json.NewDecoder(resp.Body).Decode(out); errDecode != nil {
+			return false, fmt.Errorf("failed to decode reply: %w", errDecode)
+		}
+		return true, nil
+	case http.StatusNoContent:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusTooManyRequests:
+		return false, errors.ErrRateLimited
+	case http.StatusForbidden:
+		return false, errors.Permanent(errors.ErrNotOwner)
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLen))
+		return false, errors.Wrap(errors.ErrUnexpectedReply, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg))))
+	}
+}
@@ -0,0 +1,527 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const (
+	// ServiceName is the DNS-SD service under which peers are announced
+	ServiceName = "_wgpunch._udp.local."
+
+	mdnsAddr = "224.0.0.251:5353"
+
+	// cacheFlushBit marks records that are unique to the announcing host (RFC 6762, section 10.2)
+	cacheFlushBit = 1 << 15
+
+	maxPacketSize = 9000
+	maxLabelLen   = 63
+
+	txtPublicKey = "pk="
+	txtAllowedIP = "ip="
+)
+
+// record is a remote peer resolved through mDNS
+type record struct {
+	info      rendezvous.PeerInfo
+	endpoint  *net.UDPAddr
+	expiresAt time.Time
+}
+
+// localPeer is a peer registered through this backend
+type localPeer struct {
+	req rendezvous.RegisterRequest
+	// expiresAt is the end of the lease of the registration, the zero time if it has none
+	expiresAt time.Time
+}
+
+// expired reports whether the lease of the registration has lapsed at the given time
+func (l *localPeer) expired(now time.Time) bool {
+	return !l.expiresAt.IsZero() && now.After(l.expiresAt)
+}
+
+// Rendezvous is a backend for peers sitting on the same LAN. Local peers are announced over mDNS as instances of the
+// _wgpunch._udp.local service, and remote peers are resolved the same way, so no server nor internet connection is
+// needed. The endpoint of a remote peer is built from the address its announcement came from and the port in its SRV
+// record, so the IP of the endpoint registered by the local peer is ignored
+type Rendezvous struct {
+	conn          *net.UDPConn
+	group         *net.UDPAddr
+	queryInterval time.Duration
+	recordTTL     time.Duration
+	logger        logr.Logger
+
+	mu      sync.Mutex
+	local   map[string]localPeer
+	remote  map[string]record
+	changed chan struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// New joins the mDNS multicast group and starts answering queries for the peers registered later on. Close must be
+// called to leave the group
+func New(opts ...Option) (*Rendezvous, error) {
+	cfg := newDefaultConfig()
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	group, err := net.ResolveUDPAddr(util.UDPProtocol, mdnsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve mDNS group: %w", err)
+	}
+
+	conn, err := net.ListenMulticastUDP(util.UDPProtocol, cfg.iface, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join mDNS group: %w", err)
+	}
+
+	// Multicast loopback is disabled by default, enable it so that peers running on the same host find each other
+	if errLoop := ipv4.NewPacketConn(conn).SetMulticastLoopback(true); errLoop != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to enable multicast loopback: %w", errLoop)
+	}
+
+	r := &Rendezvous{
+		conn:          conn,
+		group:         group,
+		queryInterval: cfg.queryInterval,
+		recordTTL:     cfg.recordTTL,
+		logger:        cfg.logger,
+		local:         make(map[string]localPeer),
+		remote:        make(map[string]record),
+		changed:       make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	go r.readLoop()
+
+	return r, nil
+}
+
+// Register announces the local peer on the LAN and keeps answering queries for it until it is deregistered or its
+// lease lapses. The candidates and the ICE credentials of the request are not announced since remote peers
+// already reach the local peer through the address its announcements come from
+func (r *Rendezvous) Register(_ context.Context, req rendezvous.RegisterRequest) error {
+	if err := validatePeerID(req.PeerID); err != nil {
+		return err
+	}
+
+	if _, err := net.ResolveUDPAddr(util.UDPProtocol, req.Endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", req.Endpoint, err)
+	}
+
+	local := localPeer{req: req, expiresAt: req.ExpiresAt(time.Now())}
+
+	r.mu.Lock()
+	r.local[req.PeerID] = local
+	r.mu.Unlock()
+
+	// Announce right away so that peers already waiting do not need to query again
+	return r.announce(req, r.announceTTL(local))
+}
+
+// WaitForPeer queries the LAN for the remote peer until it answers
+func (r *Rendezvous) WaitForPeer(ctx context.Context, peerID string) (*rendezvous.PeerInfo, *net.UDPAddr, error) {
+	if err := validatePeerID(peerID); err != nil {
+		return nil, nil, err
+	}
+
+	ticker := time.NewTicker(r.queryInterval)
+	defer ticker.Stop()
+
+	for {
+		r.mu.Lock()
+		rec, found := r.remote[peerID]
+		changed := r.changed
+		r.mu.Unlock()
+
+		if found && time.Now().Before(rec.expiresAt) {
+			info := rec.info
+			info.ExpiresAt = rec.expiresAt
+			return &info, rec.endpoint, nil
+		}
+
+		if !found {
+			if err := r.query(peerID); err != nil {
+				r.logger.Error(err, "failed to send mDNS query", "peerID", peerID)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-r.done:
+			return nil, nil, net.ErrClosed
+		case <-changed:
+		case <-ticker.C:
+			// Forget the peer if its record expired so that it is queried again
+			r.mu.Lock()
+			if rec, found = r.remote[peerID]; found && time.Now().After(rec.expiresAt) {
+				delete(r.remote, peerID)
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// Deregister stops announcing the local peer and lets the LAN know that its records are no longer valid
+func (r *Rendezvous) Deregister(_ context.Context, peerID string) error {
+	r.mu.Lock()
+	local, found := r.local[peerID]
+	delete(r.local, peerID)
+	r.mu.Unlock()
+
+	if !found {
+		return nil
+	}
+
+	// Records with a TTL of 0 are goodbye packets (RFC 6762, section 10.1)
+	return r.announce(local.req, 0)
+}
+
+// Close sends goodbye packets for every local peer and leaves the mDNS group
+func (r *Rendezvous) Close() error {
+	var err error
+
+	r.closeOnce.Do(func() {
+		r.mu.Lock()
+		local := make([]rendezvous.RegisterRequest, 0, len(r.local))
+		for _, peer := range r.local {
+			local = append(local, peer.req)
+		}
+		r.local = make(map[string]localPeer)
+		r.mu.Unlock()
+
+		for _, req := range local {
+			_ = r.announce(req, 0)
+		}
+
+		close(r.done)
+		err = r.conn.Close()
+	})
+
+	return err
+}
+
+// readLoop answers the queries about local peers and records the announcements of remote peers
+func (r *Rendezvous) readLoop() {
+	buf := make([]byte, maxPacketSize)
+
+	for {
+		n, src, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			r.logger.Error(err, "failed to read mDNS packet")
+			continue
+		}
+
+		var p dnsmessage.Parser
+		header, err := p.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		if header.Response {
+			r.handleResponse(&p, src)
+			continue
+		}
+
+		r.handleQuery(&p)
+	}
+}
+
+// handleQuery answers the questions about the service or about any local peer
+func (r *Rendezvous) handleQuery(p *dnsmessage.Parser) {
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+
+	r.mu.Lock()
+	var matches []localPeer
+	for peerID, local := range r.local {
+		// Stop answering for peers whose lease has lapsed, the records already cached expire on their own
+		if local.expired(now) {
+			delete(r.local, peerID)
+			continue
+		}
+
+		for _, q := range questions {
+			name := strings.ToLower(q.Name.String())
+			if name == ServiceName || name == strings.ToLower(instanceName(peerID)) {
+				matches = append(matches, local)
+				break
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for _, local := range matches {
+		if errAnnounce := r.announce(local.req, r.announceTTL(local)); errAnnounce != nil {
+			r.logger.Error(errAnnounce, "failed to answer mDNS query", "peerID", local.req.PeerID)
+		}
+	}
+}
+
+// handleResponse records the remote peers announced in a response. The endpoint is built from the source address of
+// the packet, which is known to be reachable, and the port of the SRV record
+func (r *Rendezvous) handleResponse(p *dnsmessage.Parser, src *net.UDPAddr) {
+	if errSkip := p.SkipAllQuestions(); errSkip != nil {
+		return
+	}
+
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return
+	}
+
+	if errSkip := p.SkipAllAuthorities(); errSkip != nil {
+		return
+	}
+
+	additionals, _ := p.AllAdditionals()
+
+	type partial struct {
+		port    uint16
+		ttl     uint32
+		txt     []string
+		hasSRV  bool
+		hasTXT  bool
+		goodbye bool
+	}
+	peers := make(map[string]*partial)
+
+	for _, res := range append(answers, additionals...) {
+		peerID, ok := peerIDFromInstance(res.Header.Name.String())
+		if !ok {
+			continue
+		}
+
+		entry, found := peers[peerID]
+		if !found {
+			entry = &partial{}
+			peers[peerID] = entry
+		}
+
+		switch body := res.Body.(type) {
+		case *dnsmessage.SRVResource:
+			entry.port = body.Port
+			entry.ttl = res.Header.TTL
+			entry.hasSRV = true
+			entry.goodbye = res.Header.TTL == 0
+		case *dnsmessage.TXTResource:
+			entry.txt = body.TXT
+			entry.hasTXT = true
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for peerID, entry := range peers {
+		if entry.goodbye {
+			delete(r.remote, peerID)
+			continue
+		}
+
+		if !entry.hasSRV || !entry.hasTXT {
+			continue
+		}
+
+		info := rendezvous.PeerInfo{PeerID: peerID}
+		for _, txt := range entry.txt {
+			switch {
+			case strings.HasPrefix(txt, txtPublicKey):
+				info.PublicKey = strings.TrimPrefix(txt, txtPublicKey)
+			case strings.HasPrefix(txt, txtAllowedIP):
+				info.AllowedIPs = append(info.AllowedIPs, strings.TrimPrefix(txt, txtAllowedIP))
+			}
+		}
+
+		endpoint := &net.UDPAddr{IP: src.IP, Port: int(entry.port), Zone: src.Zone}
+		info.Endpoint = endpoint.String()
+
+		r.remote[peerID] = record{
+			info:      info,
+			endpoint:  endpoint,
+			expiresAt: time.Now().Add(time.Duration(entry.ttl) * time.Second),
+		}
+	}
+
+	if len(peers) > 0 {
+		close(r.changed)
+		r.changed = make(chan struct{})
+	}
+}
+
+// announceTTL returns the TTL of the records announced for a local peer, which never outlives the lease of its
+// registration
+func (r *Rendezvous) announceTTL(local localPeer) time.Duration {
+	if local.expiresAt.IsZero() {
+		return r.recordTTL
+	}
+
+	// Round up so that the records of a lease about to lapse are not mistaken for goodbye packets
+	remaining := time.Until(local.expiresAt).Truncate(time.Second) + time.Second
+	if remaining < r.recordTTL {
+		return remaining
+	}
+
+	return r.recordTTL
+}
+
+// announce multicasts the records of a local peer with the given TTL
+func (r *Rendezvous) announce(req rendezvous.RegisterRequest, ttl time.Duration) error {
+	endpoint, err := net.ResolveUDPAddr(util.UDPProtocol, req.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", req.Endpoint, err)
+	}
+
+	service, err := dnsmessage.NewName(ServiceName)
+	if err != nil {
+		return fmt.Errorf("invalid service name: %w", err)
+	}
+
+	instance, err := dnsmessage.NewName(instanceName(req.PeerID))
+	if err != nil {
+		return fmt.Errorf("invalid instance name: %w", err)
+	}
+
+	host, err := dnsmessage.NewName(req.PeerID + ".local.")
+	if err != nil {
+		return fmt.Errorf("invalid host name: %w", err)
+	}
+
+	txt := []string{txtPublicKey + req.PublicKey}
+	for _, allowedIP := range req.AllowedIPs {
+		txt = append(txt, txtAllowedIP+allowedIP)
+	}
+
+	ttlSec := uint32(ttl.Seconds())
+	shared := dnsmessage.ResourceHeader{Name: service, Class: dnsmessage.ClassINET, TTL: ttlSec}
+	unique := dnsmessage.ResourceHeader{Name: instance, Class: dnsmessage.ClassINET | cacheFlushBit, TTL: ttlSec}
+	hostHeader := dnsmessage.ResourceHeader{Name: host, Class: dnsmessage.ClassINET | cacheFlushBit, TTL: ttlSec}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+
+	if err = b.StartAnswers(); err != nil {
+		return err
+	}
+
+	if err = b.PTRResource(shared, dnsmessage.PTRResource{PTR: instance}); err != nil {
+		return err
+	}
+
+	if err = b.SRVResource(unique, dnsmessage.SRVResource{Port: uint16(endpoint.Port), Target: host}); err != nil {
+		return err
+	}
+
+	if err = b.TXTResource(unique, dnsmessage.TXTResource{TXT: txt}); err != nil {
+		return err
+	}
+
+	// The SRV target must resolve, publish every address of the host
+	for _, ip := range util.LocalIPs(true) {
+		if ip.To4() == nil {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip)
+
+			if err = b.AAAAResource(hostHeader, aaaa); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+
+		if err = b.AResource(hostHeader, a); err != nil {
+			return err
+		}
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		return fmt.Errorf("failed to build mDNS response: %w", err)
+	}
+
+	if _, err = r.conn.WriteToUDP(msg, r.group); err != nil {
+		return fmt.Errorf("failed to send mDNS response: %w", err)
+	}
+
+	return nil
+}
+
+// query multicasts a question for the records of a remote peer
+func (r *Rendezvous) query(peerID string) error {
+	instance, err := dnsmessage.NewName(instanceName(peerID))
+	if err != nil {
+		return fmt.Errorf("invalid instance name: %w", err)
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+
+	if err = b.StartQuestions(); err != nil {
+		return err
+	}
+
+	for _, qType := range []dnsmessage.Type{dnsmessage.TypeSRV, dnsmessage.TypeTXT} {
+		if err = b.Question(dnsmessage.Question{Name: instance, Type: qType, Class: dnsmessage.ClassINET}); err != nil {
+			return err
+		}
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		return fmt.Errorf("failed to build mDNS query: %w", err)
+	}
+
+	_, err = r.conn.WriteToUDP(msg, r.group)
+	return err
+}
+
+// instanceName returns the DNS-SD instance name of a peer
+func instanceName(peerID string) string {
+	return peerID + "." + ServiceName
+}
+
+// peerIDFromInstance extracts the peer ID from a DNS-SD instance name
+func peerIDFromInstance(name string) (string, bool) {
+	peerID, found := strings.CutSuffix(strings.ToLower(name), "."+ServiceName)
+	if !found || peerID == "" {
+		return "", false
+	}
+
+	// Keep the original case of the announced name
+	return name[:len(peerID)], true
+}
+
+// validatePeerID checks that peerID can be used as a single DNS label
+func validatePeerID(peerID string) error {
+	if peerID == "" || len(peerID) > maxLabelLen || strings.ContainsAny(peerID, ". ") {
+		return fmt.Errorf("peer ID %q cannot be announced over mDNS", peerID)
+	}
+
+	return nil
+}
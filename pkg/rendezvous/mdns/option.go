@@ -0,0 +1,59 @@
+package mdns
+
+import (
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	defaultQueryInterval = 1 * time.Second
+	defaultRecordTTL     = 120 * time.Second
+)
+
+type config struct {
+	iface         *net.Interface
+	queryInterval time.Duration
+	recordTTL     time.Duration
+	logger        logr.Logger
+}
+
+type Option func(*config)
+
+func newDefaultConfig() *config {
+	return &config{
+		queryInterval: defaultQueryInterval,
+		recordTTL:     defaultRecordTTL,
+		logger:        logr.Discard(),
+	}
+}
+
+// WithInterface sets the network interface on which peers are announced and resolved. By default the system picks it
+func WithInterface(iface *net.Interface) Option {
+	return func(cfg *config) {
+		cfg.iface = iface
+	}
+}
+
+// WithQueryInterval sets the interval at which queries are repeated while waiting for a remote peer. The interval must
+// be greater than 0
+func WithQueryInterval(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.queryInterval = interval
+	}
+}
+
+// WithRecordTTL sets the TTL of the announced records. Remote peers forget the local peer once it expires
+func WithRecordTTL(ttl time.Duration) Option {
+	return func(cfg *config) {
+		cfg.recordTTL = ttl
+	}
+}
+
+// WithLogger sets the logger to use for logging. The logger must implement the logr.Logger interface
+func WithLogger(logger logr.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
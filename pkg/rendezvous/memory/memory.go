@@ -0,0 +1,190 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const (
+	// requestTTL bounds how long a connection request waits to be consumed, like the registration lease of the peer
+	// that left it
+	requestTTL = 1 * time.Minute
+	// maxRequestsPerPeer bounds the queue of connection requests of every peer, the oldest request is dropped first
+	maxRequestsPerPeer = 64
+)
+
+// pendingRequest is a connection request waiting to be consumed
+type pendingRequest struct {
+	req       rendezvous.ConnRequest
+	expiresAt time.Time
+}
+
+// Rendezvous is an in-memory backend meant to be shared by every connector of the same process, so that peers can
+// find each other without any server. Waiters are woken up as soon as the information they wait for is available,
+// which makes it suitable for deterministic tests and embedded simulations
+type Rendezvous struct {
+	mu       sync.Mutex
+	peers    map[string]rendezvous.PeerInfo
+	requests map[string][]pendingRequest
+
+	// changed is closed and replaced every time the state changes in order to wake up the waiters
+	changed chan struct{}
+}
+
+func New() *Rendezvous {
+	return &Rendezvous{
+		peers:    make(map[string]rendezvous.PeerInfo),
+		requests: make(map[string][]pendingRequest),
+		changed:  make(chan struct{}),
+	}
+}
+
+func (r *Rendezvous) Register(_ context.Context, req rendezvous.RegisterRequest) error {
+	if _, err := net.ResolveUDPAddr(util.UDPProtocol, req.Endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", req.Endpoint, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.peers[req.PeerID] = rendezvous.PeerInfo{
+		PeerID:      req.PeerID,
+		PublicKey:   req.PublicKey,
+		Endpoint:    req.Endpoint,
+		AllowedIPs:  append([]string(nil), req.AllowedIPs...),
+		Candidates:  append([]string(nil), req.Candidates...),
+		Ufrag:       req.Ufrag,
+		Pwd:         req.Pwd,
+		PortMapping: req.PortMapping,
+		NATBehavior: req.NATBehavior,
+		ExpiresAt:   req.ExpiresAt(time.Now()),
+	}
+	r.notify()
+
+	return nil
+}
+
+func (r *Rendezvous) WaitForPeer(ctx context.Context, peerID string) (*rendezvous.PeerInfo, *net.UDPAddr, error) {
+	for {
+		r.mu.Lock()
+		info, found := r.peers[peerID]
+		changed := r.changed
+
+		// Lapsed registrations are dropped, the peer shows up again once it registers anew
+		if found && info.Expired(time.Now()) {
+			delete(r.peers, peerID)
+			found = false
+		}
+		r.mu.Unlock()
+
+		if found {
+			endpoint, err := net.ResolveUDPAddr(util.UDPProtocol, info.Endpoint)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid endpoint %q for peer %s: %w", info.Endpoint, peerID, err)
+			}
+			return &info, endpoint, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (r *Rendezvous) Deregister(_ context.Context, peerID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.peers, peerID)
+	r.notify()
+
+	return nil
+}
+
+func (r *Rendezvous) Peers(_ context.Context) ([]rendezvous.PeerInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	peers := make([]rendezvous.PeerInfo, 0, len(r.peers))
+	for peerID, info := range r.peers {
+		if info.Expired(now) {
+			delete(r.peers, peerID)
+			continue
+		}
+
+		peers = append(peers, info)
+	}
+
+	return peers, nil
+}
+
+// RequestConnection queues a connection request for req.ToPeerID. Requests that are not consumed within requestTTL
+// are dropped, and so is the oldest one once the queue of the peer is full
+func (r *Rendezvous) RequestConnection(_ context.Context, req rendezvous.ConnRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	queue := pending(r.requests[req.ToPeerID], time.Now())
+	if len(queue) >= maxRequestsPerPeer {
+		queue = queue[len(queue)-maxRequestsPerPeer+1:]
+	}
+
+	r.requests[req.ToPeerID] = append(queue, pendingRequest{req: req, expiresAt: time.Now().Add(requestTTL)})
+	r.notify()
+
+	return nil
+}
+
+func (r *Rendezvous) WaitForRequest(ctx context.Context, peerID string) (*rendezvous.ConnRequest, error) {
+	for {
+		r.mu.Lock()
+		queue := pending(r.requests[peerID], time.Now())
+		changed := r.changed
+
+		if len(queue) > 0 {
+			req := queue[0].req
+			if len(queue) == 1 {
+				delete(r.requests, peerID)
+			} else {
+				r.requests[peerID] = queue[1:]
+			}
+			r.mu.Unlock()
+
+			return &req, nil
+		}
+
+		delete(r.requests, peerID)
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// pending skips the requests of the queue that expired at now. Requests are queued in order, so expired ones are
+// always at the front
+func pending(queue []pendingRequest, now time.Time) []pendingRequest {
+	for len(queue) > 0 && now.After(queue[0].expiresAt) {
+		queue = queue[1:]
+	}
+
+	return queue
+}
+
+// notify wakes up every waiter. Must be called with the lock held
+func (r *Rendezvous) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
@@ -0,0 +1,52 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+)
+
+func TestRequestQueueIsBounded(t *testing.T) {
+	r := New()
+	ctx := context.Background()
+
+	for i := range maxRequestsPerPeer + 1 {
+		if err := r.RequestConnection(ctx, rendezvous.ConnRequest{FromPeerID: fmt.Sprint(i), ToPeerID: "hub"}); err != nil {
+			t.Fatalf("failed to request connection: %v", err)
+		}
+	}
+
+	if n := len(r.requests["hub"]); n != maxRequestsPerPeer {
+		t.Fatalf("expected %d queued requests, got %d", maxRequestsPerPeer, n)
+	}
+
+	// The oldest request has been dropped
+	req, err := r.WaitForRequest(ctx, "hub")
+	if err != nil || req.FromPeerID != "1" {
+		t.Fatalf("expected request from 1, got %+v: %v", req, err)
+	}
+}
+
+func TestExpiredRequestsAreDropped(t *testing.T) {
+	r := New()
+	ctx := context.Background()
+
+	if err := r.RequestConnection(ctx, rendezvous.ConnRequest{FromPeerID: "stale", ToPeerID: "hub"}); err != nil {
+		t.Fatalf("failed to request connection: %v", err)
+	}
+	r.requests["hub"][0].expiresAt = time.Now().Add(-time.Second)
+
+	ctxWait, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	if req, err := r.WaitForRequest(ctxWait, "hub"); err == nil {
+		t.Fatalf("expected expired request dropped, got %+v", req)
+	}
+
+	if _, found := r.requests["hub"]; found {
+		t.Fatalf("expected queue of expired requests released")
+	}
+}
@@ -0,0 +1,56 @@
+package peerhub
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/yago-123/peer-hub/pkg/client"
+	"github.com/yago-123/peer-hub/pkg/types"
+
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+)
+
+// peerHub adapts the peer-hub client to the rendezvous.Rendezvous interface
+type peerHub struct {
+	client client.Rendezvous
+}
+
+// New creates a rendezvous backend that talks to the peer-hub server at serverURL, polling it every waitInterval while
+// waiting for remote peers. It does not deliver connection requests, so Connector.Listen fails with it unless a
+// requester is configured via connect.WithRequester
+func New(serverURL string, waitInterval time.Duration) rendezvous.Rendezvous {
+	return &peerHub{
+		client: client.New(serverURL, waitInterval),
+	}
+}
+
+// Register publishes the local peer in peer-hub. The TTL, the candidates and the ICE credentials of the request are
+// ignored since peer-hub supports none of them, so remote peers only see the endpoint and punch it
+func (p *peerHub) Register(ctx context.Context, req rendezvous.RegisterRequest) error {
+	return p.client.Register(ctx, types.RegisterRequest{
+		PeerID:     req.PeerID,
+		PublicKey:  req.PublicKey,
+		Endpoint:   req.Endpoint,
+		AllowedIPs: req.AllowedIPs,
+	})
+}
+
+func (p *peerHub) WaitForPeer(ctx context.Context, peerID string) (*rendezvous.PeerInfo, *net.UDPAddr, error) {
+	remote, endpoint, err := p.client.WaitForPeer(ctx, peerID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &rendezvous.PeerInfo{
+		PeerID:     peerID,
+		PublicKey:  remote.PublicKey,
+		Endpoint:   endpoint.String(),
+		AllowedIPs: remote.AllowedIPs,
+	}, endpoint, nil
+}
+
+// Deregister is a no-op, peer-hub does not support removing registrations
+func (p *peerHub) Deregister(_ context.Context, _ string) error {
+	return nil
+}
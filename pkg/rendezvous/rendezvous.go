@@ -0,0 +1,118 @@
+package rendezvous
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// RegisterRequest holds the information that a peer publishes about itself so that remote peers can connect to it
+type RegisterRequest struct {
+	PeerID     string   `json:"peer_id"`
+	PublicKey  string   `json:"public_key"`
+	Endpoint   string   `json:"endpoint"`
+	AllowedIPs []string `json:"allowed_ips"`
+	// Candidates are additional addresses the peer might be reachable at, like the addresses of its local interfaces
+	// for peers on the same LAN or behind the same NAT. They are encoded as ICE candidate attributes, plain addresses
+	// are taken as host candidates
+	Candidates []string `json:"candidates,omitempty"`
+	// Ufrag and Pwd authenticate the connectivity checks of the peer, they are empty if the peer does not run them
+	Ufrag string `json:"ufrag,omitempty"`
+	Pwd   string `json:"pwd,omitempty"`
+	// PortMapping is the mapping of the NAT in front of the peer encoded via puncher.Mapping, which lets remote peers
+	// predict its ports if it is symmetric. It is empty if the peer did not measure it
+	PortMapping string `json:"port_mapping,omitempty"`
+	// NATBehavior is the mapping and filtering behavior of the NAT in front of the peer encoded via
+	// natcheck.NATBehavior, which lets remote peers skip punching if it is bound to fail. It is empty if the peer did
+	// not discover it
+	NATBehavior string `json:"nat_behavior,omitempty"`
+	// TTL is the lease of the registration, which lapses unless it is registered again in time. A TTL of 0 leaves the
+	// lifetime of the registration up to the backend
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// ExpiresAt returns the time at which a registration performed at now lapses, which is the zero time if the request
+// has no TTL
+func (r RegisterRequest) ExpiresAt(now time.Time) time.Time {
+	if r.TTL <= 0 {
+		return time.Time{}
+	}
+
+	return now.Add(r.TTL)
+}
+
+// PeerInfo holds the information published by a remote peer
+type PeerInfo struct {
+	PeerID     string   `json:"peer_id"`
+	PublicKey  string   `json:"public_key"`
+	Endpoint   string   `json:"endpoint"`
+	AllowedIPs []string `json:"allowed_ips"`
+	Candidates []string `json:"candidates,omitempty"`
+	Ufrag      string   `json:"ufrag,omitempty"`
+	Pwd        string   `json:"pwd,omitempty"`
+	// PortMapping is the mapping of the NAT in front of the peer, see RegisterRequest
+	PortMapping string `json:"port_mapping,omitempty"`
+	// NATBehavior is the behavior of the NAT in front of the peer, see RegisterRequest
+	NATBehavior string `json:"nat_behavior,omitempty"`
+	// ExpiresAt is the time at which the registration lapses, the zero time if it does not
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// Expired reports whether the registration has lapsed at the given time
+func (p *PeerInfo) Expired(now time.Time) bool {
+	return !p.ExpiresAt.IsZero() && now.After(p.ExpiresAt)
+}
+
+// ConnRequest is the record left by a peer that wants to connect with another one
+type ConnRequest struct {
+	FromPeerID string `json:"from_peer_id"`
+	ToPeerID   string `json:"to_peer_id"`
+}
+
+// Rendezvous is the backend through which peers exchange the information required to connect with each other
+type Rendezvous interface {
+	// Register publishes the information of the local peer, replacing the previous registration and renewing its
+	// lease if any
+	Register(ctx context.Context, req RegisterRequest) error
+	// WaitForPeer blocks until the remote peer identified by peerID is registered and returns its information
+	// together with its resolved endpoint. Registrations whose lease has lapsed are ignored
+	WaitForPeer(ctx context.Context, peerID string) (*PeerInfo, *net.UDPAddr, error)
+	// Deregister removes the information published by the peer identified by peerID
+	Deregister(ctx context.Context, peerID string) error
+}
+
+// Requester is implemented by backends able to deliver connection requests, so that a peer can accept connections
+// from peers whose ID is not known in advance
+type Requester interface {
+	// RequestConnection leaves a connection request for req.ToPeerID
+	RequestConnection(ctx context.Context, req ConnRequest) error
+	// WaitForRequest blocks until a connection request addressed to peerID is available and consumes it
+	WaitForRequest(ctx context.Context, peerID string) (*ConnRequest, error)
+}
+
+// Lister is implemented by backends able to enumerate the registered peers, so that the members of a mesh can follow
+// the peers joining and leaving the rendezvous
+type Lister interface {
+	// Peers returns every peer whose registration has not lapsed
+	Peers(ctx context.Context) ([]PeerInfo, error)
+}
+
+// RelayGrant gives access to a relay server in pkg/relay/server through which the traffic with a remote peer is
+// forwarded when no direct path can be opened
+type RelayGrant struct {
+	// Server is the address of the relay server
+	Server string `json:"server"`
+	// Token grants access to the relay session shared with the remote peer
+	Token string `json:"token"`
+	// Key proves possession of Token when joining the session, see relay.BindKey. Unlike the token it is never sent to
+	// the relay server
+	Key []byte `json:"key"`
+}
+
+// RelayBroker is implemented by backends able to hand out access to a relay server
+type RelayBroker interface {
+	// RequestRelay returns the grant through which req.FromPeerID reaches req.ToPeerID via the relay server. The remote
+	// peer must request its own grant, the relay server only forwards traffic once both peers have joined the session.
+	// Backends must only hand out grants to req.FromPeerID itself
+	RequestRelay(ctx context.Context, req ConnRequest) (*RelayGrant, error)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	errors "github.com/yago-123/wg-punch/pkg/error"
+)
+
+const (
+	fileStorePerm = 0o600
+)
+
+// fileState is the content of the file backing a fileStore
+type fileState struct {
+	Peers    map[string]Entry     `json:"peers"`
+	Requests map[string][]Request `json:"requests"`
+}
+
+// fileStore keeps registrations and connection requests in a JSON file, so that they survive server restarts. The
+// whole state is kept in memory and written back atomically after every change
+type fileStore struct {
+	path string
+
+	mu    sync.Mutex
+	state fileState
+}
+
+// NewFileStore creates a store backed by the file at path, loading its content if the file already exists
+func NewFileStore(path string) (Store, error) {
+	f := &fileStore{
+		path: path,
+		state: fileState{
+			Peers:    make(map[string]Entry),
+			Requests: make(map[string][]Request),
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, fmt.Errorf("failed to read store file %s: %w", path, err)
+	}
+
+	if errDecode := json.Unmarshal(data, &f.state); errDecode != nil {
+		return nil, fmt.Errorf("failed to decode store file %s: %w", path, errDecode)
+	}
+
+	if f.state.Peers == nil {
+		f.state.Peers = make(map[string]Entry)
+	}
+
+	if f.state.Requests == nil {
+		f.state.Requests = make(map[string][]Request)
+	}
+
+	return f, nil
+}
+
+func (f *fileStore) PutPeer(_ context.Context, entry Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.state.Peers[entry.Peer.PeerID] = entry
+
+	return f.flush()
+}
+
+func (f *fileStore) GetPeer(_ context.Context, peerID string) (*Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, found := f.state.Peers[peerID]
+	if !found || entry.Expired(time.Now()) {
+		return nil, errors.ErrPeerNotFound
+	}
+
+	return &entry, nil
+}
+
+func (f *fileStore) ListPeers(_ context.Context) ([]Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	entries := make([]Entry, 0, len(f.state.Peers))
+	for _, entry := range f.state.Peers {
+		if !entry.Expired(now) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+func (f *fileStore) DeletePeer(_ context.Context, peerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, found := f.state.Peers[peerID]; !found {
+		return nil
+	}
+
+	delete(f.state.Peers, peerID)
+
+	return f.flush()
+}
+
+func (f *fileStore) PushRequest(_ context.Context, request Request) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	peerID := request.Request.ToPeerID
+	f.state.Requests[peerID] = enqueue(f.state.Requests[peerID], request, time.Now())
+
+	return f.flush()
+}
+
+func (f *fileStore) PopRequest(_ context.Context, peerID string) (*Request, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	queue, found := f.state.Requests[peerID]
+	if !found {
+		return nil, errors.ErrRequestNotFound
+	}
+
+	now := time.Now()
+	for len(queue) > 0 {
+		request := queue[0]
+		queue = queue[1:]
+
+		if !request.Expired(now) {
+			f.state.Requests[peerID] = queue
+			if len(queue) == 0 {
+				delete(f.state.Requests, peerID)
+			}
+			return &request, f.flush()
+		}
+	}
+
+	delete(f.state.Requests, peerID)
+
+	if errFlush := f.flush(); errFlush != nil {
+		return nil, errFlush
+	}
+
+	return nil, errors.ErrRequestNotFound
+}
+
+// flush drops the expired entries and writes the state to a temporary file that is then renamed over the store file,
+// so that readers never observe a partially written file. Must be called with the lock held
+func (f *fileStore) flush() error {
+	now := time.Now()
+	for peerID, entry := range f.state.Peers {
+		if entry.Expired(now) {
+			delete(f.state.Peers, peerID)
+		}
+	}
+
+	data, err := json.Marshal(f.state)
+	if err != nil {
+		return fmt.Errorf("failed to encode store: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary store file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, errWrite := tmp.Write(data); errWrite != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write store file: %w", errWrite)
+	}
+
+	if errClose := tmp.Close(); errClose != nil {
+		return fmt.Errorf("failed to write store file: %w", errClose)
+	}
+
+	if errChmod := os.Chmod(tmp.Name(), fileStorePerm); errChmod != nil {
+		return fmt.Errorf("failed to set store file permissions: %w", errChmod)
+	}
+
+	if errRename := os.Rename(tmp.Name(), f.path); errRename != nil {
+		return fmt.Errorf("failed to replace store file: %w", errRename)
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	errors "github.com/yago-123/wg-punch/pkg/error"
+)
+
+// memoryStore keeps registrations and connection requests in memory, they are lost when the server stops
+type memoryStore struct {
+	mu       sync.Mutex
+	peers    map[string]Entry
+	requests map[string][]Request
+}
+
+// NewMemoryStore creates a store that keeps everything in memory
+func NewMemoryStore() Store {
+	return &memoryStore{
+		peers:    make(map[string]Entry),
+		requests: make(map[string][]Request),
+	}
+}
+
+func (m *memoryStore) PutPeer(_ context.Context, entry Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.peers[entry.Peer.PeerID] = entry
+
+	return nil
+}
+
+func (m *memoryStore) GetPeer(_ context.Context, peerID string) (*Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, found := m.peers[peerID]
+	if !found {
+		return nil, errors.ErrPeerNotFound
+	}
+
+	if entry.Expired(time.Now()) {
+		delete(m.peers, peerID)
+		return nil, errors.ErrPeerNotFound
+	}
+
+	return &entry, nil
+}
+
+func (m *memoryStore) ListPeers(_ context.Context) ([]Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	entries := make([]Entry, 0, len(m.peers))
+	for peerID, entry := range m.peers {
+		if entry.Expired(now) {
+			delete(m.peers, peerID)
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (m *memoryStore) DeletePeer(_ context.Context, peerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.peers, peerID)
+
+	return nil
+}
+
+func (m *memoryStore) PushRequest(_ context.Context, request Request) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peerID := request.Request.ToPeerID
+	m.requests[peerID] = enqueue(m.requests[peerID], request, time.Now())
+
+	return nil
+}
+
+func (m *memoryStore) PopRequest(_ context.Context, peerID string) (*Request, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	queue := m.requests[peerID]
+
+	for len(queue) > 0 {
+		request := queue[0]
+		queue = queue[1:]
+
+		if !request.Expired(now) {
+			m.requests[peerID] = queue
+			if len(queue) == 0 {
+				delete(m.requests, peerID)
+			}
+			return &request, nil
+		}
+	}
+
+	delete(m.requests, peerID)
+
+	return nil, errors.ErrRequestNotFound
+}
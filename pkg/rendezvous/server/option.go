@@ -0,0 +1,81 @@
+package server
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	defaultEntryTTL   = 5 * time.Minute
+	defaultRate       = 5
+	defaultBurst      = 20
+	defaultMaxBodyLen = 64 * 1024
+
+	// Relay tokens only grant joining a session, which outlives them as long as the peers keep refreshing it. Peers
+	// request a new one every time they connect
+	defaultRelayTokenTTL = 5 * time.Minute
+)
+
+type config struct {
+	entryTTL time.Duration
+	rate     float64
+	burst    int
+
+	relayServer   string
+	relaySecret   []byte
+	relayTokenTTL time.Duration
+
+	logger logr.Logger
+}
+
+type Option func(*config)
+
+func newDefaultConfig() *config {
+	return &config{
+		entryTTL: defaultEntryTTL,
+		rate:     defaultRate,
+		burst:    defaultBurst,
+
+		relayTokenTTL: defaultRelayTokenTTL,
+
+		logger: logr.Discard(),
+	}
+}
+
+// WithEntryTTL sets how long registrations and connection requests are kept. Peers may request a shorter lease for
+// their registrations but not a longer one. A TTL of 0 keeps them forever unless the peer requests a lease
+func WithEntryTTL(ttl time.Duration) Option {
+	return func(cfg *config) {
+		cfg.entryTTL = ttl
+	}
+}
+
+// WithRateLimit sets the number of requests per second allowed per client address, with bursts of up to burst
+// requests. A rate of 0 disables rate limiting
+func WithRateLimit(rate float64, burst int) Option {
+	return func(cfg *config) {
+		cfg.rate = rate
+		cfg.burst = burst
+	}
+}
+
+// WithRelay makes the server hand out access to the relay server at addr, see cmd/relay. Tokens are signed with the
+// secret shared with the relay server and are valid for tokenTTL, which falls back to 5 minutes if it is 0. They are
+// only handed out to registered peers that present the token of their registration
+func WithRelay(addr string, secret []byte, tokenTTL time.Duration) Option {
+	return func(cfg *config) {
+		cfg.relayServer = addr
+		cfg.relaySecret = secret
+		if tokenTTL > 0 {
+			cfg.relayTokenTTL = tokenTTL
+		}
+	}
+}
+
+// WithLogger sets the logger to use for logging. The logger must implement the logr.Logger interface
+func WithLogger(logger logr.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
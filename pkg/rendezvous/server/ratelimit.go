@@ -0,0 +1,80 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// limiterIdleTimeout is how long the bucket of a client is kept after its last request
+const limiterIdleTimeout = 10 * time.Minute
+
+// bucket is a token bucket that refills at a fixed rate
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter limits the number of requests per client with a token bucket per client address
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// newRateLimiter creates a limiter that allows rate requests per second per client, with bursts of up to burst requests.
+// A rate of 0 disables the limiter
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow reports whether a new request from client fits in its bucket, consuming a token if so
+func (r *rateLimiter) Allow(client string) bool {
+	if r.rate <= 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.sweep(now)
+
+	b, found := r.buckets[client]
+	if !found {
+		b = &bucket{tokens: r.burst, lastSeen: now}
+		r.buckets[client] = b
+	}
+
+	// Refill the tokens accumulated since the last request
+	b.tokens = min(r.burst, b.tokens+now.Sub(b.lastSeen).Seconds()*r.rate)
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// sweep drops the buckets of clients that have been idle for a while. Must be called with the lock held
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < limiterIdleTimeout {
+		return
+	}
+
+	for client, b := range r.buckets {
+		if now.Sub(b.lastSeen) > limiterIdleTimeout {
+			delete(r.buckets, client)
+		}
+	}
+
+	r.lastSweep = now
+}
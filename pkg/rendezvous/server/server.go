@@ -0,0 +1,523 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/ice"
+	"github.com/yago-123/wg-punch/pkg/natcheck"
+	"github.com/yago-123/wg-punch/pkg/puncher"
+	"github.com/yago-123/wg-punch/pkg/relay"
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+// HTTP routes served by the rendezvous server. RegisterPath and PeerPath make up the protocol of peer-hub, so its
+// client registers and looks up peers as it does against rendezvous.yago.ninja. The rest of the routes extend it with
+// deregistration, peer listing, connection requests and relay access, see pkg/rendezvous/httpclient
+const (
+	RegisterPath = "/register"
+	PeerPath     = "/peer"
+	PeersPath    = "/peers"
+	RequestsPath = "/requests"
+	RelayPath    = "/relay"
+
+	peerIDParam = "peerID"
+
+	// maxCandidates bounds the number of candidates a peer can register
+	maxCandidates = 16
+
+	// tokenLen is the number of random bytes of the token handed out on registration
+	tokenLen     = 32
+	bearerPrefix = "Bearer "
+
+	shutdownTimeout = 5 * time.Second
+)
+
+// RegisterReply is the reply to a registration. Token must be presented as a bearer token in order to update or remove
+// the registration, or to consume the connection requests addressed to the peer, until the registration lapses
+type RegisterReply struct {
+	Token string `json:"token"`
+}
+
+// Server is a rendezvous server that lets peers register themselves, look up each other and exchange connection
+// requests over HTTP. Registrations and lookups follow the peer-hub protocol, the extra fields of a registration like
+// its candidates or its lease are optional and ignored by peer-hub clients. It can also hand out access to a relay server for peers that cannot reach each other directly.
+//
+// A peer ID belongs to whoever registered it first until the registration lapses or is removed, later registrations of
+// the same ID must present the token returned by the first one. peer-hub clients do not present it, so they can only
+// register IDs that are free
+type Server struct {
+	store   Store
+	limiter *rateLimiter
+
+	// mu serializes the changes of registrations, so that their ownership is checked and updated at once
+	mu sync.Mutex
+
+	entryTTL time.Duration
+
+	relayServer   string
+	relaySecret   []byte
+	relayTokenTTL time.Duration
+
+	logger logr.Logger
+}
+
+func New(store Store, opts ...Option) *Server {
+	cfg := newDefaultConfig()
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &Server{
+		store:    store,
+		limiter:  newRateLimiter(cfg.rate, cfg.burst),
+		entryTTL: cfg.entryTTL,
+
+		relayServer:   cfg.relayServer,
+		relaySecret:   cfg.relaySecret,
+		relayTokenTTL: cfg.relayTokenTTL,
+
+		logger: cfg.logger,
+	}
+}
+
+// Handler returns the HTTP handler serving the rendezvous protocol
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// peer-hub protocol
+	mux.HandleFunc("POST "+RegisterPath, s.handleRegister)
+	mux.HandleFunc("GET "+PeerPath+"/{"+peerIDParam+"}", s.handleGetPeer)
+
+	// Extensions
+	mux.HandleFunc("DELETE "+PeerPath+"/{"+peerIDParam+"}", s.handleDeletePeer)
+	mux.HandleFunc("GET "+PeersPath, s.handleListPeers)
+	mux.HandleFunc("POST "+RequestsPath, s.handlePushRequest)
+	mux.HandleFunc("GET "+RequestsPath+"/{"+peerIDParam+"}", s.handlePopRequest)
+	mux.HandleFunc("POST "+RelayPath, s.handleRelay)
+
+	return mux
+}
+
+// ListenAndServe serves the rendezvous protocol on addr until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: shutdownTimeout,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	s.logger.Info("Rendezvous server listening", "address", addr)
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		ctxShutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		return srv.Shutdown(ctxShutdown)
+	}
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req rendezvous.RegisterRequest
+	if !s.decode(w, r, &req) {
+		return
+	}
+
+	if req.PeerID == "" || req.PublicKey == "" {
+		http.Error(w, "peer_id and public_key are required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := net.ResolveUDPAddr(util.UDPProtocol, req.Endpoint); err != nil {
+		http.Error(w, "invalid endpoint", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Candidates) > maxCandidates {
+		http.Error(w, "too many candidates", http.StatusBadRequest)
+		return
+	}
+
+	for _, candidate := range req.Candidates {
+		if _, err := ice.ParseCandidate(candidate); err != nil {
+			http.Error(w, "invalid candidate", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.PortMapping != "" {
+		if _, err := puncher.ParseMapping(req.PortMapping); err != nil {
+			http.Error(w, "invalid port mapping", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.NATBehavior != "" {
+		if _, err := natcheck.ParseNATBehavior(req.NATBehavior); err != nil {
+			http.Error(w, "invalid NAT behavior", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !s.allow(w, r) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.authorize(w, r, req.PeerID)
+	if !ok {
+		return
+	}
+
+	// The owner keeps its token across registrations, a new one is handed out for IDs that are free
+	token := bearerToken(r)
+	if current == nil || current.TokenHash == "" {
+		var err error
+		if token, err = newToken(); err != nil {
+			s.fail(w, err, "failed to generate token", "peerID", req.PeerID)
+			return
+		}
+	}
+
+	entry := Entry{
+		Peer: rendezvous.PeerInfo{
+			PeerID:      req.PeerID,
+			PublicKey:   req.PublicKey,
+			Endpoint:    req.Endpoint,
+			AllowedIPs:  req.AllowedIPs,
+			Candidates:  req.Candidates,
+			Ufrag:       req.Ufrag,
+			Pwd:         req.Pwd,
+			PortMapping: req.PortMapping,
+			NATBehavior: req.NATBehavior,
+		},
+		ExpiresAt: s.leaseExpiry(req),
+		TokenHash: hashToken(token),
+	}
+
+	if err := s.store.PutPeer(r.Context(), entry); err != nil {
+		s.fail(w, err, "failed to store peer", "peerID", req.PeerID)
+		return
+	}
+
+	s.logger.Info("Registered peer", "peerID", req.PeerID, "endpoint", req.Endpoint, "allowedIPs", req.AllowedIPs)
+
+	// peer-hub clients expect 200 OK and ignore the body
+	s.encode(w, RegisterReply{Token: token})
+}
+
+func (s *Server) handleGetPeer(w http.ResponseWriter, r *http.Request) {
+	peerID := r.PathValue(peerIDParam)
+	if !s.allow(w, r) {
+		return
+	}
+
+	entry, err := s.store.GetPeer(r.Context(), peerID)
+	if errors.Is(err, wgerrors.ErrPeerNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		s.fail(w, err, "failed to get peer", "peerID", peerID)
+		return
+	}
+
+	// Let the client know when the registration lapses
+	info := entry.Peer
+	info.ExpiresAt = entry.ExpiresAt
+
+	s.encode(w, info)
+}
+
+func (s *Server) handleListPeers(w http.ResponseWriter, r *http.Request) {
+	if !s.allow(w, r) {
+		return
+	}
+
+	entries, err := s.store.ListPeers(r.Context())
+	if err != nil {
+		s.fail(w, err, "failed to list peers")
+		return
+	}
+
+	peers := make([]rendezvous.PeerInfo, 0, len(entries))
+	for _, entry := range entries {
+		info := entry.Peer
+		info.ExpiresAt = entry.ExpiresAt
+		peers = append(peers, info)
+	}
+
+	s.encode(w, peers)
+}
+
+func (s *Server) handleDeletePeer(w http.ResponseWriter, r *http.Request) {
+	peerID := r.PathValue(peerIDParam)
+	if !s.allow(w, r) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.authorize(w, r, peerID)
+	if !ok {
+		return
+	}
+
+	if current == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := s.store.DeletePeer(r.Context(), peerID); err != nil {
+		s.fail(w, err, "failed to delete peer", "peerID", peerID)
+		return
+	}
+
+	s.logger.Info("Deregistered peer", "peerID", peerID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handlePushRequest(w http.ResponseWriter, r *http.Request) {
+	var req rendezvous.ConnRequest
+	if !s.decode(w, r, &req) {
+		return
+	}
+
+	if req.FromPeerID == "" || req.ToPeerID == "" {
+		http.Error(w, "from_peer_id and to_peer_id are required", http.StatusBadRequest)
+		return
+	}
+
+	if !s.allow(w, r) {
+		return
+	}
+
+	if err := s.store.PushRequest(r.Context(), Request{Request: req, ExpiresAt: s.expiry()}); err != nil {
+		s.fail(w, err, "failed to store connection request", "fromPeerID", req.FromPeerID, "toPeerID", req.ToPeerID)
+		return
+	}
+
+	s.logger.Info("Stored connection request", "fromPeerID", req.FromPeerID, "toPeerID", req.ToPeerID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handlePopRequest(w http.ResponseWriter, r *http.Request) {
+	peerID := r.PathValue(peerIDParam)
+	if !s.allow(w, r) {
+		return
+	}
+
+	// Only the owner of the registration consumes its requests, they are left waiting until the peer registers
+	current, ok := s.authorize(w, r, peerID)
+	if !ok {
+		return
+	}
+
+	if current == nil {
+		http.Error(w, wgerrors.ErrRequestNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	request, err := s.store.PopRequest(r.Context(), peerID)
+	if errors.Is(err, wgerrors.ErrRequestNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		s.fail(w, err, "failed to get connection request", "peerID", peerID)
+		return
+	}
+
+	s.encode(w, request.Request)
+}
+
+func (s *Server) handleRelay(w http.ResponseWriter, r *http.Request) {
+	if s.relayServer == "" {
+		http.Error(w, wgerrors.ErrRelayUnavailable.Error(), http.StatusNotFound)
+		return
+	}
+
+	var req rendezvous.ConnRequest
+	if !s.decode(w, r, &req) {
+		return
+	}
+
+	if req.FromPeerID == "" || req.ToPeerID == "" {
+		http.Error(w, "from_peer_id and to_peer_id are required", http.StatusBadRequest)
+		return
+	}
+
+	if !s.allow(w, r) {
+		return
+	}
+
+	// Grants are only handed out to the owner of the registration of the requesting peer
+	current, ok := s.authorize(w, r, req.FromPeerID)
+	if !ok {
+		return
+	}
+
+	if current == nil || current.TokenHash == "" {
+		http.Error(w, wgerrors.ErrNotOwner.Error(), http.StatusForbidden)
+		return
+	}
+
+	token, err := relay.IssueToken(s.relaySecret, req.FromPeerID, req.ToPeerID, s.relayTokenTTL)
+	if err != nil {
+		s.fail(w, err, "failed to issue relay token", "fromPeerID", req.FromPeerID, "toPeerID", req.ToPeerID)
+		return
+	}
+
+	s.logger.Info("Issued relay token", "fromPeerID", req.FromPeerID, "toPeerID", req.ToPeerID, "relay", s.relayServer)
+
+	s.encode(w, rendezvous.RelayGrant{Server: s.relayServer, Token: token, Key: relay.BindKey(s.relaySecret, token)})
+}
+
+// expiry returns the expiration time of an entry stored now
+func (s *Server) expiry() time.Time {
+	if s.entryTTL <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(s.entryTTL)
+}
+
+// leaseExpiry returns the expiration time of a registration. The TTL requested by the peer is honored as long as it
+// does not exceed the entry TTL of the server
+func (s *Server) leaseExpiry(req rendezvous.RegisterRequest) time.Time {
+	if req.TTL > 0 && (s.entryTTL <= 0 || req.TTL < s.entryTTL) {
+		return req.ExpiresAt(time.Now())
+	}
+
+	return s.expiry()
+}
+
+// allow applies the rate limit of the address the request comes from, replying with an error if it has been exceeded.
+// Peer IDs are chosen by the clients, so they cannot be used to tell clients apart
+func (s *Server) allow(w http.ResponseWriter, r *http.Request) bool {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	if s.limiter.Allow(client) {
+		return true
+	}
+
+	http.Error(w, wgerrors.ErrRateLimited.Error(), http.StatusTooManyRequests)
+	return false
+}
+
+// authorize checks that the request acts on behalf of the owner of the registration of peerID, replying with an error
+// if it does not. Returns the registration of peerID, which is nil if the ID is free
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, peerID string) (*Entry, bool) {
+	entry, err := s.store.GetPeer(r.Context(), peerID)
+	if errors.Is(err, wgerrors.ErrPeerNotFound) {
+		return nil, true
+	}
+
+	if err != nil {
+		s.fail(w, err, "failed to get peer", "peerID", peerID)
+		return nil, false
+	}
+
+	// Registrations stored before tokens were handed out are not owned by anyone
+	if entry.TokenHash == "" {
+		return entry, true
+	}
+
+	presented := hashToken(bearerToken(r))
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(entry.TokenHash)) != 1 {
+		http.Error(w, wgerrors.ErrNotOwner.Error(), http.StatusForbidden)
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// bearerToken returns the bearer token of the request, which is empty if there is none
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return ""
+	}
+
+	return strings.TrimPrefix(header, bearerPrefix)
+}
+
+// newToken generates a random token to hand out on registration
+func newToken() (string, error) {
+	buf := make([]byte, tokenLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken returns the hash under which token is stored, so that the store never holds usable tokens. The empty token
+// has no hash
+func hashToken(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// decode reads the JSON body of the request into v, replying with an error if it is not valid
+func (s *Server) decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	body := http.MaxBytesReader(w, r.Body, defaultMaxBodyLen)
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// encode writes v as the JSON body of the reply
+func (s *Server) encode(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Error(err, "failed to encode reply")
+	}
+}
+
+// fail logs an internal error and replies with a generic error
+func (s *Server) fail(w http.ResponseWriter, err error, msg string, keysAndValues ...any) {
+	s.logger.Error(err, msg, keysAndValues...)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
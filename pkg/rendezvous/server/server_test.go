@@ -0,0 +1,243 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yago-123/peer-hub/pkg/client"
+	"github.com/yago-123/peer-hub/pkg/types"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/relay"
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+	"github.com/yago-123/wg-punch/pkg/rendezvous/httpclient"
+	"github.com/yago-123/wg-punch/pkg/rendezvous/server"
+)
+
+const waitInterval = 10 * time.Millisecond
+
+func newTestServer(t *testing.T, opts ...server.Option) string {
+	t.Helper()
+
+	srv := httptest.NewServer(server.New(server.NewMemoryStore(), opts...).Handler())
+	t.Cleanup(srv.Close)
+
+	return srv.URL
+}
+
+func TestPeerHubClient(t *testing.T) {
+	peerHub := client.New(newTestServer(t), waitInterval)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := peerHub.Register(ctx, types.RegisterRequest{
+		PeerID:     "alice",
+		PublicKey:  "alice-key",
+		Endpoint:   "192.0.2.1:51820",
+		AllowedIPs: []string{"10.0.0.1/32"},
+	})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	info, endpoint, err := peerHub.WaitForPeer(ctx, "alice")
+	if err != nil {
+		t.Fatalf("failed to wait for peer: %v", err)
+	}
+
+	if info.PublicKey != "alice-key" || endpoint.String() != "192.0.2.1:51820" || len(info.AllowedIPs) != 1 {
+		t.Fatalf("unexpected peer info %+v at %s", info, endpoint)
+	}
+}
+
+func TestPeerHubClientSeesExtendedRegistrations(t *testing.T) {
+	url := newTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := httpclient.New(url, waitInterval).Register(ctx, rendezvous.RegisterRequest{
+		PeerID:     "alice",
+		PublicKey:  "alice-key",
+		Endpoint:   "192.0.2.1:51820",
+		AllowedIPs: []string{"10.0.0.1/32"},
+		Candidates: []string{"192.168.1.2:51820"},
+		TTL:        time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	info, _, err := client.New(url, waitInterval).WaitForPeer(ctx, "alice")
+	if err != nil {
+		t.Fatalf("failed to wait for peer: %v", err)
+	}
+
+	if info.PublicKey != "alice-key" {
+		t.Fatalf("unexpected peer info %+v", info)
+	}
+}
+
+func TestHTTPClientExtensions(t *testing.T) {
+	c := httpclient.New(newTestServer(t), waitInterval)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, peerID := range []string{"alice", "bob"} {
+		if err := c.Register(ctx, rendezvous.RegisterRequest{PeerID: peerID, PublicKey: peerID + "-key", Endpoint: "192.0.2.1:51820"}); err != nil {
+			t.Fatalf("failed to register %s: %v", peerID, err)
+		}
+	}
+
+	if err := c.Deregister(ctx, "bob"); err != nil {
+		t.Fatalf("failed to deregister: %v", err)
+	}
+
+	peers, err := c.Peers(ctx)
+	if err != nil {
+		t.Fatalf("failed to list peers: %v", err)
+	}
+
+	if len(peers) != 1 || peers[0].PeerID != "alice" {
+		t.Fatalf("expected alice only, got %+v", peers)
+	}
+
+	if err = c.RequestConnection(ctx, rendezvous.ConnRequest{FromPeerID: "bob", ToPeerID: "alice"}); err != nil {
+		t.Fatalf("failed to request connection: %v", err)
+	}
+
+	req, err := c.WaitForRequest(ctx, "alice")
+	if err != nil || req.FromPeerID != "bob" {
+		t.Fatalf("expected request from bob, got %+v: %v", req, err)
+	}
+}
+
+func TestRegistrationOwnership(t *testing.T) {
+	url := newTestServer(t)
+	owner := httpclient.New(url, waitInterval)
+	intruder := httpclient.New(url, waitInterval)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := rendezvous.RegisterRequest{PeerID: "alice", PublicKey: "alice-key", Endpoint: "192.0.2.1:51820"}
+	if err := owner.Register(ctx, req); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	forged := req
+	forged.Endpoint = "198.51.100.1:51820"
+	if err := intruder.Register(ctx, forged); !errors.Is(err, wgerrors.ErrNotOwner) {
+		t.Fatalf("expected ErrNotOwner on overwrite, got %v", err)
+	}
+
+	if err := intruder.Deregister(ctx, "alice"); !errors.Is(err, wgerrors.ErrNotOwner) {
+		t.Fatalf("expected ErrNotOwner on removal, got %v", err)
+	}
+
+	info, _, err := intruder.WaitForPeer(ctx, "alice")
+	if err != nil || info.Endpoint != req.Endpoint {
+		t.Fatalf("expected registration of the owner kept, got %+v: %v", info, err)
+	}
+
+	// The owner keeps renewing and eventually removes its registration, which frees the ID
+	if err = owner.Register(ctx, req); err != nil {
+		t.Fatalf("failed to renew registration: %v", err)
+	}
+
+	if err = owner.Deregister(ctx, "alice"); err != nil {
+		t.Fatalf("failed to deregister: %v", err)
+	}
+
+	if err = intruder.Register(ctx, forged); err != nil {
+		t.Fatalf("failed to register freed ID: %v", err)
+	}
+}
+
+func TestRequestQueueIsBounded(t *testing.T) {
+	c := httpclient.New(newTestServer(t, server.WithRateLimit(0, 0)), waitInterval)
+
+	ctx := context.Background()
+	for i := range 70 {
+		if err := c.RequestConnection(ctx, rendezvous.ConnRequest{FromPeerID: fmt.Sprintf("peer-%d", i), ToPeerID: "alice"}); err != nil {
+			t.Fatalf("failed to request connection: %v", err)
+		}
+	}
+
+	if err := c.Register(ctx, rendezvous.RegisterRequest{PeerID: "alice", PublicKey: "alice-key", Endpoint: "192.0.2.1:51820"}); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	var received []string
+	for {
+		ctxWait, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		req, err := c.WaitForRequest(ctxWait, "alice")
+		cancel()
+		if err != nil {
+			break
+		}
+		received = append(received, req.FromPeerID)
+	}
+
+	if len(received) != 64 || received[0] != "peer-6" {
+		t.Fatalf("expected the 64 latest requests, got %d starting with %v", len(received), received[:1])
+	}
+}
+
+func TestRateLimitPerClientAddress(t *testing.T) {
+	c := httpclient.New(newTestServer(t, server.WithRateLimit(0.01, 2)), waitInterval)
+
+	ctx := context.Background()
+
+	// Changing the peer ID does not get the client a new bucket
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = c.Register(ctx, rendezvous.RegisterRequest{PeerID: fmt.Sprintf("peer-%d", i), PublicKey: "key", Endpoint: "192.0.2.1:51820"})
+	}
+
+	if !errors.Is(err, wgerrors.ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+}
+
+func TestRelayGrantRequiresRegistration(t *testing.T) {
+	url := newTestServer(t, server.WithRelay("127.0.0.1:3479", []byte("relay-secret"), 0))
+	owner := httpclient.New(url, waitInterval)
+	intruder := httpclient.New(url, waitInterval)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := rendezvous.ConnRequest{FromPeerID: "alice", ToPeerID: "bob"}
+	if _, err := owner.RequestRelay(ctx, req); !errors.Is(err, wgerrors.ErrNotOwner) {
+		t.Fatalf("expected ErrNotOwner for unregistered peer, got %v", err)
+	}
+
+	if err := owner.Register(ctx, rendezvous.RegisterRequest{PeerID: "alice", PublicKey: "alice-key", Endpoint: "192.0.2.1:51820"}); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	if _, err := intruder.RequestRelay(ctx, req); !errors.Is(err, wgerrors.ErrNotOwner) {
+		t.Fatalf("expected ErrNotOwner on behalf of another peer, got %v", err)
+	}
+
+	grant, err := owner.RequestRelay(ctx, req)
+	if err != nil {
+		t.Fatalf("failed to request relay: %v", err)
+	}
+
+	token, err := relay.ParseToken([]byte("relay-secret"), grant.Token)
+	if err != nil || token.PeerID != "alice" || len(grant.Key) == 0 {
+		t.Fatalf("unexpected grant %+v: %v", grant, err)
+	}
+
+	if time.Until(token.ExpiresAt) > 5*time.Minute {
+		t.Fatalf("expected a short-lived token, expires at %s", token.ExpiresAt)
+	}
+}
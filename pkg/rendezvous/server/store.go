@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/yago-123/wg-punch/pkg/rendezvous"
+)
+
+// maxRequestsPerPeer bounds the queue of connection requests of every peer, the oldest request is dropped first
+const maxRequestsPerPeer = 64
+
+// Entry is a peer registration kept by the server
+type Entry struct {
+	Peer      rendezvous.PeerInfo `json:"peer"`
+	ExpiresAt time.Time           `json:"expires_at"`
+	// TokenHash is the hash of the token handed out when the peer registered, which the peer must present in order to
+	// update or remove the registration
+	TokenHash string `json:"token_hash,omitempty"`
+}
+
+// Expired reports whether the entry is no longer valid at the given time
+func (e *Entry) Expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// Request is a connection request kept by the server until the addressed peer consumes it
+type Request struct {
+	Request   rendezvous.ConnRequest `json:"request"`
+	ExpiresAt time.Time              `json:"expires_at"`
+}
+
+// Expired reports whether the request is no longer valid at the given time
+func (r *Request) Expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && now.After(r.ExpiresAt)
+}
+
+// enqueue appends request to queue once the expired requests have been dropped, dropping the oldest request as well if
+// the queue is full
+func enqueue(queue []Request, request Request, now time.Time) []Request {
+	pending := make([]Request, 0, len(queue)+1)
+	for _, queued := range queue {
+		if !queued.Expired(now) {
+			pending = append(pending, queued)
+		}
+	}
+
+	if len(pending) >= maxRequestsPerPeer {
+		pending = pending[len(pending)-maxRequestsPerPeer+1:]
+	}
+
+	return append(pending, request)
+}
+
+// Store persists the registrations and the connection requests handled by the server. Implementations must not return
+// entries or requests that have expired
+type Store interface {
+	// PutPeer creates or replaces the registration of entry.Peer.PeerID
+	PutPeer(ctx context.Context, entry Entry) error
+	// GetPeer returns the registration of peerID, or ErrPeerNotFound if there is no valid one
+	GetPeer(ctx context.Context, peerID string) (*Entry, error)
+	// ListPeers returns every valid registration
+	ListPeers(ctx context.Context) ([]Entry, error)
+	// DeletePeer removes the registration of peerID, if any
+	DeletePeer(ctx context.Context, peerID string) error
+	// PushRequest queues a connection request for request.Request.ToPeerID, dropping the oldest one if the queue of the
+	// peer already holds maxRequestsPerPeer requests
+	PushRequest(ctx context.Context, request Request) error
+	// PopRequest consumes the oldest connection request addressed to peerID, or returns ErrRequestNotFound if there
+	// is none
+	PopRequest(ctx context.Context, peerID string) (*Request, error)
+}
@@ -2,9 +2,11 @@ package tunnel
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"time"
 
+	"github.com/yago-123/wg-punch/pkg/demux"
 	"github.com/yago-123/wg-punch/pkg/peer"
 )
 
@@ -15,12 +17,119 @@ type Tunnel interface {
 	Stop(ctx context.Context) error
 }
 
+// MultiPeerTunnel is implemented by tunnels able to carry several remote peers over a single interface and socket
+type MultiPeerTunnel interface {
+	Tunnel
+	// Open brings up the interface on top of conn without configuring any remote peer
+	Open(ctx context.Context, conn *net.UDPConn) error
+	// AddPeer configures a new remote peer in the running interface and waits until the handshake is done
+	AddPeer(ctx context.Context, peer peer.Info) error
+	// RemovePeer removes a remote peer from the running interface together with its routes
+	RemovePeer(ctx context.Context, publicKey string) error
+}
+
+// PeerStats holds the runtime state of a remote peer as reported by the tunnel
+type PeerStats struct {
+	LastHandshake time.Time
+	Endpoint      *net.UDPAddr
+}
+
+// SupervisedTunnel is implemented by tunnels whose remote peers can be repaired in place, without tearing down the
+// interface nor its routes, when the path towards them dies
+type SupervisedTunnel interface {
+	Tunnel
+	// PeerStats returns the runtime state of the remote peer identified by publicKey
+	PeerStats(publicKey string) (PeerStats, error)
+	// Suspend releases the UDP socket used by the tunnel while keeping the interface, its addresses and routes
+	Suspend(ctx context.Context) error
+	// Resume hands a new UDP socket to a suspended tunnel
+	Resume(ctx context.Context, conn *net.UDPConn) error
+	// UpdateEndpoint points the remote peer identified by publicKey to a new endpoint
+	UpdateEndpoint(ctx context.Context, publicKey string, endpoint *net.UDPAddr) error
+}
+
+// MonitoredTunnel is implemented by tunnels that can stop working on their own, like when the underlying device fails
+type MonitoredTunnel interface {
+	Tunnel
+	// Done returns a channel that is closed once the tunnel stops, nil if it has not been started
+	Done() <-chan struct{}
+	// Err returns why the tunnel stopped, nil while it runs or if it was stopped via Stop
+	Err() error
+}
+
+// DemuxedTunnel is implemented by tunnels that route the datagrams of other protocols arriving through their socket to
+// a demultiplexer, so that STUN keepalives and public address discovery keep working on the socket once the tunnel
+// reads it
+type DemuxedTunnel interface {
+	Tunnel
+	// Demux returns the demultiplexer of the socket, nil if the tunnel is not running
+	Demux() *demux.Demux
+}
+
 type Config struct {
-	PrivKey           string
-	Iface             string
-	IfaceIPv4CIDR     string
+	PrivKey string
+	Iface   string
+	// IfaceIPv4CIDR is the IPv4 overlay address of the interface in CIDR notation, like 10.1.1.1/24
+	IfaceIPv4CIDR string
+	// IfaceCIDRs are additional overlay addresses of the interface in CIDR notation, IPv4 or IPv6 (ULA ranges like
+	// fd00::/8 included), assigned next to IfaceIPv4CIDR
+	IfaceCIDRs        []string
 	ListenPort        int
 	ReplacePeer       bool
 	CreateIface       bool
 	KeepAliveInterval time.Duration
+	// PresharedKey is the optional WireGuard pre-shared key, encoded in base64, used with remote peers that do not
+	// carry one of their own in peer.Info
+	PresharedKey string
+}
+
+// PresharedKeyOf returns the pre-shared key to use with the remote peer, which is empty if none has been configured
+func (c *Config) PresharedKeyOf(remotePeer peer.Info) string {
+	if remotePeer.PresharedKey != "" {
+		return remotePeer.PresharedKey
+	}
+
+	return c.PresharedKey
+}
+
+// Addresses returns every overlay address of the interface in CIDR notation, starting by IfaceIPv4CIDR if set.
+// Repeated addresses are only returned once
+func (c *Config) Addresses() []string {
+	var addrs []string
+	seen := make(map[string]struct{})
+
+	for _, cidr := range append([]string{c.IfaceIPv4CIDR}, c.IfaceCIDRs...) {
+		if _, found := seen[cidr]; found || cidr == "" {
+			continue
+		}
+
+		seen[cidr] = struct{}{}
+		addrs = append(addrs, cidr)
+	}
+
+	return addrs
+}
+
+// AllowedIPs returns the host prefixes of the overlay addresses of the interface, a /32 for IPv4 and a /128 for IPv6,
+// which are the allowed IPs to advertise to remote peers so that they route the traffic towards the local peer
+// through the tunnel
+func (c *Config) AllowedIPs() ([]string, error) {
+	addrs := c.Addresses()
+	allowedIPs := make([]string, 0, len(addrs))
+
+	for _, cidr := range addrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid overlay address %q: %w", cidr, err)
+		}
+
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), net.IPv4len*8
+		}
+
+		allowedIPs = append(allowedIPs, (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String())
+	}
+
+	return allowedIPs, nil
 }
@@ -1,12 +1,25 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/vishvananda/netlink"
 	"net"
 	"os"
+	"syscall"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/peer"
 )
 
+// presharedKeyPollInterval is how often the interface is checked while waiting for a remote peer to show up on it
+const presharedKeyPollInterval = 50 * time.Millisecond
+
 // AssignAddressToIface assigns the internal IP address to the WireGuard interface in CIDR notation in order to allow
 // communications between peers
 // todo(): move addrCIDR to a native type like Addr?
@@ -44,6 +57,53 @@ func AssignAddressToIface(iface, addrCIDR string) error {
 	return nil
 }
 
+// RemoveAddressFromIface removes an address assigned via AssignAddressToIface. Addresses and interfaces that are
+// already gone are ignored
+func RemoveAddressFromIface(iface, addrCIDR string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		if IsLinkNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get link %s: %w", iface, err)
+	}
+
+	addr, err := netlink.ParseAddr(addrCIDR)
+	if err != nil {
+		return fmt.Errorf("failed to parse address %s: %w", addrCIDR, err)
+	}
+
+	if errAddr := netlink.AddrDel(link, addr); errAddr != nil && !errors.Is(errAddr, syscall.EADDRNOTAVAIL) {
+		return fmt.Errorf("failed to remove address %s: %w", addrCIDR, errAddr)
+	}
+
+	return nil
+}
+
+// DeleteIface deletes the interface together with its addresses and routes. Nothing is done if the interface does
+// not exist
+func DeleteIface(iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		if IsLinkNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get link %s: %w", iface, err)
+	}
+
+	if errDel := netlink.LinkDel(link); errDel != nil && !errors.Is(errDel, syscall.ENODEV) {
+		return fmt.Errorf("failed to delete link %s: %w", iface, errDel)
+	}
+
+	return nil
+}
+
+// IsLinkNotFound reports whether err was returned because the interface looked up does not exist
+func IsLinkNotFound(err error) bool {
+	var notFound netlink.LinkNotFoundError
+	return errors.As(err, &notFound)
+}
+
 // AddPeerRoutes adds the allowed IPs of the peer to the WireGuard interface so that the kernel can route packets
 func AddPeerRoutes(iface string, allowedIPs []net.IPNet) error {
 	link, err := netlink.LinkByName(iface)
@@ -65,3 +125,111 @@ func AddPeerRoutes(iface string, allowedIPs []net.IPNet) error {
 
 	return nil
 }
+
+// DelPeerRoutes removes the routes towards the allowed IPs of the peer from the WireGuard interface. Routes are removed
+// together with the interface, so nothing is done if the interface is already gone
+func DelPeerRoutes(iface string, allowedIPs []net.IPNet) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		if IsLinkNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get link %q: %w", iface, err)
+	}
+
+	for _, ipNet := range allowedIPs {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &ipNet,
+		}
+
+		// Ignore routes that are already gone
+		if errRoute := netlink.RouteDel(route); errRoute != nil && !errors.Is(errRoute, syscall.ESRCH) {
+			return fmt.Errorf("failed to delete route %s: %w", ipNet.String(), errRoute)
+		}
+	}
+
+	return nil
+}
+
+// PeerConfig converts the information of a remote peer into the WireGuard configuration of the peer, pre-shared key
+// included. Used by the userspace tunnel. The kernel backend of wg-punch-kernel configures its peers on its own,
+// without pre-shared key, see SetPresharedKey
+func PeerConfig(remotePeer peer.Info, keepAliveInterval time.Duration) (wgtypes.PeerConfig, error) {
+	remotePubKey, err := wgtypes.ParseKey(remotePeer.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, wgerrors.Permanent(fmt.Errorf("invalid remote public key: %w", err))
+	}
+
+	peerConfig := wgtypes.PeerConfig{
+		PublicKey:                   remotePubKey,
+		Endpoint:                    remotePeer.Endpoint,
+		AllowedIPs:                  remotePeer.AllowedIPs,
+		PersistentKeepaliveInterval: &keepAliveInterval,
+	}
+
+	if remotePeer.PresharedKey != "" {
+		psk, errPSK := wgtypes.ParseKey(remotePeer.PresharedKey)
+		if errPSK != nil {
+			return wgtypes.PeerConfig{}, wgerrors.Permanent(fmt.Errorf("invalid preshared key: %w", errPSK))
+		}
+		peerConfig.PresharedKey = &psk
+	}
+
+	return peerConfig, nil
+}
+
+// SetPresharedKey sets the pre-shared key of the remote peer identified by publicKey on the kernel WireGuard interface
+// iface, waiting until the peer shows up on the interface if it has not been configured yet. Used on top of the kernel
+// backend of wg-punch-kernel, which configures its peers without pre-shared key
+func SetPresharedKey(ctx context.Context, iface, publicKey, presharedKey string) error {
+	remotePubKey, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return wgerrors.Permanent(fmt.Errorf("invalid remote public key: %w", err))
+	}
+
+	psk, err := wgtypes.ParseKey(presharedKey)
+	if err != nil {
+		return wgerrors.Permanent(fmt.Errorf("invalid preshared key: %w", err))
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return fmt.Errorf("failed to open WireGuard control client: %w", err)
+	}
+	defer client.Close()
+
+	ticker := time.NewTicker(presharedKeyPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if device, errDevice := client.Device(iface); errDevice == nil && hasPeer(device, remotePubKey) {
+			cfg := wgtypes.Config{
+				Peers: []wgtypes.PeerConfig{{PublicKey: remotePubKey, UpdateOnly: true, PresharedKey: &psk}},
+			}
+
+			if errConfigure := client.ConfigureDevice(iface, cfg); errConfigure != nil {
+				return fmt.Errorf("failed to configure preshared key on %s: %w", iface, errConfigure)
+			}
+
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("remote peer never showed up on %s: %w", iface, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// hasPeer reports whether the remote peer identified by publicKey is configured in device
+func hasPeer(device *wgtypes.Device, publicKey wgtypes.Key) bool {
+	for _, remotePeer := range device.Peers {
+		if remotePeer.PublicKey == publicKey {
+			return true
+		}
+	}
+
+	return false
+}
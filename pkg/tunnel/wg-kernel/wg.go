@@ -0,0 +1,77 @@
+package kernelwg
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/yago-123/wg-punch-kernel/kernel"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/peer"
+	"github.com/yago-123/wg-punch/pkg/tunnel"
+	tunnelUtil "github.com/yago-123/wg-punch/pkg/tunnel/util"
+)
+
+// backend is the kernel tunnel of wg-punch-kernel
+type backend interface {
+	Start(ctx context.Context, conn *net.UDPConn, remotePeer peer.Info) error
+	Stop() error
+}
+
+// Tunnel runs the kernel backend of wg-punch-kernel and sets the pre-shared key of the remote peer on top of it, since
+// the backend configures the remote peer without it
+type Tunnel struct {
+	cfg     *tunnel.Config
+	backend backend
+}
+
+func NewTunnel(cfg *tunnel.Config) (*Tunnel, error) {
+	backend, err := kernel.NewTunnel(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tunnel{cfg: cfg, backend: backend}, nil
+}
+
+// Start brings up the kernel interface and configures the remote peer, together with its pre-shared key if the peer or
+// the tunnel configuration carries one
+func (t *Tunnel) Start(ctx context.Context, conn *net.UDPConn, remotePeer peer.Info) error {
+	presharedKey := t.cfg.PresharedKeyOf(remotePeer)
+	if presharedKey == "" {
+		return t.backend.Start(ctx, conn, remotePeer)
+	}
+
+	if _, err := wgtypes.ParseKey(presharedKey); err != nil {
+		return wgerrors.Permanent(fmt.Errorf("invalid preshared key: %w", err))
+	}
+
+	// The backend might wait for the handshake before returning, which the remote peer only answers once the key is
+	// set, so the key is set as soon as the remote peer shows up on the interface
+	ctxPSK, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errPSK := make(chan error, 1)
+	go func() {
+		errPSK <- tunnelUtil.SetPresharedKey(ctxPSK, t.cfg.Iface, remotePeer.PublicKey, presharedKey)
+	}()
+
+	if err := t.backend.Start(ctx, conn, remotePeer); err != nil {
+		return err
+	}
+
+	if err := <-errPSK; err != nil {
+		_ = t.backend.Stop()
+		return fmt.Errorf("failed to set preshared key: %w", err)
+	}
+
+	return nil
+}
+
+// Stop tears down the kernel interface
+func (t *Tunnel) Stop() error {
+	return t.backend.Stop()
+}
@@ -27,6 +27,19 @@ func ConvertWgTypesToUAPI(cfg wgtypes.Config) (string, error) {
 	for _, peer := range cfg.Peers {
 		b.WriteString(fmt.Sprintf("public_key=%s\n", hex.EncodeToString(peer.PublicKey[:])))
 
+		if peer.Remove {
+			b.WriteString("remove=true\n\n")
+			continue
+		}
+
+		if peer.UpdateOnly {
+			b.WriteString("update_only=true\n")
+		}
+
+		if peer.PresharedKey != nil {
+			b.WriteString(fmt.Sprintf("preshared_key=%s\n", hex.EncodeToString(peer.PresharedKey[:])))
+		}
+
 		if peer.Endpoint != nil {
 			b.WriteString(fmt.Sprintf("endpoint=%s\n", peer.Endpoint.String()))
 		}
@@ -2,21 +2,34 @@ package userspacewg
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
-	"github.com/yago-123/peer-hub/pkg/common"
 
 	"net"
 
+	"github.com/yago-123/wg-punch/pkg/demux"
+	"github.com/yago-123/wg-punch/pkg/peer"
+	"github.com/yago-123/wg-punch/pkg/util"
+
 	"golang.zx2c4.com/wireguard/conn"
 )
 
 type ReceiveFunc func(bufs [][]byte, eps []UDPEndpoint) (n int, err error)
 
-// UDPBind implements conn.Bind for a single pre-established UDP socket.
+// UDPBind implements conn.Bind for a single pre-established UDP socket. The socket is reused across Close and Open
+// calls so that the NAT mapping opened during the punching process is preserved, it is only released via Release.
+// Remote peers that can only be reached through a relay are registered via AddRelay, their packets are exchanged with
+// the relay server through the same socket. Datagrams that are not WireGuard messages, like STUN responses or punch
+// packets, are handed to the demultiplexer instead, see Demux.
 type UDPBind struct {
 	conn   *net.UDPConn
 	addr   *net.UDPAddr
+	open   bool
+	relays map[string]peer.Relay
+	demux  *demux.Demux
+	mu     sync.Mutex
 	logger logr.Logger
 }
 
@@ -25,24 +38,28 @@ func NewUDPBind(conn *net.UDPConn, addr *net.UDPAddr, logger logr.Logger) *UDPBi
 	return &UDPBind{
 		conn:   conn,
 		addr:   addr,
+		relays: make(map[string]peer.Relay),
+		demux:  demux.New(conn),
 		logger: logger,
 	}
 }
 
-// todo(): this implementation is flawed. Connections must be reused, not recreated.
 // Open returns a ReceiveFunc slice for reading packets and reports the bound port.
 // Since the UDP connection is pre-established, no new binding is performed (port is ignored).
 func (b *UDPBind) Open(_ uint16) (fns []conn.ReceiveFunc, actualPort uint16, err error) {
 	b.logger.Info("bind: Open called on existing UDP connection")
 
-	// If the connection is nil or closed, we need to recreate it
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// If the connection has been released, we need to recreate it
 	if b.conn == nil {
-		// Recreate the connection
-		conn, errListen := net.ListenUDP(common.UDPProtocol, b.addr)
+		conn, errListen := net.ListenUDP(util.UDPProtocol, b.addr)
 		if errListen != nil {
 			return nil, 0, errListen
 		}
 		b.conn = conn
+		b.demux.Reset(conn)
 	}
 
 	localAddr, ok := b.conn.LocalAddr().(*net.UDPAddr)
@@ -50,6 +67,14 @@ func (b *UDPBind) Open(_ uint16) (fns []conn.ReceiveFunc, actualPort uint16, err
 		return nil, 0, errors.New("invalid local address type")
 	}
 
+	// Clear the deadline that was used to unblock the readers of a previous Close
+	if errDeadline := b.conn.SetReadDeadline(time.Time{}); errDeadline != nil {
+		return nil, 0, errDeadline
+	}
+
+	b.open = true
+	udpConn := b.conn
+
 	// Define function for receiving packets. This func receives batches of packets. Fills buffer with incoming data
 	// record how many bytes were read and capture sender address into endpoint type.
 	recvFn := func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
@@ -58,33 +83,135 @@ func (b *UDPBind) Open(_ uint16) (fns []conn.ReceiveFunc, actualPort uint16, err
 			return 0, nil
 		}
 
-		// Read from the UDP connection
-		nRead, addr, err := b.conn.ReadFromUDP(bufs[0])
-		if err != nil {
-			return 0, err
-		}
+		for {
+			// Read from the UDP connection
+			nRead, addr, err := udpConn.ReadFromUDP(bufs[0])
+			if err != nil {
+				// Readers are unblocked on Close via a read deadline, report it as closed so that the device stops them
+				if !b.isOpen() {
+					return 0, net.ErrClosed
+				}
+				return 0, err
+			}
+
+			// Dual-stack sockets report IPv4 peers as IPv4-mapped addresses
+			addr.IP = util.NormalizeIP(addr.IP)
 
-		// Fill the first endpoint with source address
-		eps[0] = &UDPEndpoint{addr: addr}
-		bufs[0] = bufs[0][:nRead]
-		sizes[0] = nRead
-		return 1, nil
+			// Packets coming from a relay server are unwrapped and attributed to the remote peer that sent them
+			var relay peer.Relay
+			if relay = b.relayFor(addr); relay != nil {
+				payload, from, ok := relay.Unwrap(bufs[0][:nRead])
+				if !ok {
+					// Messages addressed to the relay itself are consumed by it
+					continue
+				}
+				nRead = copy(bufs[0], payload)
+				addr = from
+			} else if demux.Classify(bufs[0][:nRead]) != demux.ClassWireGuard {
+				// Anything else sharing the socket is routed to its consumer, WireGuard would drop it anyway
+				b.demux.Dispatch(bufs[0][:nRead], addr)
+				continue
+			}
+
+			// Fill the first endpoint with source address
+			eps[0] = &UDPEndpoint{addr: addr, relay: relay}
+			bufs[0] = bufs[0][:nRead]
+			sizes[0] = nRead
+			return 1, nil
+		}
 	}
 
 	return []conn.ReceiveFunc{recvFn}, uint16(localAddr.Port), nil
 }
 
-// Close closes the underlying UDP connection.
+// Close stops the receive functions returned by Open. The underlying UDP connection is kept so that it can be reused
+// by a later call to Open.
 func (b *UDPBind) Close() error {
 	b.logger.Info("bind: Close called on existing UDP connection")
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.open = false
+	if b.conn == nil {
+		return nil
+	}
+
+	// Unblock any pending read without closing the socket
+	return b.conn.SetReadDeadline(time.Now())
+}
+
+// Release closes the underlying UDP connection. A later call to Open recreates it unless a new one is provided via
+// Reset.
+func (b *UDPBind) Release() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.open = false
 	if b.conn == nil {
 		return nil
 	}
+
 	err := b.conn.Close()
 	b.conn = nil
+	b.demux.Reset(nil)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
 	return err
 }
 
+// Reset replaces the underlying UDP connection. It must be called while the bind is closed, the new connection is
+// used from the next call to Open.
+func (b *UDPBind) Reset(conn *net.UDPConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.conn = conn
+	b.demux.Reset(conn)
+
+	// Relays talk to their server through the socket they were set up on, so they do not survive a new socket
+	b.relays = make(map[string]peer.Relay)
+}
+
+// AddRelay makes the packets sent to addr go through relay, and the packets received from the relay server get
+// unwrapped by it
+func (b *UDPBind) AddRelay(addr *net.UDPAddr, relay peer.Relay) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.relays[addr.String()] = relay
+}
+
+// Demux returns the demultiplexer that receives the datagrams of other protocols arriving through the socket, which
+// lets them run next to WireGuard while the bind is open
+func (b *UDPBind) Demux() *demux.Demux {
+	return b.demux
+}
+
+// relayFor returns the relay whose server is at addr, or nil if addr is not a relay server
+func (b *UDPBind) relayFor(addr *net.UDPAddr) peer.Relay {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, relay := range b.relays {
+		server := relay.Server()
+		if server.IP.Equal(addr.IP) && server.Port == addr.Port {
+			return relay
+		}
+	}
+
+	return nil
+}
+
+// isOpen reports whether the bind is open
+func (b *UDPBind) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.open
+}
+
 // SetMark sets the SO_MARK option on the socket.
 // This is a no-op in this implementation because net.UDPConn does not expose setting socket options.
 func (b *UDPBind) SetMark(_ uint32) error {
@@ -103,17 +230,41 @@ func (b *UDPBind) Send(bufs [][]byte, ep conn.Endpoint) error {
 	if !ok {
 		return errors.New("invalid endpoint type")
 	}
-	_, err := b.conn.WriteToUDP(bufs[0], udpEp.addr)
+
+	b.mu.Lock()
+	udpConn := b.conn
+	b.mu.Unlock()
+
+	if udpConn == nil {
+		return net.ErrClosed
+	}
+
+	if udpEp.relay == nil {
+		_, err := udpConn.WriteToUDP(bufs[0], udpEp.addr)
+		return err
+	}
+
+	wrapped, err := udpEp.relay.Wrap(bufs[0], udpEp.addr)
+	if err != nil {
+		return err
+	}
+
+	_, err = udpConn.WriteToUDP(wrapped, udpEp.relay.Server())
 	return err
 }
 
-// ParseEndpoint parses a string into a UDPEndpoint.
+// ParseEndpoint parses a string into a UDPEndpoint, which goes through a relay if one was registered for the address.
 func (b *UDPBind) ParseEndpoint(s string) (conn.Endpoint, error) {
 	addr, err := net.ResolveUDPAddr("udp", s)
 	if err != nil {
 		return nil, err
 	}
-	return &UDPEndpoint{addr: addr}, nil
+
+	b.mu.Lock()
+	relay := b.relays[addr.String()]
+	b.mu.Unlock()
+
+	return &UDPEndpoint{addr: addr, relay: relay}, nil
 }
 
 // BatchSize returns the number of buffers expected by ReceiveFunc and Send.
@@ -4,12 +4,16 @@ import (
 	"encoding/binary"
 	"net"
 	"net/netip"
+
+	"github.com/yago-123/wg-punch/pkg/peer"
+	"github.com/yago-123/wg-punch/pkg/util"
 )
 
 // UDPEndpoint implements the conn.Endpoint interface for UDP connections.
 type UDPEndpoint struct {
-	src  *net.UDPAddr // where the packet came from
-	addr *net.UDPAddr // where to send packets
+	src   *net.UDPAddr // where the packet came from
+	addr  *net.UDPAddr // where to send packets
+	relay peer.Relay   // relay carrying the packets, nil if the peer is reached directly
 }
 
 // ClearSrc clears the source address of the endpoint.
@@ -30,18 +34,19 @@ func (ep *UDPEndpoint) DstToString() string {
 	return ep.addr.String()
 }
 
-// DstToBytes converts the destination address to a byte slice.
+// DstToBytes converts the destination address to a byte slice. IPv4 addresses are encoded in their 4-byte form even if
+// they were seen through a dual-stack socket, so that the same peer always gets the same bytes.
 func (ep *UDPEndpoint) DstToBytes() []byte {
-	ip := ep.addr.IP.To16()
+	ip := util.NormalizeIP(ep.addr.IP)
 	port := make([]byte, 2)
 	binary.BigEndian.PutUint16(port, uint16(ep.addr.Port))
-	return append(ip, port...)
+	return append(append([]byte(nil), ip...), port...)
 }
 
-// DstIP returns the destination IP address.
+// DstIP returns the destination IP address, unmapping the IPv4-mapped addresses seen through dual-stack sockets.
 func (ep *UDPEndpoint) DstIP() netip.Addr {
 	addr, _ := netip.AddrFromSlice(ep.addr.IP)
-	return addr
+	return addr.Unmap()
 }
 
 // SrcIP returns the source IP address.
@@ -50,5 +55,5 @@ func (ep *UDPEndpoint) SrcIP() netip.Addr {
 		return netip.Addr{}
 	}
 	addr, _ := netip.AddrFromSlice(ep.src.IP)
-	return addr
+	return addr.Unmap()
 }
@@ -3,9 +3,12 @@ package userspacewg
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -13,10 +16,13 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/vishvananda/netlink"
 
+	"github.com/yago-123/wg-punch/pkg/demux"
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
 	"github.com/yago-123/wg-punch/pkg/peer"
 	"github.com/yago-123/wg-punch/pkg/tunnel"
 	tunnelUtil "github.com/yago-123/wg-punch/pkg/tunnel/util"
-	
+	"github.com/yago-123/wg-punch/pkg/util"
+
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
 )
@@ -40,16 +46,31 @@ const (
 type userspaceWGTunnel struct {
 	privKey   wgtypes.Key
 	tunDevice *device.Device
+	bind      *UDPBind
 	conn      *net.UDPConn
+	peers     map[string]peer.Info
+	mu        sync.Mutex
+
+	// done is closed once the device opened last stops, err tells why if it was not stopped via Stop
+	done chan struct{}
+	err  error
 
 	config *tunnel.Config
 	logger logr.Logger
 }
 
-func New(cfg *tunnel.Config, logger logr.Logger) (tunnel.Tunnel, error) {
+// Tunnel groups every capability implemented by the userspace WireGuard tunnel
+type Tunnel interface {
+	tunnel.MultiPeerTunnel
+	tunnel.SupervisedTunnel
+	tunnel.DemuxedTunnel
+	tunnel.MonitoredTunnel
+}
+
+func New(cfg *tunnel.Config, logger logr.Logger) (Tunnel, error) {
 	privKey, err := wgtypes.ParseKey(cfg.PrivKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse private key: %w", err)
+		return nil, wgerrors.Permanent(fmt.Errorf("failed to parse private key: %w", err))
 	}
 
 	return &userspaceWGTunnel{
@@ -60,38 +81,56 @@ func New(cfg *tunnel.Config, logger logr.Logger) (tunnel.Tunnel, error) {
 }
 
 func (u *userspaceWGTunnel) Start(ctx context.Context, conn *net.UDPConn, remotePeer peer.Info, cancelPunch context.CancelFunc) error {
+	// Cancel the punching process so that it doesn't interfere with the new connection
+	cancelPunch()
+
+	if err := u.Open(ctx, conn); err != nil {
+		return err
+	}
+
+	if err := u.AddPeer(ctx, remotePeer); err != nil {
+		// Tear down the device, its address and the interface brought up by Open
+		_ = u.Stop(ctx)
+		return err
+	}
+
+	return nil
+}
+
+// Open creates the TUN interface and brings up the WireGuard device on top of conn without any remote peer. Peers are
+// configured afterwards via AddPeer
+func (u *userspaceWGTunnel) Open(_ context.Context, conn *net.UDPConn) error {
 	tun, err := u.ensureTunInterfaceExists(u.config.Iface)
 	if err != nil {
 		return fmt.Errorf("failed to ensure TUN interface exists: %w", err)
 	}
 
+	// Undo every step performed so far if a later one fails
+	rollback := util.NewRollback(u.logger)
+	defer rollback.Run()
+
+	rollback.Add("delete interface", func() error {
+		return tunnelUtil.DeleteIface(u.config.Iface)
+	})
+
 	// Create logger for the WireGuard device todo(): this needs rethinking
 	logger := device.NewLogger(device.LogLevelVerbose, "wireguard: ")
-	localAddr := &net.UDPAddr{IP: net.IPv4zero, Port: u.config.ListenPort}
-
-	// Cancel the punching process so that it doesn't interfere with the new connection
-	cancelPunch()
+	localAddr := util.DualStackAddr(u.config.ListenPort)
 
 	// Spawn new virtual device that will handle packets in userspace
-	tunDevice := device.NewDevice(tun, NewUDPBind(conn, localAddr, u.logger), logger)
+	bind := NewUDPBind(conn, localAddr, u.logger)
+	tunDevice := device.NewDevice(tun, bind, logger)
 
-	remotePubKey, err := wgtypes.ParseKey(remotePeer.PublicKey)
-	if err != nil {
-		return fmt.Errorf("invalid remote public key: %w", err)
-	}
+	// Closing the device closes the TUN as well, the bind keeps the socket open so it must be released explicitly
+	rollback.Add("close device", func() error {
+		tunDevice.Close()
+		return bind.Release()
+	})
 
 	wgConfig := wgtypes.Config{
 		PrivateKey:   &u.privKey,
 		ListenPort:   &u.config.ListenPort,
 		ReplacePeers: u.config.ReplacePeer,
-		Peers: []wgtypes.PeerConfig{
-			{
-				PublicKey:                   remotePubKey,
-				Endpoint:                    remotePeer.Endpoint,
-				AllowedIPs:                  remotePeer.AllowedIPs,
-				PersistentKeepaliveInterval: &u.config.KeepAliveInterval,
-			},
-		},
 	}
 
 	uapiConfig, err := ConvertWgTypesToUAPI(wgConfig)
@@ -99,50 +138,167 @@ func (u *userspaceWGTunnel) Start(ctx context.Context, conn *net.UDPConn, remote
 		return fmt.Errorf("failed to convert wgtypes.Config to UAPI: %w", err)
 	}
 
-	u.logger.Info("Creating uapi configuration", "config", uapiConfig)
-
-	if err = tunnelUtil.AssignAddressToIface(u.config.Iface, u.config.IfaceIPv4CIDR); err != nil {
-		cleanup(tunDevice, conn)
-		return fmt.Errorf("failed to assign address to interface %s: %w", u.config.Iface, err)
-	}
+	// Assign every overlay address, IPv4 and IPv6, to the interface
+	for _, addr := range u.config.Addresses() {
+		if err = tunnelUtil.AssignAddressToIface(u.config.Iface, addr); err != nil {
+			return fmt.Errorf("failed to assign address %s to interface %s: %w", addr, u.config.Iface, err)
+		}
 
-	if err = tunnelUtil.AddPeerRoutes(u.config.Iface, remotePeer.AllowedIPs); err != nil {
-		cleanup(tunDevice, conn)
-		return fmt.Errorf("failed to add peer routes to interface %s: %w", u.config.Iface, err)
+		rollback.Add("remove interface address", func() error {
+			return tunnelUtil.RemoveAddressFromIface(u.config.Iface, addr)
+		})
 	}
 
-	//Pass the configuration to the device via IPC
+	// Pass the configuration to the device via IPC
 	if errIpc := tunDevice.IpcSetOperation(strings.NewReader(uapiConfig)); errIpc != nil {
-		cleanup(tunDevice, conn)
 		return fmt.Errorf("failed to set IPC operation: %w", errIpc)
 	}
 
 	// Bring up the TUN device
 	if errDevice := tunDevice.Up(); errDevice != nil {
-		cleanup(tunDevice, conn)
 		return fmt.Errorf("failed to bring up TUN device: %w", errDevice)
 	}
 
+	rollback.Commit()
+
+	done := make(chan struct{})
+
+	u.mu.Lock()
+	u.tunDevice = tunDevice
+	u.bind = bind
+	u.conn = conn
+	u.peers = make(map[string]peer.Info)
+	u.done, u.err = done, nil
+	u.mu.Unlock()
+
+	go u.monitor(tunDevice, done)
+
+	return nil
+}
+
+// monitor waits until the device closes and records an error if it closed on its own rather than via Stop, like when
+// the TUN interface goes away
+func (u *userspaceWGTunnel) monitor(tunDevice *device.Device, done chan struct{}) {
+	<-tunDevice.Wait()
+
+	u.mu.Lock()
+	if u.tunDevice == tunDevice {
+		u.err = fmt.Errorf("device of interface %s closed", u.config.Iface)
+		u.logger.Error(u.err, "tunnel stopped unexpectedly")
+	}
+	u.mu.Unlock()
+
+	close(done)
+}
+
+// Done returns a channel that is closed once the device stops, nil if it has never been opened
+func (u *userspaceWGTunnel) Done() <-chan struct{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.done
+}
+
+// Err returns why the device stopped, nil while it runs or if it was stopped via Stop
+func (u *userspaceWGTunnel) Err() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.err
+}
+
+// AddPeer configures a remote peer in the running device, installs the routes towards its allowed IPs and waits until
+// the handshake with it has been completed
+func (u *userspaceWGTunnel) AddPeer(ctx context.Context, remotePeer peer.Info) error {
+	u.mu.Lock()
+	tunDevice, bind := u.tunDevice, u.bind
+	u.mu.Unlock()
+
+	if tunDevice == nil {
+		return wgerrors.Permanent(fmt.Errorf("device must be opened before adding peers"))
+	}
+
+	// The endpoint is parsed by the bind when the configuration is applied, so the relay must be known by then
+	if remotePeer.Relay != nil && remotePeer.Endpoint != nil {
+		bind.AddRelay(remotePeer.Endpoint, remotePeer.Relay)
+	}
+
+	// Fall back to the pre-shared key of the tunnel if the remote peer carries none
+	remotePeer.PresharedKey = u.config.PresharedKeyOf(remotePeer)
+
+	peerConfig, err := tunnelUtil.PeerConfig(remotePeer, u.config.KeepAliveInterval)
+	if err != nil {
+		return err
+	}
+	remotePubKey := peerConfig.PublicKey
+
+	wgConfig := wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{peerConfig},
+	}
+
+	uapiConfig, err := ConvertWgTypesToUAPI(wgConfig)
+	if err != nil {
+		return fmt.Errorf("failed to convert wgtypes.Config to UAPI: %w", err)
+	}
+
+	// The UAPI configuration is not logged as is since it might hold the preshared key
+	u.logger.Info("Configuring remote peer", "publicKey", remotePeer.PublicKey, "endpoint", remotePeer.Endpoint, "allowedIPs", remotePeer.AllowedIPs, "presharedKey", remotePeer.PresharedKey != "", "relayed", remotePeer.Relay != nil)
+
+	if err = tunnelUtil.AddPeerRoutes(u.config.Iface, remotePeer.AllowedIPs); err != nil {
+		return fmt.Errorf("failed to add peer routes to interface %s: %w", u.config.Iface, err)
+	}
+
+	if errIpc := tunDevice.IpcSetOperation(strings.NewReader(uapiConfig)); errIpc != nil {
+		_ = tunnelUtil.DelPeerRoutes(u.config.Iface, remotePeer.AllowedIPs)
+		return fmt.Errorf("failed to set IPC operation: %w", errIpc)
+	}
+
+	u.mu.Lock()
+	u.peers[remotePeer.PublicKey] = remotePeer
+	u.mu.Unlock()
+
 	// todo(): handle the hex encoding of the public key better
 	if errHandshake := u.waitForHandshake(ctx, tunDevice, hex.EncodeToString(remotePubKey[:])); errHandshake != nil {
-		cleanup(tunDevice, conn)
+		_ = u.RemovePeer(context.Background(), remotePeer.PublicKey)
 		return fmt.Errorf("handshake did not complete: %w", errHandshake)
 	}
 
-	u.tunDevice = tunDevice
-	u.conn = conn
-
 	return nil
 }
 
-// TODO(): TEMPORARY FUNCTION, come up with a more elegant solution
-func cleanup(dev *device.Device, conn *net.UDPConn) {
-	if dev != nil {
-		dev.Close()
+// RemovePeer removes a remote peer from the running device together with the routes towards its allowed IPs
+func (u *userspaceWGTunnel) RemovePeer(_ context.Context, publicKey string) error {
+	u.mu.Lock()
+	tunDevice := u.tunDevice
+	remotePeer, found := u.peers[publicKey]
+	delete(u.peers, publicKey)
+	u.mu.Unlock()
+
+	if tunDevice == nil || !found {
+		return nil
+	}
+
+	remotePubKey, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return wgerrors.Permanent(fmt.Errorf("invalid remote public key: %w", err))
 	}
-	if conn != nil {
-		conn.Close()
+
+	uapiConfig, err := ConvertWgTypesToUAPI(wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: remotePubKey, Remove: true}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to convert wgtypes.Config to UAPI: %w", err)
 	}
+
+	if errIpc := tunDevice.IpcSetOperation(strings.NewReader(uapiConfig)); errIpc != nil {
+		return fmt.Errorf("failed to set IPC operation: %w", errIpc)
+	}
+
+	if errRoutes := tunnelUtil.DelPeerRoutes(u.config.Iface, remotePeer.AllowedIPs); errRoutes != nil {
+		return fmt.Errorf("failed to delete peer routes from interface %s: %w", u.config.Iface, errRoutes)
+	}
+
+	return nil
 }
 
 func (u *userspaceWGTunnel) ListenPort() int {
@@ -153,13 +309,141 @@ func (u *userspaceWGTunnel) PublicKey() string {
 	return u.privKey.PublicKey().String()
 }
 
-func (u *userspaceWGTunnel) Stop(ctx context.Context) error {
-	// todo(): handle errors and cleanup
-	u.tunDevice.Close()
-	// todo(): this might be nil (might be already closed via wireguard-go)
-	u.conn.Close()
+// Stop closes the device and releases the socket, the address and the interface. Calling Stop on a tunnel that is not
+// open does nothing
+func (u *userspaceWGTunnel) Stop(_ context.Context) error {
+	u.mu.Lock()
+	tunDevice, bind := u.tunDevice, u.bind
+	u.tunDevice, u.bind, u.conn, u.peers = nil, nil, nil, nil
+	u.mu.Unlock()
+
+	if tunDevice == nil {
+		return nil
+	}
+
+	tunDevice.Close()
+
+	// The bind keeps the socket open across device restarts, so it must be released explicitly
+	errRelease := bind.Release()
+
+	// The interface is usually gone once the TUN is closed, make sure nothing is left behind anyway
+	errs := []error{errRelease}
+	for _, addr := range u.config.Addresses() {
+		errs = append(errs, tunnelUtil.RemoveAddressFromIface(u.config.Iface, addr))
+	}
+	errs = append(errs, tunnelUtil.DeleteIface(u.config.Iface))
+
+	return errors.Join(errs...)
+}
+
+// PeerStats returns the last handshake time and the current endpoint of the remote peer as reported by the device
+func (u *userspaceWGTunnel) PeerStats(publicKey string) (tunnel.PeerStats, error) {
+	u.mu.Lock()
+	tunDevice := u.tunDevice
+	u.mu.Unlock()
+
+	if tunDevice == nil {
+		return tunnel.PeerStats{}, wgerrors.Permanent(fmt.Errorf("device has not been opened"))
+	}
+
+	remotePubKey, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return tunnel.PeerStats{}, wgerrors.Permanent(fmt.Errorf("invalid remote public key: %w", err))
+	}
+
+	var buf strings.Builder
+	if errIpc := tunDevice.IpcGetOperation(&buf); errIpc != nil {
+		return tunnel.PeerStats{}, fmt.Errorf("failed to get device status: %w", errIpc)
+	}
+
+	stats, found := parsePeerStats(buf.String(), hex.EncodeToString(remotePubKey[:]))
+	if !found {
+		return tunnel.PeerStats{}, fmt.Errorf("peer %s not found in device", publicKey)
+	}
+
+	return stats, nil
+}
+
+// Suspend brings the device down and releases its UDP socket. The interface, its addresses, routes and peers are kept
+// so that the tunnel can be resumed in place
+func (u *userspaceWGTunnel) Suspend(_ context.Context) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.tunDevice == nil {
+		return wgerrors.Permanent(fmt.Errorf("device has not been opened"))
+	}
+
+	if err := u.tunDevice.Down(); err != nil {
+		return fmt.Errorf("failed to bring down device: %w", err)
+	}
+
+	if err := u.bind.Release(); err != nil {
+		return fmt.Errorf("failed to release UDP socket: %w", err)
+	}
+
+	u.conn = nil
+
+	return nil
+}
+
+// Demux returns the demultiplexer of the socket read by the device, nil if the device is not open
+func (u *userspaceWGTunnel) Demux() *demux.Demux {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.bind == nil {
+		return nil
+	}
+
+	return u.bind.Demux()
+}
+
+// Resume hands conn to the suspended device and brings it back up
+func (u *userspaceWGTunnel) Resume(_ context.Context, conn *net.UDPConn) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.tunDevice == nil {
+		return wgerrors.Permanent(fmt.Errorf("device has not been opened"))
+	}
+
+	u.bind.Reset(conn)
+	u.conn = conn
+
+	if err := u.tunDevice.Up(); err != nil {
+		return fmt.Errorf("failed to bring up device: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateEndpoint points the remote peer to a new endpoint without touching the rest of its configuration
+func (u *userspaceWGTunnel) UpdateEndpoint(_ context.Context, publicKey string, endpoint *net.UDPAddr) error {
+	u.mu.Lock()
+	tunDevice := u.tunDevice
+	u.mu.Unlock()
+
+	if tunDevice == nil {
+		return wgerrors.Permanent(fmt.Errorf("device has not been opened"))
+	}
+
+	remotePubKey, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return wgerrors.Permanent(fmt.Errorf("invalid remote public key: %w", err))
+	}
+
+	uapiConfig, err := ConvertWgTypesToUAPI(wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: remotePubKey, UpdateOnly: true, Endpoint: endpoint}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to convert wgtypes.Config to UAPI: %w", err)
+	}
+
+	if errIpc := tunDevice.IpcSetOperation(strings.NewReader(uapiConfig)); errIpc != nil {
+		return fmt.Errorf("failed to set IPC operation: %w", errIpc)
+	}
 
-	// todo(): handle iface link deletion
 	return nil
 }
 
@@ -171,14 +455,11 @@ func (u *userspaceWGTunnel) ensureTunInterfaceExists(iface string) (tun.Device,
 	// Try to delete the existing interface (optional safety)
 	// todo(): this is like this just for testing, remove it later
 	link, err := netlink.LinkByName(iface)
-	if err == nil {
+	switch {
+	case err == nil:
 		u.logger.Info("Deleting pre-existing interface", "iface", iface)
 		_ = netlink.LinkDel(link) // ignore error — best effort
-	}
-
-	// Only proceed if the interface is truly missing
-	// todo(): improve error handling
-	if !strings.Contains(err.Error(), "Link not found") {
+	case !tunnelUtil.IsLinkNotFound(err):
 		return nil, fmt.Errorf("error checking interface %s: %w", iface, err)
 	}
 
@@ -190,11 +471,13 @@ func (u *userspaceWGTunnel) ensureTunInterfaceExists(iface string) (tun.Device,
 
 	link, err = netlink.LinkByName(iface)
 	if err != nil {
+		_ = tunDev.Close()
 		return nil, fmt.Errorf("failed to lookup interface %s: %w", iface, err)
 	}
 
 	// Set the interface up
 	if errSetup := netlink.LinkSetUp(link); errSetup != nil {
+		_ = tunDev.Close()
 		return nil, fmt.Errorf("failed to bring interface %s up: %w", iface, errSetup)
 	}
 
@@ -226,19 +509,53 @@ func (u *userspaceWGTunnel) waitForHandshake(ctx context.Context, dev *device.De
 	}
 }
 
-// hasHandshakeOccurred checks if the handshake has occurred with the given public key
+// hasHandshakeOccurred checks if the handshake has occurred with the given public key. Only the section of that peer
+// is looked at, the handshakes of the rest of the peers of the device do not count
 func hasHandshakeOccurred(status, pubKey string) bool {
-	lines := strings.Split(status, "\n")
+	stats, found := parsePeerStats(status, pubKey)
+	return found && !stats.LastHandshake.IsZero()
+}
+
+// parsePeerStats extracts the stats of the peer with the given public key from the device status
+func parsePeerStats(status, pubKey string) (tunnel.PeerStats, bool) {
+	var stats tunnel.PeerStats
+	var sec, nsec int64
 	found := false
-	for _, line := range lines {
-		if strings.HasPrefix(line, "public_key=") && strings.HasSuffix(line, pubKey) {
-			found = true
+
+	for _, line := range strings.Split(status, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		// A new peer section starts, stop if the peer we were looking for has already been parsed
+		if key == "public_key" {
+			if found {
+				break
+			}
+			found = value == pubKey
+			continue
+		}
+
+		if !found {
+			continue
 		}
-		if found && strings.HasPrefix(line, "last_handshake_time_sec=") {
-			if !strings.HasSuffix(line, "=0") {
-				return true
+
+		switch key {
+		case "endpoint":
+			if addr, err := net.ResolveUDPAddr(util.UDPProtocol, value); err == nil {
+				stats.Endpoint = addr
 			}
+		case "last_handshake_time_sec":
+			sec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsec, _ = strconv.ParseInt(value, 10, 64)
 		}
 	}
-	return false
+
+	if sec != 0 || nsec != 0 {
+		stats.LastHandshake = time.Unix(sec, nsec)
+	}
+
+	return stats, found
 }
@@ -0,0 +1,195 @@
+package turn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	lifetimeLen      = 4
+	channelNumberLen = 4
+
+	// TransportUDP is the protocol number of UDP, the only transport relayed (RFC 5766, section 14.7)
+	TransportUDP = 17
+)
+
+// Lifetime is the LIFETIME attribute, which carries the lifetime of an allocation in seconds
+type Lifetime time.Duration
+
+func (l Lifetime) AddTo(m *stun.Message) error {
+	v := make([]byte, lifetimeLen)
+	binary.BigEndian.PutUint32(v, uint32(time.Duration(l)/time.Second))
+	m.Add(stun.AttrLifetime, v)
+
+	return nil
+}
+
+func (l *Lifetime) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrLifetime)
+	if err != nil {
+		return err
+	}
+
+	if len(v) != lifetimeLen {
+		return fmt.Errorf("invalid LIFETIME length %d", len(v))
+	}
+
+	*l = Lifetime(time.Duration(binary.BigEndian.Uint32(v)) * time.Second)
+
+	return nil
+}
+
+// RequestedTransport is the REQUESTED-TRANSPORT attribute of an allocation request
+type RequestedTransport byte
+
+func (t RequestedTransport) AddTo(m *stun.Message) error {
+	m.Add(stun.AttrRequestedTransport, []byte{byte(t), 0, 0, 0})
+	return nil
+}
+
+func (t *RequestedTransport) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrRequestedTransport)
+	if err != nil {
+		return err
+	}
+
+	if len(v) != 4 {
+		return fmt.Errorf("invalid REQUESTED-TRANSPORT length %d", len(v))
+	}
+
+	*t = RequestedTransport(v[0])
+
+	return nil
+}
+
+// ChannelNumber is the CHANNEL-NUMBER attribute of a channel binding
+type ChannelNumber uint16
+
+func (n ChannelNumber) AddTo(m *stun.Message) error {
+	v := make([]byte, channelNumberLen)
+	binary.BigEndian.PutUint16(v, uint16(n))
+	m.Add(stun.AttrChannelNumber, v)
+
+	return nil
+}
+
+func (n *ChannelNumber) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrChannelNumber)
+	if err != nil {
+		return err
+	}
+
+	if len(v) != channelNumberLen {
+		return fmt.Errorf("invalid CHANNEL-NUMBER length %d", len(v))
+	}
+
+	*n = ChannelNumber(binary.BigEndian.Uint16(v))
+
+	return nil
+}
+
+// PeerAddress is the XOR-PEER-ADDRESS attribute, which identifies a remote peer of the relayed address
+type PeerAddress net.UDPAddr
+
+func (a PeerAddress) AddTo(m *stun.Message) error {
+	return stun.XORMappedAddress{IP: a.IP, Port: a.Port}.AddToAs(m, stun.AttrXORPeerAddress)
+}
+
+func (a *PeerAddress) GetFrom(m *stun.Message) error {
+	var addr stun.XORMappedAddress
+	if err := addr.GetFromAs(m, stun.AttrXORPeerAddress); err != nil {
+		return err
+	}
+
+	*a = PeerAddress{IP: addr.IP, Port: addr.Port}
+
+	return nil
+}
+
+// RelayedAddress is the XOR-RELAYED-ADDRESS attribute, which carries the address allocated by the server
+type RelayedAddress net.UDPAddr
+
+func (a RelayedAddress) AddTo(m *stun.Message) error {
+	return stun.XORMappedAddress{IP: a.IP, Port: a.Port}.AddToAs(m, stun.AttrXORRelayedAddress)
+}
+
+func (a *RelayedAddress) GetFrom(m *stun.Message) error {
+	var addr stun.XORMappedAddress
+	if err := addr.GetFromAs(m, stun.AttrXORRelayedAddress); err != nil {
+		return err
+	}
+
+	*a = RelayedAddress{IP: addr.IP, Port: addr.Port}
+
+	return nil
+}
+
+// Data is the DATA attribute, which carries the payload of Send and Data indications
+type Data []byte
+
+func (d Data) AddTo(m *stun.Message) error {
+	m.Add(stun.AttrData, d)
+	return nil
+}
+
+func (d *Data) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrData)
+	if err != nil {
+		return err
+	}
+
+	*d = v
+
+	return nil
+}
+
+// ChannelData is a packet exchanged over a channel binding (RFC 5766, section 11.4)
+type ChannelData struct {
+	Number uint16
+	Data   []byte
+}
+
+const (
+	channelHeaderLen = 4
+
+	// FirstChannel and LastChannel bound the numbers that can be bound to remote peers
+	FirstChannel = 0x4000
+	LastChannel  = 0x7FFF
+)
+
+// IsChannelData reports whether packet looks like a ChannelData message, whose first two bits are 01 as opposed to
+// the 00 of STUN messages
+func IsChannelData(packet []byte) bool {
+	return len(packet) >= channelHeaderLen && packet[0]>>6 == 1
+}
+
+// Encode returns the wire format of the message
+func (c ChannelData) Encode() []byte {
+	buf := make([]byte, channelHeaderLen+len(c.Data))
+	binary.BigEndian.PutUint16(buf[0:2], c.Number)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(c.Data)))
+	copy(buf[channelHeaderLen:], c.Data)
+
+	return buf
+}
+
+// DecodeChannelData parses a ChannelData message. The data of the returned message aliases packet
+func DecodeChannelData(packet []byte) (ChannelData, error) {
+	if !IsChannelData(packet) {
+		return ChannelData{}, fmt.Errorf("not a ChannelData message")
+	}
+
+	length := int(binary.BigEndian.Uint16(packet[2:4]))
+	if length > len(packet)-channelHeaderLen {
+		return ChannelData{}, fmt.Errorf("truncated ChannelData message")
+	}
+
+	return ChannelData{
+		Number: binary.BigEndian.Uint16(packet[0:2]),
+		Data:   packet[channelHeaderLen : channelHeaderLen+length],
+	}, nil
+}
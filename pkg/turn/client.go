@@ -0,0 +1,631 @@
+package turn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pion/stun"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const (
+	// Permissions expire after 5 minutes and channel bindings after 10 (RFC 5766, sections 8 and 11), both are
+	// refreshed together with the allocation
+	permissionRefresh = 4 * time.Minute
+
+	readPollInterval = 100 * time.Millisecond
+)
+
+// Client allocates a relayed address on a TURN server (RFC 5766) and relays through it the traffic exchanged with the
+// remote peers that cannot be reached directly. The client shares the socket of the tunnel: while nobody else reads
+// the socket it reads the responses of the server itself, otherwise whoever reads the socket must hand the packets
+// received from the server to Unwrap. Client implements peer.Relay
+type Client struct {
+	conn     *net.UDPConn
+	server   *net.UDPAddr
+	username string
+	password string
+
+	lifetime          time.Duration
+	retransmitTimeout time.Duration
+	maxRetransmits    int
+	logger            logr.Logger
+
+	mu          sync.Mutex
+	realm       stun.Realm
+	nonce       stun.Nonce
+	relayed     *net.UDPAddr
+	permissions map[string]net.IP
+	numbers     map[string]uint16
+	channels    map[uint16]*net.UDPAddr
+	binding     map[uint16]struct{}
+	nextChannel uint16
+	pending     map[[stun.TransactionIDSize]byte]chan *stun.Message
+	closed      bool
+
+	// ctx is canceled once the client is closed, stopping the requests sent in the background
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewClient creates a client of the TURN server at server, authenticated with the given long-term credentials, that
+// talks to it through conn
+func NewClient(conn *net.UDPConn, server *net.UDPAddr, username, password string, opts ...Option) *Client {
+	cfg := newDefaultConfig()
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Client{
+		conn:              conn,
+		server:            server,
+		username:          username,
+		password:          password,
+		lifetime:          cfg.lifetime,
+		retransmitTimeout: cfg.retransmitTimeout,
+		maxRetransmits:    cfg.maxRetransmits,
+		logger:            cfg.logger,
+		permissions:       make(map[string]net.IP),
+		numbers:           make(map[string]uint16),
+		channels:          make(map[uint16]*net.UDPAddr),
+		binding:           make(map[uint16]struct{}),
+		nextChannel:       FirstChannel,
+		pending:           make(map[[stun.TransactionIDSize]byte]chan *stun.Message),
+		ctx:               ctx,
+		cancel:            cancel,
+		done:              make(chan struct{}),
+	}
+}
+
+// Allocate requests a relayed address on the server and keeps it alive in the background until Close is called. conn
+// must not be read by anyone else until Allocate returns
+func (c *Client) Allocate(ctx context.Context) (*net.UDPAddr, error) {
+	c.mu.Lock()
+	allocated, closed := c.relayed != nil, c.closed
+	c.mu.Unlock()
+
+	if closed {
+		return nil, wgerrors.ErrRelayClosed
+	}
+
+	if allocated {
+		return nil, wgerrors.Permanent(fmt.Errorf("address already allocated"))
+	}
+
+	var res *stun.Message
+	err := c.exclusive(ctx, func(ctx context.Context) error {
+		var errReq error
+		res, errReq = c.request(ctx, stun.MethodAllocate, RequestedTransport(TransportUDP), Lifetime(c.lifetime))
+		return errReq
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var relayed RelayedAddress
+	if errAddr := relayed.GetFrom(res); errAddr != nil {
+		return nil, fmt.Errorf("failed to extract XOR-RELAYED-ADDRESS: %w", errAddr)
+	}
+
+	// Servers are free to grant a lifetime other than the one requested
+	lifetime := Lifetime(c.lifetime)
+	if errLifetime := lifetime.GetFrom(res); errLifetime != nil || lifetime <= 0 {
+		lifetime = Lifetime(c.lifetime)
+	}
+
+	addr := &net.UDPAddr{IP: relayed.IP, Port: relayed.Port}
+
+	c.mu.Lock()
+	c.relayed = addr
+	c.mu.Unlock()
+
+	c.logger.Info("Allocated relayed address", "server", c.server.String(), "relayed", addr.String(), "lifetime", time.Duration(lifetime))
+
+	go c.maintain(time.Duration(lifetime))
+
+	return addr, nil
+}
+
+// Permit allows the given remote peers to send traffic to the relayed address. Permissions apply to the IP address of
+// the peers regardless of their port and are kept alive in the background. Every address is permitted on its own,
+// since servers reject whole requests if any address is forbidden, and an error is only returned if none could be
+// permitted. conn must not be read by anyone else until Permit returns
+func (c *Client) Permit(ctx context.Context, peers []*net.UDPAddr) error {
+	seen := make(map[string]struct{})
+	var ips []net.IP
+	for _, p := range peers {
+		if _, found := seen[p.IP.String()]; !found {
+			seen[p.IP.String()] = struct{}{}
+			ips = append(ips, p.IP)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil
+	}
+
+	return c.exclusive(ctx, func(ctx context.Context) error {
+		var errs []error
+		for _, ip := range ips {
+			if err := c.createPermissions(ctx, []net.IP{ip}); err != nil {
+				c.logger.Info("Relay permission rejected", "peer", ip.String(), "err", err.Error())
+				errs = append(errs, err)
+			}
+		}
+
+		if len(errs) == len(ips) {
+			return errors.Join(errs...)
+		}
+
+		return nil
+	})
+}
+
+// Relayed returns the relayed address, or nil if none has been allocated
+func (c *Client) Relayed() *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.relayed
+}
+
+// Server returns the address of the TURN server
+func (c *Client) Server() *net.UDPAddr {
+	return c.server
+}
+
+// Wrap encapsulates a packet addressed to a remote peer. Packets are sent over a channel once it has been bound to the
+// peer, which is done in the background the first time, and as Send indications meanwhile
+func (c *Client) Wrap(packet []byte, to *net.UDPAddr) ([]byte, error) {
+	c.mu.Lock()
+	closed := c.closed
+	number, assigned := c.numbers[to.String()]
+	_, bound := c.channels[number]
+	c.mu.Unlock()
+
+	if closed {
+		return nil, wgerrors.ErrRelayClosed
+	}
+
+	if assigned && bound {
+		return ChannelData{Number: number, Data: packet}.Encode(), nil
+	}
+
+	c.bindChannel(to)
+
+	msg, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodSend, stun.ClassIndication), PeerAddress(*to), Data(packet))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build Send indication: %w", err)
+	}
+
+	return msg.Raw, nil
+}
+
+// Unwrap decapsulates a packet received from the server. Responses to the requests of the client are consumed, in
+// which case ok is false
+func (c *Client) Unwrap(packet []byte) ([]byte, *net.UDPAddr, bool) {
+	if IsChannelData(packet) {
+		data, err := DecodeChannelData(packet)
+		if err != nil {
+			return nil, nil, false
+		}
+
+		c.mu.Lock()
+		from := c.channels[data.Number]
+		c.mu.Unlock()
+
+		if from == nil {
+			return nil, nil, false
+		}
+
+		return data.Data, from, true
+	}
+
+	if !stun.IsMessage(packet) {
+		return nil, nil, false
+	}
+
+	msg := &stun.Message{Raw: append([]byte(nil), packet...)}
+	if err := msg.Decode(); err != nil {
+		return nil, nil, false
+	}
+
+	switch msg.Type.Class {
+	case stun.ClassIndication:
+		if msg.Type.Method != stun.MethodData {
+			return nil, nil, false
+		}
+
+		var from PeerAddress
+		var data Data
+		if from.GetFrom(msg) != nil || data.GetFrom(msg) != nil {
+			return nil, nil, false
+		}
+
+		return data, &net.UDPAddr{IP: from.IP, Port: from.Port}, true
+	case stun.ClassSuccessResponse, stun.ClassErrorResponse:
+		c.mu.Lock()
+		responses, found := c.pending[msg.TransactionID]
+		c.mu.Unlock()
+
+		if found {
+			select {
+			case responses <- msg:
+			default:
+			}
+		}
+	}
+
+	return nil, nil, false
+}
+
+// Close releases the allocation and stops keeping it alive, after which traffic can no longer be relayed
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	allocated := c.relayed != nil
+	c.mu.Unlock()
+
+	c.cancel()
+
+	if !allocated {
+		return nil
+	}
+
+	<-c.done
+
+	// A zero lifetime deletes the allocation. The response is not awaited since nobody might be reading the socket
+	// anymore, the allocation expires on its own otherwise
+	msg, err := c.build(stun.MethodRefresh, Lifetime(0))
+	if err != nil {
+		return err
+	}
+
+	if _, errWrite := c.conn.WriteToUDP(msg.Raw, c.server); errWrite != nil && !errors.Is(errWrite, net.ErrClosed) {
+		return fmt.Errorf("failed to release allocation: %w", errWrite)
+	}
+
+	return nil
+}
+
+// maintain refreshes the allocation, its permissions and its channels until the client is closed or its socket is
+// gone. Responses only arrive while someone reads the socket, but the server applies the refreshes regardless
+func (c *Client) maintain(lifetime time.Duration) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(min(lifetime/2, permissionRefresh))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			err := c.refresh(c.ctx)
+			switch {
+			case err == nil:
+			case errors.Is(err, net.ErrClosed):
+				c.logger.Info("Socket closed, stopping relay", "server", c.server.String())
+				return
+			case wgerrors.IsTimeout(err):
+				c.logger.Info("Relay refresh not acknowledged", "server", c.server.String())
+			default:
+				c.logger.Error(err, "failed to refresh relay", "server", c.server.String())
+			}
+		}
+	}
+}
+
+// refresh renews the allocation together with every permission and channel installed
+func (c *Client) refresh(ctx context.Context) error {
+	if _, err := c.request(ctx, stun.MethodRefresh, Lifetime(c.lifetime)); err != nil {
+		return fmt.Errorf("failed to refresh allocation: %w", err)
+	}
+
+	c.mu.Lock()
+	ips := make([]net.IP, 0, len(c.permissions))
+	for _, ip := range c.permissions {
+		ips = append(ips, ip)
+	}
+	channels := make(map[uint16]*net.UDPAddr, len(c.channels))
+	for number, p := range c.channels {
+		channels[number] = p
+	}
+	c.mu.Unlock()
+
+	var errs []error
+	if err := c.createPermissions(ctx, ips); err != nil {
+		errs = append(errs, err)
+	}
+
+	for number, p := range channels {
+		if err := c.channelBind(ctx, number, p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// createPermissions installs or refreshes the permissions of the given IP addresses
+func (c *Client) createPermissions(ctx context.Context, ips []net.IP) error {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	setters := make([]stun.Setter, 0, len(ips))
+	for _, ip := range ips {
+		setters = append(setters, PeerAddress{IP: ip})
+	}
+
+	if _, err := c.request(ctx, stun.MethodCreatePermission, setters...); err != nil {
+		return fmt.Errorf("failed to create permissions: %w", err)
+	}
+
+	c.mu.Lock()
+	for _, ip := range ips {
+		c.permissions[ip.String()] = ip
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// bindChannel binds a channel to the remote peer in the background, unless one is already bound or being bound. The
+// number assigned to a peer is kept across attempts
+func (c *Client) bindChannel(to *net.UDPAddr) {
+	c.mu.Lock()
+	number, assigned := c.numbers[to.String()]
+	if !assigned {
+		if c.nextChannel > LastChannel {
+			c.mu.Unlock()
+			return
+		}
+
+		number = c.nextChannel
+		c.nextChannel++
+		c.numbers[to.String()] = number
+	}
+
+	if _, inFlight := c.binding[number]; inFlight || c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.binding[number] = struct{}{}
+	c.mu.Unlock()
+
+	go func() {
+		err := c.channelBind(c.ctx, number, to)
+
+		c.mu.Lock()
+		delete(c.binding, number)
+		c.mu.Unlock()
+
+		if err != nil {
+			c.logger.Error(err, "failed to bind channel", "peer", to.String(), "channel", number)
+		}
+	}()
+}
+
+// channelBind binds or refreshes a channel, which installs the permission of the remote peer as well
+func (c *Client) channelBind(ctx context.Context, number uint16, to *net.UDPAddr) error {
+	if _, err := c.request(ctx, stun.MethodChannelBind, ChannelNumber(number), PeerAddress(*to)); err != nil {
+		return fmt.Errorf("failed to bind channel %#x to %s: %w", number, to, err)
+	}
+
+	c.mu.Lock()
+	c.channels[number] = to
+	c.permissions[to.IP.String()] = to.IP
+	c.mu.Unlock()
+
+	return nil
+}
+
+// request sends a request authenticated with the long-term credentials and waits for its success response. Requests
+// rejected because the realm and nonce of the server are missing or stale are retried once with the ones received
+func (c *Client) request(ctx context.Context, method stun.Method, setters ...stun.Setter) (*stun.Message, error) {
+	for attempt := 0; ; attempt++ {
+		msg, err := c.build(method, setters...)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := c.roundTrip(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.Type.Class == stun.ClassSuccessResponse {
+			if errIntegrity := c.checkIntegrity(res); errIntegrity != nil {
+				return nil, fmt.Errorf("invalid integrity of %s response: %w", method, errIntegrity)
+			}
+
+			return res, nil
+		}
+
+		var code stun.ErrorCodeAttribute
+		if errCode := code.GetFrom(res); errCode != nil {
+			return nil, fmt.Errorf("%s failed: %w", method, errCode)
+		}
+
+		retry := code.Code == stun.CodeUnauthorized || code.Code == stun.CodeStaleNonce
+		if retry && attempt == 0 {
+			if errNonce := c.updateNonce(res); errNonce != nil {
+				return nil, fmt.Errorf("%s failed: %w", method, errNonce)
+			}
+			continue
+		}
+
+		errRes := fmt.Errorf("%s failed: %d %s", method, code.Code, code.Reason)
+		switch code.Code {
+		case stun.CodeUnauthorized, stun.CodeForbidden, stun.CodeWrongCredentials, stun.CodeUnsupportedTransProto:
+			return nil, wgerrors.Permanent(errRes)
+		case stun.CodeAllocQuotaReached, stun.CodeInsufficientCapacity:
+			return nil, wgerrors.Temporary(errRes)
+		default:
+			return nil, errRes
+		}
+	}
+}
+
+// build encodes a request, authenticated once the realm and nonce of the server are known
+func (c *Client) build(method stun.Method, setters ...stun.Setter) (*stun.Message, error) {
+	c.mu.Lock()
+	realm, nonce := c.realm, c.nonce
+	c.mu.Unlock()
+
+	all := append([]stun.Setter{stun.TransactionID, stun.NewType(method, stun.ClassRequest)}, setters...)
+	if len(realm) > 0 {
+		all = append(all, stun.NewUsername(c.username), realm, nonce, c.integrity())
+	}
+
+	msg, err := stun.Build(all...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build %s request: %w", method, err)
+	}
+
+	return msg, nil
+}
+
+// integrity returns the key derived from the long-term credentials and the realm of the server
+func (c *Client) integrity() stun.MessageIntegrity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return stun.NewLongTermIntegrity(c.username, c.realm.String(), c.password)
+}
+
+// checkIntegrity verifies the integrity of a response to an authenticated request. Servers that do not authenticate
+// their clients do not sign their responses either
+func (c *Client) checkIntegrity(res *stun.Message) error {
+	c.mu.Lock()
+	authenticated := len(c.realm) > 0
+	c.mu.Unlock()
+
+	if !authenticated {
+		return nil
+	}
+
+	return c.integrity().Check(res)
+}
+
+// updateNonce stores the realm and nonce sent by the server along with a 401 or 438 error
+func (c *Client) updateNonce(res *stun.Message) error {
+	var realm stun.Realm
+	var nonce stun.Nonce
+
+	if err := nonce.GetFrom(res); err != nil {
+		return fmt.Errorf("missing NONCE: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The realm only comes along with 401 errors
+	if err := realm.GetFrom(res); err == nil {
+		c.realm = realm
+	}
+
+	if len(c.realm) == 0 {
+		return fmt.Errorf("missing REALM")
+	}
+
+	c.nonce = nonce
+
+	return nil
+}
+
+// roundTrip sends a request and waits for its response, retransmitting it with an exponential backoff
+func (c *Client) roundTrip(ctx context.Context, msg *stun.Message) (*stun.Message, error) {
+	responses := make(chan *stun.Message, 1)
+
+	c.mu.Lock()
+	c.pending[msg.TransactionID] = responses
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, msg.TransactionID)
+		c.mu.Unlock()
+	}()
+
+	rto := c.retransmitTimeout
+	for range c.maxRetransmits + 1 {
+		if _, err := c.conn.WriteToUDP(msg.Raw, c.server); err != nil {
+			return nil, fmt.Errorf("failed to send request to %s: %w", c.server, err)
+		}
+
+		timer := time.NewTimer(rto)
+		select {
+		case res := <-responses:
+			timer.Stop()
+			return res, nil
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		rto *= 2
+	}
+
+	return nil, fmt.Errorf("no response from %s: %w", c.server, os.ErrDeadlineExceeded)
+}
+
+// exclusive runs fn while reading conn on behalf of the client, so that the responses of the server are received
+func (c *Client) exclusive(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctxRead, cancel := context.WithCancel(ctx)
+
+	done := make(chan struct{})
+	go c.read(ctxRead, done)
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	return fn(ctxRead)
+}
+
+// read hands the packets received from the server to Unwrap until ctx is done. Anything else is dropped
+func (c *Client) read(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	defer func() {
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}()
+
+	buf := make([]byte, util.UDPMaxBuffer)
+
+	for ctx.Err() == nil {
+		// Wake up regularly in order to notice the cancellation of ctx
+		_ = c.conn.SetReadDeadline(time.Now().Add(readPollInterval))
+
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if wgerrors.IsTimeout(err) {
+				continue
+			}
+			return
+		}
+
+		if from.IP.Equal(c.server.IP) && from.Port == c.server.Port {
+			c.Unwrap(buf[:n])
+		}
+	}
+}
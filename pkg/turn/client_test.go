@@ -0,0 +1,120 @@
+package turn_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/yago-123/wg-punch/pkg/turn"
+	"github.com/yago-123/wg-punch/pkg/turn/turntest"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const (
+	username = "user"
+	password = "pass"
+)
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to bind socket: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+// receive reads conn until a packet relayed by the client arrives, handing everything received to Unwrap like a
+// tunnel sharing the socket would do
+func receive(t *testing.T, client *turn.Client, conn *net.UDPConn) ([]byte, *net.UDPAddr) {
+	t.Helper()
+
+	buf := make([]byte, util.UDPMaxBuffer)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("failed to receive relayed packet: %v", err)
+		}
+
+		if data, from, ok := client.Unwrap(buf[:n]); ok {
+			return data, from
+		}
+	}
+}
+
+func TestRelayedExchange(t *testing.T) {
+	srv, err := turntest.NewServer("127.0.0.1:0", username, password, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to start TURN server: %v", err)
+	}
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := listenLoopback(t)
+	client := turn.NewClient(conn, srv.Addr(), username, password)
+	defer client.Close()
+
+	relayed, err := client.Allocate(ctx)
+	if err != nil {
+		t.Fatalf("failed to allocate: %v", err)
+	}
+
+	if srv.Allocations() != 1 {
+		t.Fatalf("expected 1 allocation, got %d", srv.Allocations())
+	}
+
+	remote := listenLoopback(t)
+	remoteAddr := remote.LocalAddr().(*net.UDPAddr)
+	if err = client.Permit(ctx, []*net.UDPAddr{remoteAddr}); err != nil {
+		t.Fatalf("failed to permit remote peer: %v", err)
+	}
+
+	buf := make([]byte, util.UDPMaxBuffer)
+
+	// Traffic goes through Send and Data indications first and through the channel bound in the background later on
+	channel := false
+	for round := 0; round < 10 && !channel; round++ {
+		packet, errWrap := client.Wrap([]byte("ping"), remoteAddr)
+		if errWrap != nil {
+			t.Fatalf("failed to wrap packet: %v", errWrap)
+		}
+		channel = turn.IsChannelData(packet)
+
+		if _, errWrite := conn.WriteToUDP(packet, srv.Addr()); errWrite != nil {
+			t.Fatalf("failed to send packet: %v", errWrite)
+		}
+
+		_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, from, errRead := remote.ReadFromUDP(buf)
+		if errRead != nil {
+			t.Fatalf("remote peer did not receive the packet: %v", errRead)
+		}
+
+		if string(buf[:n]) != "ping" || from.String() != relayed.String() {
+			t.Fatalf("expected ping from %s, got %q from %s", relayed, buf[:n], from)
+		}
+
+		if _, errWrite := remote.WriteToUDP([]byte("pong"), relayed); errWrite != nil {
+			t.Fatalf("failed to answer: %v", errWrite)
+		}
+
+		data, peer := receive(t, client, conn)
+		if string(data) != "pong" || peer.String() != remoteAddr.String() {
+			t.Fatalf("expected pong from %s, got %q from %s", remoteAddr, data, peer)
+		}
+	}
+
+	if !channel {
+		t.Fatalf("expected traffic to move to a channel")
+	}
+}
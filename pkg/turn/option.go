@@ -0,0 +1,57 @@
+package turn
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// RFC 5766 recommends 10 minutes, servers may grant a different lifetime
+	defaultLifetime = 10 * time.Minute
+
+	defaultRetransmitTimeout = 500 * time.Millisecond
+	defaultMaxRetransmits    = 5
+)
+
+type config struct {
+	lifetime          time.Duration
+	retransmitTimeout time.Duration
+	maxRetransmits    int
+	logger            logr.Logger
+}
+
+type Option func(*config)
+
+func newDefaultConfig() *config {
+	return &config{
+		lifetime:          defaultLifetime,
+		retransmitTimeout: defaultRetransmitTimeout,
+		maxRetransmits:    defaultMaxRetransmits,
+		logger:            logr.Discard(),
+	}
+}
+
+// WithLifetime sets the lifetime requested for the allocation. The allocation is refreshed in the background before it
+// expires, using the lifetime granted by the server
+func WithLifetime(lifetime time.Duration) Option {
+	return func(cfg *config) {
+		cfg.lifetime = lifetime
+	}
+}
+
+// WithRetransmits sets the number of retransmissions of a request before giving up, together with the initial
+// retransmission timeout, which doubles after every retransmission
+func WithRetransmits(retransmits int, timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxRetransmits = retransmits
+		cfg.retransmitTimeout = timeout
+	}
+}
+
+// WithLogger sets the logger to use for logging. The logger must implement the logr.Logger interface
+func WithLogger(logger logr.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
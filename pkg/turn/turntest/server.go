@@ -0,0 +1,537 @@
+// Package turntest provides a minimal TURN server meant to exercise relayed connections locally, in the spirit of
+// net/http/httptest. It is not meant to face the internet
+package turntest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pion/stun"
+
+	"github.com/yago-123/wg-punch/pkg/turn"
+	"github.com/yago-123/wg-punch/pkg/util"
+)
+
+const (
+	realm = "wg-punch"
+
+	defaultLifetime    = 10 * time.Minute
+	maxLifetime        = 1 * time.Hour
+	permissionLifetime = 5 * time.Minute
+	channelLifetime    = 10 * time.Minute
+
+	expiryInterval = 1 * time.Second
+)
+
+// Server is a TURN server (RFC 5766) that relays UDP for clients authenticated with a single set of long-term
+// credentials. It supports allocations, permissions, channel bindings and Send and Data indications. Relayed addresses
+// are allocated on the IP address the server listens on
+type Server struct {
+	conn     *net.UDPConn
+	username string
+	password string
+	nonce    stun.Nonce
+	logger   logr.Logger
+
+	mu          sync.Mutex
+	allocations map[string]*allocation
+
+	closeOnce sync.Once
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// allocation is the relayed address of a client together with its permissions and channels
+type allocation struct {
+	client      *net.UDPAddr
+	relay       *net.UDPConn
+	expiresAt   time.Time
+	permissions map[string]time.Time
+	channels    map[uint16]*net.UDPAddr
+	numbers     map[string]uint16
+	channelsExp map[uint16]time.Time
+}
+
+// NewServer starts a server listening on addr, like "127.0.0.1:0"
+func NewServer(addr, username, password string, logger logr.Logger) (*Server, error) {
+	listenAddr, err := net.ResolveUDPAddr(util.UDPProtocol, addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+
+	conn, err := net.ListenUDP(util.UDPProtocol, listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	nonce := make([]byte, 8)
+	if _, errRand := rand.Read(nonce); errRand != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to generate nonce: %w", errRand)
+	}
+
+	s := &Server{
+		conn:        conn,
+		username:    username,
+		password:    password,
+		nonce:       stun.NewNonce(hex.EncodeToString(nonce)),
+		logger:      logger,
+		allocations: make(map[string]*allocation),
+		done:        make(chan struct{}),
+	}
+
+	s.wg.Add(2)
+	go s.serve()
+	go s.expire()
+
+	return s, nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() *net.UDPAddr {
+	addr, _ := s.conn.LocalAddr().(*net.UDPAddr)
+	return addr
+}
+
+// Allocations returns the number of live allocations
+func (s *Server) Allocations() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.allocations)
+}
+
+// Close stops the server and releases every allocation
+func (s *Server) Close() error {
+	var err error
+
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.conn.Close()
+
+		s.mu.Lock()
+		for key, alloc := range s.allocations {
+			_ = alloc.relay.Close()
+			delete(s.allocations, key)
+		}
+		s.mu.Unlock()
+
+		s.wg.Wait()
+	})
+
+	return err
+}
+
+// serve handles the packets sent by clients until the server is closed
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	buf := make([]byte, util.UDPMaxBuffer)
+
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		packet := buf[:n]
+		switch {
+		case turn.IsChannelData(packet):
+			s.handleChannelData(packet, from)
+		case stun.IsMessage(packet):
+			msg := &stun.Message{Raw: append([]byte(nil), packet...)}
+			if errDecode := msg.Decode(); errDecode != nil {
+				continue
+			}
+			s.handleMessage(msg, from)
+		}
+	}
+}
+
+// expire drops the allocations, permissions and channels whose lifetime is over
+func (s *Server) expire() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, alloc := range s.allocations {
+				if now.After(alloc.expiresAt) {
+					_ = alloc.relay.Close()
+					delete(s.allocations, key)
+					continue
+				}
+
+				for ip, expiresAt := range alloc.permissions {
+					if now.After(expiresAt) {
+						delete(alloc.permissions, ip)
+					}
+				}
+
+				for number, expiresAt := range alloc.channelsExp {
+					if now.After(expiresAt) {
+						delete(alloc.numbers, alloc.channels[number].String())
+						delete(alloc.channels, number)
+						delete(alloc.channelsExp, number)
+					}
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// handleChannelData relays a packet sent by a client over one of its channels
+func (s *Server) handleChannelData(packet []byte, from *net.UDPAddr) {
+	data, err := turn.DecodeChannelData(packet)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	alloc := s.allocations[from.String()]
+	var to *net.UDPAddr
+	if alloc != nil {
+		to = alloc.channels[data.Number]
+	}
+	s.mu.Unlock()
+
+	if to != nil {
+		_, _ = alloc.relay.WriteToUDP(data.Data, to)
+	}
+}
+
+// handleMessage handles a STUN message sent by a client
+func (s *Server) handleMessage(msg *stun.Message, from *net.UDPAddr) {
+	if msg.Type == stun.NewType(stun.MethodSend, stun.ClassIndication) {
+		s.handleSend(msg, from)
+		return
+	}
+
+	if msg.Type.Class != stun.ClassRequest {
+		return
+	}
+
+	if !s.authenticate(msg, from) {
+		return
+	}
+
+	switch msg.Type.Method {
+	case stun.MethodAllocate:
+		s.handleAllocate(msg, from)
+	case stun.MethodRefresh:
+		s.handleRefresh(msg, from)
+	case stun.MethodCreatePermission:
+		s.handleCreatePermission(msg, from)
+	case stun.MethodChannelBind:
+		s.handleChannelBind(msg, from)
+	default:
+		s.reject(msg, from, stun.CodeBadRequest)
+	}
+}
+
+// authenticate checks the long-term credentials of a request, challenging the client if they are missing or stale
+func (s *Server) authenticate(msg *stun.Message, from *net.UDPAddr) bool {
+	if !msg.Contains(stun.AttrMessageIntegrity) {
+		s.challenge(msg, from, stun.CodeUnauthorized)
+		return false
+	}
+
+	var username stun.Username
+	var nonce stun.Nonce
+	if username.GetFrom(msg) != nil || nonce.GetFrom(msg) != nil {
+		s.reject(msg, from, stun.CodeBadRequest)
+		return false
+	}
+
+	if username.String() != s.username {
+		s.challenge(msg, from, stun.CodeUnauthorized)
+		return false
+	}
+
+	if nonce.String() != s.nonce.String() {
+		s.challenge(msg, from, stun.CodeStaleNonce)
+		return false
+	}
+
+	if err := s.integrity().Check(msg); err != nil {
+		s.challenge(msg, from, stun.CodeUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) handleAllocate(msg *stun.Message, from *net.UDPAddr) {
+	var transport turn.RequestedTransport
+	if err := transport.GetFrom(msg); err != nil {
+		s.reject(msg, from, stun.CodeBadRequest)
+		return
+	}
+
+	if transport != turn.TransportUDP {
+		s.reject(msg, from, stun.CodeUnsupportedTransProto)
+		return
+	}
+
+	s.mu.Lock()
+	_, exists := s.allocations[from.String()]
+	s.mu.Unlock()
+
+	if exists {
+		s.reject(msg, from, stun.CodeAllocMismatch)
+		return
+	}
+
+	relay, err := net.ListenUDP(util.UDPProtocol, &net.UDPAddr{IP: s.Addr().IP})
+	if err != nil {
+		s.reject(msg, from, stun.CodeInsufficientCapacity)
+		return
+	}
+
+	lifetime := requestedLifetime(msg)
+	alloc := &allocation{
+		client:      from,
+		relay:       relay,
+		expiresAt:   time.Now().Add(lifetime),
+		permissions: make(map[string]time.Time),
+		channels:    make(map[uint16]*net.UDPAddr),
+		numbers:     make(map[string]uint16),
+		channelsExp: make(map[uint16]time.Time),
+	}
+
+	s.mu.Lock()
+	s.allocations[from.String()] = alloc
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.relay(alloc)
+
+	relayed, _ := relay.LocalAddr().(*net.UDPAddr)
+	s.logger.Info("Allocated relayed address", "client", from.String(), "relayed", relayed.String())
+
+	s.respond(msg, from,
+		turn.RelayedAddress(*relayed),
+		&stun.XORMappedAddress{IP: from.IP, Port: from.Port},
+		turn.Lifetime(lifetime),
+	)
+}
+
+func (s *Server) handleRefresh(msg *stun.Message, from *net.UDPAddr) {
+	lifetime := requestedLifetime(msg)
+
+	s.mu.Lock()
+	alloc, found := s.allocations[from.String()]
+	if found {
+		if lifetime == 0 {
+			_ = alloc.relay.Close()
+			delete(s.allocations, from.String())
+		} else {
+			alloc.expiresAt = time.Now().Add(lifetime)
+		}
+	}
+	s.mu.Unlock()
+
+	if !found {
+		s.reject(msg, from, stun.CodeAllocMismatch)
+		return
+	}
+
+	s.respond(msg, from, turn.Lifetime(lifetime))
+}
+
+func (s *Server) handleCreatePermission(msg *stun.Message, from *net.UDPAddr) {
+	var peers []net.IP
+	for _, attr := range msg.Attributes {
+		if attr.Type != stun.AttrXORPeerAddress {
+			continue
+		}
+
+		// Every XOR-PEER-ADDRESS is decoded on its own since Message.Get only returns the first one
+		single := &stun.Message{TransactionID: msg.TransactionID}
+		single.Add(stun.AttrXORPeerAddress, attr.Value)
+
+		var peer turn.PeerAddress
+		if err := peer.GetFrom(single); err != nil {
+			s.reject(msg, from, stun.CodeBadRequest)
+			return
+		}
+		peers = append(peers, peer.IP)
+	}
+
+	if len(peers) == 0 {
+		s.reject(msg, from, stun.CodeBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	alloc, found := s.allocations[from.String()]
+	if found {
+		for _, ip := range peers {
+			alloc.permissions[ip.String()] = time.Now().Add(permissionLifetime)
+		}
+	}
+	s.mu.Unlock()
+
+	if !found {
+		s.reject(msg, from, stun.CodeAllocMismatch)
+		return
+	}
+
+	s.respond(msg, from)
+}
+
+func (s *Server) handleChannelBind(msg *stun.Message, from *net.UDPAddr) {
+	var number turn.ChannelNumber
+	var peer turn.PeerAddress
+	if number.GetFrom(msg) != nil || peer.GetFrom(msg) != nil || number < turn.FirstChannel || number > turn.LastChannel {
+		s.reject(msg, from, stun.CodeBadRequest)
+		return
+	}
+
+	to := &net.UDPAddr{IP: peer.IP, Port: peer.Port}
+
+	s.mu.Lock()
+	alloc, found := s.allocations[from.String()]
+	ok := found
+	if found {
+		// A channel can only be bound to a single peer and a peer to a single channel
+		bound, taken := alloc.channels[uint16(number)]
+		current, assigned := alloc.numbers[to.String()]
+		if (taken && bound.String() != to.String()) || (assigned && current != uint16(number)) {
+			ok = false
+		} else {
+			now := time.Now()
+			alloc.channels[uint16(number)] = to
+			alloc.numbers[to.String()] = uint16(number)
+			alloc.channelsExp[uint16(number)] = now.Add(channelLifetime)
+			alloc.permissions[to.IP.String()] = now.Add(permissionLifetime)
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case !found:
+		s.reject(msg, from, stun.CodeAllocMismatch)
+	case !ok:
+		s.reject(msg, from, stun.CodeBadRequest)
+	default:
+		s.respond(msg, from)
+	}
+}
+
+// handleSend relays the data of a Send indication to the remote peer, provided it has a permission
+func (s *Server) handleSend(msg *stun.Message, from *net.UDPAddr) {
+	var peer turn.PeerAddress
+	var data turn.Data
+	if peer.GetFrom(msg) != nil || data.GetFrom(msg) != nil {
+		return
+	}
+
+	s.mu.Lock()
+	alloc := s.allocations[from.String()]
+	permitted := alloc != nil && time.Now().Before(alloc.permissions[peer.IP.String()])
+	s.mu.Unlock()
+
+	if permitted {
+		_, _ = alloc.relay.WriteToUDP(data, &net.UDPAddr{IP: peer.IP, Port: peer.Port})
+	}
+}
+
+// relay forwards the packets received on the relayed address to the client, over a channel if one is bound to the
+// sender and as Data indications otherwise. Packets from peers without a permission are dropped
+func (s *Server) relay(alloc *allocation) {
+	defer s.wg.Done()
+
+	buf := make([]byte, util.UDPMaxBuffer)
+
+	for {
+		n, from, err := alloc.relay.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		permitted := time.Now().Before(alloc.permissions[from.IP.String()])
+		number, bound := alloc.numbers[from.String()]
+		s.mu.Unlock()
+
+		if !permitted {
+			continue
+		}
+
+		var packet []byte
+		if bound {
+			packet = turn.ChannelData{Number: number, Data: buf[:n]}.Encode()
+		} else {
+			msg, errBuild := stun.Build(stun.TransactionID, stun.NewType(stun.MethodData, stun.ClassIndication), turn.PeerAddress(*from), turn.Data(buf[:n]))
+			if errBuild != nil {
+				continue
+			}
+			packet = msg.Raw
+		}
+
+		_, _ = s.conn.WriteToUDP(packet, alloc.client)
+	}
+}
+
+// respond sends a success response signed with the long-term credentials
+func (s *Server) respond(req *stun.Message, to *net.UDPAddr, setters ...stun.Setter) {
+	all := []stun.Setter{stun.NewTransactionIDSetter(req.TransactionID), stun.NewType(req.Type.Method, stun.ClassSuccessResponse)}
+	all = append(all, setters...)
+	all = append(all, s.integrity())
+
+	s.send(all, to)
+}
+
+// reject sends an error response signed with the long-term credentials
+func (s *Server) reject(req *stun.Message, to *net.UDPAddr, code stun.ErrorCode) {
+	s.send([]stun.Setter{stun.NewTransactionIDSetter(req.TransactionID), stun.NewType(req.Type.Method, stun.ClassErrorResponse), code, s.integrity()}, to)
+}
+
+// challenge sends an unsigned error response carrying the realm and nonce the client must authenticate with
+func (s *Server) challenge(req *stun.Message, to *net.UDPAddr, code stun.ErrorCode) {
+	s.send([]stun.Setter{stun.NewTransactionIDSetter(req.TransactionID), stun.NewType(req.Type.Method, stun.ClassErrorResponse), code, stun.NewRealm(realm), s.nonce}, to)
+}
+
+func (s *Server) send(setters []stun.Setter, to *net.UDPAddr) {
+	msg, err := stun.Build(setters...)
+	if err != nil {
+		s.logger.Error(err, "failed to build response")
+		return
+	}
+
+	_, _ = s.conn.WriteToUDP(msg.Raw, to)
+}
+
+func (s *Server) integrity() stun.MessageIntegrity {
+	return stun.NewLongTermIntegrity(s.username, realm, s.password)
+}
+
+// requestedLifetime returns the lifetime requested by the client, capped to the maximum allowed
+func requestedLifetime(msg *stun.Message) time.Duration {
+	var lifetime turn.Lifetime
+	if err := lifetime.GetFrom(msg); err != nil {
+		return defaultLifetime
+	}
+
+	return min(time.Duration(lifetime), maxLifetime)
+}
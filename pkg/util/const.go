@@ -3,4 +3,8 @@ package util
 const (
 	TCPProtocol = "tcp"
 	UDPProtocol = "udp"
+
+	// UDP4Protocol and UDP6Protocol restrict the resolution of addresses to a single family
+	UDP4Protocol = "udp4"
+	UDP6Protocol = "udp6"
 )
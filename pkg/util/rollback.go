@@ -0,0 +1,45 @@
+package util
+
+import (
+	"github.com/go-logr/logr"
+)
+
+// Rollback keeps track of the resources acquired by a multi-step operation so that they can be released in reverse
+// order if one of the later steps fails. Once the operation succeeds Commit must be called so that the resources are
+// kept
+type Rollback struct {
+	steps  []rollbackStep
+	logger logr.Logger
+}
+
+type rollbackStep struct {
+	name string
+	undo func() error
+}
+
+func NewRollback(logger logr.Logger) *Rollback {
+	return &Rollback{logger: logger}
+}
+
+// Add registers the action that releases a resource that has just been acquired
+func (r *Rollback) Add(name string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{name: name, undo: undo})
+}
+
+// Commit forgets every registered action, so that a later call to Run does nothing
+func (r *Rollback) Commit() {
+	r.steps = nil
+}
+
+// Run releases the acquired resources in reverse order. Every action is attempted even if some of them fail, since
+// Run usually happens while another error is being returned the failures are only logged
+func (r *Rollback) Run() {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		if err := step.undo(); err != nil {
+			r.logger.Error(err, "failed to roll back", "step", step.name)
+		}
+	}
+
+	r.steps = nil
+}
@@ -0,0 +1,301 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pion/stun"
+
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
+)
+
+const (
+	// Retransmission schedule of RFC 5389, section 7.2.1. Requests are sent up to 7 times, doubling the timeout after
+	// every transmission, and the last one is given 16 times the initial timeout to be answered
+	stunInitialRTO       = 500 * time.Millisecond
+	stunMaxTransmissions = 7
+	stunFinalWaitFactor  = 16
+
+	// stunReadPollInterval bounds every read so that the cancellation of ctx is noticed
+	stunReadPollInterval = 200 * time.Millisecond
+)
+
+// stunResult is the outcome of the Binding transaction with a single STUN server
+type stunResult struct {
+	server string
+	addr   *net.UDPAddr
+	err    error
+}
+
+// stunTransaction is a Binding request awaiting its response
+type stunTransaction struct {
+	id            [stun.TransactionIDSize]byte
+	index         int
+	server        *net.UDPAddr
+	raw           []byte
+	rto           time.Duration
+	transmissions int
+	next          time.Time
+}
+
+// querySTUNServers sends a Binding request to every server at once through conn, in the same order as the servers,
+// and waits for their responses, retransmitting every request on its own schedule. Only responses that come from the server they were sent to, match
+// the transaction ID of the request and carry a valid FINGERPRINT, if any, are accepted, anything else that arrives
+// through conn is dropped. The results are returned in the same order as the servers. Unless decided is nil, the queries
+// stop as soon as it reports that the pending responses cannot change the outcome anymore. The read deadline of conn is
+// cleared once done, since the socket is usually handed to someone else afterwards
+func querySTUNServers(ctx context.Context, conn UDPConn, servers []string, network string, decided func(results []stunResult, pending int) bool) []stunResult {
+	results := make([]stunResult, len(servers))
+
+	// Bound the queries if the caller did not, the final wait of the retransmission schedule is too long otherwise
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultSTUNTimeout)
+		defer cancel()
+	}
+
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	// The map only matches the responses, the requests are sent in the order of the servers, which tells how the NAT
+	// allocates public ports for consecutive destinations
+	pending := make(map[[stun.TransactionIDSize]byte]*stunTransaction)
+	queue := make([]*stunTransaction, 0, len(servers))
+	for i, server := range servers {
+		results[i].server = server
+
+		serverAddr, err := net.ResolveUDPAddr(network, server)
+		if err != nil {
+			results[i].err = fmt.Errorf("failed to resolve STUN server %q: %w", server, err)
+			continue
+		}
+
+		req, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+		if err != nil {
+			results[i].err = fmt.Errorf("failed to build STUN request: %w", err)
+			continue
+		}
+
+		tx := &stunTransaction{id: req.TransactionID, index: i, server: serverAddr, raw: req.Raw, rto: stunInitialRTO}
+		pending[tx.id] = tx
+		queue = append(queue, tx)
+	}
+
+	buf := make([]byte, UDPMaxBuffer)
+
+	for len(pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			for _, tx := range pending {
+				results[tx.index].err = wgerrors.Temporary(fmt.Errorf("no response from STUN server %s: %w", tx.server, err))
+			}
+			break
+		}
+
+		deadline := time.Now().Add(stunReadPollInterval)
+		for _, tx := range queue {
+			if _, found := pending[tx.id]; !found {
+				continue
+			}
+
+			if err := tx.retransmit(conn); err != nil {
+				results[tx.index].err = err
+				delete(pending, tx.id)
+				continue
+			}
+
+			if tx.next.Before(deadline) {
+				deadline = tx.next
+			}
+		}
+
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		_ = conn.SetReadDeadline(deadline)
+
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if wgerrors.IsTimeout(err) {
+				continue
+			}
+
+			for _, tx := range pending {
+				results[tx.index].err = fmt.Errorf("failed to read STUN response from %s: %w", tx.server, err)
+			}
+			break
+		}
+
+		res, tx := matchSTUNResponse(buf[:n], from, pending)
+		if tx == nil {
+			continue
+		}
+
+		delete(pending, res.TransactionID)
+		results[tx.index].addr, results[tx.index].err = mappedAddress(res)
+
+		if decided != nil && decided(results, len(pending)) {
+			for _, tx := range pending {
+				results[tx.index].err = fmt.Errorf("query to STUN server %s abandoned, consensus already reached", tx.server)
+			}
+			break
+		}
+	}
+
+	return results
+}
+
+// retransmit sends the request if its retransmission timeout has expired. Once the schedule is exhausted without
+// answer a timeout error is returned
+func (tx *stunTransaction) retransmit(conn UDPConn) error {
+	now := time.Now()
+	if now.Before(tx.next) {
+		return nil
+	}
+
+	if tx.transmissions == stunMaxTransmissions {
+		return wgerrors.Temporary(fmt.Errorf("no response from STUN server %s: %w", tx.server, os.ErrDeadlineExceeded))
+	}
+
+	if _, err := conn.WriteToUDP(tx.raw, tx.server); err != nil {
+		return fmt.Errorf("failed to send STUN request to %s: %w", tx.server, err)
+	}
+
+	tx.transmissions++
+	tx.next = now.Add(tx.rto)
+	tx.rto *= 2
+
+	if tx.transmissions == stunMaxTransmissions {
+		tx.next = now.Add(stunInitialRTO * stunFinalWaitFactor)
+	}
+
+	return nil
+}
+
+// matchSTUNResponse decodes packet and returns it together with the pending transaction it answers, nil if it answers
+// none of them
+func matchSTUNResponse(packet []byte, from *net.UDPAddr, pending map[[stun.TransactionIDSize]byte]*stunTransaction) (*stun.Message, *stunTransaction) {
+	if !stun.IsMessage(packet) {
+		return nil, nil
+	}
+
+	res := &stun.Message{Raw: append([]byte(nil), packet...)}
+	if res.Decode() != nil {
+		return nil, nil
+	}
+
+	tx, found := pending[res.TransactionID]
+	if !found || !sameUDPAddr(tx.server, from) {
+		return nil, nil
+	}
+
+	if res.Type.Class != stun.ClassSuccessResponse && res.Type.Class != stun.ClassErrorResponse {
+		return nil, nil
+	}
+
+	if CheckFingerprint(res) != nil {
+		return nil, nil
+	}
+
+	return res, tx
+}
+
+// mappedAddress extracts the public address from a Binding response
+func mappedAddress(res *stun.Message) (*net.UDPAddr, error) {
+	if res.Type.Class == stun.ClassErrorResponse {
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(res); err != nil {
+			return nil, fmt.Errorf("STUN server returned an error")
+		}
+		return nil, fmt.Errorf("STUN server returned error %d: %s", code.Code, code.Reason)
+	}
+
+	var xorAddr stun.XORMappedAddress
+	if err := xorAddr.GetFrom(res); err != nil {
+		// A malformed reply does not mean that the server will keep sending them
+		return nil, wgerrors.Temporary(fmt.Errorf("failed to extract XOR-MAPPED-ADDRESS: %w", err))
+	}
+
+	return &net.UDPAddr{IP: NormalizeIP(xorAddr.IP), Port: xorAddr.Port}, nil
+}
+
+// CheckFingerprint validates the FINGERPRINT attribute of a STUN message. Messages without it are accepted, since
+// the attribute is optional
+func CheckFingerprint(msg *stun.Message) error {
+	if !msg.Contains(stun.AttrFingerprint) {
+		return nil
+	}
+
+	return stun.Fingerprint.Check(msg)
+}
+
+// stunConsensus returns the public address reported by most servers, ties are broken in favour of the servers listed
+// first. nil is returned if no server answered
+func stunConsensus(results []stunResult) *net.UDPAddr {
+	best, _, _ := stunVotes(results)
+	return best
+}
+
+// stunDecided reports whether the address reported by most servers so far keeps the lead whatever the pending servers
+// report
+func stunDecided(results []stunResult, pending int) bool {
+	best, bestVotes, runnerUpVotes := stunVotes(results)
+	return best != nil && bestVotes > runnerUpVotes+pending
+}
+
+// stunVotes returns the public address reported by most servers together with its votes, and the votes of the address
+// that comes next
+func stunVotes(results []stunResult) (*net.UDPAddr, int, int) {
+	var best *net.UDPAddr
+	bestVotes, runnerUpVotes := 0, 0
+
+	for i, candidate := range results {
+		if candidate.addr == nil {
+			continue
+		}
+
+		votes := 0
+		for _, other := range results[i:] {
+			if other.addr != nil && sameUDPAddr(other.addr, candidate.addr) {
+				votes++
+			}
+		}
+
+		switch {
+		case votes > bestVotes:
+			best, bestVotes, runnerUpVotes = candidate.addr, votes, bestVotes
+		case votes > runnerUpVotes && !sameUDPAddr(candidate.addr, best):
+			runnerUpVotes = votes
+		}
+	}
+
+	return best, bestVotes, runnerUpVotes
+}
+
+// stunError summarizes the errors of every server that did not answer. Retrying makes sense as long as one of them
+// failed for a transient reason
+func stunError(results []stunResult) error {
+	var lastErr error
+	temporary := false
+
+	for _, result := range results {
+		if result.err != nil {
+			lastErr = result.err
+			temporary = temporary || wgerrors.IsTemporary(result.err)
+		}
+	}
+
+	errAll := fmt.Errorf("all STUN servers failed: %w", lastErr)
+	if temporary {
+		return wgerrors.Temporary(errAll)
+	}
+
+	return errAll
+}
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
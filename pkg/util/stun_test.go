@@ -0,0 +1,212 @@
+package util
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// datagram is a packet waiting to be read from fakeSTUNConn
+type datagram struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// fakeSTUNConn records the destinations of the requests written to it and queues the answers of the servers, as
+// computed by answer, to be read back
+type fakeSTUNConn struct {
+	answer func(req *stun.Message, server *net.UDPAddr) []datagram
+
+	mu       sync.Mutex
+	sent     []*net.UDPAddr
+	deadline time.Time
+	inbox    chan datagram
+}
+
+func newFakeSTUNConn(answer func(req *stun.Message, server *net.UDPAddr) []datagram) *fakeSTUNConn {
+	return &fakeSTUNConn{answer: answer, inbox: make(chan datagram, 64)}
+}
+
+func (f *fakeSTUNConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	f.mu.Lock()
+	f.sent = append(f.sent, addr)
+	f.mu.Unlock()
+
+	req := &stun.Message{Raw: append([]byte(nil), b...)}
+	if err := req.Decode(); err != nil {
+		return 0, err
+	}
+
+	for _, d := range f.answer(req, addr) {
+		f.inbox <- d
+	}
+
+	return len(b), nil
+}
+
+func (f *fakeSTUNConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	f.mu.Lock()
+	deadline := f.deadline
+	f.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case d := <-f.inbox:
+		return copy(b, d.data), d.from, nil
+	case <-timer.C:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (f *fakeSTUNConn) SetReadDeadline(t time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.deadline = t
+	return nil
+}
+
+func (f *fakeSTUNConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51820}
+}
+
+func (f *fakeSTUNConn) destinations() []*net.UDPAddr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*net.UDPAddr(nil), f.sent...)
+}
+
+// bindingResponse builds the response to the transaction id reporting mapped as public address
+func bindingResponse(t *testing.T, id [stun.TransactionIDSize]byte, mapped *net.UDPAddr) []byte {
+	t.Helper()
+
+	res, err := stun.Build(stun.NewTransactionIDSetter(id), stun.BindingSuccess, &stun.XORMappedAddress{IP: mapped.IP, Port: mapped.Port}, stun.Fingerprint)
+	if err != nil {
+		t.Fatalf("failed to build response: %v", err)
+	}
+
+	return res.Raw
+}
+
+func TestGetPublicEndpointsQueriesServersInOrder(t *testing.T) {
+	servers := []string{"127.0.0.1:10001", "127.0.0.1:10002", "127.0.0.1:10003", "127.0.0.1:10004", "127.0.0.1:10005"}
+
+	// The NAT allocates a new port for every destination, in the order they are contacted
+	var mu sync.Mutex
+	nextPort := 40000
+	conn := newFakeSTUNConn(func(req *stun.Message, server *net.UDPAddr) []datagram {
+		mu.Lock()
+		defer mu.Unlock()
+
+		nextPort++
+		return []datagram{{data: bindingResponse(t, req.TransactionID, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: nextPort}), from: server}}
+	})
+
+	endpoints, err := GetPublicEndpoints(context.Background(), conn, servers)
+	if err != nil {
+		t.Fatalf("failed to get public endpoints: %v", err)
+	}
+
+	sent := conn.destinations()
+	if len(sent) != len(servers) || len(endpoints) != len(servers) {
+		t.Fatalf("expected %d requests and endpoints, got %d and %d", len(servers), len(sent), len(endpoints))
+	}
+
+	for i, server := range servers {
+		if sent[i].String() != server || endpoints[i].Port != 40001+i {
+			t.Fatalf("expected request %d to %s mapped to port %d, got %s mapped to port %d", i, server, 40001+i, sent[i], endpoints[i].Port)
+		}
+	}
+}
+
+func TestMatchSTUNResponse(t *testing.T) {
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478}
+	mapped := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}
+
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+
+	pending := map[[stun.TransactionIDSize]byte]*stunTransaction{
+		req.TransactionID: {id: req.TransactionID, server: server},
+	}
+
+	valid := bindingResponse(t, req.TransactionID, mapped)
+
+	corrupted := append([]byte(nil), valid...)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	var otherID [stun.TransactionIDSize]byte
+	copy(otherID[:], "another-txid")
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		from    *net.UDPAddr
+		matches bool
+	}{
+		{name: "valid response", packet: valid, from: server, matches: true},
+		{name: "other transaction", packet: bindingResponse(t, otherID, mapped), from: server},
+		{name: "other server", packet: valid, from: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3479}},
+		{name: "bad fingerprint", packet: corrupted, from: server},
+		{name: "request echoed", packet: req.Raw, from: server},
+		{name: "not STUN", packet: []byte("garbage"), from: server},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, tx := matchSTUNResponse(tt.packet, tt.from, pending)
+			if (tx != nil) != tt.matches {
+				t.Fatalf("expected match %v, got %v", tt.matches, tx != nil)
+			}
+
+			if tt.matches {
+				addr, errAddr := mappedAddress(res)
+				if errAddr != nil || !sameUDPAddr(addr, mapped) {
+					t.Fatalf("expected %s, got %v: %v", mapped, addr, errAddr)
+				}
+			}
+		})
+	}
+}
+
+func TestSTUNConsensus(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}
+	b := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 40000}
+
+	tests := []struct {
+		name    string
+		results []stunResult
+		pending int
+		want    *net.UDPAddr
+		decided bool
+	}{
+		{name: "no answer", results: []stunResult{{}, {}}, pending: 2},
+		{name: "majority", results: []stunResult{{addr: b}, {addr: a}, {addr: a}}, want: a, decided: true},
+		{name: "tie goes to the first server", results: []stunResult{{addr: b}, {addr: a}}, want: b},
+		{name: "lead that pending servers can overturn", results: []stunResult{{addr: a}, {}, {}}, pending: 2, want: a},
+		{name: "lead that pending servers cannot overturn", results: []stunResult{{addr: a}, {addr: a}, {}}, pending: 1, want: a, decided: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stunConsensus(tt.results)
+			if (got == nil) != (tt.want == nil) || (got != nil && !sameUDPAddr(got, tt.want)) {
+				t.Fatalf("expected consensus %v, got %v", tt.want, got)
+			}
+
+			if decided := stunDecided(tt.results, tt.pending); decided != tt.decided {
+				t.Fatalf("expected decided %v, got %v", tt.decided, decided)
+			}
+		})
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"net"
 	"time"
 
-	"github.com/pion/stun"
+	wgerrors "github.com/yago-123/wg-punch/pkg/error"
 )
 
 const (
@@ -14,6 +14,15 @@ const (
 	DefaultSTUNTimeout = 2 * time.Second
 )
 
+// UDPConn is the subset of *net.UDPConn used to exchange datagrams with STUN servers, which lets them be queried
+// through sockets whose reads are demultiplexed by someone else, like the socket of a running tunnel
+type UDPConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	SetReadDeadline(t time.Time) error
+	LocalAddr() net.Addr
+}
+
 // ConvertAllowedIPs takes a slice of CIDR strings and converts them to a slice of net.IPNet.
 // It returns an error if any string is not a valid CIDR.
 func ConvertAllowedIPs(allowedIPs []string) ([]net.IPNet, error) {
@@ -30,68 +39,115 @@ func ConvertAllowedIPs(allowedIPs []string) ([]net.IPNet, error) {
 	return result, nil
 }
 
-// GetPublicEndpoint attempts to discover the public-facing UDP address of the local machine by querying a list of STUN
-// servers. It sends a STUN Binding Request through the provided UDP connection and returns the first successful
-// response.
-func GetPublicEndpoint(ctx context.Context, conn *net.UDPConn, servers []string) (*net.UDPAddr, error) {
-	var lastErr error
+// GetPublicEndpoint discovers the public-facing UDP address of the local machine by querying every STUN server at
+// once through the provided UDP connection. The address reported by most servers is returned, which protects against
+// a single misbehaving server
+func GetPublicEndpoint(ctx context.Context, conn UDPConn, servers []string) (*net.UDPAddr, error) {
+	return getPublicEndpoint(ctx, conn, servers, UDPProtocol)
+}
+
+// GetPublicEndpoint6 is like GetPublicEndpoint but only queries the IPv6 addresses of the STUN servers, which discovers
+// the public IPv6 address of a dual-stack socket. Servers without IPv6 address are skipped
+func GetPublicEndpoint6(ctx context.Context, conn UDPConn, servers []string) (*net.UDPAddr, error) {
+	return getPublicEndpoint(ctx, conn, servers, UDP6Protocol)
+}
+
+// GetPublicEndpoints queries every STUN server through conn and returns the public addresses they reported, in the
+// same order. The first requests are sent in that order as well and servers that fail are skipped, which makes it
+// possible to learn how the NAT allocates public ports for consecutive destinations
+func GetPublicEndpoints(ctx context.Context, conn UDPConn, servers []string) ([]*net.UDPAddr, error) {
+	if len(servers) == 0 {
+		return nil, wgerrors.Permanent(fmt.Errorf("no STUN servers configured"))
+	}
 
-	for _, server := range servers {
-		endpoint, err := trySTUNServer(ctx, conn, server)
-		if err == nil {
-			return endpoint, nil
+	// NATs only translate ports of IPv4 traffic
+	results := querySTUNServers(ctx, conn, servers, UDP4Protocol, nil)
+
+	var endpoints []*net.UDPAddr
+	for _, result := range results {
+		if result.addr != nil {
+			endpoints = append(endpoints, result.addr)
 		}
+	}
 
-		lastErr = err
+	if len(endpoints) == 0 {
+		return nil, stunError(results)
 	}
 
-	return nil, fmt.Errorf("all STUN servers failed: %w", lastErr)
+	return endpoints, nil
 }
 
-// todo(): adjust hardcoded values
-// trySTUNServer sends a STUN Binding Request to the specified server and waits for a response. It returns the public
-// address extracted from the response or an error if the request fails.
-func trySTUNServer(ctx context.Context, conn *net.UDPConn, server string) (*net.UDPAddr, error) {
-	serverAddr, err := net.ResolveUDPAddr(UDPProtocol, server)
-	if err != nil {
-		return nil, fmt.Errorf("failed to resolve STUN server %q: %w", server, err)
+func getPublicEndpoint(ctx context.Context, conn UDPConn, servers []string, network string) (*net.UDPAddr, error) {
+	if len(servers) == 0 {
+		return nil, wgerrors.Permanent(fmt.Errorf("no STUN servers configured"))
 	}
 
-	// Build STUN Binding Request
-	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	results := querySTUNServers(ctx, conn, servers, network, stunDecided)
 
-	// Send UDP request to STUN server
-	if _, errWrite := conn.WriteToUDP(req.Raw, serverAddr); errWrite != nil {
-		return nil, fmt.Errorf("failed to send STUN request to %s: %w", server, errWrite)
+	endpoint := stunConsensus(results)
+	if endpoint == nil {
+		return nil, stunError(results)
 	}
 
-	// Respect context deadline for read timeout
-	deadline, hasDeadline := ctx.Deadline()
-	if hasDeadline {
-		_ = conn.SetReadDeadline(deadline)
-	} else {
-		_ = conn.SetReadDeadline(time.Now().Add(DefaultSTUNTimeout))
-	}
+	return endpoint, nil
+}
+
+// LocalIPs returns the addresses of the interfaces that are up, excluding loopback and link-local addresses. Link-local
+// addresses are only reachable through the interface they belong to, which the rest of the library does not track.
+// IPv6 addresses are only returned if ipv6 is set
+func LocalIPs(ipv6 bool) []net.IP {
+	var ips []net.IP
 
-	buf := make([]byte, UDPMaxBuffer)
-	n, _, err := conn.ReadFromUDP(buf)
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read STUN response from %s: %w", server, err)
+		return nil
 	}
 
-	var res stun.Message
-	res.Raw = buf[:n]
-	if errDecode := res.Decode(); errDecode != nil {
-		return nil, fmt.Errorf("failed to decode STUN response: %w", errDecode)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, errAddrs := iface.Addrs()
+		if errAddrs != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+
+			if ipNet.IP.To4() != nil || ipv6 {
+				ips = append(ips, NormalizeIP(ipNet.IP))
+			}
+		}
 	}
 
-	var xorAddr stun.XORMappedAddress
-	if errAddr := xorAddr.GetFrom(&res); errAddr != nil {
-		return nil, fmt.Errorf("failed to extract XOR-MAPPED-ADDRESS: %w", errAddr)
+	return ips
+}
+
+// NormalizeIP returns IPv4 addresses in their 4-byte form, including the IPv4-mapped IPv6 addresses seen by dual-stack
+// sockets, so that addresses of the same peer compare and print the same regardless of the socket they went through
+func NormalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
 	}
 
-	return &net.UDPAddr{
-		IP:   xorAddr.IP,
-		Port: xorAddr.Port,
-	}, nil
+	return ip
+}
+
+// DualStackAddr returns the address to bind to in order to receive IPv4 and IPv6 traffic on port through a single
+// socket. The socket is only dual-stack if the system supports IPv4-mapped IPv6 addresses, otherwise it is bound to
+// whichever family is available. Dual-stack sockets report IPv4 peers as IPv4-mapped IPv6 addresses, see NormalizeIP
+func DualStackAddr(port int) *net.UDPAddr {
+	return &net.UDPAddr{Port: port}
+}
+
+// SupportsIPv6 reports whether conn is able to send and receive IPv6 traffic, which is the case for dual-stack sockets
+func SupportsIPv6(conn *net.UDPConn) bool {
+	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+
+	return ok && localAddr.IP.To4() == nil
 }